@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"math/big"
+	"sync"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/gorilla/websocket"
+	"ogsma_protocol"
+)
+
+func randomID() string {
+	chars := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
+	id := make([]byte, 64)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			panic(err)
+		}
+		id[i] = chars[n.Int64()]
+	}
+	return string(id)
+}
+
+// simClient is one authenticated device, it pings like the real client and
+// reports the latency of every message it receives.
+type simClient struct {
+	id       string
+	identity *secp256k1.PrivateKey // identity grants the device key like a keystore's private key
+	device   ed25519.PrivateKey
+	binary   bool // binary offers the binary encoding, which a version 2 server always accepts
+	conn     *websocket.Conn
+	wmu      sync.Mutex
+	done     chan struct{}
+	closed   chan struct{}
+	rec      *recorder
+}
+
+func newSimClient(id string, binary bool, rec *recorder) *simClient {
+	identity, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		panic(err)
+	}
+	_, device, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		panic(err)
+	}
+	return &simClient{id: id, identity: identity, device: device, binary: binary, rec: rec}
+}
+
+func dialer(certPEM []byte) *websocket.Dialer {
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	return &websocket.Dialer{
+		TLSClientConfig:  &tls.Config{RootCAs: roots},
+		HandshakeTimeout: 30 * time.Second,
+	}
+}
+
+func (c *simClient) connect(d *websocket.Dialer, addr string) error {
+	conn, _, err := d.Dial("wss://"+addr+"/ws", nil)
+	if err != nil {
+		return err
+	}
+	c.conn = conn
+	c.done = make(chan struct{})
+	c.closed = make(chan struct{})
+	encodings := []string{protocol.EncodingJSON}
+	if c.binary {
+		encodings = []string{protocol.EncodingBinary}
+	}
+	h := &protocol.Hello{Type: protocol.FrameHello, ID: c.id, Device: "bench", Versions: []int{protocol.ProtocolVersion}, Encodings: encodings}
+	protocol.SignHello(h, c.device, time.Now())
+	protocol.GrantDevice(h, c.identity.Serialize())
+	hello, _ := json.Marshal(h)
+	if err := c.write(websocket.TextMessage, hello); err != nil {
+		conn.Close()
+		return err
+	}
+	go c.read()
+	go c.keepAlive()
+	return nil
+}
+
+func (c *simClient) write(messageType int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.conn.WriteMessage(messageType, data)
+}
+
+func (c *simClient) read() {
+	defer close(c.closed)
+	for {
+		_, m, err := c.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		now := time.Now()
+		msg := &protocol.Msg{}
+		if protocol.IsBinaryFrame(m) {
+			if msg, err = protocol.DecodeBinary(m); err != nil || msg.Type != protocol.FrameMessage {
+				continue
+			}
+		} else if err := json.Unmarshal(m, msg); err != nil || msg.Type != protocol.FrameMessage {
+			continue
+		}
+		c.rec.record(now, msg.TimeStamp)
+	}
+}
+
+func (c *simClient) keepAlive() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			c.write(websocket.PingMessage, []byte("ping"))
+		}
+	}
+}
+
+// send sends payload as the message, the server only reads the routing fields so
+// random bytes stand in for the ciphertext.
+func (c *simClient) send(to string, payload []byte) error {
+	msg := &protocol.Msg{Type: protocol.FrameMessage, ID: to, Message: payload, TimeStamp: time.Now(), FromID: c.id}
+	if c.binary {
+		m, err := protocol.EncodeBinary(msg)
+		if err != nil {
+			return err
+		}
+		return c.write(websocket.BinaryMessage, m)
+	}
+	m, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return c.write(websocket.TextMessage, m)
+}
+
+func (c *simClient) close() {
+	if c.conn == nil {
+		return
+	}
+	close(c.done)
+	c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.conn.Close()
+	<-c.closed
+	c.conn = nil
+}
@@ -0,0 +1,11 @@
+module ogsma-bench
+
+go 1.25.3
+
+replace ogsma_protocol => ../protocol
+
+require (
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.4.0
+	github.com/gorilla/websocket v1.5.3
+	ogsma_protocol v0.0.0-00010101000000-000000000000
+)
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"ogsma_protocol"
+)
+
+func mib(b uint64) float64 {
+	return float64(b) / (1 << 20)
+}
+
+func (r *Result) print() {
+	fmt.Printf("%s: %s\n", r.Pattern, r.Description)
+	fmt.Printf("  connected %d clients in %v\n", r.Clients, r.ConnectTime.Round(time.Millisecond))
+	rate := 0.0
+	if r.Elapsed > 0 {
+		rate = float64(r.Delivered) / r.Elapsed.Seconds()
+	}
+	fmt.Printf("  delivered %d/%d in %v (%.0f msg/s)\n", r.Delivered, r.Expected, r.Elapsed.Round(time.Millisecond), rate)
+	fmt.Printf("  latency p50 %v p99 %v max %v\n", r.P50.Round(time.Microsecond), r.P99.Round(time.Microsecond), r.Max.Round(time.Microsecond))
+	fmt.Printf("  server peak: %d goroutines, %d sessions, %d queued, heap %.1f MiB, sys %.1f MiB\n",
+		r.Server.Goroutines, r.Server.Sessions, r.Server.Queued, mib(r.Server.MemStats.HeapAlloc), mib(r.Server.MemStats.Sys))
+	if r.Err != nil {
+		fmt.Printf("  error: %v\n", r.Err)
+	}
+}
+
+// buildServer builds ogsma_server from the checkout, embedded configs are not needed
+// since the bench passes -config.
+func buildServer(repo, dir string) (string, error) {
+	out := filepath.Join(dir, "ogsma_server")
+	cmd := exec.Command("go", "build", "-o", out, ".")
+	cmd.Dir = filepath.Join(repo, "server")
+	cmd.Env = append(os.Environ(), "GOFLAGS=-mod=mod")
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("building server: %v\n%s", err, b)
+	}
+	return out, nil
+}
+
+func main() {
+	var serverBinary, repo, patterns, serverLog, encoding string
+	b := &Bench{rec: &recorder{}}
+	var users int
+	flag.StringVar(&serverBinary, "server", "", "ogsma_server binary, built from -repo when empty")
+	flag.StringVar(&repo, "repo", "..", "path to the ogsma checkout")
+	flag.StringVar(&patterns, "patterns", "fanin,fanout,offline", "comma-separated send patterns to run (fanin, fanout, offline)")
+	flag.StringVar(&serverLog, "serverlog", "", "file to write the server log to, discarded when empty")
+	flag.StringVar(&encoding, "encoding", protocol.EncodingJSON, "frame encoding the clients use (json, binary)")
+	flag.IntVar(&users, "users", 1000, "number of simulated clients")
+	flag.IntVar(&b.messages, "messages", 10, "messages per sender and target")
+	flag.IntVar(&b.size, "size", 256, "message payload size in bytes")
+	flag.Float64Var(&b.rate, "rate", 0, "messages per second per sender, 0 for as fast as possible")
+	flag.IntVar(&b.jobs, "j", 200, "concurrent connection handshakes")
+	flag.DurationVar(&b.timeout, "timeout", 2*time.Minute, "timeout for connecting and for each pattern to deliver")
+	flag.Parse()
+	if users < 2 {
+		log.Fatal("at least two users are required")
+	}
+	if encoding != protocol.EncodingJSON && encoding != protocol.EncodingBinary {
+		log.Fatalf("unknown encoding %q", encoding)
+	}
+	run := map[string]func() *Result{"fanin": b.fanIn, "fanout": b.fanOut, "offline": b.offline}
+	selected := strings.Split(patterns, ",")
+	for _, p := range selected {
+		if _, ok := run[p]; !ok {
+			log.Fatalf("unknown pattern %q", p)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "ogsma-bench-")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if len(serverBinary) == 0 {
+		log.Printf("building server")
+		if serverBinary, err = buildServer(repo, dir); err != nil {
+			log.Fatal(err)
+		}
+	}
+	var logOutput io.Writer = io.Discard
+	if len(serverLog) > 0 {
+		f, err := os.Create(serverLog)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		logOutput = f
+	}
+	ids := make([]string, users)
+	userKeys := make(map[string]string, users)
+	b.clients = make([]*simClient, users)
+	for i := range ids {
+		ids[i] = randomID()
+		b.clients[i] = newSimClient(ids[i], encoding == protocol.EncodingBinary, b.rec)
+		userKeys[ids[i]] = base64.StdEncoding.EncodeToString(b.clients[i].identity.PubKey().SerializeUncompressed())
+	}
+	if b.server, err = startServer(serverBinary, dir, ids, userKeys, logOutput); err != nil {
+		log.Fatal(err)
+	}
+	defer b.server.close()
+	b.dialer = dialer(b.server.certPEM)
+
+	failed := false
+	for _, p := range selected {
+		r := run[p]()
+		r.print()
+		failed = failed || r.Err != nil
+	}
+	if failed {
+		b.server.close()
+		os.RemoveAll(dir)
+		os.Exit(1)
+	}
+}
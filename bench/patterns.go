@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// recorder collects delivery latencies for one pattern run.
+type recorder struct {
+	mu        sync.Mutex
+	latencies []time.Duration
+	expected  int
+	floor     time.Time // floor is when queued messages became deliverable, for offline bursts
+	last      time.Time
+	done      chan struct{}
+}
+
+func (r *recorder) reset(expected int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies = make([]time.Duration, 0, expected)
+	r.expected = expected
+	r.floor = time.Time{}
+	r.last = time.Time{}
+	r.done = make(chan struct{})
+}
+
+func (r *recorder) setFloor(t time.Time) {
+	r.mu.Lock()
+	r.floor = t
+	r.mu.Unlock()
+}
+
+func (r *recorder) record(now, sent time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.done == nil || len(r.latencies) >= r.expected {
+		return
+	}
+	if sent.Before(r.floor) {
+		sent = r.floor
+	}
+	r.latencies = append(r.latencies, now.Sub(sent))
+	r.last = now
+	if len(r.latencies) == r.expected {
+		close(r.done)
+	}
+}
+
+func (r *recorder) result() (delivered int, last time.Time, p50, p99, pmax time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	l := slices.Clone(r.latencies)
+	slices.Sort(l)
+	if len(l) == 0 {
+		return 0, r.last, 0, 0, 0
+	}
+	return len(l), r.last, l[len(l)*50/100], l[min(len(l)*99/100, len(l)-1)], l[len(l)-1]
+}
+
+type Bench struct {
+	server   *benchServer
+	dialer   *websocket.Dialer
+	clients  []*simClient
+	rec      *recorder
+	messages int
+	size     int
+	rate     float64 // rate is messages per second per sender, 0 sends as fast as possible
+	jobs     int
+	timeout  time.Duration
+}
+
+// connect connects clients with at most b.jobs handshakes in flight.
+func (b *Bench) connect(clients []*simClient) (time.Duration, error) {
+	before, err := b.server.stats()
+	if err != nil {
+		return 0, err
+	}
+	start := time.Now()
+	sem := make(chan struct{}, b.jobs)
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			errs[i] = c.connect(b.dialer, b.server.addr)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return 0, fmt.Errorf("connecting clients: %w", err)
+	}
+	// the hello is processed asynchronously, wait until every session is registered
+	deadline := time.Now().Add(b.timeout)
+	for {
+		st, err := b.server.stats()
+		if err == nil && st.Sessions >= before.Sessions+len(clients) {
+			b.server.observe(st)
+			break
+		}
+		if time.Now().After(deadline) {
+			return 0, errors.New("timed out waiting for sessions to register")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return time.Since(start), nil
+}
+
+func (b *Bench) disconnect(clients []*simClient) {
+	var wg sync.WaitGroup
+	for _, c := range clients {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.close()
+		}()
+	}
+	wg.Wait()
+	for {
+		if st, err := b.server.stats(); err != nil || st.Sessions == 0 {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// sendAll has every sender send b.messages messages to each of its targets.
+func (b *Bench) sendAll(senders []*simClient, targets func(i int) []string) error {
+	payload := make([]byte, b.size)
+	rand.Read(payload)
+	var interval time.Duration
+	if b.rate > 0 {
+		interval = time.Duration(float64(time.Second) / b.rate)
+	}
+	errs := make([]error, len(senders))
+	var wg sync.WaitGroup
+	for i, c := range senders {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			to := targets(i)
+			for range b.messages {
+				for _, id := range to {
+					if err := c.send(id, payload); err != nil {
+						errs[i] = err
+						return
+					}
+					if interval > 0 {
+						time.Sleep(interval)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (b *Bench) wait() error {
+	select {
+	case <-b.rec.done:
+		return nil
+	case <-time.After(b.timeout):
+		return errors.New("timed out waiting for deliveries")
+	}
+}
+
+type Result struct {
+	Pattern     string
+	Description string
+	Clients     int
+	ConnectTime time.Duration
+	Expected    int
+	Delivered   int
+	Elapsed     time.Duration
+	P50         time.Duration
+	P99         time.Duration
+	Max         time.Duration
+	Server      Stats
+	Err         error
+}
+
+func (b *Bench) result(pattern, description string, clients int, connect time.Duration, start time.Time, err error) *Result {
+	delivered, last, p50, p99, pmax := b.rec.result()
+	r := &Result{
+		Pattern:     pattern,
+		Description: description,
+		Clients:     clients,
+		ConnectTime: connect,
+		Expected:    b.rec.expected,
+		Delivered:   delivered,
+		P50:         p50,
+		P99:         p99,
+		Max:         pmax,
+		Server:      b.server.peakStats(),
+		Err:         err,
+	}
+	if delivered > 0 {
+		r.Elapsed = last.Sub(start)
+	}
+	return r
+}
+
+// fanIn has every other client send to the first one.
+func (b *Bench) fanIn() *Result {
+	receiver, senders := b.clients[0], b.clients[1:]
+	desc := fmt.Sprintf("%d senders -> 1 receiver, %d messages each", len(senders), b.messages)
+	b.server.resetPeak()
+	b.rec.reset(len(senders) * b.messages)
+	connect, err := b.connect(b.clients)
+	defer b.disconnect(b.clients)
+	if err != nil {
+		return b.result("fanin", desc, len(b.clients), 0, time.Now(), err)
+	}
+	start := time.Now()
+	err = b.sendAll(senders, func(int) []string { return []string{receiver.id} })
+	if err == nil {
+		err = b.wait()
+	}
+	return b.result("fanin", desc, len(b.clients), connect, start, err)
+}
+
+// fanOut has the first client send to every other one.
+func (b *Bench) fanOut() *Result {
+	sender, receivers := b.clients[0], b.clients[1:]
+	desc := fmt.Sprintf("1 sender -> %d receivers, %d messages each", len(receivers), b.messages)
+	b.server.resetPeak()
+	b.rec.reset(len(receivers) * b.messages)
+	connect, err := b.connect(b.clients)
+	defer b.disconnect(b.clients)
+	if err != nil {
+		return b.result("fanout", desc, len(b.clients), 0, time.Now(), err)
+	}
+	ids := make([]string, len(receivers))
+	for i, c := range receivers {
+		ids[i] = c.id
+	}
+	start := time.Now()
+	err = b.sendAll([]*simClient{sender}, func(int) []string { return ids })
+	if err == nil {
+		err = b.wait()
+	}
+	return b.result("fanout", desc, len(b.clients), connect, start, err)
+}
+
+// offline has half the clients send bursts to the other half while they are offline,
+// then connects the receivers and measures the queue replay. Latency is counted from
+// when the receivers started connecting.
+func (b *Bench) offline() *Result {
+	half := len(b.clients) / 2
+	receivers, senders := b.clients[:half], b.clients[half:]
+	desc := fmt.Sprintf("%d senders -> %d offline receivers, %d messages each", len(senders), len(receivers), b.messages)
+	b.server.resetPeak()
+	expected := len(senders) * b.messages
+	b.rec.reset(expected)
+	connect, err := b.connect(senders)
+	defer b.disconnect(b.clients)
+	if err != nil {
+		return b.result("offline", desc, len(senders), 0, time.Now(), err)
+	}
+	if err := b.sendAll(senders, func(i int) []string { return []string{receivers[i%len(receivers)].id} }); err != nil {
+		return b.result("offline", desc, len(senders), connect, time.Now(), err)
+	}
+	deadline := time.Now().Add(b.timeout)
+	for {
+		st, err := b.server.stats()
+		if err == nil && st.Queued >= expected {
+			b.server.observe(st)
+			break
+		}
+		if time.Now().After(deadline) {
+			return b.result("offline", desc, len(senders), connect, time.Now(), errors.New("timed out waiting for messages to queue"))
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	start := time.Now()
+	b.rec.setFloor(start)
+	if _, err := b.connect(receivers); err != nil {
+		return b.result("offline", desc, len(b.clients), connect, start, err)
+	}
+	err = b.wait()
+	return b.result("offline", desc, len(b.clients), connect, start, err)
+}
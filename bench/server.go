@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type ServerConfig struct {
+	Port     int               `json:"port"`
+	Endpoint string            `json:"endpoint"`
+	CertFile string            `json:"certFile"`
+	KeyFile  string            `json:"keyFile"`
+	Users    []string          `json:"users"`
+	UserKeys map[string]string `json:"userKeys"`
+	Limits   *Limits           `json:"limits"`
+}
+
+// Limits mirrors the server's limits, the bench raises them so they don't skew the results.
+type Limits struct {
+	ConnectRate  float64 `json:"connectRate"`
+	ConnectBurst int     `json:"connectBurst"`
+	FrameRate    float64 `json:"frameRate"`
+	FrameBurst   int     `json:"frameBurst"`
+	QueueFrames  int     `json:"queueFrames"`
+}
+
+// Stats is the subset of the server's /debug/vars the report uses.
+type Stats struct {
+	Goroutines int `json:"goroutines"`
+	Sessions   int `json:"sessions"`
+	Queued     int `json:"queued"`
+	MemStats   struct {
+		HeapAlloc uint64 `json:"HeapAlloc"`
+		Sys       uint64 `json:"Sys"`
+	} `json:"memstats"`
+}
+
+// benchServer is an ogsma_server process on loopback ports with a throwaway cert.
+type benchServer struct {
+	cmd       *exec.Cmd
+	addr      string
+	debugAddr string
+	certPEM   []byte
+
+	mu   sync.Mutex
+	peak Stats
+	stop chan struct{}
+}
+
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func writeCert(dir string) (certPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "ogsma-bench"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	kb, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, "cert.pem"), certPEM, 0600); err != nil {
+		return nil, err
+	}
+	return certPEM, os.WriteFile(filepath.Join(dir, "key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb}), 0600)
+}
+
+func startServer(binary, dir string, users []string, userKeys map[string]string, logOutput io.Writer) (*benchServer, error) {
+	certPEM, err := writeCert(dir)
+	if err != nil {
+		return nil, fmt.Errorf("generating cert: %v", err)
+	}
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	debugPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(&ServerConfig{
+		Port:     port,
+		Endpoint: "ws",
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+		Users:    users,
+		UserKeys: userKeys,
+		Limits:   &Limits{ConnectRate: 1e6, ConnectBurst: 1e6, FrameRate: 1e6, FrameBurst: 1e6, QueueFrames: 1e6},
+	})
+	if err != nil {
+		return nil, err
+	}
+	configFile := filepath.Join(dir, "server_config.json")
+	if err := os.WriteFile(configFile, b, 0600); err != nil {
+		return nil, err
+	}
+	s := &benchServer{
+		addr:      fmt.Sprintf("127.0.0.1:%d", port),
+		debugAddr: fmt.Sprintf("127.0.0.1:%d", debugPort),
+		certPEM:   certPEM,
+		stop:      make(chan struct{}),
+	}
+	s.cmd = exec.Command(binary, "-config", configFile, "-debug", s.debugAddr)
+	s.cmd.Stdout = logOutput
+	s.cmd.Stderr = logOutput
+	if err := s.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s: %v", binary, err)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := s.stats(); err == nil {
+			if c, err := net.Dial("tcp", s.addr); err == nil {
+				c.Close()
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			s.close()
+			return nil, fmt.Errorf("server did not start listening on %s", s.addr)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	go s.sample()
+	return s, nil
+}
+
+func (s *benchServer) stats() (*Stats, error) {
+	resp, err := http.Get("http://" + s.debugAddr + "/debug/vars")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	st := &Stats{}
+	return st, json.NewDecoder(resp.Body).Decode(st)
+}
+
+// sample records the peak goroutine count and memory use while the bench runs.
+func (s *benchServer) sample() {
+	t := time.NewTicker(100 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-t.C:
+		}
+		if st, err := s.stats(); err == nil {
+			s.observe(st)
+		}
+	}
+}
+
+func (s *benchServer) observe(st *Stats) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peak.Goroutines = max(s.peak.Goroutines, st.Goroutines)
+	s.peak.Sessions = max(s.peak.Sessions, st.Sessions)
+	s.peak.Queued = max(s.peak.Queued, st.Queued)
+	s.peak.MemStats.HeapAlloc = max(s.peak.MemStats.HeapAlloc, st.MemStats.HeapAlloc)
+	s.peak.MemStats.Sys = max(s.peak.MemStats.Sys, st.MemStats.Sys)
+}
+
+// resetPeak starts peak tracking over for the next pattern.
+func (s *benchServer) resetPeak() {
+	s.mu.Lock()
+	s.peak = Stats{}
+	s.mu.Unlock()
+}
+
+func (s *benchServer) peakStats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.peak
+}
+
+func (s *benchServer) close() {
+	close(s.stop)
+	s.cmd.Process.Kill()
+	s.cmd.Wait()
+}
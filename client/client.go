@@ -1,71 +1,150 @@
 package main
 
 import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"ogsma_protocol"
 )
 
 type Client struct {
 	ID          string
+	Device      string
+	DeviceKey   ed25519.PrivateKey // DeviceKey signs the hello, the server rejects the device with any other key
+	Identity    []byte             // Identity is the user's private key, it grants the device key to the server
 	targetID    string
-	Conn        *websocket.Conn
+	conn        *websocket.Conn // conn is replaced by the reconnect goroutine, it is guarded by wmu
 	Addr        string
-	SelfSigned  bool // SelfSigned Disables checking CA store for cert
+	SelfSigned  bool   // SelfSigned Disables checking CA store for cert
+	PinnedCert  []byte // PinnedCert is the DER server certificate to accept instead of checking the CA store
 	wsPath      string
+	Version     int  // Version is the protocol version negotiated on the last connect, guarded by wmu
+	binary      bool // binary is set when the server agreed to binary message frames, guarded by wmu
 	MessageChan chan []byte
+	presence    *protocol.Presence // presence is resent after every reconnect once the user opted in, guarded by wmu
+	wmu         sync.Mutex         // wmu serialises writes and guards the connection state
 }
 
-type Msg struct {
-	ID        string    `json:"id"`
-	Message   []byte    `json:"msg"`
-	TimeStamp time.Time `json:"timestamp"`
-	FromID    string    `json:"from"`
+var errNotConnected = errors.New("not connected")
+
+func (c *Client) write(messageType int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.conn == nil {
+		return errNotConnected
+	}
+	return c.conn.WriteMessage(messageType, data)
+}
+
+// connected reports whether the client holds a connection, it may still be broken
+// until the keepalive notices.
+func (c *Client) connected() bool {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.conn != nil
 }
 
 func (c *Client) Connect() error {
-	var err error
-	c.Conn = nil
-	dd := websocket.DefaultDialer
+	c.wmu.Lock()
+	c.conn = nil
+	c.wmu.Unlock()
+	dd := *websocket.DefaultDialer
 	dd.TLSClientConfig = &tls.Config{
 		InsecureSkipVerify: c.SelfSigned,
 	}
+	if len(c.PinnedCert) > 0 {
+		pinned := c.PinnedCert
+		dd.TLSClientConfig.InsecureSkipVerify = true
+		dd.TLSClientConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 || !bytes.Equal(rawCerts[0], pinned) {
+				return errors.New("server certificate does not match pinned certificate")
+			}
+			return nil
+		}
+	}
 	dd.HandshakeTimeout = 5 * time.Second
-	c.Conn, _, err = dd.Dial(fmt.Sprintf("wss://%s/%s", c.Addr, c.wsPath), nil)
+	conn, _, err := dd.Dial(fmt.Sprintf("wss://%s/%s", c.Addr, c.wsPath), nil)
 	if err != nil {
 		return fmt.Errorf("dial: %v", err)
 	}
-	c.listener()
-	mts := struct {
-		ID string `json:"id"`
-	}{}
-	mts.ID = c.ID
-	loginJson, err := json.Marshal(mts)
+	w, err := c.handshake(conn)
 	if err != nil {
-		return fmt.Errorf("error: json marshal: %v", err)
+		conn.Close()
+		return err
 	}
-	if err = c.Conn.WriteMessage(websocket.BinaryMessage, loginJson); err != nil {
-		return fmt.Errorf("write %v", err)
+	c.wmu.Lock()
+	c.conn = conn
+	c.Version = w.Version
+	c.binary = w.Encoding == protocol.EncodingBinary
+	presence := c.presence
+	c.wmu.Unlock()
+	c.listener(conn)
+	if presence != nil {
+		if err := c.SendPresence(presence.Status, presence.Contacts); err != nil {
+			log.Printf("failed to send presence: %v", err)
+		}
 	}
 	fmt.Println("connected")
 	c.KeepAlive()
-	return err
+	return nil
 }
 
-func (c *Client) listener() {
+// handshake sends the hello on conn and waits for the welcome, a rejected client gets
+// the server's close reason back as the error.
+func (c *Client) handshake(conn *websocket.Conn) (*protocol.Welcome, error) {
+	h := &protocol.Hello{Type: protocol.FrameHello, ID: c.ID, Device: c.Device, Versions: []int{protocol.MinProtocolVersion, protocol.ProtocolVersion}, Encodings: []string{protocol.EncodingBinary, protocol.EncodingJSON}}
+	if c.DeviceKey != nil {
+		protocol.SignHello(h, c.DeviceKey, time.Now())
+		protocol.GrantDevice(h, c.Identity)
+	}
+	hello, err := json.Marshal(h)
+	if err != nil {
+		return nil, fmt.Errorf("error: json marshal: %v", err)
+	}
+	if err = conn.WriteMessage(websocket.TextMessage, hello); err != nil {
+		return nil, fmt.Errorf("write %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+	_, m, err := conn.ReadMessage()
+	if err != nil {
+		var ce *websocket.CloseError
+		if errors.As(err, &ce) {
+			return nil, fmt.Errorf("server refused connection: %s", ce.Text)
+		}
+		return nil, fmt.Errorf("reading welcome: %v", err)
+	}
+	w := &protocol.Welcome{}
+	if err := json.Unmarshal(m, w); err != nil || w.Type != protocol.FrameWelcome {
+		return nil, fmt.Errorf("expected a welcome from the server, got %q", m)
+	}
+	if _, ok := protocol.NegotiateVersion([]int{w.Version}); !ok {
+		return nil, fmt.Errorf("server chose unsupported protocol version %d", w.Version)
+	}
+	return w, nil
+}
+
+func (c *Client) listener(conn *websocket.Conn) {
 	go func() {
 		for {
-			mt, message, err := c.Conn.ReadMessage()
+			mt, message, err := conn.ReadMessage()
 			if err != nil {
 				log.Printf("failed to read: %v", err)
 				break
 			}
 			switch mt {
-			case websocket.TextMessage:
+			case websocket.TextMessage, websocket.BinaryMessage:
 				c.MessageChan <- message
 			}
 		}
@@ -77,7 +156,7 @@ func (c *Client) KeepAlive() {
 	go func() {
 		for {
 			time.Sleep(1 * time.Second)
-			if err := c.Conn.WriteMessage(websocket.PingMessage, []byte("ping")); err == nil {
+			if err := c.write(websocket.PingMessage, []byte("ping")); err == nil {
 				continue
 			} else {
 				for {
@@ -94,21 +173,76 @@ func (c *Client) KeepAlive() {
 	}()
 }
 
-func (c *Client) SendMsg(msg *Msg) error {
+func (c *Client) SendMsg(msg *protocol.Msg) error {
+	if len(msg.Ref) == 0 && msg.Type == protocol.FrameMessage {
+		msg.Ref = newRef()
+	}
+	c.wmu.Lock()
+	version, binary := c.Version, c.binary
+	c.wmu.Unlock()
+	if version < 3 {
+		// older servers can't read the expiry, the message is then only removed by the clients
+		msg.Expires = time.Time{}
+	}
+	if binary {
+		bm, err := protocol.EncodeBinary(msg)
+		if err != nil {
+			return fmt.Errorf("error: binary encode: %v", err)
+		}
+		return c.write(websocket.BinaryMessage, bm)
+	}
 	jm, err := json.Marshal(msg)
 	if err != nil {
 		return fmt.Errorf("error: json marshal: %v", err)
 	}
-	return c.Conn.WriteMessage(websocket.TextMessage, jm)
+	return c.write(websocket.TextMessage, jm)
+}
+
+func (c *Client) SendPresence(status string, contacts []string) error {
+	p := &protocol.Presence{
+		Type:     protocol.FramePresence,
+		Status:   status,
+		Contacts: contacts,
+	}
+	c.wmu.Lock()
+	c.presence = p
+	c.wmu.Unlock()
+	jm, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("error: json marshal: %v", err)
+	}
+	return c.write(websocket.TextMessage, jm)
+}
+
+// StopPresence opts out of sharing presence, the server forgets it and it is no
+// longer sent after a reconnect.
+func (c *Client) StopPresence() error {
+	c.wmu.Lock()
+	c.presence = nil
+	c.wmu.Unlock()
+	jm, err := json.Marshal(&protocol.Presence{Type: protocol.FramePresence, Status: statusOffline})
+	if err != nil {
+		return fmt.Errorf("error: json marshal: %v", err)
+	}
+	return c.write(websocket.TextMessage, jm)
+}
+
+// newRef returns a random reference for matching acks, errors and receipts to a message.
+func newRef() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 func (c *Client) disconnect() {
-	err := c.Conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	err := c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
 	if err != nil {
 		log.Println("write close:", err)
 		return
 	}
-	if err := c.Conn.Close(); err != nil {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := c.conn.Close(); err != nil {
 		log.Printf("error: websocket Conn close: %v", err)
 	}
 }
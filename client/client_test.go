@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ogsma_protocol"
+)
+
+// dropServer welcomes every hello, it drops the first connection right away and then
+// reads from the others until the client goes away.
+func dropServer(t *testing.T, connects *atomic.Int32) *httptest.Server {
+	t.Helper()
+	upgrader := websocket.Upgrader{}
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+		welcome, _ := json.Marshal(&protocol.Welcome{Type: protocol.FrameWelcome, Version: protocol.ProtocolVersion, Encoding: protocol.EncodingJSON})
+		if err := conn.WriteMessage(websocket.TextMessage, welcome); err != nil {
+			return
+		}
+		if connects.Add(1) == 1 {
+			return
+		}
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// TestReconnect sends while the keepalive reconnects, run it with -race.
+func TestReconnect(t *testing.T) {
+	var connects atomic.Int32
+	s := dropServer(t, &connects)
+	c := &Client{
+		ID:          "alice",
+		Addr:        strings.TrimPrefix(s.URL, "https://"),
+		PinnedCert:  s.Certificate().Raw,
+		MessageChan: make(chan []byte, 16),
+	}
+	if c.connected() {
+		t.Fatal("connected before connecting")
+	}
+	if err := c.SendPresence(statusOnline, []string{"bob"}); err != errNotConnected {
+		t.Errorf("sending without a connection returned %v, want %v", err, errNotConnected)
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+
+	// sends fail while the dropped connection is replaced, they must not race with it
+	deadline := time.Now().Add(5 * time.Second)
+	for connects.Load() < 2 || !c.connected() {
+		if time.Now().After(deadline) {
+			t.Fatal("the keepalive didn't reconnect")
+		}
+		if c.connected() {
+			c.SendPresence(statusOnline, []string{"bob"})
+			c.SendMsg(&protocol.Msg{Type: protocol.FrameMessage, ID: "bob"})
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := c.StopPresence(); err != nil {
+		t.Error(err)
+	}
+}
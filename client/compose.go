@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	"ogsma_protocol"
+)
+
+// composeState is a reply or an edit being written in a conversation.
+type composeState struct {
+	kind   string // kind is envelopeReply or envelopeEdit
+	target *chatMessage
+}
+
+func (g *GUI) initCompose(contact *Contact) {
+	g.composeLabel[contact.ID] = widget.NewLabel("")
+	g.composeLabel[contact.ID].Truncation = fyne.TextTruncateEllipsis
+	cancel := widget.NewButtonWithIcon("", theme.CancelIcon(), func() {
+		g.cancelCompose(contact.ID)
+	})
+	g.composeBar[contact.ID] = container.NewBorder(nil, nil, nil, cancel, g.composeLabel[contact.ID])
+	g.composeBar[contact.ID].Hide()
+}
+
+// markdownToggle switches every conversation between plain text and Markdown.
+func (g *GUI) markdownToggle() *widget.Check {
+	check := widget.NewCheck("Markdown", func(on bool) {
+		g.app.Preferences().SetBool("markdown", on)
+		for _, list := range g.chatOutput {
+			list.setMarkdown(on)
+		}
+	})
+	check.SetChecked(g.app.Preferences().Bool("markdown"))
+	return check
+}
+
+// messageActions lists what can be done with a message, only our own messages can
+// be edited or deleted.
+func (g *GUI) messageActions(contact *Contact) func(m *chatMessage) []*fyne.MenuItem {
+	return func(m *chatMessage) []*fyne.MenuItem {
+		items := []*fyne.MenuItem{
+			fyne.NewMenuItem("Copy", func() { g.app.Clipboard().SetContent(m.text) }),
+		}
+		if len(m.id) == 0 {
+			return items
+		}
+		items = append(items, fyne.NewMenuItem("Reply", func() { g.startCompose(contact.ID, envelopeReply, m) }))
+		if m.from == g.client.ID {
+			items = append(items,
+				fyne.NewMenuItem("Edit", func() { g.startCompose(contact.ID, envelopeEdit, m) }),
+				fyne.NewMenuItem("Delete for everyone", func() {
+					dialog.ShowConfirm("Delete message", fmt.Sprintf("Delete this message for you and %s?", contact.Username), func(ok bool) {
+						if ok {
+							g.deleteMessage(contact, m)
+						}
+					}, g.window)
+				}))
+		}
+		return items
+	}
+}
+
+func (g *GUI) startCompose(id, kind string, m *chatMessage) {
+	g.composing[id] = &composeState{kind: kind, target: m}
+	if kind == envelopeEdit {
+		g.composeLabel[id].SetText("Editing message")
+		if entry, ok := g.msgEntry[id]; ok {
+			entry.SetText(m.text)
+		}
+	} else {
+		g.composeLabel[id].SetText(fmt.Sprintf("Replying to %s", quoteOf(m.text)))
+	}
+	g.composeBar[id].Show()
+	if entry, ok := g.msgEntry[id]; ok {
+		g.window.Canvas().Focus(entry)
+	}
+}
+
+func (g *GUI) cancelCompose(id string) {
+	c, ok := g.composing[id]
+	if !ok {
+		return
+	}
+	delete(g.composing, id)
+	g.composeBar[id].Hide()
+	if entry, ok := g.msgEntry[id]; ok && c.kind == envelopeEdit {
+		entry.SetText("")
+	}
+}
+
+// composeEnvelope wraps text typed in a conversation as a new message, a reply
+// or an edit depending on what is being composed.
+func (g *GUI) composeEnvelope(id, text string) *Envelope {
+	c := g.composing[id]
+	switch {
+	case c != nil && c.kind == envelopeEdit:
+		return &Envelope{Kind: envelopeEdit, Target: c.target.id, Text: text}
+	case c != nil && c.kind == envelopeReply:
+		return &Envelope{Kind: envelopeReply, ID: newRef(), Target: c.target.id, Text: text, TTL: g.timer(id)}
+	}
+	return &Envelope{Kind: envelopeText, ID: newRef(), Text: text, TTL: g.timer(id)}
+}
+
+// envelopeMsg encrypts env for the contact and for our other devices.
+func (g *GUI) envelopeMsg(contact *Contact, env *Envelope) (*protocol.Msg, error) {
+	targetEncryptedBytes, err := g.enc.publicEncrypt(env.seal(), contact.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	selfEncryptedBytes, err := g.enc.publicEncrypt(env.seal(), g.enc.keys.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	sent := time.Now()
+	return &protocol.Msg{
+		Type:      protocol.FrameMessage,
+		ID:        contact.ID,
+		TimeStamp: sent,
+		Message:   targetEncryptedBytes,
+		FromID:    g.client.ID,
+		Self:      selfEncryptedBytes,
+		Expires:   env.expires(sent),
+	}, nil
+}
+
+func (g *GUI) sendEnvelope(contact *Contact, env *Envelope) error {
+	msg, err := g.envelopeMsg(contact, env)
+	if err != nil {
+		return err
+	}
+	return g.client.SendMsg(msg)
+}
+
+func (g *GUI) deleteMessage(contact *Contact, m *chatMessage) {
+	env := &Envelope{Kind: envelopeDelete, Target: m.id}
+	if err := g.sendEnvelope(contact, env); err != nil {
+		log.Printf("error sending delete: %v", err)
+		dialog.ShowError(fmt.Errorf("failed to delete the message: %v", err), g.window)
+		return
+	}
+	g.applyEnvelope(contact.ID, g.client.ID, g.enc.keys.Username, env, time.Now())
+}
+
+// applyEnvelope shows an envelope from the user from in the conversation id, who
+// is the name shown with new messages.
+func (g *GUI) applyEnvelope(id, from, who string, env *Envelope, sent time.Time) {
+	list, ok := g.chatOutput[id]
+	if !ok {
+		log.Printf("message for unknown contact %s", id)
+		return
+	}
+	switch env.Kind {
+	case envelopeTimer:
+		g.proposeTimer(id, env, from == g.client.ID, who)
+	case envelopeAccept:
+		g.applyTimer(id, env, from == g.client.ID, who)
+	case envelopeText, envelopeReply:
+		m := &chatMessage{id: env.ID, from: from, prefix: who, text: env.Text, sent: sent, expires: env.expires(sent)}
+		if !m.expires.IsZero() && time.Now().After(m.expires) {
+			return
+		}
+		g.storeMessage(id, QueueMessage{id: env.ID, sent: sent, msg: env.Text, expires: m.expires, mine: from == g.client.ID})
+		fyne.Do(func() {
+			if _, target := list.find(env.Target); env.Kind == envelopeReply && target != nil {
+				m.quote = quoteOf(target.text)
+			}
+			list.add(m)
+		})
+	case envelopeEdit:
+		g.editStored(id, from == g.client.ID, env)
+		fyne.Do(func() {
+			if !list.edit(env.Target, from, env.Text) {
+				log.Printf("ignoring edit of unknown message %s", env.Target)
+			}
+		})
+	case envelopeDelete:
+		g.editStored(id, from == g.client.ID, env)
+		fyne.Do(func() {
+			if !list.remove(env.Target, from) {
+				log.Printf("ignoring delete of unknown message %s", env.Target)
+			}
+		})
+	default:
+		log.Printf("unknown envelope kind %q", env.Kind)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// timerChoices are the disappearing message timers offered, in seconds.
+var timerChoices = []struct {
+	label string
+	ttl   int
+}{
+	{"Off", 0},
+	{"30 seconds", 30},
+	{"5 minutes", 5 * 60},
+	{"1 hour", 60 * 60},
+	{"1 day", 24 * 60 * 60},
+	{"1 week", 7 * 24 * 60 * 60},
+}
+
+func formatTTL(ttl int) string {
+	for _, c := range timerChoices {
+		if c.ttl == ttl {
+			return c.label
+		}
+	}
+	return (time.Duration(ttl) * time.Second).String()
+}
+
+// timer is the conversation's disappearing message timer in seconds, 0 when off.
+func (g *GUI) timer(id string) int {
+	return g.app.Preferences().Int("timer." + id)
+}
+
+// timerProposal is a timer change waiting for the other side to accept it.
+type timerProposal struct {
+	ID   string
+	TTL  int
+	Mine bool // Mine is set when we proposed it
+}
+
+// proposal is the conversation's pending timer change, nil when there is none.
+func (g *GUI) proposal(id string) *timerProposal {
+	s := g.app.Preferences().String("timer.proposal." + id)
+	if len(s) == 0 {
+		return nil
+	}
+	p := &timerProposal{}
+	if err := json.Unmarshal([]byte(s), p); err != nil {
+		log.Printf("error reading timer proposal: %v", err)
+		return nil
+	}
+	return p
+}
+
+func (g *GUI) setProposal(id string, p *timerProposal) {
+	if p == nil {
+		g.app.Preferences().RemoveValue("timer.proposal." + id)
+		return
+	}
+	b, _ := json.Marshal(p)
+	g.app.Preferences().SetString("timer.proposal."+id, string(b))
+}
+
+func (g *GUI) initTimer(contact *Contact) {
+	g.timerLabel[contact.ID] = widget.NewLabelWithStyle("", fyne.TextAlignLeading, fyne.TextStyle{Italic: true})
+	g.offerLabel[contact.ID] = widget.NewLabel("")
+	accept := widget.NewButton("Accept", func() {
+		g.acceptTimer(contact)
+	})
+	g.timerOffer[contact.ID] = container.NewBorder(nil, nil, nil, accept, g.offerLabel[contact.ID])
+	g.showTimer(contact.ID)
+}
+
+// showTimer shows the conversation's timer with our pending proposal, and the
+// contact's proposal with a button to accept it.
+func (g *GUI) showTimer(id string) {
+	label, offer, offerLabel := g.timerLabel[id], g.timerOffer[id], g.offerLabel[id]
+	ttl, p := g.timer(id), g.proposal(id)
+	fyne.Do(func() {
+		text := ""
+		if ttl > 0 {
+			text = fmt.Sprintf("Disappearing after %s", formatTTL(ttl))
+		}
+		if p != nil && p.Mine {
+			if len(text) > 0 {
+				text += ", "
+			}
+			text += fmt.Sprintf("%s proposed, waiting for the contact", formatTTL(p.TTL))
+		}
+		label.SetText(text)
+		label.Hidden = len(text) == 0
+		label.Refresh()
+		if p == nil || p.Mine {
+			offer.Hide()
+			return
+		}
+		offerLabel.SetText(fmt.Sprintf("Proposed disappearing messages: %s", formatTTL(p.TTL)))
+		offer.Show()
+	})
+}
+
+func (g *GUI) timerButton(contact *Contact) *widget.Button {
+	return widget.NewButtonWithIcon("", theme.HistoryIcon(), func() {
+		var labels []string
+		for _, c := range timerChoices {
+			labels = append(labels, c.label)
+		}
+		choice := widget.NewSelect(labels, nil)
+		choice.SetSelected(formatTTL(g.timer(contact.ID)))
+		dialog.ShowCustomConfirm("Disappearing messages", "Set", "Cancel", choice, func(ok bool) {
+			if i := slices.Index(labels, choice.Selected); ok && i >= 0 {
+				g.setTimer(contact, timerChoices[i].ttl)
+			}
+		}, g.window)
+	})
+}
+
+// setTimer proposes a new timer to the contact, and tells our other devices through
+// the self copy. The timer only changes once the contact accepts it.
+func (g *GUI) setTimer(contact *Contact, ttl int) {
+	if ttl == g.timer(contact.ID) {
+		return
+	}
+	env := &Envelope{Kind: envelopeTimer, ID: newRef(), TTL: ttl}
+	if err := g.sendEnvelope(contact, env); err != nil {
+		log.Printf("error sending timer: %v", err)
+		dialog.ShowError(fmt.Errorf("failed to change the timer: %v", err), g.window)
+		return
+	}
+	g.applyEnvelope(contact.ID, g.client.ID, g.enc.keys.Username, env, time.Now())
+}
+
+// acceptTimer agrees to the contact's pending proposal.
+func (g *GUI) acceptTimer(contact *Contact) {
+	p := g.proposal(contact.ID)
+	if p == nil || p.Mine {
+		return
+	}
+	env := &Envelope{Kind: envelopeAccept, Target: p.ID, TTL: p.TTL}
+	if err := g.sendEnvelope(contact, env); err != nil {
+		log.Printf("error sending timer acceptance: %v", err)
+		dialog.ShowError(fmt.Errorf("failed to accept the timer: %v", err), g.window)
+		return
+	}
+	g.applyEnvelope(contact.ID, g.client.ID, g.enc.keys.Username, env, time.Now())
+}
+
+// proposeTimer records a proposal from either side of the conversation id, a new
+// proposal replaces the pending one.
+func (g *GUI) proposeTimer(id string, env *Envelope, mine bool, who string) {
+	if _, ok := g.timerLabel[id]; !ok {
+		log.Printf("timer for unknown contact %s", id)
+		return
+	}
+	g.setProposal(id, &timerProposal{ID: env.ID, TTL: env.TTL, Mine: mine})
+	g.showTimer(id)
+	g.appendText(who, fmt.Sprintf("proposed disappearing messages: %s", formatTTL(env.TTL)), id)
+}
+
+// applyTimer changes the timer when env accepts the pending proposal, an acceptance
+// only counts from the side that didn't propose it.
+func (g *GUI) applyTimer(id string, env *Envelope, mine bool, who string) {
+	p := g.proposal(id)
+	if p == nil || p.ID != env.Target || p.Mine == mine {
+		log.Printf("ignoring acceptance of unknown timer proposal %s", env.Target)
+		return
+	}
+	g.setProposal(id, nil)
+	g.app.Preferences().SetInt("timer."+id, p.TTL)
+	g.showTimer(id)
+	g.appendText(who, fmt.Sprintf("accepted, disappearing messages: %s", formatTTL(p.TTL)), id)
+}
+
+// expireMessages removes expired messages from the conversations and contactMessages
+// every second.
+func (g *GUI) expireMessages() {
+	for now := range time.Tick(time.Second) {
+		messagesMu.Lock()
+		expired := false
+		for id, msgs := range contactMessages {
+			contactMessages[id] = slices.DeleteFunc(msgs, func(m QueueMessage) bool {
+				return !m.expires.IsZero() && now.After(m.expires)
+			})
+			expired = expired || len(contactMessages[id]) < len(msgs)
+		}
+		history := g.history
+		messagesMu.Unlock()
+		if history != nil {
+			history.expire(now)
+		}
+		if expired {
+			g.refreshContacts()
+		}
+		fyne.Do(func() {
+			for _, list := range g.chatOutput {
+				list.expire(now)
+			}
+		})
+	}
+}
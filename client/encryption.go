@@ -2,99 +2,70 @@ package main
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/pbkdf2"
-	"crypto/sha256"
-	"encoding/hex"
-	"encoding/json"
+	"encoding/base64"
 	"errors"
-	
+
 	_ "embed"
-	
+
 	ecies "github.com/ecies/go/v2"
+	"ogsma_protocol/keystore"
 )
 
-type Keystore struct {
-	Username   []byte          `json:"username"`
-	ID         []byte          `json:"id"`
-	PublicKey  []byte          `json:"publicKey"`
-	PrivateKey []byte          `json:"privateKey"`
-	Contacts   []*StoreContact `json:"contacts"`
-}
-
-type StoreContact struct {
-	PublicKey []byte `json:"publicKey"`
-	ID        []byte `json:"id"`
-	Username  []byte `json:"username"`
-}
-
 type Keys struct {
-	Username   string `json:"username"`
-	ID         string `json:"id"`
-	PublicKey  *ecies.PublicKey
-	PrivateKey *ecies.PrivateKey
-	Contacts   []*Contact
+	Username     string `json:"username"`
+	ID           string `json:"id"`
+	PublicKey    *ecies.PublicKey
+	PrivateKey   *ecies.PrivateKey
+	PreviousKeys []*ecies.PrivateKey // PreviousKeys decrypt messages sent before a key rotation
+	Contacts     []*Contact
 }
 
 type Contact struct {
-	PublicKey *ecies.PublicKey
-	ID        string
-	Username  string
+	PublicKey  *ecies.PublicKey
+	ID         string
+	Username   string
+	Verified   bool
+	KeyChanged bool
 }
 
 type Encryption struct {
 	configKeystore []byte
 	password       string
-	iter           int
 	keys           *Keys
 }
 
-func (e *Encryption) passwordDecrypt(cipherText []byte) ([]byte, error) {
-	if !bytes.ContainsAny(cipherText, "-") {
-		return nil, errors.New("invalid data")
-	}
-	data := bytes.Split(cipherText, []byte("-"))
-	salt := make([]byte, hex.DecodedLen(len(data[0])))
-	if _, err := hex.Decode(salt, data[0]); err != nil {
-		return nil, errors.New("invalid data: salt" + err.Error())
-	}
-	iv := make([]byte, hex.DecodedLen(len(data[1])))
-	if _, err := hex.Decode(iv, data[1]); err != nil {
-		return nil, errors.New("invalid data: iv" + err.Error())
-	}
-	ciphertext := make([]byte, hex.DecodedLen(len(data[2])))
-	if _, err := hex.Decode(ciphertext, data[2]); err != nil {
-		return nil, errors.New("invalid data: ciphertext" + err.Error())
-	}
-	key, err := pbkdf2.Key(sha256.New, e.password, salt, e.iter, 32)
-	if err != nil {
-		return nil, errors.New("error generating pbkdf2 key:" + err.Error())
-	}
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, errors.New("decrypt failed:" + err.Error())
-	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, errors.New("decrypt failed:" + err.Error())
+// openKeystore decrypts the configured keystore with e.password.
+func (e *Encryption) openKeystore() (*keystore.Keystore, error) {
+	data := e.configKeystore
+	// v1 keystores are a hex string, v2 ones are embedded base64 encoded
+	if !bytes.ContainsAny(data, "-") {
+		decoded, err := base64.StdEncoding.DecodeString(string(data))
+		if err != nil {
+			return nil, errors.New("Error decoding keystore:" + err.Error())
+		}
+		data = decoded
 	}
-	plaintext, err := gcm.Open(nil, iv, ciphertext, nil)
+	ks, _, err := keystore.Read(e.password, data)
 	if err != nil {
-		return nil, errors.New("decrypt failed:" + err.Error())
+		return nil, errors.New("Error decrypting keystore:" + err.Error())
 	}
-	return plaintext, nil
+	return ks, nil
+}
+
+// checkPassword reports whether password opens the keystore, for unlocking after
+// the keys are loaded.
+func (e *Encryption) checkPassword(password string) error {
+	e.password = password
+	defer func() { e.password = "" }()
+	_, err := e.openKeystore()
+	return err
 }
 
 func (e *Encryption) loadKeys() error {
-	keystoreFileBytes, err := e.passwordDecrypt(e.configKeystore)
-	if err != nil {
-		return errors.New("Error decrypting keystore:" + err.Error())
-	}
+	ks, err := e.openKeystore()
 	e.password = ""
-	ks := &Keystore{}
-	if err := json.Unmarshal(keystoreFileBytes, ks); err != nil {
-		return errors.New("Error unmarshaling keystore:" + err.Error())
+	if err != nil {
+		return err
 	}
 	publicKeyFromBytes, err := ecies.NewPublicKeyFromBytes(ks.PublicKey)
 	if err != nil {
@@ -107,15 +78,20 @@ func (e *Encryption) loadKeys() error {
 		PrivateKey: ecies.NewPrivateKeyFromBytes(ks.PrivateKey),
 		Contacts:   []*Contact{},
 	}
+	for _, pk := range ks.PreviousPrivateKeys {
+		e.keys.PreviousKeys = append(e.keys.PreviousKeys, ecies.NewPrivateKeyFromBytes(pk))
+	}
 	for _, i := range ks.Contacts {
 		contactPublicKeyFromBytes, err := ecies.NewPublicKeyFromBytes(i.PublicKey)
 		if err != nil {
 			return errors.New("Error decrypting contact:" + err.Error())
 		}
 		e.keys.Contacts = append(e.keys.Contacts, &Contact{
-			PublicKey: contactPublicKeyFromBytes,
-			ID:        string(i.ID),
-			Username:  string(i.Username),
+			PublicKey:  contactPublicKeyFromBytes,
+			ID:         string(i.ID),
+			Username:   string(i.Username),
+			Verified:   i.Verified,
+			KeyChanged: i.KeyChanged,
 		})
 	}
 	return nil
@@ -131,8 +107,13 @@ func (e *Encryption) publicEncrypt(plaintext []byte, publicKey *ecies.PublicKey)
 
 func (e *Encryption) privateDecrypt(ciphertext []byte) ([]byte, error) {
 	plaintext, err := ecies.Decrypt(e.keys.PrivateKey, ciphertext)
-	if err != nil {
-		return nil, errors.New("error decrypting with private key" + err.Error())
+	if err == nil {
+		return plaintext, nil
+	}
+	for _, pk := range e.keys.PreviousKeys {
+		if plaintext, perr := ecies.Decrypt(pk, ciphertext); perr == nil {
+			return plaintext, nil
+		}
 	}
-	return plaintext, nil
+	return nil, errors.New("error decrypting with private key" + err.Error())
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	envelopeText   = "text"
+	envelopeReply  = "reply"  // envelopeReply is a text quoting the message Target
+	envelopeEdit   = "edit"   // envelopeEdit replaces the text of the sender's message Target
+	envelopeDelete = "delete" // envelopeDelete removes the sender's message Target for everyone
+	envelopeTimer  = "timer"  // envelopeTimer proposes a new disappearing message timer for the conversation
+	envelopeAccept = "accept" // envelopeAccept agrees to the timer proposal Target, both sides then use it
+)
+
+// Envelope is the plaintext inside a message ciphertext, control kinds are never
+// shown as messages. Clients before envelopes sent the bare text, which opens as
+// a text envelope.
+type Envelope struct {
+	Kind   string `json:"kind"`
+	ID     string `json:"id,omitempty"` // ID is chosen by the sender of a text, reply or timer
+	Target string `json:"target,omitempty"`
+	Text   string `json:"text,omitempty"`
+	TTL    int    `json:"ttl,omitempty"` // TTL is the seconds a text is kept, or the new timer for a timer envelope
+}
+
+func openEnvelope(plaintext []byte) *Envelope {
+	env := &Envelope{}
+	if err := json.Unmarshal(plaintext, env); err != nil || len(env.Kind) == 0 {
+		return &Envelope{Kind: envelopeText, Text: string(plaintext)}
+	}
+	return env
+}
+
+func (env *Envelope) seal() []byte {
+	b, _ := json.Marshal(env)
+	return b
+}
+
+// expires is when a text sent at sent disappears, zero when it's kept.
+func (env *Envelope) expires(sent time.Time) time.Time {
+	if env.TTL <= 0 {
+		return time.Time{}
+	}
+	return sent.Add(time.Duration(env.TTL) * time.Second)
+}
@@ -1,11 +1,15 @@
 module ogsma_client
 
-go 1.25
+go 1.25.3
+
+replace ogsma_protocol => ../protocol
 
 require (
 	fyne.io/fyne/v2 v2.7.0
 	github.com/ecies/go/v2 v2.0.11
 	github.com/gorilla/websocket v1.5.3
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	ogsma_protocol v0.0.0-00010101000000-000000000000
 )
 
 require (
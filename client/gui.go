@@ -6,22 +6,47 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"sync/atomic"
 	"time"
 
 	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
 	"fyne.io/fyne/v2/layout"
+	"fyne.io/fyne/v2/theme"
 	"fyne.io/fyne/v2/widget"
+	"ogsma_protocol"
 )
 
 type GUI struct {
-	tabs            bool
-	app             fyne.App
-	window          fyne.Window
-	chatOutput      map[string]*widget.RichText
-	scrollContainer map[string]*container.Scroll
-	client          *Client
-	enc             *Encryption
+	tabs          bool
+	sharePresence bool
+	app           fyne.App
+	window        fyne.Window
+	chatOutput    map[string]*messageList
+	client        *Client
+	enc           *Encryption
+	statusDot     map[string]*canvas.Circle
+	statusText    map[string]*widget.Label
+	typingLabel   map[string]*widget.Label
+	timerLabel    map[string]*widget.Label
+	timerOffer    map[string]*fyne.Container // timerOffer shows the contact's timer proposal
+	offerLabel    map[string]*widget.Label
+	msgEntry      map[string]*widget.Entry // msgEntry is the entry of the open conversation with each contact
+	composing     map[string]*composeState
+	composeLabel  map[string]*widget.Label
+	composeBar    map[string]*fyne.Container
+	contactList   *fyne.Container // contactList holds the contact rows while the list is on screen
+	chatTabs      *container.AppTabs
+	tabItem       map[string]*container.TabItem
+	history       *historyIndex // history is set at login, guarded by messagesMu
+	foreground    atomic.Bool   // foreground is set by the lifecycle callbacks while the app is on screen
+	hidden        time.Time     // hidden is when the app last left the foreground
+	locked        bool
+	typingTimers  map[string]*time.Timer
+	lastTyping    map[string]time.Time
 }
 
 func (g *GUI) loginWindow() {
@@ -29,39 +54,68 @@ func (g *GUI) loginWindow() {
 	messageLabel := widget.NewLabel("")
 	passEntry := widget.NewPasswordEntry()
 	passEntry.SetPlaceHolder("Password")
+	profiles := g.profiles()
+	var profile *Profile
+	var names []string
+	for _, p := range profiles {
+		names = append(names, p.Name)
+	}
+	profileSelect := widget.NewSelect(names, func(name string) {
+		for _, p := range profiles {
+			if p.Name == name {
+				profile = p
+			}
+		}
+	})
+	profileSelect.PlaceHolder = "Import a profile to log in"
+	if last := g.app.Preferences().String("profile"); slices.Contains(names, last) {
+		profileSelect.SetSelected(last)
+	} else if len(names) > 0 {
+		profileSelect.SetSelectedIndex(0)
+	}
+	importButton := widget.NewButtonWithIcon("Import profile", theme.FolderOpenIcon(), g.importProfileDialog)
 	login := func() {
+		if profile == nil {
+			messageLabel.SetText("No profile selected, import a .ogsma profile first")
+			return
+		}
+		if err := g.useProfile(profile); err != nil {
+			messageLabel.SetText(fmt.Sprintf("Invalid profile: %v", err))
+			return
+		}
 		g.enc.password = passEntry.Text
 		if err := g.enc.loadKeys(); err != nil {
 			messageLabel.SetText(fmt.Sprintf("Invalid Password: %v", err))
 			return
 		}
 		g.client.ID = g.enc.keys.ID
+		g.client.Identity = g.enc.keys.PrivateKey.Bytes()
+		g.checkContactKeys()
+		for _, contact := range g.enc.keys.Contacts {
+			g.chatOutput[contact.ID] = newMessageList(g.client.ID, g.app.Preferences().Bool("markdown"), g.messageActions(contact))
+			g.initPresence(contact)
+			g.initTimer(contact)
+			g.initCompose(contact)
+		}
+		// the lists and history must be ready before messages arrive
+		g.loadHistory()
 		if err := g.client.Connect(); err != nil {
 			log.Fatal(err)
 		}
-		for _, contact := range g.enc.keys.Contacts {
-			g.chatOutput[contact.ID] = widget.NewRichText()
-			g.chatOutput[contact.ID].Wrapping = fyne.TextWrapWord
-			g.scrollContainer[contact.ID] = container.NewVScroll(g.chatOutput[contact.ID])
-		}
+		g.setStatus(statusOnline)
 		g.contactsWindow()
+		g.warnChangedKeys()
 	}
 	passEntry.OnSubmitted = func(s string) {
 		login()
 	}
-	////////////
-	passEntry.SetText("password1234!") // set password
-	////////////
 	loginButton := widget.NewButton("Login", login)
 	content := container.NewVBox(
-		widget.NewLabel("Please log in"),
+		container.NewBorder(nil, nil, nil, g.settingsButton(g.loginWindow), widget.NewLabel("Please log in")),
+		container.NewBorder(nil, nil, nil, importButton, profileSelect),
 		passEntry,
 		loginButton,
 		messageLabel,
-		widget.NewCheck("tabs", func(value bool) {
-			log.Println("tabs option set to", value)
-			g.tabs = value
-		}),
 	)
 	g.window.SetContent(content)
 }
@@ -69,41 +123,50 @@ func (g *GUI) loginWindow() {
 func (g *GUI) contactsWindow() {
 	g.window.SetTitle("Contacts")
 	if g.tabs {
-		tabs := container.NewAppTabs()
+		g.contactList = nil
+		g.chatTabs = container.NewAppTabs()
 		for _, contact := range g.enc.keys.Contacts {
-			tabs.Append(container.NewTabItem(contact.Username, g.chatTab(contact)))
+			g.tabItem[contact.ID] = container.NewTabItem(contact.Username, g.chatTab(contact))
+			g.chatTabs.Append(g.tabItem[contact.ID])
 		}
-		g.window.SetContent(tabs)
-	} else {
-		content := container.NewVBox(widget.NewLabel("Contacts"))
-		for _, contact := range g.enc.keys.Contacts {
-			content.Add(widget.NewButton(contact.Username, func() {
-				g.client.targetID = contact.ID
-				g.chatWindow(contact)
-			}))
-			content.Add(widget.NewSeparator())
+		g.chatTabs.OnSelected = func(item *container.TabItem) {
+			for id, it := range g.tabItem {
+				if it == item {
+					g.openChat(id)
+				}
+			}
+		}
+		if len(g.enc.keys.Contacts) > 0 {
+			g.openChat(g.enc.keys.Contacts[0].ID)
 		}
-		g.window.SetContent(content)
+		bar := container.NewHBox(layout.NewSpacer(), g.notificationsButton(), g.searchButton(nil, g.contactsWindow), g.settingsButton(g.contactsWindow))
+		g.window.SetContent(container.NewBorder(bar, nil, nil, nil, g.chatTabs))
+	} else {
+		g.chatTabs = nil
+		g.contactList = container.NewVBox()
+		g.fillContactList()
+		header := container.NewBorder(nil, nil, nil, container.NewHBox(g.notificationsButton(), g.searchButton(nil, g.contactsWindow), g.settingsButton(g.contactsWindow)),
+			widget.NewLabel("Contacts"))
+		g.window.SetContent(container.NewVBox(header, g.contactList))
+		g.openChat("")
 	}
 }
 
 func (g *GUI) chatWindow(contact *Contact) {
 	g.window.SetTitle("messaging")
+	g.contactList = nil
+	g.openChat(contact.ID)
 	msgEntry := widget.NewEntry()
 	msgEntry.OnSubmitted = func(s string) {
 		if len(s) > 0 {
-			targetPublicKeyEncryptedBytes, err := g.enc.publicEncrypt([]byte(msgEntry.Text), contact.PublicKey)
+			env := g.composeEnvelope(contact.ID, msgEntry.Text)
+			msg, err := g.envelopeMsg(contact, env)
 			if err != nil {
 				log.Println(err)
 				return
 			}
 			// TODO : resend if fail
-			if err := g.client.SendMsg(&Msg{
-				ID:        g.client.targetID,
-				TimeStamp: time.Now(),
-				Message:   targetPublicKeyEncryptedBytes,
-				FromID:    g.client.ID,
-			}); err != nil {
+			if err := g.client.SendMsg(msg); err != nil {
 				log.Println(err)
 				g.appendText("Error:", err.Error(), contact.ID)
 				if err := g.client.Connect(); err != nil {
@@ -113,18 +176,26 @@ func (g *GUI) chatWindow(contact *Contact) {
 					os.Exit(1)
 				}
 			}
-			g.appendText(g.enc.keys.Username, msgEntry.Text, contact.ID)
+			g.applyEnvelope(contact.ID, g.client.ID, g.enc.keys.Username, env, msg.TimeStamp)
+			g.cancelCompose(contact.ID)
 			msgEntry.SetText("")
 		}
 	}
+	msgEntry.OnChanged = func(s string) {
+		g.sendTyping(contact)
+	}
+	g.msgEntry[contact.ID] = msgEntry
 	backButton := widget.NewButton("back", func() {
 		g.client.targetID = ""
 		g.contactsWindow()
 	})
-	content := container.New(layout.NewBorderLayout(backButton, msgEntry, nil, nil),
-		backButton,
-		g.scrollContainer[contact.ID],
-		msgEntry,
+	top := container.NewBorder(nil, nil, backButton, container.NewHBox(g.markdownToggle(), g.timerButton(contact), g.muteButton(contact),
+		g.searchButton(contact, func() { g.chatWindow(contact) })), g.timerLabel[contact.ID])
+	bottom := container.NewVBox(g.typingLabel[contact.ID], g.timerOffer[contact.ID], g.composeBar[contact.ID], msgEntry)
+	content := container.New(layout.NewBorderLayout(top, bottom, nil, nil),
+		top,
+		g.chatOutput[contact.ID],
+		bottom,
 	)
 	g.window.SetContent(content)
 }
@@ -134,7 +205,8 @@ func (g *GUI) chatTab(contact *Contact) *fyne.Container {
 	msgEntry := widget.NewEntry()
 	msgEntry.OnSubmitted = func(s string) {
 		if len(s) > 0 {
-			targetPublicKeyEncryptedBytes, err := g.enc.publicEncrypt([]byte(msgEntry.Text), contact.PublicKey)
+			env := g.composeEnvelope(contact.ID, msgEntry.Text)
+			msg, err := g.envelopeMsg(contact, env)
 			if err != nil {
 				log.Println(err)
 				return
@@ -142,12 +214,7 @@ func (g *GUI) chatTab(contact *Contact) *fyne.Container {
 			retry := 0
 			for {
 				retry++
-				if err := g.client.SendMsg(&Msg{
-					ID:        contact.ID,
-					TimeStamp: time.Now(),
-					Message:   targetPublicKeyEncryptedBytes,
-					FromID:    g.client.ID,
-				}); err == nil {
+				if err := g.client.SendMsg(msg); err == nil {
 					break
 				}
 				if retry > 16 {
@@ -157,40 +224,49 @@ func (g *GUI) chatTab(contact *Contact) *fyne.Container {
 				}
 				time.Sleep(250 * time.Millisecond)
 			}
-			g.appendText(g.enc.keys.Username, msgEntry.Text, contact.ID)
+			g.applyEnvelope(contact.ID, g.client.ID, g.enc.keys.Username, env, msg.TimeStamp)
+			g.cancelCompose(contact.ID)
 			msgEntry.SetText("")
 		}
 	}
-	return container.New(layout.NewBorderLayout(nil, msgEntry, nil, nil),
-		g.scrollContainer[contact.ID],
-		msgEntry,
+	msgEntry.OnChanged = func(s string) {
+		g.sendTyping(contact)
+	}
+	g.msgEntry[contact.ID] = msgEntry
+	top := container.NewBorder(nil, nil, container.NewHBox(g.statusIndicator(contact.ID), g.statusText[contact.ID]),
+		container.NewHBox(g.markdownToggle(), g.timerButton(contact), g.muteButton(contact),
+			g.searchButton(contact, g.contactsWindow), g.contactInfoButton(contact)), g.timerLabel[contact.ID])
+	bottom := container.NewVBox(g.typingLabel[contact.ID], g.timerOffer[contact.ID], g.composeBar[contact.ID], msgEntry)
+	return container.New(layout.NewBorderLayout(top, bottom, nil, nil),
+		top,
+		g.chatOutput[contact.ID],
+		bottom,
 	)
 }
 
+// appendText shows a notice in a conversation, notices can't be replied to.
 func (g *GUI) appendText(prefix, content any, id string) {
-	go func() {
-		fyne.DoAndWait(func() {
-			g.chatOutput[id].AppendMarkdown(fmt.Sprintf("%v: %v", prefix, content))
-			g.chatOutput[id].AppendMarkdown("---")
-			g.scrollContainer[id].ScrollToBottom()
-			g.chatOutput[id].Refresh()
-		})
-	}()
+	m := &chatMessage{prefix: fmt.Sprint(prefix), text: fmt.Sprint(content), sent: time.Now()}
+	fyne.Do(func() {
+		g.chatOutput[id].add(m)
+	})
 }
 
 func (g *GUI) lifecycle() {
 	lifecycle := g.app.Lifecycle()
 	lifecycle.SetOnStopped(func() {
-		background = true
+		g.setForeground(false)
 	})
 	lifecycle.SetOnStarted(func() {
-		background = false
+		g.setForeground(true)
 	})
 	lifecycle.SetOnExitedForeground(func() {
-		background = true
+		g.setForeground(false)
+		g.setStatus(statusAway)
 	})
 	lifecycle.SetOnEnteredForeground(func() {
-		background = false
+		g.setForeground(true)
+		g.setStatus(statusOnline)
 	})
 }
 
@@ -207,33 +283,102 @@ func (g *GUI) lookupUsername(id string) (string, error) {
 func (g *GUI) listen() {
 	for {
 		nm := <-g.client.MessageChan
-		nms := Msg{}
-		if err := json.Unmarshal(nm, &nms); err != nil {
+		nms := protocol.Msg{}
+		if protocol.IsBinaryFrame(nm) {
+			bm, err := protocol.DecodeBinary(nm)
+			if err != nil {
+				log.Printf("error decoding binary frame: %v", err)
+				continue
+			}
+			nms = *bm
+		} else if err := json.Unmarshal(nm, &nms); err != nil {
 			log.Printf("error unmarshalling message: %v", err)
 		}
+		switch nms.Type {
+		case protocol.FramePresence:
+			g.handlePresence(nm)
+			continue
+		case protocol.FrameTyping:
+			g.handleTyping(nms)
+			continue
+		case protocol.FrameError:
+			g.handleError(nm)
+			continue
+		case protocol.FrameAck, protocol.FrameReceipt:
+			continue
+		case protocol.FrameMessage:
+		default:
+			log.Printf("unknown frame type %q", nms.Type)
+			continue
+		}
+		if nms.FromID == g.client.ID {
+			g.syncSent(nms)
+			continue
+		}
 		decryptedMessage, err := g.enc.privateDecrypt(nms.Message)
 		if err != nil {
 			log.Printf("error decrypting message: %v", err)
+			continue
 		}
-		since := time.Now().Sub(nms.TimeStamp).Round(time.Second)
-		contactMessages[nms.FromID] = append(contactMessages[nms.FromID], QueueMessage{
-			sent: nms.TimeStamp,
-			msg:  string(decryptedMessage),
-		})
+		g.sendReceipt(nms)
 		username, err := g.lookupUsername(nms.FromID)
 		if err != nil {
 			log.Printf("error looking up username: %v", err)
 		}
-		if background {
-			fyne.CurrentApp().SendNotification(&fyne.Notification{
-				Title:   fmt.Sprintf("Msg from: %s", username),
-				Content: fmt.Sprintf("%s", string(decryptedMessage)),
-			})
+		env := openEnvelope(decryptedMessage)
+		if env.Kind != envelopeText && env.Kind != envelopeReply {
+			g.applyEnvelope(nms.FromID, nms.FromID, username, env, nms.TimeStamp)
+			continue
+		}
+		if expires := env.expires(nms.TimeStamp); !expires.IsZero() && time.Now().After(expires) {
+			continue
 		}
-		if since > time.Second*5 {
-			g.appendText(fmt.Sprintf("%s %v:", username, since), string(decryptedMessage), nms.FromID)
-		} else {
-			g.appendText(username, string(decryptedMessage), nms.FromID)
+		g.notify(nms.FromID, username, env.Text)
+		if label, ok := g.typingLabel[nms.FromID]; ok {
+			fyne.Do(label.Hide)
 		}
+		g.applyEnvelope(nms.FromID, nms.FromID, username, env, nms.TimeStamp)
+	}
+}
+
+func (g *GUI) sendReceipt(nms protocol.Msg) {
+	if len(nms.Ref) == 0 {
+		return
+	}
+	if err := g.client.SendMsg(&protocol.Msg{
+		Type:      protocol.FrameReceipt,
+		ID:        nms.FromID,
+		Ref:       nms.Ref,
+		TimeStamp: time.Now(),
+		FromID:    g.client.ID,
+	}); err != nil {
+		log.Printf("error sending receipt: %v", err)
+	}
+}
+
+func (g *GUI) handleError(nm []byte) {
+	e := protocol.ErrorFrame{}
+	if err := json.Unmarshal(nm, &e); err != nil {
+		log.Printf("error unmarshalling error frame: %v", err)
+		return
+	}
+	log.Printf("server rejected frame %s: %s: %s", e.Ref, e.Code, e.Reason)
+	fyne.Do(func() {
+		dialog.ShowError(fmt.Errorf("server rejected a message: %s", e.Reason), g.window)
+	})
+}
+
+// syncSent shows a message sent from one of our other devices in its conversation.
+func (g *GUI) syncSent(nms protocol.Msg) {
+	if _, ok := g.chatOutput[nms.ID]; !ok {
+		log.Printf("sent message for unknown contact %s", nms.ID)
+		return
+	}
+	decryptedMessage, err := g.enc.privateDecrypt(nms.Self)
+	if err != nil {
+		log.Printf("error decrypting sent message: %v", err)
+		return
 	}
+	who := fmt.Sprintf("%s (other device)", g.enc.keys.Username)
+	g.applyEnvelope(nms.ID, g.client.ID, who, openEnvelope(decryptedMessage), nms.TimeStamp)
 }
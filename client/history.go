@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	ecies "github.com/ecies/go/v2"
+)
+
+// maxResults is the most search results shown, the newest first.
+const maxResults = 200
+
+// nonceSize is the AES-GCM nonce prefixed to the encrypted history.
+const nonceSize = 12
+
+// historyEntry is a stored message, exported fields are saved.
+type historyEntry struct {
+	Contact string
+	ID      string // ID is the envelope ID, empty for messages from clients before envelopes
+	Mine    bool
+	Sent    time.Time
+	Text    string
+	Edited  bool
+	Expires time.Time
+}
+
+func (e *historyEntry) key() string {
+	if len(e.ID) == 0 {
+		return fmt.Sprintf("%s/@%d", e.Contact, e.Sent.UnixNano())
+	}
+	return e.Contact + "/" + e.ID
+}
+
+// historyIndex is the local message history with a word index for search. It is
+// kept in memory and saved to app storage sealed with a key derived from the
+// private key, so message text never reaches the disk in plaintext.
+type historyIndex struct {
+	mu      sync.Mutex
+	entries map[string]*historyEntry
+	words   map[string]map[string]bool // words maps each word to the keys of the entries containing it
+	storage fyne.Storage
+	name    string
+	gcms    []cipher.AEAD // gcms seal with the current key first, then the keys before rotations
+	dirty   bool
+}
+
+// words splits text into lowercase words for the index and for queries.
+func words(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// newHistory is an empty history saved in app storage for the user, keys are the
+// current private key followed by the previous ones.
+func newHistory(s fyne.Storage, userID string, keys ...*ecies.PrivateKey) (*historyIndex, error) {
+	h := &historyIndex{
+		entries: make(map[string]*historyEntry),
+		words:   make(map[string]map[string]bool),
+		storage: s,
+		name:    "history-" + userID + ".idx",
+	}
+	for _, key := range keys {
+		k, err := hkdf.Key(sha256.New, key.Bytes(), nil, "ogsma history "+userID, 32)
+		if err != nil {
+			return nil, err
+		}
+		gcm, err := newGCM(k)
+		if err != nil {
+			return nil, err
+		}
+		h.gcms = append(h.gcms, gcm)
+	}
+	return h, nil
+}
+
+// load reads the saved history, a missing file leaves it empty. Expired messages
+// are dropped.
+func (h *historyIndex) load() error {
+	if !slices.Contains(h.storage.List(), h.name) {
+		return nil
+	}
+	r, err := h.storage.Open(h.name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < nonceSize {
+		return errors.New("invalid history: truncated")
+	}
+	var plaintext []byte
+	err = errors.New("no keys")
+	used := 0
+	for i, gcm := range h.gcms {
+		if plaintext, err = gcm.Open(nil, data[:nonceSize], data[nonceSize:], []byte(h.name)); err == nil {
+			used = i
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("decrypt failed: %v", err)
+	}
+	var entries []*historyEntry
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&entries); err != nil {
+		return fmt.Errorf("error decoding history: %v", err)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	for _, e := range entries {
+		if e.Expires.IsZero() || now.Before(e.Expires) {
+			h.put(e)
+		}
+	}
+	// a history sealed with a key from before a rotation is saved again with the current one
+	h.dirty = used > 0
+	return nil
+}
+
+// put adds e to the index, h.mu must be held.
+func (h *historyIndex) put(e *historyEntry) {
+	key := e.key()
+	h.entries[key] = e
+	for _, w := range words(e.Text) {
+		if h.words[w] == nil {
+			h.words[w] = make(map[string]bool)
+		}
+		h.words[w][key] = true
+	}
+	h.dirty = true
+}
+
+// drop removes the entry key from the index, h.mu must be held.
+func (h *historyIndex) drop(key string) {
+	e, ok := h.entries[key]
+	if !ok {
+		return
+	}
+	for _, w := range words(e.Text) {
+		delete(h.words[w], key)
+		if len(h.words[w]) == 0 {
+			delete(h.words, w)
+		}
+	}
+	delete(h.entries, key)
+	h.dirty = true
+}
+
+// messages lists the stored messages ordered by the time they were sent.
+func (h *historyIndex) messages() []*historyEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var entries []*historyEntry
+	for _, e := range h.entries {
+		entries = append(entries, e)
+	}
+	slices.SortFunc(entries, func(a, b *historyEntry) int { return a.Sent.Compare(b.Sent) })
+	return entries
+}
+
+func (h *historyIndex) add(contact string, qm QueueMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.put(&historyEntry{Contact: contact, ID: qm.id, Mine: qm.mine, Sent: qm.sent, Text: qm.msg, Expires: qm.expires})
+}
+
+// edit applies an edit or delete by the message's sender.
+func (h *historyIndex) edit(contact string, mine bool, env *Envelope) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := (&historyEntry{Contact: contact, ID: env.Target}).key()
+	e, ok := h.entries[key]
+	if len(env.Target) == 0 || !ok || e.Mine != mine {
+		return
+	}
+	h.drop(key)
+	if env.Kind == envelopeEdit {
+		edited := *e
+		edited.Text, edited.Edited = env.Text, true
+		h.put(&edited)
+	}
+}
+
+// expire removes the messages that expired before now.
+func (h *historyIndex) expire(now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key, e := range h.entries {
+		if !e.Expires.IsZero() && now.After(e.Expires) {
+			h.drop(key)
+		}
+	}
+}
+
+// search finds the messages containing a word starting with each word of query,
+// only with contact unless it is empty. The newest come first.
+func (h *historyIndex) search(query, contact string) []*historyEntry {
+	terms := words(query)
+	if len(terms) == 0 {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var matches map[string]bool
+	for _, t := range terms {
+		found := make(map[string]bool)
+		for w, keys := range h.words {
+			if !strings.HasPrefix(w, t) {
+				continue
+			}
+			for key := range keys {
+				if matches == nil || matches[key] {
+					found[key] = true
+				}
+			}
+		}
+		matches = found
+	}
+	var results []*historyEntry
+	for key := range matches {
+		if e := h.entries[key]; len(contact) == 0 || e.Contact == contact {
+			results = append(results, e)
+		}
+	}
+	slices.SortFunc(results, func(a, b *historyEntry) int { return b.Sent.Compare(a.Sent) })
+	if len(results) > maxResults {
+		results = results[:maxResults]
+	}
+	return results
+}
+
+// save writes the history to app storage if it changed since it was last saved.
+func (h *historyIndex) save() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.dirty {
+		return nil
+	}
+	var entries []*historyEntry
+	for _, e := range h.entries {
+		entries = append(entries, e)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entries); err != nil {
+		return err
+	}
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	save := h.storage.Save
+	if !slices.Contains(h.storage.List(), h.name) {
+		save = h.storage.Create
+	}
+	w, err := save(h.name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(h.gcms[0].Seal(nonce, nonce, buf.Bytes(), []byte(h.name))); err != nil {
+		w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	h.dirty = false
+	return nil
+}
+
+// moveAside keeps a saved history that couldn't be read under another name, so
+// the next save doesn't replace it, and returns that name.
+func (h *historyIndex) moveAside(now time.Time) (string, error) {
+	r, err := h.storage.Open(h.name)
+	if err != nil {
+		return "", err
+	}
+	data, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return "", err
+	}
+	aside := fmt.Sprintf("%s.unreadable-%d", h.name, now.Unix())
+	w, err := h.storage.Create(aside)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Close()
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return aside, h.storage.Remove(h.name)
+}
+
+// saveHistory saves changes to h every few seconds.
+func saveHistory(h *historyIndex) {
+	for range time.Tick(5 * time.Second) {
+		if err := h.save(); err != nil {
+			log.Printf("error saving history: %v", err)
+		}
+	}
+}
+
+// loadHistory opens the stored history and shows it in the conversations, it is
+// called once at login after the message lists exist.
+func (g *GUI) loadHistory() {
+	h, err := newHistory(g.app.Storage(), g.client.ID, append([]*ecies.PrivateKey{g.enc.keys.PrivateKey}, g.enc.keys.PreviousKeys...)...)
+	if err != nil {
+		log.Printf("error creating history: %v", err)
+		return
+	}
+	keep := true
+	if err := h.load(); err != nil {
+		log.Printf("error loading history: %v", err)
+		if aside, moveErr := h.moveAside(time.Now()); moveErr != nil {
+			// never replace a history that couldn't be read or moved, this session isn't saved
+			log.Printf("error moving history aside: %v", moveErr)
+			keep = false
+			dialog.ShowError(fmt.Errorf("the message history can't be read (%v), messages from this session won't be saved", err), g.window)
+		} else {
+			dialog.ShowInformation("Message history", fmt.Sprintf("The message history can't be read (%v). It was kept as %s and a new history was started.", err, aside), g.window)
+		}
+	}
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+	g.history = h
+	loaded := map[string][]*chatMessage{}
+	for _, e := range h.messages() {
+		if _, ok := g.chatOutput[e.Contact]; !ok {
+			continue
+		}
+		contactMessages[e.Contact] = append(contactMessages[e.Contact], QueueMessage{
+			id: e.ID, sent: e.Sent, msg: e.Text, expires: e.Expires, mine: e.Mine, read: true,
+		})
+		from, who := e.Contact, ""
+		if e.Mine {
+			from, who = g.client.ID, g.enc.keys.Username
+		} else if who, err = g.lookupUsername(e.Contact); err != nil {
+			log.Printf("error looking up username: %v", err)
+		}
+		loaded[e.Contact] = append(loaded[e.Contact], &chatMessage{id: e.ID, from: from, prefix: who, text: e.Text, sent: e.Sent, edited: e.Edited, expires: e.Expires})
+	}
+	for contact, messages := range loaded {
+		g.chatOutput[contact].addAll(messages)
+	}
+	if keep {
+		go saveHistory(h)
+	}
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("NewGCM: %w", err)
+	}
+	return gcm, nil
+}
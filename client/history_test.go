@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/storage"
+	ecies "github.com/ecies/go/v2"
+)
+
+// memStorage is an in-memory fyne.Storage.
+type memStorage struct {
+	files map[string][]byte
+}
+
+type memReader struct {
+	io.Reader
+	name string
+}
+
+func (r *memReader) URI() fyne.URI { return storage.NewFileURI("/" + r.name) }
+func (r *memReader) Close() error  { return nil }
+
+type memWriter struct {
+	bytes.Buffer
+	s    *memStorage
+	name string
+}
+
+func (w *memWriter) URI() fyne.URI { return storage.NewFileURI("/" + w.name) }
+func (w *memWriter) Close() error {
+	w.s.files[w.name] = w.Bytes()
+	return nil
+}
+
+func (s *memStorage) RootURI() fyne.URI { return storage.NewFileURI("/") }
+
+func (s *memStorage) Create(name string) (fyne.URIWriteCloser, error) {
+	if _, ok := s.files[name]; ok {
+		return nil, errors.New("file exists")
+	}
+	return &memWriter{s: s, name: name}, nil
+}
+
+func (s *memStorage) Open(name string) (fyne.URIReadCloser, error) {
+	data, ok := s.files[name]
+	if !ok {
+		return nil, errors.New("file not found")
+	}
+	return &memReader{Reader: bytes.NewReader(data), name: name}, nil
+}
+
+func (s *memStorage) Save(name string) (fyne.URIWriteCloser, error) {
+	if _, ok := s.files[name]; !ok {
+		return nil, errors.New("file not found")
+	}
+	return &memWriter{s: s, name: name}, nil
+}
+
+func (s *memStorage) Remove(name string) error {
+	delete(s.files, name)
+	return nil
+}
+
+func (s *memStorage) List() []string {
+	var names []string
+	for name := range s.files {
+		names = append(names, name)
+	}
+	return names
+}
+
+func testHistory(t *testing.T, s fyne.Storage, keys ...*ecies.PrivateKey) *historyIndex {
+	t.Helper()
+	h, err := newHistory(s, "me", keys...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func testKey(t *testing.T) *ecies.PrivateKey {
+	t.Helper()
+	k, err := ecies.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// texts lists the text of entries in order.
+func texts(entries []*historyEntry) []string {
+	var out []string
+	for _, e := range entries {
+		out = append(out, e.Text)
+	}
+	return out
+}
+
+func TestHistorySearch(t *testing.T) {
+	h := testHistory(t, &memStorage{files: map[string][]byte{}}, testKey(t))
+	start := time.Unix(1700000000, 0)
+	for i, m := range []struct {
+		contact string
+		text    string
+	}{
+		{"alice", "Hello world"},
+		{"bob", "hello there"},
+		{"alice", "the world is round"},
+		{"bob", "nothing here"},
+	} {
+		h.add(m.contact, QueueMessage{id: string(rune('a' + i)), sent: start.Add(time.Duration(i) * time.Minute), msg: m.text})
+	}
+	for _, tc := range []struct {
+		query   string
+		contact string
+		want    []string
+	}{
+		{"hel", "", []string{"hello there", "Hello world"}},
+		{"HELLO", "alice", []string{"Hello world"}},
+		{"wor hel", "", []string{"Hello world"}},
+		{"the", "", []string{"the world is round", "hello there"}},
+		{"missing", "", nil},
+		{"  ", "", nil},
+	} {
+		if got := texts(h.search(tc.query, tc.contact)); !slices.Equal(got, tc.want) {
+			t.Errorf("search(%q, %q) = %q, want %q", tc.query, tc.contact, got, tc.want)
+		}
+	}
+}
+
+func TestHistoryEditAndExpire(t *testing.T) {
+	h := testHistory(t, &memStorage{files: map[string][]byte{}}, testKey(t))
+	now := time.Now()
+	h.add("alice", QueueMessage{id: "1", sent: now, msg: "first draft", mine: true})
+	h.add("alice", QueueMessage{id: "2", sent: now.Add(time.Second), msg: "their message"})
+	h.add("alice", QueueMessage{id: "3", sent: now.Add(2 * time.Second), msg: "vanishing note", expires: now.Add(time.Minute)})
+
+	h.edit("alice", true, &Envelope{Kind: envelopeEdit, Target: "1", Text: "final copy"})
+	// only the sender can change a message
+	h.edit("alice", true, &Envelope{Kind: envelopeEdit, Target: "2", Text: "forged"})
+	h.edit("alice", true, &Envelope{Kind: envelopeDelete, Target: "2"})
+	if got := texts(h.messages()); !slices.Equal(got, []string{"final copy", "their message", "vanishing note"}) {
+		t.Fatalf("after edits %q", got)
+	}
+	if len(h.search("draft", "")) != 0 || len(h.search("final", "")) != 1 {
+		t.Error("edit did not update the index")
+	}
+	if e := h.search("final", "")[0]; !e.Edited {
+		t.Error("edited message not marked as edited")
+	}
+
+	h.edit("alice", false, &Envelope{Kind: envelopeDelete, Target: "2"})
+	h.expire(now.Add(2 * time.Minute))
+	if got := texts(h.messages()); !slices.Equal(got, []string{"final copy"}) {
+		t.Errorf("after delete and expiry %q", got)
+	}
+	if len(h.words["vanishing"]) != 0 || len(h.words["their"]) != 0 {
+		t.Error("removed messages left words in the index")
+	}
+}
+
+func TestHistorySaveLoad(t *testing.T) {
+	s := &memStorage{files: map[string][]byte{}}
+	key := testKey(t)
+	h := testHistory(t, s, key)
+	now := time.Now()
+	h.add("alice", QueueMessage{id: "1", sent: now, msg: "kept secret"})
+	h.add("bob", QueueMessage{sent: now.Add(time.Second), msg: "from an old client"})
+	h.add("bob", QueueMessage{id: "2", sent: now.Add(2 * time.Second), msg: "gone soon", expires: now.Add(-time.Second)})
+	if err := h.save(); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(s.files[h.name], []byte("kept secret")) {
+		t.Error("history saved in plaintext")
+	}
+
+	loaded := testHistory(t, s, key)
+	if err := loaded.load(); err != nil {
+		t.Fatal(err)
+	}
+	if got := texts(loaded.messages()); !slices.Equal(got, []string{"kept secret", "from an old client"}) {
+		t.Errorf("loaded %q", got)
+	}
+	if len(loaded.search("secret", "alice")) != 1 {
+		t.Error("loaded history is not indexed")
+	}
+	if err := testHistory(t, s, testKey(t)).load(); err == nil {
+		t.Error("loading with another key succeeded")
+	}
+}
+
+func TestHistoryRotatedKey(t *testing.T) {
+	s := &memStorage{files: map[string][]byte{}}
+	old, current := testKey(t), testKey(t)
+	h := testHistory(t, s, old)
+	h.add("alice", QueueMessage{id: "1", sent: time.Now(), msg: "before rotation"})
+	if err := h.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := testHistory(t, s, current, old)
+	if err := rotated.load(); err != nil {
+		t.Fatal(err)
+	}
+	if !rotated.dirty {
+		t.Fatal("history opened with a previous key is not saved again")
+	}
+	if err := rotated.save(); err != nil {
+		t.Fatal(err)
+	}
+	reopened := testHistory(t, s, current)
+	if err := reopened.load(); err != nil {
+		t.Fatalf("history not resealed with the current key: %v", err)
+	}
+	if got := texts(reopened.messages()); !slices.Equal(got, []string{"before rotation"}) {
+		t.Errorf("loaded %q", got)
+	}
+}
+
+func TestHistoryMoveAside(t *testing.T) {
+	s := &memStorage{files: map[string][]byte{}}
+	h := testHistory(t, s, testKey(t))
+	h.add("alice", QueueMessage{id: "1", sent: time.Now(), msg: "unreadable later"})
+	if err := h.save(); err != nil {
+		t.Fatal(err)
+	}
+	saved := s.files[h.name]
+
+	other := testHistory(t, s, testKey(t))
+	if err := other.load(); err == nil {
+		t.Fatal("loading with another key succeeded")
+	}
+	aside, err := other.moveAside(time.Unix(1700000000, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(aside, h.name+".unreadable-") || !bytes.Equal(s.files[aside], saved) {
+		t.Errorf("moved to %s with %d bytes, want a copy of %d bytes", aside, len(s.files[aside]), len(saved))
+	}
+	other.add("alice", QueueMessage{id: "2", sent: time.Now(), msg: "new history"})
+	if err := other.save(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s.files[aside], saved) {
+		t.Error("saving replaced the unreadable history")
+	}
+}
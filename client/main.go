@@ -1,26 +1,32 @@
 package main
 
 import (
-	_ "embed"
-	"encoding/json"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
 	"log"
+	"sync"
 	"time"
 
+	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
+	"fyne.io/fyne/v2/canvas"
 	"fyne.io/fyne/v2/container"
 	"fyne.io/fyne/v2/widget"
 )
 
 var (
-	background = false
-	//go:embed config.json
-	config          []byte
 	contactMessages map[string][]QueueMessage
+	messagesMu      sync.Mutex // messagesMu guards contactMessages
 )
 
 type QueueMessage struct {
-	sent time.Time
-	msg  string
+	id      string // id is the envelope ID, edits and deletes refer to it
+	sent    time.Time
+	msg     string
+	expires time.Time // expires is when a disappearing message is removed, zero keeps it
+	mine    bool      // mine is set on messages we sent
+	read    bool
 }
 
 type Config struct {
@@ -29,33 +35,72 @@ type Config struct {
 	Endpoint string `json:"endpoint"`
 }
 
+func deviceID(a fyne.App) string {
+	id := a.Preferences().String("deviceID")
+	if len(id) == 0 {
+		b := make([]byte, 16)
+		if _, err := rand.Read(b); err != nil {
+			log.Fatalf("Error generating device id: %v\n", err)
+		}
+		id = hex.EncodeToString(b)
+		a.Preferences().SetString("deviceID", id)
+	}
+	return id
+}
+
+// deviceKey is the key this device signs its hello with, the server ties the
+// device to the first key it sees.
+func deviceKey(a fyne.App) ed25519.PrivateKey {
+	seed, err := hex.DecodeString(a.Preferences().String("deviceKey"))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		seed = make([]byte, ed25519.SeedSize)
+		if _, err := rand.Read(seed); err != nil {
+			log.Fatalf("Error generating device key: %v\n", err)
+		}
+		a.Preferences().SetString("deviceKey", hex.EncodeToString(seed))
+	}
+	return ed25519.NewKeyFromSeed(seed)
+}
+
 func main() {
 	contactMessages = make(map[string][]QueueMessage)
-	c := Config{}
-	if err := json.Unmarshal(config, &c); err != nil {
-		log.Fatalf("Error parsing config file: %v\n", err)
-	}
+	a := app.NewWithID("com.martin.ogsma")
 	g := &GUI{
-		scrollContainer: make(map[string]*container.Scroll),
-		chatOutput:      make(map[string]*widget.RichText),
-		enc: &Encryption{
-			iter:           100000,
-			configKeystore: []byte(c.KeyStore),
-		},
+		chatOutput:   make(map[string]*messageList),
+		statusDot:    make(map[string]*canvas.Circle),
+		statusText:   make(map[string]*widget.Label),
+		typingLabel:  make(map[string]*widget.Label),
+		timerLabel:   make(map[string]*widget.Label),
+		timerOffer:   make(map[string]*fyne.Container),
+		offerLabel:   make(map[string]*widget.Label),
+		msgEntry:     make(map[string]*widget.Entry),
+		composing:    make(map[string]*composeState),
+		composeLabel: make(map[string]*widget.Label),
+		composeBar:   make(map[string]*fyne.Container),
+		tabItem:      make(map[string]*container.TabItem),
+		typingTimers: make(map[string]*time.Timer),
+		lastTyping:   make(map[string]time.Time),
+		enc:          &Encryption{},
 		client: &Client{
+			Device:      deviceID(a),
+			DeviceKey:   deviceKey(a),
 			SelfSigned:  true,
-			Addr:        c.Addr,
-			wsPath:      c.Endpoint,
 			MessageChan: make(chan []byte),
 		},
-		app:  app.New(),
-		tabs: false,
+		app:           a,
+		tabs:          a.Preferences().Bool("tabs"),
+		sharePresence: a.Preferences().Bool("sharePresence"),
 	}
 	g.window = g.app.NewWindow("Login")
 	g.window.SetMaster()
 	platformDo(g)
+	g.applyTheme()
+	g.window.SetOnDropped(func(_ fyne.Position, uris []fyne.URI) {
+		g.importProfileURIs(uris)
+	})
 	g.loginWindow()
 	go g.listen()
+	go g.expireMessages()
 	g.lifecycle()
 	g.window.ShowAndRun()
 }
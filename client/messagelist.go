@@ -0,0 +1,311 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// chatMessage is one entry of a conversation, notices have no id and can't be
+// replied to, edited or deleted.
+type chatMessage struct {
+	id      string // id is the envelope ID chosen by the sender
+	from    string // from is the sender's user ID, empty for notices
+	prefix  string // prefix is the sender's name
+	text    string
+	quote   string // quote is the start of the message this one replies to
+	sent    time.Time
+	edited  bool
+	deleted bool
+	expires time.Time
+	height  float32 // height is the row height at the list's current width, 0 when unknown
+}
+
+// meta is the line under a message with its sender, time and state.
+func (m *chatMessage) meta(mine bool) string {
+	var parts []string
+	if !mine && len(m.prefix) > 0 {
+		parts = append(parts, m.prefix)
+	}
+	layout := "15:04"
+	if m.sent.Local().Format(time.DateOnly) != time.Now().Format(time.DateOnly) {
+		layout = "Jan 2 15:04"
+	}
+	parts = append(parts, m.sent.Local().Format(layout))
+	if m.edited && !m.deleted {
+		parts = append(parts, "edited")
+	}
+	if !m.expires.IsZero() && !m.deleted {
+		parts = append(parts, "disappears "+m.expires.Local().Format("Jan 2 15:04:05"))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// quoteOf shortens a message's text for showing above a reply.
+func quoteOf(text string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if r := []rune(text); len(r) > 60 {
+		return string(r[:60]) + "..."
+	}
+	return text
+}
+
+// messageList shows a conversation ordered by the time messages were sent, sent
+// messages on the right and received ones on the left. It must only be changed
+// from the UI goroutine.
+type messageList struct {
+	widget.BaseWidget
+	self     string // self is our user ID, our messages are drawn as sent
+	list     *widget.List
+	messages []*chatMessage
+	markdown bool // markdown renders message text as Markdown instead of plain text
+	width    float32
+	actions  func(m *chatMessage) []*fyne.MenuItem
+}
+
+func newMessageList(self string, markdown bool, actions func(m *chatMessage) []*fyne.MenuItem) *messageList {
+	l := &messageList{self: self, markdown: markdown, actions: actions}
+	l.list = widget.NewList(
+		func() int { return len(l.messages) },
+		func() fyne.CanvasObject { return newMessageRow(l) },
+		func(id widget.ListItemID, o fyne.CanvasObject) { l.updateRow(id, o.(*messageRow)) },
+	)
+	l.list.OnSelected = func(widget.ListItemID) { l.list.UnselectAll() }
+	l.ExtendBaseWidget(l)
+	return l
+}
+
+func (l *messageList) CreateRenderer() fyne.WidgetRenderer {
+	return widget.NewSimpleRenderer(l.list)
+}
+
+// Resize forgets the row heights when the width changes, wrapped text needs new ones.
+func (l *messageList) Resize(size fyne.Size) {
+	if size.Width != l.width {
+		l.width = size.Width
+		for _, m := range l.messages {
+			m.height = 0
+		}
+	}
+	l.BaseWidget.Resize(size)
+}
+
+func (l *messageList) updateRow(id widget.ListItemID, r *messageRow) {
+	m := l.messages[id]
+	r.set(m, m.from == l.self)
+	if w := l.list.Size().Width; w > 0 && m.height == 0 {
+		m.height = r.heightFor(w)
+		l.list.SetItemHeight(id, m.height)
+	}
+}
+
+// heightsChanged tells the list about the heights of rows that moved.
+func (l *messageList) heightsChanged() {
+	for i, m := range l.messages {
+		if m.height > 0 {
+			l.list.SetItemHeight(i, m.height)
+		}
+	}
+	l.list.Refresh()
+}
+
+func (l *messageList) setMarkdown(markdown bool) {
+	l.markdown = markdown
+	for _, m := range l.messages {
+		m.height = 0
+	}
+	l.list.Refresh()
+}
+
+// add inserts m after the messages sent before or at the same time.
+func (l *messageList) add(m *chatMessage) {
+	i := sort.Search(len(l.messages), func(i int) bool { return l.messages[i].sent.After(m.sent) })
+	l.messages = append(l.messages, nil)
+	copy(l.messages[i+1:], l.messages[i:])
+	l.messages[i] = m
+	l.heightsChanged()
+	if i == len(l.messages)-1 {
+		l.list.ScrollToBottom()
+	}
+}
+
+// addAll inserts messages like add, the heights and the list are updated once for
+// all of them so loading a long history doesn't redo the list per message.
+func (l *messageList) addAll(messages []*chatMessage) {
+	if len(messages) == 0 {
+		return
+	}
+	l.messages = append(l.messages, messages...)
+	sort.SliceStable(l.messages, func(i, j int) bool { return l.messages[i].sent.Before(l.messages[j].sent) })
+	l.heightsChanged()
+	l.list.ScrollToBottom()
+}
+
+func (l *messageList) find(id string) (int, *chatMessage) {
+	for i, m := range l.messages {
+		if len(id) > 0 && m.id == id {
+			return i, m
+		}
+	}
+	return -1, nil
+}
+
+// reveal scrolls to a message, messages without an id are found by the time they were sent.
+func (l *messageList) reveal(id string, sent time.Time) {
+	for i, m := range l.messages {
+		if len(m.from) > 0 && m.id == id && (len(id) > 0 || m.sent.Equal(sent)) {
+			l.list.ScrollTo(i)
+			return
+		}
+	}
+}
+
+func (l *messageList) redraw(i int) {
+	l.messages[i].height = 0
+	l.list.RefreshItem(i)
+}
+
+// edit replaces the text of a message, only the message's sender may edit it.
+func (l *messageList) edit(id, from, text string) bool {
+	i, m := l.find(id)
+	if m == nil || m.from != from || m.deleted {
+		return false
+	}
+	m.text, m.edited = text, true
+	l.redraw(i)
+	return true
+}
+
+// remove deletes a message's text, leaving a placeholder. Only the sender may delete it.
+func (l *messageList) remove(id, from string) bool {
+	i, m := l.find(id)
+	if m == nil || m.from != from {
+		return false
+	}
+	m.text, m.quote, m.deleted = "", "", true
+	l.redraw(i)
+	return true
+}
+
+// expire removes the messages that expired before now.
+func (l *messageList) expire(now time.Time) {
+	var messages []*chatMessage
+	for _, m := range l.messages {
+		if m.expires.IsZero() || !now.After(m.expires) {
+			messages = append(messages, m)
+		}
+	}
+	if len(messages) < len(l.messages) {
+		l.messages = messages
+		l.heightsChanged()
+	}
+}
+
+// messageRow draws one message as a bubble taking up to three quarters of the row.
+type messageRow struct {
+	widget.BaseWidget
+	list   *messageList
+	msg    *chatMessage
+	mine   bool
+	bubble *canvas.Rectangle
+	quote  *widget.Label
+	text   *widget.RichText
+	meta   *widget.Label
+	menu   *widget.Button
+	body   *fyne.Container // body is the bubble with its content, placed by rowLayout
+}
+
+func newMessageRow(l *messageList) *messageRow {
+	r := &messageRow{list: l, bubble: canvas.NewRectangle(theme.Color(theme.ColorNameInputBackground))}
+	r.bubble.CornerRadius = theme.Size(theme.SizeNameInputRadius)
+	r.quote = widget.NewLabel("")
+	r.quote.TextStyle = fyne.TextStyle{Italic: true}
+	r.quote.Truncation = fyne.TextTruncateEllipsis
+	r.text = widget.NewRichText()
+	r.text.Wrapping = fyne.TextWrapWord
+	r.meta = widget.NewLabel("")
+	r.meta.SizeName = theme.SizeNameCaptionText
+	r.meta.Importance = widget.LowImportance
+	r.menu = widget.NewButtonWithIcon("", theme.MoreHorizontalIcon(), func() {
+		c := fyne.CurrentApp().Driver().CanvasForObject(r.menu)
+		widget.ShowPopUpMenuAtRelativePosition(fyne.NewMenu("", r.list.actions(r.msg)...), c, fyne.NewPos(0, r.menu.Size().Height), r.menu)
+	})
+	r.menu.Importance = widget.LowImportance
+	r.body = container.NewStack(r.bubble, container.NewBorder(r.quote, r.meta, nil, container.NewVBox(r.menu), r.text))
+	r.ExtendBaseWidget(r)
+	return r
+}
+
+func (r *messageRow) CreateRenderer() fyne.WidgetRenderer {
+	return widget.NewSimpleRenderer(container.New(&rowLayout{row: r}, r.body))
+}
+
+func (r *messageRow) set(m *chatMessage, mine bool) {
+	r.msg, r.mine = m, mine
+	r.quote.SetText("> " + m.quote)
+	r.quote.Hidden = len(m.quote) == 0
+	switch {
+	case m.deleted:
+		r.text.Segments = []widget.RichTextSegment{&widget.TextSegment{Text: "message deleted", Style: widget.RichTextStyle{Inline: true, TextStyle: fyne.TextStyle{Italic: true}}}}
+		r.text.Refresh()
+	case r.list.markdown:
+		r.text.ParseMarkdown(m.text)
+	default:
+		// plain text is never interpreted, so # or links typed by a contact show as typed
+		r.text.Segments = []widget.RichTextSegment{&widget.TextSegment{Text: m.text, Style: widget.RichTextStyleParagraph}}
+		r.text.Refresh()
+	}
+	r.meta.SetText(m.meta(mine))
+	r.menu.Hidden = m.deleted
+	switch {
+	case mine:
+		r.bubble.FillColor = theme.Color(theme.ColorNameSelection)
+	case len(m.from) == 0:
+		r.bubble.FillColor = theme.Color(theme.ColorNameBackground)
+	default:
+		r.bubble.FillColor = theme.Color(theme.ColorNameInputBackground)
+	}
+	r.bubble.Refresh()
+	r.Refresh()
+}
+
+// bubbleWidth is the width of the bubble in a row of width w, notices use the whole row.
+func (r *messageRow) bubbleWidth(w float32) float32 {
+	if r.msg != nil && len(r.msg.from) == 0 {
+		return w
+	}
+	return w * 3 / 4
+}
+
+// heightFor lays the bubble out at the width it gets in a row of width w and
+// returns the height the wrapped text needs.
+func (r *messageRow) heightFor(w float32) float32 {
+	bw := r.bubbleWidth(w)
+	r.body.Resize(fyne.NewSize(bw, r.body.MinSize().Height))
+	return r.body.MinSize().Height
+}
+
+// rowLayout puts the bubble on the right for sent messages and on the left for received ones.
+type rowLayout struct {
+	row *messageRow
+}
+
+func (rl *rowLayout) Layout(objects []fyne.CanvasObject, size fyne.Size) {
+	bw := rl.row.bubbleWidth(size.Width)
+	x := float32(0)
+	if rl.row.mine {
+		x = size.Width - bw
+	}
+	objects[0].Resize(fyne.NewSize(bw, size.Height))
+	objects[0].Move(fyne.NewPos(x, 0))
+}
+
+func (rl *rowLayout) MinSize(objects []fyne.CanvasObject) fyne.Size {
+	return objects[0].MinSize()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"fyne.io/fyne/v2/test"
+)
+
+func TestAddAll(t *testing.T) {
+	test.NewTempApp(t)
+	start := time.Now()
+	messages := func() []*chatMessage {
+		var ms []*chatMessage
+		for i, minute := range []int{3, 1, 2, 1, 0} {
+			ms = append(ms, &chatMessage{id: string(rune('a' + i)), sent: start.Add(time.Duration(minute) * time.Minute)})
+		}
+		return ms
+	}
+	notice := &chatMessage{text: "history starts here", sent: start.Add(time.Minute)}
+
+	one, all := newMessageList("alice", false, nil), newMessageList("alice", false, nil)
+	one.add(notice)
+	for _, m := range messages() {
+		one.add(m)
+	}
+	all.add(notice)
+	all.addAll(messages())
+	all.addAll(nil)
+
+	var got, want string
+	for i := range one.messages {
+		want += one.messages[i].id + "|"
+		got += all.messages[i].id + "|"
+	}
+	// messages sent at the same time keep the order they were added in
+	if got != want || want != "e||b|d|c|a|" {
+		t.Errorf("addAll ordered %q, add ordered %q", got, want)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const (
+	notifyFull    = "full"    // notifyFull shows the sender and the message text
+	notifySender  = "sender"  // notifySender shows only who sent a message
+	notifyGeneric = "generic" // notifyGeneric shows that a message arrived
+)
+
+// notifyModes are the notification modes with the labels offered for them.
+var notifyModes = []struct {
+	mode  string
+	label string
+}{
+	{notifyFull, "Sender and message"},
+	{notifySender, "Sender only"},
+	{notifyGeneric, "New message only"},
+}
+
+func (g *GUI) notifyMode() string {
+	return g.app.Preferences().StringWithFallback("notifications", notifySender)
+}
+
+func (g *GUI) muted(id string) bool {
+	return g.app.Preferences().Bool("mute." + id)
+}
+
+// quietHours reports whether t is in the do not disturb hours, which may run past midnight.
+func (g *GUI) quietHours(t time.Time) bool {
+	p := g.app.Preferences()
+	if !p.Bool("dnd") {
+		return false
+	}
+	start, end, h := p.Int("dnd.start"), p.IntWithFallback("dnd.end", 7), t.Hour()
+	if start <= end {
+		return h >= start && h < end
+	}
+	return h >= start || h < end
+}
+
+// notify tells the user about a message from a contact while the app is in the
+// background, showing as much as the notification mode allows.
+func (g *GUI) notify(id, who, text string) {
+	if g.foreground.Load() || g.muted(id) || g.quietHours(time.Now()) {
+		return
+	}
+	n := &fyne.Notification{Title: "ogsma", Content: "New message"}
+	switch g.notifyMode() {
+	case notifyFull:
+		n.Title, n.Content = fmt.Sprintf("Msg from: %s", who), text
+	case notifySender:
+		n.Title = fmt.Sprintf("Msg from: %s", who)
+	}
+	g.app.SendNotification(n)
+}
+
+// muteButton turns notifications for one contact off and on.
+func (g *GUI) muteButton(contact *Contact) *widget.Button {
+	b := widget.NewButtonWithIcon("", theme.VolumeUpIcon(), nil)
+	show := func() {
+		if g.muted(contact.ID) {
+			b.SetIcon(theme.VolumeMuteIcon())
+		} else {
+			b.SetIcon(theme.VolumeUpIcon())
+		}
+	}
+	b.OnTapped = func() {
+		g.app.Preferences().SetBool("mute."+contact.ID, !g.muted(contact.ID))
+		show()
+	}
+	show()
+	return b
+}
+
+// notificationSettings edits the notification mode and the do not disturb hours.
+func (g *GUI) notificationSettings() fyne.CanvasObject {
+	p := g.app.Preferences()
+	var labels []string
+	for _, m := range notifyModes {
+		labels = append(labels, m.label)
+	}
+	mode := widget.NewRadioGroup(labels, func(label string) {
+		if i := slices.Index(labels, label); i >= 0 {
+			p.SetString("notifications", notifyModes[i].mode)
+		}
+	})
+	mode.Required = true
+	for _, m := range notifyModes {
+		if m.mode == g.notifyMode() {
+			mode.SetSelected(m.label)
+		}
+	}
+	var hours []string
+	for h := range 24 {
+		hours = append(hours, fmt.Sprintf("%02d:00", h))
+	}
+	hourSelect := func(key string, fallback int) *widget.Select {
+		s := widget.NewSelect(hours, func(h string) {
+			p.SetInt(key, slices.Index(hours, h))
+		})
+		s.SetSelectedIndex(p.IntWithFallback(key, fallback))
+		return s
+	}
+	start, end := hourSelect("dnd.start", 0), hourSelect("dnd.end", 7)
+	dnd := widget.NewCheck("Do not disturb", func(on bool) {
+		p.SetBool("dnd", on)
+		if on {
+			start.Enable()
+			end.Enable()
+		} else {
+			start.Disable()
+			end.Disable()
+		}
+	})
+	dnd.SetChecked(p.Bool("dnd"))
+	dnd.OnChanged(dnd.Checked)
+	return widget.NewForm(
+		widget.NewFormItem("Show", mode),
+		widget.NewFormItem("", dnd),
+		widget.NewFormItem("From", start),
+		widget.NewFormItem("Until", end),
+	)
+}
+
+func (g *GUI) notificationsButton() *widget.Button {
+	return widget.NewButtonWithIcon("", theme.MailComposeIcon(), func() {
+		dialog.ShowCustom("Notifications", "Close", g.notificationSettings(), g.window)
+	})
+}
+
+// setForeground records whether the app is on screen, coming back locks the app
+// after the auto-lock timeout or marks the open conversation as read.
+func (g *GUI) setForeground(on bool) {
+	g.foreground.Store(on)
+	g.autoLock(on)
+	if !on || g.locked {
+		return
+	}
+	messagesMu.Lock()
+	id := openConversation
+	messagesMu.Unlock()
+	if len(id) > 0 {
+		g.openChat(id)
+	}
+}
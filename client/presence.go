@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/color"
+	"log"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	"ogsma_protocol"
+)
+
+const (
+	statusOnline  = "online"
+	statusAway    = "away"
+	statusOffline = "offline"
+	typingTimeout = 5 * time.Second
+)
+
+func (g *GUI) initPresence(contact *Contact) {
+	g.statusDot[contact.ID] = canvas.NewCircle(g.statusColor(""))
+	g.statusText[contact.ID] = widget.NewLabel("")
+	g.statusText[contact.ID].Importance = widget.LowImportance
+	g.typingLabel[contact.ID] = widget.NewLabel("")
+	g.typingLabel[contact.ID].TextStyle = fyne.TextStyle{Italic: true}
+	g.typingLabel[contact.ID].Hide()
+}
+
+// statusIndicator is the dot shown next to a contact, the widgets are shared
+// so they must only be placed in one visible container at a time.
+func (g *GUI) statusIndicator(id string) fyne.CanvasObject {
+	return container.NewCenter(container.NewGridWrap(fyne.NewSize(10, 10), g.statusDot[id]))
+}
+
+func (g *GUI) statusColor(status string) color.Color {
+	switch status {
+	case statusOnline:
+		return theme.Color(theme.ColorNameSuccess)
+	case statusAway:
+		return theme.Color(theme.ColorNameWarning)
+	default:
+		return theme.Color(theme.ColorNameDisabled)
+	}
+}
+
+func (g *GUI) contactIDs() []string {
+	var ids []string
+	for _, contact := range g.enc.keys.Contacts {
+		ids = append(ids, contact.ID)
+	}
+	return ids
+}
+
+func (g *GUI) setStatus(status string) {
+	if !g.sharePresence || !g.client.connected() {
+		return
+	}
+	if err := g.client.SendPresence(status, g.contactIDs()); err != nil {
+		log.Printf("error sending presence: %v", err)
+	}
+}
+
+// stopSharing opts out of presence, contacts see the user offline.
+func (g *GUI) stopSharing() {
+	if !g.client.connected() {
+		return
+	}
+	if err := g.client.StopPresence(); err != nil {
+		log.Printf("error sending presence: %v", err)
+	}
+}
+
+func (g *GUI) handlePresence(nm []byte) {
+	p := protocol.Presence{}
+	if err := json.Unmarshal(nm, &p); err != nil {
+		log.Printf("error unmarshalling presence: %v", err)
+		return
+	}
+	dot, ok := g.statusDot[p.From]
+	if !ok {
+		log.Printf("presence for unknown contact %s", p.From)
+		return
+	}
+	text := p.Status
+	if p.Status == statusOffline {
+		text = fmt.Sprintf("last seen %s", p.LastSeen.Local().Format(time.DateTime))
+	}
+	fyne.Do(func() {
+		dot.FillColor = g.statusColor(p.Status)
+		dot.Refresh()
+		g.statusText[p.From].SetText(text)
+	})
+}
+
+func (g *GUI) sendTyping(contact *Contact) {
+	if !g.sharePresence || time.Since(g.lastTyping[contact.ID]) < typingTimeout/2 {
+		return
+	}
+	g.lastTyping[contact.ID] = time.Now()
+	encryptedBytes, err := g.enc.publicEncrypt([]byte("typing"), contact.PublicKey)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if err := g.client.SendMsg(&protocol.Msg{
+		Type:      protocol.FrameTyping,
+		ID:        contact.ID,
+		TimeStamp: time.Now(),
+		Message:   encryptedBytes,
+		FromID:    g.client.ID,
+	}); err != nil {
+		log.Printf("error sending typing notification: %v", err)
+	}
+}
+
+func (g *GUI) handleTyping(nms protocol.Msg) {
+	label, ok := g.typingLabel[nms.FromID]
+	if !ok {
+		return
+	}
+	if _, err := g.enc.privateDecrypt(nms.Message); err != nil {
+		log.Printf("error decrypting typing notification: %v", err)
+		return
+	}
+	username, err := g.lookupUsername(nms.FromID)
+	if err != nil {
+		log.Printf("error looking up username: %v", err)
+		return
+	}
+	fyne.Do(func() {
+		label.SetText(fmt.Sprintf("%s is typing...", username))
+		label.Show()
+	})
+	if t, ok := g.typingTimers[nms.FromID]; ok {
+		t.Stop()
+	}
+	g.typingTimers[nms.FromID] = time.AfterFunc(typingTimeout, func() {
+		fyne.Do(label.Hide)
+	})
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"crypto/x509"
+	"embed"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/storage"
+	"ogsma_protocol/keystore"
+)
+
+const (
+	profileExt         = ".ogsma"
+	defaultProfileName = "built in"
+)
+
+var (
+	// defaults may hold a build time config.json, used as the default profile when present
+	//go:embed all:defaults
+	defaults embed.FS
+
+	validProfileName = regexp.MustCompile(`^[A-Za-z0-9_. -]+$`)
+)
+
+// Profile is everything a generic client build needs to log in, imported from a .ogsma file.
+type Profile struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	Endpoint string `json:"endpoint"`
+	KeyStore string `json:"keystore"`
+	Cert     string `json:"cert,omitempty"` // Cert is the PEM encoded server certificate to pin
+}
+
+func (p *Profile) validate() error {
+	var errs []error
+	if !validProfileName.MatchString(p.Name) || p.Name == defaultProfileName {
+		errs = append(errs, fmt.Errorf("invalid profile name %q", p.Name))
+	}
+	if len(p.Addr) == 0 {
+		errs = append(errs, errors.New("missing server address"))
+	}
+	if len(p.Endpoint) == 0 {
+		errs = append(errs, errors.New("missing endpoint"))
+	}
+	if len(p.KeyStore) == 0 {
+		errs = append(errs, errors.New("missing keystore"))
+	} else if strings.Contains(p.KeyStore, "-") {
+		if _, _, _, err := keystore.ParseV1([]byte(p.KeyStore)); err != nil {
+			errs = append(errs, fmt.Errorf("invalid keystore: %v", err))
+		}
+	} else if b, err := base64.StdEncoding.DecodeString(p.KeyStore); err != nil {
+		errs = append(errs, fmt.Errorf("invalid keystore: %v", err))
+	} else if !keystore.IsV2(b) {
+		errs = append(errs, errors.New("invalid keystore: not a v1 or v2 keystore"))
+	}
+	if len(p.Cert) > 0 {
+		if _, err := p.pinnedCert(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// pinnedCert returns the DER bytes of the pinned certificate, nil if none is set.
+func (p *Profile) pinnedCert() ([]byte, error) {
+	if len(p.Cert) == 0 {
+		return nil, nil
+	}
+	block, _ := pem.Decode([]byte(p.Cert))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("invalid cert: no PEM certificate found")
+	}
+	if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+		return nil, fmt.Errorf("invalid cert: %v", err)
+	}
+	return block.Bytes, nil
+}
+
+func defaultProfile() *Profile {
+	b, err := defaults.ReadFile("defaults/config.json")
+	if err != nil {
+		return nil
+	}
+	c := Config{}
+	if err := json.Unmarshal(b, &c); err != nil {
+		log.Printf("Error parsing embedded config file: %v\n", err)
+		return nil
+	}
+	return &Profile{
+		Name:     defaultProfileName,
+		Addr:     c.Addr,
+		Endpoint: c.Endpoint,
+		KeyStore: c.KeyStore,
+	}
+}
+
+// profiles lists the embedded default followed by the profiles imported into app storage.
+func (g *GUI) profiles() []*Profile {
+	var profiles []*Profile
+	if p := defaultProfile(); p != nil {
+		profiles = append(profiles, p)
+	}
+	names := g.app.Storage().List()
+	slices.Sort(names)
+	for _, name := range names {
+		if !strings.HasSuffix(name, profileExt) {
+			continue
+		}
+		r, err := g.app.Storage().Open(name)
+		if err != nil {
+			log.Printf("Error opening profile %s: %v\n", name, err)
+			continue
+		}
+		p, err := readProfile(r)
+		r.Close()
+		if err != nil {
+			log.Printf("Error reading profile %s: %v\n", name, err)
+			continue
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles
+}
+
+func readProfile(r io.Reader) (*Profile, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	p := &Profile{}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	if err := d.Decode(p); err != nil {
+		return nil, fmt.Errorf("parsing profile: %v", err)
+	}
+	return p, p.validate()
+}
+
+func (g *GUI) importProfile(uri fyne.URI) (*Profile, error) {
+	if uri.Extension() != profileExt {
+		return nil, fmt.Errorf("%s is not a %s profile", uri.Name(), profileExt)
+	}
+	r, err := storage.Reader(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	p, err := readProfile(r)
+	if err != nil {
+		return nil, err
+	}
+	w, err := g.app.Storage().Save(p.Name + profileExt)
+	if err != nil {
+		return nil, fmt.Errorf("saving profile: %v", err)
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		w.Close()
+		return nil, err
+	}
+	if _, err := w.Write(b); err != nil {
+		w.Close()
+		return nil, fmt.Errorf("saving profile: %v", err)
+	}
+	return p, w.Close()
+}
+
+func (g *GUI) useProfile(p *Profile) error {
+	pinned, err := p.pinnedCert()
+	if err != nil {
+		return err
+	}
+	g.enc.configKeystore = []byte(p.KeyStore)
+	g.client.Addr = p.Addr
+	if addr := g.serverOverride(); len(addr) > 0 {
+		g.client.Addr = addr
+	}
+	g.client.wsPath = p.Endpoint
+	g.client.PinnedCert = pinned
+	g.app.Preferences().SetString("profile", p.Name)
+	return nil
+}
+
+func (g *GUI) importProfileDialog() {
+	d := dialog.NewFileOpen(func(r fyne.URIReadCloser, err error) {
+		if err != nil {
+			dialog.ShowError(err, g.window)
+			return
+		}
+		if r == nil {
+			return
+		}
+		r.Close()
+		g.importProfileURIs([]fyne.URI{r.URI()})
+	}, g.window)
+	d.SetFilter(storage.NewExtensionFileFilter([]string{profileExt}))
+	d.Show()
+}
+
+func (g *GUI) importProfileURIs(uris []fyne.URI) {
+	var errs []error
+	for _, uri := range uris {
+		p, err := g.importProfile(uri)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", uri.Name(), err))
+			continue
+		}
+		g.app.Preferences().SetString("profile", p.Name)
+	}
+	if len(errs) > 0 {
+		dialog.ShowError(errors.Join(errs...), g.window)
+	}
+	if g.enc.keys == nil {
+		g.loginWindow()
+	}
+}
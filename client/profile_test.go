@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"ogsma_protocol/keystore"
+)
+
+func TestProfileKeystoreValidation(t *testing.T) {
+	v2, err := keystore.Seal("other", keystore.KDFParams{Algorithm: keystore.PBKDF2, Time: 1}, []byte("keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := strings.Repeat("00", keystore.NonceSize)
+	for _, tc := range []struct {
+		keystore string
+		valid    bool
+	}{
+		{"x-", false},
+		{"-", false},
+		{"aa-" + iv, false},
+		{"zz-" + iv + "-aa", false},
+		{"aa-00-aa", false},
+		{"aa-" + iv + "-aa", true},
+		{base64.StdEncoding.EncodeToString([]byte("not a keystore")), false},
+		{base64.StdEncoding.EncodeToString(v2), true},
+	} {
+		p := &Profile{Name: "test", Addr: "localhost:443", Endpoint: "ws", KeyStore: tc.keystore}
+		if err := p.validate(); (err == nil) != tc.valid {
+			t.Errorf("keystore %q: validate returned %v, want valid %v", tc.keystore, err, tc.valid)
+		}
+		// logging in with an invalid keystore is an error, never a panic
+		e := &Encryption{configKeystore: []byte(tc.keystore), password: "secret"}
+		if err := e.loadKeys(); err == nil {
+			t.Errorf("keystore %q: loadKeys succeeded", tc.keystore)
+		}
+	}
+}
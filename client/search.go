@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+const allConversations = "All conversations"
+
+func (g *GUI) searchButton(contact *Contact, back func()) *widget.Button {
+	return widget.NewButtonWithIcon("", theme.SearchIcon(), func() {
+		g.searchWindow(contact, back)
+	})
+}
+
+// searchWindow searches the history of every conversation, or only the one with
+// contact when it isn't nil. Choosing a result opens the conversation at it.
+func (g *GUI) searchWindow(contact *Contact, back func()) {
+	g.window.SetTitle("Search")
+	g.contactList = nil
+	g.openChat("")
+	messagesMu.Lock()
+	history := g.history
+	messagesMu.Unlock()
+	var results []*historyEntry
+	var terms []string
+	count := widget.NewLabel("")
+	list := widget.NewList(
+		func() int { return len(results) },
+		func() fyne.CanvasObject {
+			snippet := widget.NewRichText()
+			snippet.Truncation = fyne.TextTruncateEllipsis
+			return container.NewVBox(widget.NewLabelWithStyle("", fyne.TextAlignLeading, fyne.TextStyle{Bold: true}), snippet)
+		},
+		func(id widget.ListItemID, o fyne.CanvasObject) {
+			e := results[id]
+			rows := o.(*fyne.Container).Objects
+			who, _ := g.lookupUsername(e.Contact)
+			if e.Mine {
+				who = "You to " + who
+			}
+			rows[0].(*widget.Label).SetText(fmt.Sprintf("%s · %s", who, e.Sent.Local().Format("Jan 2 2006 15:04")))
+			snippet := rows[1].(*widget.RichText)
+			snippet.Segments = highlight(e.Text, terms)
+			snippet.Refresh()
+		},
+	)
+	list.OnSelected = func(id widget.ListItemID) {
+		g.openMessage(results[id])
+	}
+
+	names := []string{allConversations}
+	for _, c := range g.enc.keys.Contacts {
+		names = append(names, c.Username)
+	}
+	scope := widget.NewSelect(names, nil)
+	query := widget.NewEntry()
+	query.SetPlaceHolder("Search messages")
+	run := func() {
+		results, terms = nil, words(query.Text)
+		scoped := ""
+		if i := slices.Index(names, scope.Selected); i > 0 {
+			scoped = g.enc.keys.Contacts[i-1].ID
+		}
+		if history != nil {
+			results = history.search(query.Text, scoped)
+		}
+		switch {
+		case len(terms) == 0:
+			count.SetText("")
+		case len(results) == maxResults:
+			count.SetText(fmt.Sprintf("Showing the newest %d results", maxResults))
+		default:
+			count.SetText(fmt.Sprintf("%d results", len(results)))
+		}
+		list.UnselectAll()
+		list.Refresh()
+		list.ScrollToTop()
+	}
+	query.OnChanged = func(string) { run() }
+	scope.OnChanged = func(string) { run() }
+	if contact != nil {
+		scope.SetSelected(contact.Username)
+	} else {
+		scope.SetSelectedIndex(0)
+	}
+
+	top := container.NewVBox(
+		container.NewBorder(nil, nil, widget.NewButton("back", back), scope, query),
+		count,
+	)
+	g.window.SetContent(container.NewBorder(top, nil, nil, nil, list))
+	g.window.Canvas().Focus(query)
+}
+
+// openMessage shows a search result in its conversation.
+func (g *GUI) openMessage(e *historyEntry) {
+	i := slices.IndexFunc(g.enc.keys.Contacts, func(c *Contact) bool { return c.ID == e.Contact })
+	if i < 0 {
+		return
+	}
+	contact := g.enc.keys.Contacts[i]
+	if g.tabs {
+		g.contactsWindow()
+		g.chatTabs.Select(g.tabItem[contact.ID])
+	} else {
+		g.client.targetID = contact.ID
+		g.chatWindow(contact)
+	}
+	g.chatOutput[contact.ID].reveal(e.ID, e.Sent)
+}
+
+// highlight is a snippet of text around the first word matching terms, with the
+// matching words in bold.
+func highlight(text string, terms []string) []widget.RichTextSegment {
+	matches := func(word string) bool {
+		for _, w := range words(word) {
+			for _, t := range terms {
+				if strings.HasPrefix(w, t) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	fields := strings.Fields(text)
+	start := max(slices.IndexFunc(fields, matches)-6, 0)
+	end := min(start+24, len(fields))
+	var segments []widget.RichTextSegment
+	plain := func(s string) {
+		segments = append(segments, &widget.TextSegment{Text: s, Style: widget.RichTextStyleInline})
+	}
+	if start > 0 {
+		plain("... ")
+	}
+	for i, f := range fields[start:end] {
+		if i > 0 {
+			plain(" ")
+		}
+		if matches(f) {
+			segments = append(segments, &widget.TextSegment{Text: f, Style: widget.RichTextStyleStrong})
+		} else {
+			plain(f)
+		}
+	}
+	if end < len(fields) {
+		plain(" ...")
+	}
+	return segments
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image/color"
+	"net"
+	"slices"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// themeChoices are the theme preferences offered, "" follows the system.
+var themeChoices = []struct {
+	label string
+	value string
+}{
+	{"System", ""},
+	{"Light", "light"},
+	{"Dark", "dark"},
+}
+
+// textSizes are the text size preferences offered, as a scale of the default size.
+var textSizes = []struct {
+	label string
+	scale float64
+}{
+	{"Small", 0.85},
+	{"Normal", 1},
+	{"Large", 1.2},
+	{"Larger", 1.4},
+}
+
+// autoLockChoices are the auto-lock timeouts offered, in seconds in the background.
+var autoLockChoices = []struct {
+	label   string
+	timeout int
+}{
+	{"Never", 0},
+	{"1 minute", 60},
+	{"5 minutes", 5 * 60},
+	{"15 minutes", 15 * 60},
+	{"1 hour", 60 * 60},
+}
+
+// settingsTheme is the default theme with the user's variant and text size.
+type settingsTheme struct {
+	fyne.Theme
+	variant *fyne.ThemeVariant // variant is nil to follow the system
+	scale   float32
+}
+
+func (t *settingsTheme) Color(n fyne.ThemeColorName, v fyne.ThemeVariant) color.Color {
+	if t.variant != nil {
+		v = *t.variant
+	}
+	return t.Theme.Color(n, v)
+}
+
+func (t *settingsTheme) Size(n fyne.ThemeSizeName) float32 {
+	switch n {
+	case theme.SizeNameText, theme.SizeNameCaptionText, theme.SizeNameHeadingText, theme.SizeNameSubHeadingText:
+		return t.Theme.Size(n) * t.scale
+	}
+	return t.Theme.Size(n)
+}
+
+func (g *GUI) applyTheme() {
+	p := g.app.Preferences()
+	t := &settingsTheme{Theme: theme.DefaultTheme(), scale: float32(p.FloatWithFallback("textScale", 1))}
+	switch p.String("theme") {
+	case "light":
+		v := theme.VariantLight
+		t.variant = &v
+	case "dark":
+		v := theme.VariantDark
+		t.variant = &v
+	}
+	g.app.Settings().SetTheme(t)
+}
+
+// serverOverride is the server address used instead of the profile's, empty when unset.
+func (g *GUI) serverOverride() string {
+	return g.app.Preferences().String("server")
+}
+
+func validServer(addr string) error {
+	if len(addr) == 0 {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if len(host) == 0 || len(port) == 0 {
+		return errors.New("expected host:port")
+	}
+	return nil
+}
+
+// settingsWindow edits the preferences, they are saved as they change.
+func (g *GUI) settingsWindow(back func()) {
+	g.window.SetTitle("Settings")
+	g.contactList = nil
+	g.openChat("")
+	p := g.app.Preferences()
+
+	layouts := []string{"List", "Tabs"}
+	layoutChoice := widget.NewRadioGroup(layouts, func(s string) {
+		g.tabs = s == layouts[1]
+		p.SetBool("tabs", g.tabs)
+	})
+	layoutChoice.Horizontal = true
+	layoutChoice.Required = true
+	layoutChoice.SetSelected(layouts[0])
+	if g.tabs {
+		layoutChoice.SetSelected(layouts[1])
+	}
+
+	var themes []string
+	for _, c := range themeChoices {
+		themes = append(themes, c.label)
+	}
+	themeSelect := widget.NewSelect(themes, func(s string) {
+		p.SetString("theme", themeChoices[slices.Index(themes, s)].value)
+		g.applyTheme()
+	})
+	for _, c := range themeChoices {
+		if c.value == p.String("theme") {
+			themeSelect.SetSelected(c.label)
+		}
+	}
+
+	var sizes []string
+	for _, s := range textSizes {
+		sizes = append(sizes, s.label)
+	}
+	sizeSelect := widget.NewSelect(sizes, func(s string) {
+		p.SetFloat("textScale", textSizes[slices.Index(sizes, s)].scale)
+		g.applyTheme()
+	})
+	for _, s := range textSizes {
+		if s.scale == p.FloatWithFallback("textScale", 1) {
+			sizeSelect.SetSelected(s.label)
+		}
+	}
+
+	presence := widget.NewCheck("Share presence and typing", func(on bool) {
+		g.sharePresence = on
+		p.SetBool("sharePresence", on)
+		if on {
+			g.setStatus(statusOnline)
+		} else {
+			g.stopSharing()
+		}
+	})
+	presence.Checked = g.sharePresence
+
+	var timeouts []string
+	for _, c := range autoLockChoices {
+		timeouts = append(timeouts, c.label)
+	}
+	lockSelect := widget.NewSelect(timeouts, func(s string) {
+		p.SetInt("autoLock", autoLockChoices[slices.Index(timeouts, s)].timeout)
+	})
+	lockSelect.SetSelected(formatAutoLock(p.Int("autoLock")))
+
+	server := widget.NewEntry()
+	server.SetPlaceHolder("From the profile")
+	server.SetText(g.serverOverride())
+	server.Validator = validServer
+	server.OnChanged = func(s string) {
+		if validServer(s) == nil {
+			p.SetString("server", s)
+		}
+	}
+
+	content := container.NewVBox(
+		widget.NewButton("back", back),
+		widget.NewCard("Appearance", "", widget.NewForm(
+			widget.NewFormItem("Layout", layoutChoice),
+			widget.NewFormItem("Theme", themeSelect),
+			widget.NewFormItem("Text size", sizeSelect),
+		)),
+		widget.NewCard("Notifications", "", g.notificationSettings()),
+		widget.NewCard("Privacy", "", widget.NewForm(
+			widget.NewFormItem("", presence),
+			widget.NewFormItem("Auto-lock", lockSelect),
+		)),
+		widget.NewCard("Connection", "Used instead of the profile's server from the next login", widget.NewForm(
+			widget.NewFormItem("Server", server),
+		)),
+	)
+	g.window.SetContent(container.NewVScroll(content))
+}
+
+func formatAutoLock(timeout int) string {
+	for _, c := range autoLockChoices {
+		if c.timeout == timeout {
+			return c.label
+		}
+	}
+	return (time.Duration(timeout) * time.Second).String()
+}
+
+func (g *GUI) settingsButton(back func()) *widget.Button {
+	return widget.NewButtonWithIcon("", theme.SettingsIcon(), func() {
+		g.settingsWindow(back)
+	})
+}
+
+// autoLock locks the app when it comes back after longer in the background than
+// the auto-lock timeout. It is called from the lifecycle callbacks.
+func (g *GUI) autoLock(foreground bool) {
+	if !foreground {
+		g.hidden = time.Now()
+		return
+	}
+	timeout := time.Duration(g.app.Preferences().Int("autoLock")) * time.Second
+	if g.enc.keys == nil || g.locked || timeout == 0 || g.hidden.IsZero() || time.Since(g.hidden) < timeout {
+		return
+	}
+	g.lockWindow()
+}
+
+// lockWindow hides the conversations until the keystore password is entered again,
+// messages are still received while locked.
+func (g *GUI) lockWindow() {
+	g.locked = true
+	g.window.SetTitle("Locked")
+	g.contactList = nil
+	g.openChat("")
+	message := widget.NewLabel("")
+	passEntry := widget.NewPasswordEntry()
+	passEntry.SetPlaceHolder("Password")
+	unlock := func() {
+		if err := g.enc.checkPassword(passEntry.Text); err != nil {
+			message.SetText(fmt.Sprintf("Invalid Password: %v", err))
+			passEntry.SetText("")
+			return
+		}
+		g.locked = false
+		g.contactsWindow()
+	}
+	passEntry.OnSubmitted = func(string) { unlock() }
+	g.window.SetContent(container.NewVBox(
+		widget.NewLabelWithStyle(fmt.Sprintf("Locked, enter the password for %s", g.enc.keys.Username), fyne.TextAlignLeading, fyne.TextStyle{Bold: true}),
+		passEntry,
+		widget.NewButton("Unlock", unlock),
+		message,
+	))
+	g.window.Canvas().Focus(passEntry)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"time"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+)
+
+// openConversation is the contact whose conversation is on screen, messages
+// arriving there are read straight away. It is guarded by messagesMu.
+var openConversation string
+
+// storeMessage records a message in contactMessages and updates the contact list.
+func (g *GUI) storeMessage(id string, qm QueueMessage) {
+	messagesMu.Lock()
+	qm.read = qm.read || qm.mine || (openConversation == id && g.foreground.Load())
+	contactMessages[id] = append(contactMessages[id], qm)
+	history := g.history
+	messagesMu.Unlock()
+	if history != nil {
+		history.add(id, qm)
+	}
+	g.refreshContacts()
+}
+
+// editStored applies an edit or delete to contactMessages, mine is set when we
+// sent it. Only the sender's own messages are changed.
+func (g *GUI) editStored(id string, mine bool, env *Envelope) {
+	messagesMu.Lock()
+	msgs := contactMessages[id]
+	i := slices.IndexFunc(msgs, func(m QueueMessage) bool { return len(env.Target) > 0 && m.id == env.Target && m.mine == mine })
+	switch {
+	case i < 0:
+	case env.Kind == envelopeDelete:
+		contactMessages[id] = slices.Delete(msgs, i, i+1)
+	default:
+		msgs[i].msg = env.Text
+	}
+	history := g.history
+	messagesMu.Unlock()
+	if history != nil {
+		history.edit(id, mine, env)
+	}
+	g.refreshContacts()
+}
+
+// openChat marks a conversation as on screen and its messages as read, "" when
+// no conversation is open.
+func (g *GUI) openChat(id string) {
+	messagesMu.Lock()
+	openConversation = id
+	for i := range contactMessages[id] {
+		contactMessages[id][i].read = true
+	}
+	messagesMu.Unlock()
+	g.refreshContacts()
+}
+
+// conversation is a contact's entry in the conversation list.
+type conversation struct {
+	contact  *Contact
+	unread   int
+	last     time.Time // last is when the newest message was sent, zero without messages
+	preview  string
+	fromSelf bool
+}
+
+// conversations lists the contacts with the most recently active first, contacts
+// without messages keep the keystore order at the end.
+func (g *GUI) conversations() []*conversation {
+	messagesMu.Lock()
+	defer messagesMu.Unlock()
+	var convs []*conversation
+	for _, contact := range g.enc.keys.Contacts {
+		c := &conversation{contact: contact}
+		for _, m := range contactMessages[contact.ID] {
+			if !m.mine && !m.read {
+				c.unread++
+			}
+			if !m.sent.Before(c.last) {
+				c.last, c.preview, c.fromSelf = m.sent, quoteOf(m.msg), m.mine
+			}
+		}
+		convs = append(convs, c)
+	}
+	slices.SortStableFunc(convs, func(a, b *conversation) int {
+		return cmp.Compare(b.last.UnixNano(), a.last.UnixNano())
+	})
+	return convs
+}
+
+// refreshContacts redraws the contact list or tab titles if they are on screen.
+func (g *GUI) refreshContacts() {
+	fyne.Do(func() {
+		switch {
+		case g.contactList != nil:
+			g.fillContactList()
+		case g.chatTabs != nil:
+			for _, c := range g.conversations() {
+				item := g.tabItem[c.contact.ID]
+				item.Text = c.contact.Username
+				if c.unread > 0 {
+					item.Text = fmt.Sprintf("%s (%d)", c.contact.Username, c.unread)
+				}
+			}
+			g.chatTabs.Refresh()
+		}
+	})
+}
+
+// fillContactList rebuilds the rows of the contact list in conversation order.
+func (g *GUI) fillContactList() {
+	g.contactList.RemoveAll()
+	for _, c := range g.conversations() {
+		contact := c.contact
+		preview := widget.NewLabel(c.preview)
+		if c.fromSelf {
+			preview.SetText("You: " + c.preview)
+		}
+		preview.Truncation = fyne.TextTruncateEllipsis
+		preview.Importance = widget.LowImportance
+		preview.Hidden = c.last.IsZero()
+		open := widget.NewButton(contact.Username, func() {
+			g.client.targetID = contact.ID
+			g.chatWindow(contact)
+		})
+		if c.unread > 0 {
+			open.Importance = widget.HighImportance
+		}
+		g.contactList.Add(container.NewBorder(nil, nil, g.statusIndicator(contact.ID),
+			container.NewHBox(unreadBadge(c.unread), g.statusText[contact.ID], g.contactInfoButton(contact)),
+			container.NewVBox(open, preview)))
+		g.contactList.Add(widget.NewSeparator())
+	}
+}
+
+// unreadBadge is the count of unread messages in a circle, nothing when there are none.
+func unreadBadge(n int) fyne.CanvasObject {
+	if n == 0 {
+		return container.NewStack()
+	}
+	text := canvas.NewText(fmt.Sprint(n), theme.Color(theme.ColorNameForegroundOnPrimary))
+	text.TextStyle = fyne.TextStyle{Bold: true}
+	text.TextSize = theme.Size(theme.SizeNameCaptionText)
+	if n > 99 {
+		text.Text = "99+"
+	}
+	circle := canvas.NewCircle(theme.Color(theme.ColorNamePrimary))
+	size := fyne.NewSquareSize(max(text.MinSize().Width, text.MinSize().Height) + theme.Padding())
+	return container.NewCenter(container.NewGridWrap(size, container.NewStack(circle, container.NewCenter(text))))
+}
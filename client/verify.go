@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"fyne.io/fyne/v2"
+	"fyne.io/fyne/v2/canvas"
+	"fyne.io/fyne/v2/container"
+	"fyne.io/fyne/v2/dialog"
+	"fyne.io/fyne/v2/theme"
+	"fyne.io/fyne/v2/widget"
+	"github.com/skip2/go-qrcode"
+	"ogsma_protocol/keystore"
+)
+
+func (g *GUI) safetyNumber(contact *Contact) string {
+	return keystore.SafetyNumber(g.enc.keys.ID, g.enc.keys.PublicKey.Bytes(false), contact.ID, contact.PublicKey.Bytes(false))
+}
+
+// checkContactKeys compares each contact key with the one seen on the last login,
+// keystores are rebuilt into new binaries so a changed key would otherwise go unnoticed.
+func (g *GUI) checkContactKeys() {
+	prefs := g.app.Preferences()
+	for _, contact := range g.enc.keys.Contacts {
+		current := keystore.Fingerprint(contact.ID, contact.PublicKey.Bytes(false))
+		seen := prefs.String("contactKey." + contact.ID)
+		if len(seen) == 0 {
+			prefs.SetString("contactKey."+contact.ID, current)
+		} else if seen != current {
+			contact.KeyChanged = true
+		}
+		if contact.KeyChanged {
+			contact.Verified = false
+		}
+		if prefs.String("contactVerified."+contact.ID) == current {
+			contact.Verified = true
+			contact.KeyChanged = false
+		}
+	}
+}
+
+func (g *GUI) warnChangedKeys() {
+	var changed []string
+	for _, contact := range g.enc.keys.Contacts {
+		if contact.KeyChanged {
+			changed = append(changed, contact.Username)
+		}
+	}
+	if len(changed) == 0 {
+		return
+	}
+	dialog.ShowInformation("Safety number changed",
+		fmt.Sprintf("The keys for %s have changed.\nCompare safety numbers in the contact details before sending anything sensitive.", strings.Join(changed, ", ")),
+		g.window)
+}
+
+func (g *GUI) contactInfoButton(contact *Contact) *widget.Button {
+	b := widget.NewButtonWithIcon("", theme.InfoIcon(), func() {
+		g.contactDetails(contact, func() { g.contactsWindow() })
+	})
+	if contact.KeyChanged {
+		b.SetIcon(theme.WarningIcon())
+		b.Importance = widget.DangerImportance
+	}
+	return b
+}
+
+func (g *GUI) contactDetails(contact *Contact, back func()) {
+	g.window.SetTitle(contact.Username)
+	number := g.safetyNumber(contact)
+	digits := widget.NewLabel(keystore.FormatSafetyNumber(number))
+	digits.TextStyle = fyne.TextStyle{Monospace: true}
+	digits.Alignment = fyne.TextAlignCenter
+	content := container.NewVBox(
+		widget.NewButton("back", back),
+		widget.NewLabelWithStyle(contact.Username, fyne.TextAlignCenter, fyne.TextStyle{Bold: true}),
+	)
+	if contact.KeyChanged {
+		warning := widget.NewLabel(fmt.Sprintf("The key for %s has changed. Compare the safety number with them before trusting this contact.", contact.Username))
+		warning.Wrapping = fyne.TextWrapWord
+		warning.Importance = widget.DangerImportance
+		content.Add(widget.NewCard("", "", container.NewBorder(nil, nil, widget.NewIcon(theme.WarningIcon()), nil, warning)))
+	}
+	content.Add(widget.NewLabel("Safety number"))
+	content.Add(digits)
+	if qr, err := qrcode.New(number, qrcode.Medium); err != nil {
+		log.Printf("error generating qr code: %v", err)
+	} else {
+		img := canvas.NewImageFromImage(qr.Image(256))
+		img.FillMode = canvas.ImageFillContain
+		img.ScaleMode = canvas.ImageScalePixels
+		img.SetMinSize(fyne.NewSize(200, 200))
+		content.Add(img)
+	}
+	status := widget.NewLabel("Not verified")
+	if contact.Verified {
+		status.SetText("Verified")
+		status.Importance = widget.SuccessImportance
+	}
+	content.Add(status)
+	if !contact.Verified {
+		content.Add(widget.NewButton("Mark as verified", func() {
+			current := keystore.Fingerprint(contact.ID, contact.PublicKey.Bytes(false))
+			g.app.Preferences().SetString("contactKey."+contact.ID, current)
+			g.app.Preferences().SetString("contactVerified."+contact.ID, current)
+			contact.Verified = true
+			contact.KeyChanged = false
+			g.contactDetails(contact, back)
+		}))
+	}
+	g.window.SetContent(container.NewVScroll(content))
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/term"
+	"ogsma_protocol/keystore"
+)
+
+type KeyShare struct {
+	ID        string `json:"id"`
+	Username  string `json:"username"`
+	PublicKey string `json:"publicKey"`
+}
+
+// Deployment is a directory of <name>.keystore and <name>.keyshare files built into
+// one client config and profile per keystore and a single server config.
+type Deployment struct {
+	dir       string
+	out       string
+	addr      string
+	endpoint  string
+	cert      string
+	key       string
+	port      int
+	passwords map[string]string
+	keyshares map[string]*KeyShare // keyshares by ID
+	keystores map[string][]byte    // raw keystores by name
+	policy    string               // policy is the routing policy mode written to the server config
+	contacts  map[string][]string  // contact IDs by user ID, filled in by check
+}
+
+func readKeyShare(filename string) (*KeyShare, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	k := &KeyShare{}
+	if err := json.Unmarshal(b, k); err != nil {
+		return nil, fmt.Errorf("unmarshalling keyshare %s: %v", filename, err)
+	}
+	if len(k.ID) == 0 || len(k.PublicKey) == 0 {
+		return nil, fmt.Errorf("keyshare %s is missing id or publicKey", filename)
+	}
+	return k, nil
+}
+
+// readPasswords reads a JSON object of keystore name to password, or prompts for
+// each keystore when filename is empty.
+func (d *Deployment) readPasswords(filename string, names []string) error {
+	d.passwords = map[string]string{}
+	if len(filename) > 0 {
+		b, err := os.ReadFile(filename)
+		if err != nil {
+			return fmt.Errorf("reading passwords: %v", err)
+		}
+		if err := json.Unmarshal(b, &d.passwords); err != nil {
+			return fmt.Errorf("parsing passwords %s: %v", filename, err)
+		}
+		return nil
+	}
+	fd := int(os.Stdin.Fd())
+	in := bufio.NewReader(os.Stdin)
+	for _, name := range names {
+		if term.IsTerminal(fd) {
+			fmt.Fprintf(os.Stderr, "Password for %s: ", name)
+			b, err := term.ReadPassword(fd)
+			fmt.Fprintln(os.Stderr)
+			if err != nil {
+				return fmt.Errorf("reading password: %v", err)
+			}
+			d.passwords[name] = string(b)
+			continue
+		}
+		line, err := in.ReadString('\n')
+		if err != nil && (err != io.EOF || len(line) == 0) {
+			return fmt.Errorf("reading password for %s from stdin: %v", name, err)
+		}
+		d.passwords[name] = strings.TrimRight(line, "\r\n")
+	}
+	return nil
+}
+
+func (d *Deployment) load(passwordFile string) error {
+	keyshareFiles, err := filepath.Glob(filepath.Join(d.dir, "*.keyshare"))
+	if err != nil {
+		return err
+	}
+	keystoreFiles, err := filepath.Glob(filepath.Join(d.dir, "*.keystore"))
+	if err != nil {
+		return err
+	}
+	if len(keystoreFiles) == 0 {
+		return fmt.Errorf("no keystores found in %s", d.dir)
+	}
+	d.keyshares = map[string]*KeyShare{}
+	for _, f := range keyshareFiles {
+		k, err := readKeyShare(f)
+		if err != nil {
+			return err
+		}
+		if other, ok := d.keyshares[k.ID]; ok {
+			return fmt.Errorf("keyshares for %s and %s have the same id", other.Username, k.Username)
+		}
+		d.keyshares[k.ID] = k
+	}
+	d.keystores = map[string][]byte{}
+	var names []string
+	for _, f := range keystoreFiles {
+		name := strings.TrimSuffix(filepath.Base(f), ".keystore")
+		if d.keystores[name], err = os.ReadFile(f); err != nil {
+			return err
+		}
+		names = append(names, name)
+	}
+	return d.readPasswords(passwordFile, names)
+}
+
+// check decrypts every keystore and reports all inconsistencies between keystores,
+// keyshares and the contacts each client expects the server to accept.
+func (d *Deployment) check() error {
+	var errs []error
+	d.contacts = make(map[string][]string)
+	for _, name := range slices.Sorted(maps.Keys(d.keystores)) {
+		password, ok := d.passwords[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: no password given", name))
+			continue
+		}
+		ks, _, err := keystore.Read(password, d.keystores[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", name, err))
+			continue
+		}
+		share, ok := d.keyshares[string(ks.ID)]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: no keyshare with id %s", name, ks.ID))
+		} else if !sameKey(share, ks.PublicKey) {
+			errs = append(errs, fmt.Errorf("%s: keyshare %s does not match the keystore public key", name, share.Username))
+		}
+		for _, c := range ks.Contacts {
+			d.contacts[string(ks.ID)] = append(d.contacts[string(ks.ID)], string(c.ID))
+			share, ok := d.keyshares[string(c.ID)]
+			if !ok {
+				errs = append(errs, fmt.Errorf("%s: contact %s (%s) is not in the server users", name, c.Username, c.ID))
+			} else if !sameKey(share, c.PublicKey) {
+				errs = append(errs, fmt.Errorf("%s: contact %s has a different key than its keyshare", name, c.Username))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func sameKey(share *KeyShare, publicKey []byte) bool {
+	b, err := base64.StdEncoding.DecodeString(share.PublicKey)
+	return err == nil && bytes.Equal(b, publicKey)
+}
+
+func writeJSON(filename string, v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshalling %s: %v", filepath.Base(filename), err)
+	}
+	if err := os.WriteFile(filename, b, 0600); err != nil {
+		return fmt.Errorf("writing %s: %v", filename, err)
+	}
+	return nil
+}
+
+func (d *Deployment) write() error {
+	if err := os.MkdirAll(d.out, 0700); err != nil {
+		return err
+	}
+	var pem string
+	if len(d.cert) > 0 {
+		b, err := os.ReadFile(d.cert)
+		if err != nil {
+			return fmt.Errorf("reading cert file: %v", err)
+		}
+		pem = string(b)
+	}
+	addr := fmt.Sprintf("%s:%d", d.addr, d.port)
+	for name, raw := range d.keystores {
+		// clients tell v1 hex keystores from base64 v2 ones by the "-" separators
+		ks := string(bytes.TrimSpace(raw))
+		if keystore.IsV2(raw) {
+			ks = base64.StdEncoding.EncodeToString(raw)
+		}
+		if err := writeJSON(filepath.Join(d.out, name+"_config.json"), &ClientConfig{
+			Addr:     addr,
+			KeyStore: ks,
+			Endpoint: d.endpoint,
+		}); err != nil {
+			return err
+		}
+		if err := writeJSON(filepath.Join(d.out, name+".ogsma"), &Profile{
+			Name:     name,
+			Addr:     addr,
+			Endpoint: d.endpoint,
+			KeyStore: ks,
+			Cert:     pem,
+		}); err != nil {
+			return err
+		}
+	}
+	sc := &ServerConfig{
+		Port:     d.port,
+		Endpoint: d.endpoint,
+		CertFile: d.cert,
+		KeyFile:  d.key,
+		Users:    slices.Sorted(maps.Keys(d.keyshares)),
+		UserKeys: map[string]string{},
+	}
+	for id, share := range d.keyshares {
+		sc.UserKeys[id] = share.PublicKey
+	}
+	switch d.policy {
+	case "":
+	case "all":
+		sc.Policy = &Policy{Mode: "all"}
+	case "acl":
+		sc.Policy = &Policy{Mode: "acl", Pairs: d.contactPairs()}
+	default:
+		return fmt.Errorf("unsupported policy %q, config_gen generates all or acl", d.policy)
+	}
+	return writeJSON(filepath.Join(d.out, "server_config.json"), sc)
+}
+
+// contactPairs returns the users that list each other as contacts. One-sided
+// contacts are left out and reported, messages between them will be rejected.
+func (d *Deployment) contactPairs() [][2]string {
+	var pairs [][2]string
+	for _, a := range slices.Sorted(maps.Keys(d.contacts)) {
+		for _, b := range d.contacts[a] {
+			mutual := slices.Contains(d.contacts[b], a)
+			if !mutual {
+				fmt.Fprintf(os.Stderr, "warning: %s lists %s as a contact but not the other way around, the policy won't allow them to message each other\n", d.username(a), d.username(b))
+			}
+			if mutual && a < b {
+				pairs = append(pairs, [2]string{a, b})
+			}
+		}
+	}
+	return pairs
+}
+
+func (d *Deployment) username(id string) string {
+	if share, ok := d.keyshares[id]; ok {
+		return share.Username
+	}
+	return id
+}
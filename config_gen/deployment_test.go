@@ -0,0 +1,228 @@
+package main
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"ogsma_protocol/keystore"
+)
+
+// sealTestKeystore encrypts ks as a v2 keystore with a cheap PBKDF2 count.
+func sealTestKeystore(t *testing.T, password string, ks *keystore.Keystore) []byte {
+	t.Helper()
+	data, err := keystore.Write(password, keystore.KDFParams{Algorithm: keystore.PBKDF2, Time: 1000}, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func testUserID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeployment(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		contacts   map[string][]string // contacts lists the contacts of every user with a keystore
+		noShare    []string            // noShare are users without a keyshare
+		changedKey string              // changedKey has a keyshare with another public key
+		wrongPass  string              // wrongPass is given the wrong password
+		policy     string
+		errs       []string    // errs are substrings of the check or write error
+		pairs      [][2]string // pairs are the users the acl policy lets message each other
+	}{
+		{
+			name:     "mutual contacts",
+			contacts: map[string][]string{"alice": {"bob"}, "bob": {"alice"}},
+			policy:   "acl",
+			pairs:    [][2]string{{"alice", "bob"}},
+		},
+		{
+			name:     "one-sided contact",
+			contacts: map[string][]string{"alice": {"bob"}, "bob": nil},
+			policy:   "acl",
+		},
+		{
+			name: "mixed contacts",
+			contacts: map[string][]string{
+				"alice": {"bob", "carol"},
+				"bob":   {"alice", "carol"},
+				"carol": {"alice"},
+			},
+			policy: "acl",
+			pairs:  [][2]string{{"alice", "bob"}, {"alice", "carol"}},
+		},
+		{
+			name:     "contact without a keystore",
+			contacts: map[string][]string{"alice": {"dave"}},
+			policy:   "acl",
+		},
+		{
+			name:     "no contacts",
+			contacts: map[string][]string{"alice": nil, "bob": nil},
+			policy:   "acl",
+		},
+		{
+			name:     "all policy",
+			contacts: map[string][]string{"alice": {"bob"}, "bob": {"alice"}},
+			policy:   "all",
+		},
+		{
+			name:     "no policy",
+			contacts: map[string][]string{"alice": {"bob"}, "bob": {"alice"}},
+		},
+		{
+			name:     "unsupported policy",
+			contacts: map[string][]string{"alice": nil},
+			policy:   "groups",
+			errs:     []string{`unsupported policy "groups"`},
+		},
+		{
+			name:     "contact not on the server",
+			contacts: map[string][]string{"alice": {"bob"}, "bob": {"alice"}, "carol": {"alice", "dave"}},
+			noShare:  []string{"dave"},
+			errs:     []string{"carol: contact dave (" + testUserID("dave") + ") is not in the server users"},
+		},
+		{
+			name:     "keystore without a keyshare",
+			contacts: map[string][]string{"alice": nil, "bob": nil},
+			noShare:  []string{"bob"},
+			errs:     []string{"bob: no keyshare with id " + testUserID("bob")},
+		},
+		{
+			name:       "changed key",
+			contacts:   map[string][]string{"alice": {"bob"}, "bob": {"alice"}},
+			changedKey: "bob",
+			errs:       []string{"alice: contact bob has a different key than its keyshare", "bob: keyshare bob does not match the keystore public key"},
+		},
+		{
+			name:      "wrong password",
+			contacts:  map[string][]string{"alice": nil, "bob": nil},
+			wrongPass: "bob",
+			errs:      []string{"bob: decrypt failed"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := t.TempDir()
+			publicKey := func(name string) []byte { return []byte("public key of " + name) }
+			passwords := map[string]string{}
+			users := map[string]bool{}
+			for name, contacts := range tc.contacts {
+				ks := &keystore.Keystore{Username: []byte(name), ID: []byte(testUserID(name)), PublicKey: publicKey(name)}
+				for _, c := range contacts {
+					ks.Contacts = append(ks.Contacts, &keystore.StoreContact{ID: []byte(testUserID(c)), Username: []byte(c), PublicKey: publicKey(c)})
+					users[c] = true
+				}
+				writeTestFile(t, filepath.Join(dir, name+".keystore"), sealTestKeystore(t, name+" secret", ks))
+				passwords[name] = name + " secret"
+				users[name] = true
+			}
+			if len(tc.wrongPass) > 0 {
+				passwords[tc.wrongPass] = "guess"
+			}
+			for name := range users {
+				if slices.Contains(tc.noShare, name) {
+					continue
+				}
+				key := publicKey(name)
+				if name == tc.changedKey {
+					key = []byte("another key")
+				}
+				share, err := json.Marshal(&KeyShare{ID: testUserID(name), Username: name, PublicKey: base64.StdEncoding.EncodeToString(key)})
+				if err != nil {
+					t.Fatal(err)
+				}
+				writeTestFile(t, filepath.Join(dir, name+".keyshare"), share)
+			}
+			pw, err := json.Marshal(passwords)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writeTestFile(t, filepath.Join(dir, "passwords.json"), pw)
+
+			d := &Deployment{dir: dir, out: filepath.Join(dir, "out"), addr: "localhost", endpoint: "ws", port: 8443, policy: tc.policy}
+			if err := d.load(filepath.Join(dir, "passwords.json")); err != nil {
+				t.Fatal(err)
+			}
+			err = d.check()
+			if err == nil {
+				err = d.write()
+			}
+			if len(tc.errs) > 0 {
+				for _, want := range tc.errs {
+					if err == nil || !strings.Contains(err.Error(), want) {
+						t.Errorf("error %v, want %q", err, want)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, err := os.ReadFile(filepath.Join(d.out, "server_config.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			sc := &ServerConfig{}
+			if err := json.Unmarshal(b, sc); err != nil {
+				t.Fatal(err)
+			}
+			var wantUsers []string
+			for name := range users {
+				wantUsers = append(wantUsers, testUserID(name))
+			}
+			slices.Sort(wantUsers)
+			if !slices.Equal(sc.Users, wantUsers) {
+				t.Errorf("users %q, want %q", sc.Users, wantUsers)
+			}
+			for name := range users {
+				if k := sc.UserKeys[testUserID(name)]; k != base64.StdEncoding.EncodeToString(publicKey(name)) {
+					t.Errorf("key of %s is %q", name, k)
+				}
+			}
+			switch {
+			case tc.policy == "" && sc.Policy != nil:
+				t.Errorf("policy %+v written without -policy", sc.Policy)
+			case tc.policy != "" && (sc.Policy == nil || sc.Policy.Mode != tc.policy):
+				t.Fatalf("policy %+v, want mode %s", sc.Policy, tc.policy)
+			}
+			var want [][2]string
+			for _, p := range tc.pairs {
+				a, b := testUserID(p[0]), testUserID(p[1])
+				want = append(want, [2]string{min(a, b), max(a, b)})
+			}
+			comparePairs := func(x, y [2]string) int { return cmp.Or(cmp.Compare(x[0], y[0]), cmp.Compare(x[1], y[1])) }
+			slices.SortFunc(want, comparePairs)
+			var got [][2]string
+			if sc.Policy != nil {
+				got = slices.SortedFunc(slices.Values(sc.Policy.Pairs), comparePairs)
+			}
+			if !slices.Equal(got, want) {
+				t.Errorf("pairs %q, want %q", got, want)
+			}
+			for name := range tc.contacts {
+				if _, err := os.Stat(filepath.Join(d.out, name+".ogsma")); err != nil {
+					t.Errorf("no profile for %s: %v", name, err)
+				}
+			}
+		})
+	}
+}
@@ -1,3 +1,15 @@
 module config_gen
 
 go 1.25.3
+
+replace ogsma_protocol => ../protocol
+
+require (
+	golang.org/x/term v0.36.0
+	ogsma_protocol v0.0.0-00010101000000-000000000000
+)
+
+require (
+	golang.org/x/crypto v0.43.0 // indirect
+	golang.org/x/sys v0.37.0 // indirect
+)
@@ -15,27 +15,53 @@ type ClientConfig struct {
 	Endpoint string `json:"endpoint"`
 }
 
+// Profile is the .ogsma file imported by generic client builds at runtime.
+type Profile struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	Endpoint string `json:"endpoint"`
+	KeyStore string `json:"keystore"`
+	Cert     string `json:"cert,omitempty"`
+}
+
 type ServerConfig struct {
-	Port     int      `json:"port"`
-	Endpoint string   `json:"endpoint"`
-	CertFile string   `json:"certFile"`
-	KeyFile  string   `json:"keyFile"`
-	Users    []string `json:"users"`
+	Port     int               `json:"port"`
+	Endpoint string            `json:"endpoint"`
+	CertFile string            `json:"certFile"`
+	KeyFile  string            `json:"keyFile"`
+	Users    []string          `json:"users"`
+	UserKeys map[string]string `json:"userKeys,omitempty"` // UserKeys are the base64 public keys by user ID, the server checks new devices against them
+	Policy   *Policy           `json:"policy,omitempty"`
+}
+
+// Policy is the server's routing policy, see server/policy.go.
+type Policy struct {
+	Mode  string      `json:"mode"`
+	Pairs [][2]string `json:"pairs,omitempty"`
 }
 
 func main() {
-	var ep, ks, addr, cert, key, tp, opf, ukfs string
+	var ep, ks, addr, cert, key, tp, opf, ukfs, name, dir, out, passwords, policy string
 	var port int
 	flag.StringVar(&ukfs, "ukfs", "", "comma-separated list of user keystore files")
 	flag.StringVar(&opf, "opf", "config.json", "output file for client config")
-	flag.StringVar(&tp, "type", "", "type of config (client, server)")
+	flag.StringVar(&tp, "type", "", "type of config (client, server, profile, deployment)")
+	flag.StringVar(&dir, "dir", ".", "directory of keystores and keyshares for deployment")
+	flag.StringVar(&out, "out", ".", "output directory for deployment configs")
+	flag.StringVar(&passwords, "passwords", "", "JSON file of keystore name to password for deployment, prompts when empty")
+	flag.StringVar(&policy, "policy", "", "routing policy for deployment: all, or acl to only allow users listing each other as contacts")
+	flag.StringVar(&name, "name", "", "profile name")
 	flag.StringVar(&key, "key", "", "TLS private key")
-	flag.StringVar(&cert, "cert", "", "TLS cert file")
+	flag.StringVar(&cert, "cert", "", "TLS cert file, pinned in profiles when set")
 	flag.StringVar(&ep, "endpoint", "ws", "websocket endpoint")
 	flag.StringVar(&ks, "keystore", "", "encrypted keystore string")
 	flag.StringVar(&addr, "addr", "10.1.10.194", "address of server (10.1.10.194)")
 	flag.IntVar(&port, "port", 0, "server port")
 	flag.Parse()
+	opfSet := false
+	flag.Visit(func(f *flag.Flag) {
+		opfSet = opfSet || f.Name == "opf"
+	})
 	if port == 0 {
 		log.Fatal("port number required")
 		return
@@ -49,24 +75,54 @@ func main() {
 		}); err != nil {
 			log.Fatalf("Error marshalling config: %v\n", err)
 		} else {
-			if err := os.WriteFile(opf, cjb, 0666); err != nil {
+			if err := os.WriteFile(opf, cjb, 0600); err != nil {
 				log.Fatalf("Error writing config.json: %v\n", err)
 			}
 		}
+	case "profile":
+		if len(name) == 0 {
+			log.Fatal("profile name required")
+		}
+		p := &Profile{
+			Name:     name,
+			Addr:     fmt.Sprintf("%s:%d", addr, port),
+			Endpoint: ep,
+			KeyStore: ks,
+		}
+		if len(cert) > 0 {
+			pem, err := os.ReadFile(cert)
+			if err != nil {
+				log.Fatalf("Error reading cert file: %v\n", err)
+			}
+			p.Cert = string(pem)
+		}
+		if !opfSet {
+			opf = name + ".ogsma"
+		}
+		if pjb, err := json.Marshal(p); err != nil {
+			log.Fatalf("Error marshalling profile: %v\n", err)
+		} else {
+			if err := os.WriteFile(opf, pjb, 0600); err != nil {
+				log.Fatalf("Error writing %s: %v\n", opf, err)
+			}
+		}
 	case "server":
 		var clientIdList []string
+		userKeys := map[string]string{}
 		for _, s := range strings.Split(ukfs, ",") {
 			keystoreFileBytes, err := os.ReadFile(fmt.Sprintf("%s.keyshare", s))
 			if err != nil {
 				log.Fatalf("Error opening keystore file %s: %v\n", s, err)
 			}
 			keystoreID := &struct {
-				ID string `json:"id"`
+				ID        string `json:"id"`
+				PublicKey string `json:"publicKey"`
 			}{}
 			if err := json.Unmarshal(keystoreFileBytes, keystoreID); err != nil {
 				log.Fatalf("Error unmarshalling keystore file %s: %v\n", s, err)
 			}
 			clientIdList = append(clientIdList, keystoreID.ID)
+			userKeys[keystoreID.ID] = keystoreID.PublicKey
 		}
 		if sjb, err := json.Marshal(&ServerConfig{
 			Port:     port,
@@ -74,14 +130,42 @@ func main() {
 			CertFile: cert,
 			KeyFile:  key,
 			Users:    clientIdList,
+			UserKeys: userKeys,
 		}); err != nil {
 			log.Fatalf("Error marshalling config: %v\n", err)
 		} else {
-			if err := os.WriteFile("server_config.json", sjb, 0666); err != nil {
-				log.Fatalf("Error writing server_config.json: %v\n", err)
+			if !opfSet {
+				opf = "server_config.json"
 			}
+			if err := os.WriteFile(opf, sjb, 0600); err != nil {
+				log.Fatalf("Error writing %s: %v\n", opf, err)
+			}
+		}
+	case "deployment":
+		if policy != "" && policy != "all" && policy != "acl" {
+			log.Fatalf("Unsupported policy %q (all, acl)\n", policy)
+		}
+		d := &Deployment{
+			dir:      dir,
+			out:      out,
+			addr:     addr,
+			endpoint: ep,
+			cert:     cert,
+			key:      key,
+			port:     port,
+			policy:   policy,
+		}
+		if err := d.load(passwords); err != nil {
+			log.Fatalf("Error loading deployment: %v\n", err)
+		}
+		if err := d.check(); err != nil {
+			log.Fatalf("Deployment is inconsistent:\n%v\n", err)
+		}
+		if err := d.write(); err != nil {
+			log.Fatalf("Error writing deployment: %v\n", err)
 		}
+		fmt.Printf("wrote configs for %d clients to %s\n", len(d.keystores), out)
 	default:
-		log.Fatalf("Unsupported type of config (client, server)")
+		log.Fatalf("Unsupported type of config (client, server, profile, deployment)")
 	}
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+	"ogsma_protocol/keystore"
+)
+
+var errUsage = errors.New("usage")
+
+type command struct {
+	args  string
+	help  string
+	nargs int // nargs is the exact number of arguments, -1 for one or more
+	run   func(e *Encryption, o *options, args []string) error
+}
+
+type options struct {
+	kdf string
+	out string
+	pw  *passwordReader
+}
+
+var commands = map[string]*command{
+	"init": {"<username>", "create a new keystore", 1, func(e *Encryption, o *options, args []string) error {
+		kdf, err := keystore.DefaultKDFParams(o.kdf)
+		if err != nil {
+			return err
+		}
+		if e.password, err = o.pw.newPassword("New keystore password: "); err != nil {
+			return err
+		}
+		e.kdf = kdf
+		if err := e.keyGen(args[0]); err != nil {
+			return err
+		}
+		fmt.Printf("created %s for %s\n", e.keyStoreFile, args[0])
+		return nil
+	}},
+	"add": {"<file.keyshare>...", "add contacts or import signed key rotations", -1, func(e *Encryption, o *options, args []string) error {
+		if err := o.load(e); err != nil {
+			return err
+		}
+		for _, f := range args {
+			if err := e.addContactFromFile(f); err != nil {
+				return err
+			}
+		}
+		return nil
+	}},
+	"remove": {"<contact>", "remove a contact by username or id", 1, func(e *Encryption, o *options, args []string) error {
+		if err := o.load(e); err != nil {
+			return err
+		}
+		return e.removeContact(args[0])
+	}},
+	"list": {"", "list the keystore owner and contacts", 0, func(e *Encryption, o *options, args []string) error {
+		if err := o.load(e); err != nil {
+			return err
+		}
+		e.listContacts(os.Stdout)
+		return nil
+	}},
+	"rename": {"<contact> <new username>", "rename a contact", 2, func(e *Encryption, o *options, args []string) error {
+		if err := o.load(e); err != nil {
+			return err
+		}
+		return e.renameContact(args[0], args[1])
+	}},
+	"fingerprint": {"<contact>", "show the safety number to compare with a contact", 1, func(e *Encryption, o *options, args []string) error {
+		if err := o.load(e); err != nil {
+			return err
+		}
+		return e.printFingerprint(os.Stdout, args[0])
+	}},
+	"trust": {"<contact>", "mark a contact verified after comparing safety numbers", 1, func(e *Encryption, o *options, args []string) error {
+		if err := o.load(e); err != nil {
+			return err
+		}
+		return e.trustContact(args[0])
+	}},
+	"export": {"", "write the public keyshare (default <username>.keyshare)", 0, func(e *Encryption, o *options, args []string) error {
+		if err := o.load(e); err != nil {
+			return err
+		}
+		return e.shareKey(o.out)
+	}},
+	"verify": {"", "check the keystore decrypts and its keys are consistent", 0, func(e *Encryption, o *options, args []string) error {
+		if err := o.load(e); err != nil {
+			return err
+		}
+		return e.verifyKeystore()
+	}},
+	"passwd": {"", "re-encrypt the keystore with a new password", 0, func(e *Encryption, o *options, args []string) error {
+		if err := o.load(e); err != nil {
+			return err
+		}
+		kdf, err := keystore.DefaultKDFParams(o.kdf)
+		if err != nil {
+			return err
+		}
+		newPassword, err := o.pw.newPassword("New keystore password: ")
+		if err != nil {
+			return err
+		}
+		return e.changePassword(newPassword, kdf)
+	}},
+	"rotate": {"", "generate a new key pair and write a signed key-rotation keyshare", 0, func(e *Encryption, o *options, args []string) error {
+		if err := o.load(e); err != nil {
+			return err
+		}
+		return e.rotate(o.out)
+	}},
+	"migrate": {"", "rewrite the keystore in the current format using -kdf", 0, func(e *Encryption, o *options, args []string) error {
+		if err := o.load(e); err != nil {
+			return err
+		}
+		kdf, err := keystore.DefaultKDFParams(o.kdf)
+		if err != nil {
+			return err
+		}
+		return e.migrate(kdf)
+	}},
+}
+
+func (o *options) load(e *Encryption) error {
+	var err error
+	if e.password, err = o.pw.read("Keystore password: "); err != nil {
+		return err
+	}
+	return e.loadKeys()
+}
+
+// passwordReader prompts on the terminal without echo, or reads one password per line
+// from stdin when it is not a terminal so scripts can pipe passwords in.
+type passwordReader struct {
+	fd  int
+	tty bool
+	in  *bufio.Reader
+}
+
+func newPasswordReader(f *os.File) *passwordReader {
+	return &passwordReader{
+		fd:  int(f.Fd()),
+		tty: term.IsTerminal(int(f.Fd())),
+		in:  bufio.NewReader(f),
+	}
+}
+
+func (p *passwordReader) read(prompt string) (string, error) {
+	if p.tty {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(p.fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("reading password: %v", err)
+		}
+		return string(b), nil
+	}
+	line, err := p.in.ReadString('\n')
+	if err != nil && (err != io.EOF || len(line) == 0) {
+		return "", fmt.Errorf("reading password from stdin: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (p *passwordReader) newPassword(prompt string) (string, error) {
+	password, err := p.read(prompt)
+	if err != nil {
+		return "", err
+	}
+	if len(password) == 0 {
+		return "", errors.New("password is empty")
+	}
+	if p.tty {
+		confirm, err := p.read("Confirm password: ")
+		if err != nil {
+			return "", err
+		}
+		if confirm != password {
+			return "", errors.New("passwords do not match")
+		}
+	}
+	return password, nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: keystore_gen <command> -keystore <file> [flags] [args]\n\ncommands:\n")
+	for _, name := range []string{"init", "add", "remove", "list", "rename", "fingerprint", "trust", "export", "verify", "passwd", "rotate", "migrate"} {
+		c := commands[name]
+		fmt.Fprintf(os.Stderr, "  %-11s %-26s %s\n", name, c.args, c.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nPasswords are prompted for on a terminal, otherwise read one per line from stdin.\n")
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		usage()
+		return errUsage
+	}
+	c, ok := commands[args[0]]
+	if !ok {
+		usage()
+		return errUsage
+	}
+	e := &Encryption{}
+	o := &options{pw: newPasswordReader(os.Stdin)}
+	fs := flag.NewFlagSet(args[0], flag.ContinueOnError)
+	fs.StringVar(&e.keyStoreFile, "keystore", "", "path to keystore file")
+	fs.StringVar(&o.kdf, "kdf", "argon2id", "key derivation function for init, passwd and migrate (argon2id, pbkdf2)")
+	fs.StringVar(&o.out, "o", "", "output file for export and rotate keyshares")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: keystore_gen %s -keystore <file> [flags] %s\n", args[0], c.args)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return errUsage
+	}
+	if len(e.keyStoreFile) == 0 || (c.nargs >= 0 && fs.NArg() != c.nargs) || (c.nargs < 0 && fs.NArg() == 0) {
+		fs.Usage()
+		return errUsage
+	}
+	return c.run(e, o, fs.Args())
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "keystore_gen: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"ogsma_protocol/keystore"
+)
+
+// runPiped runs the command line args with input piped to stdin, the way scripts pass passwords.
+func runPiped(t *testing.T, input string, args ...string) error {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.WriteString(input); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() {
+		os.Stdin = stdin
+		r.Close()
+	}()
+	return run(args)
+}
+
+// contactNames loads a keystore and lists its contacts and the verified ones.
+func contactNames(t *testing.T, file, password string) (names, verified []string) {
+	t.Helper()
+	e := &Encryption{keyStoreFile: file, password: password}
+	if err := e.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range e.keys.Contacts {
+		names = append(names, c.Username)
+		if c.Verified {
+			verified = append(verified, c.Username)
+		}
+	}
+	return names, verified
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	alice, bob := filepath.Join(dir, "alice.keystore"), filepath.Join(dir, "bob.keystore")
+	aliceShare, bobShare := filepath.Join(dir, "alice.keyshare"), filepath.Join(dir, "bob.keyshare")
+	rotatedShare := filepath.Join(dir, "alice-rotated.keyshare")
+	alicePassword := "alice pw"
+
+	// the steps run in order against the same keystores
+	for _, tc := range []struct {
+		name     string
+		args     []string
+		stdin    string
+		err      string   // err is a substring of the expected error
+		contacts []string // contacts are alice's contacts after the step, unchecked when the step fails
+		verified []string // verified are alice's verified contacts after the step
+		password string   // password is alice's password after the step, unchanged when empty
+	}{
+		{name: "init", args: []string{"init", "-kdf", "pbkdf2", "-keystore", alice, "alice"}, stdin: "alice pw\n"},
+		{name: "init existing", args: []string{"init", "-keystore", alice, "alice"}, stdin: "alice pw\n", err: "already exists"},
+		{name: "init empty password", args: []string{"init", "-keystore", bob, "bob"}, stdin: "\n", err: "password is empty"},
+		{name: "init without newline", args: []string{"init", "-keystore", bob, "bob"}, stdin: "bob pw"},
+		{name: "init without username", args: []string{"init", "-keystore", filepath.Join(dir, "carol.keystore")}, err: errUsage.Error()},
+		{name: "export", args: []string{"export", "-keystore", alice, "-o", aliceShare}, stdin: "alice pw\n"},
+		{name: "export other", args: []string{"export", "-keystore", bob, "-o", bobShare}, stdin: "bob pw\n"},
+		{name: "export wrong password", args: []string{"export", "-keystore", alice, "-o", aliceShare}, stdin: "guess\n", err: "wrong password"},
+		{name: "export no password", args: []string{"export", "-keystore", alice, "-o", aliceShare}, err: "reading password from stdin"},
+		{name: "add", args: []string{"add", "-keystore", alice, bobShare}, stdin: "alice pw\n", contacts: []string{"bob"}},
+		{name: "add again", args: []string{"add", "-keystore", alice, bobShare}, stdin: "alice pw\n", contacts: []string{"bob"}},
+		{name: "add own key", args: []string{"add", "-keystore", alice, aliceShare}, stdin: "alice pw\n", err: "is our own key"},
+		{name: "add missing file", args: []string{"add", "-keystore", alice, filepath.Join(dir, "carol.keyshare")}, stdin: "alice pw\n", err: "reading keyshare"},
+		{name: "list", args: []string{"list", "-keystore", alice}, stdin: "alice pw\n", contacts: []string{"bob"}},
+		{name: "list wrong password", args: []string{"list", "-keystore", alice}, stdin: "guess\n", err: "wrong password"},
+		{name: "list with argument", args: []string{"list", "-keystore", alice, "bob"}, err: errUsage.Error()},
+		{name: "rename", args: []string{"rename", "-keystore", alice, "bob", "robert"}, stdin: "alice pw\n", contacts: []string{"robert"}},
+		{name: "rename unknown", args: []string{"rename", "-keystore", alice, "carol", "caroline"}, stdin: "alice pw\n", err: "contact carol not found"},
+		{name: "rename wrong password", args: []string{"rename", "-keystore", alice, "robert", "bob"}, stdin: "guess\n", err: "wrong password"},
+		{name: "rename one argument", args: []string{"rename", "-keystore", alice, "robert"}, err: errUsage.Error()},
+		{name: "rename three arguments", args: []string{"rename", "-keystore", alice, "robert", "bob", "b"}, err: errUsage.Error()},
+		{name: "fingerprint", args: []string{"fingerprint", "-keystore", alice, "robert"}, stdin: "alice pw\n", contacts: []string{"robert"}},
+		{name: "fingerprint unknown", args: []string{"fingerprint", "-keystore", alice, "carol"}, stdin: "alice pw\n", err: "contact carol not found"},
+		{name: "fingerprint wrong password", args: []string{"fingerprint", "-keystore", alice, "robert"}, stdin: "guess\n", err: "wrong password"},
+		{name: "fingerprint without contact", args: []string{"fingerprint", "-keystore", alice}, err: errUsage.Error()},
+		{name: "trust wrong password", args: []string{"trust", "-keystore", alice, "robert"}, stdin: "guess\n", err: "wrong password"},
+		{name: "trust unknown", args: []string{"trust", "-keystore", alice, "carol"}, stdin: "alice pw\n", err: "contact carol not found"},
+		{name: "trust without contact", args: []string{"trust", "-keystore", alice}, err: errUsage.Error()},
+		{name: "trust", args: []string{"trust", "-keystore", alice, "robert"}, stdin: "alice pw\n", contacts: []string{"robert"}, verified: []string{"robert"}},
+		{name: "verify", args: []string{"verify", "-keystore", alice}, stdin: "alice pw\n", contacts: []string{"robert"}, verified: []string{"robert"}},
+		{name: "verify wrong password", args: []string{"verify", "-keystore", alice}, stdin: "guess\n", err: "wrong password"},
+		{name: "verify with argument", args: []string{"verify", "-keystore", alice, "robert"}, err: errUsage.Error()},
+		{name: "passwd wrong password", args: []string{"passwd", "-kdf", "pbkdf2", "-keystore", alice}, stdin: "guess\nalice new\n", err: "wrong password"},
+		{name: "passwd empty password", args: []string{"passwd", "-kdf", "pbkdf2", "-keystore", alice}, stdin: "alice pw\n\n", err: "password is empty"},
+		{name: "passwd with argument", args: []string{"passwd", "-keystore", alice, "alice new"}, err: errUsage.Error()},
+		{
+			name:     "passwd",
+			args:     []string{"passwd", "-kdf", "pbkdf2", "-keystore", alice},
+			stdin:    "alice pw\nalice new\n",
+			contacts: []string{"robert"},
+			verified: []string{"robert"},
+			password: "alice new",
+		},
+		{name: "old password", args: []string{"list", "-keystore", alice}, stdin: "alice pw\n", err: "wrong password"},
+		{name: "bob adds alice", args: []string{"add", "-keystore", bob, aliceShare}, stdin: "bob pw\n", contacts: []string{"robert"}, verified: []string{"robert"}},
+		{name: "rotate wrong password", args: []string{"rotate", "-keystore", alice, "-o", rotatedShare}, stdin: "alice pw\n", err: "wrong password"},
+		{name: "rotate with argument", args: []string{"rotate", "-keystore", alice, rotatedShare}, err: errUsage.Error()},
+		{name: "rotate", args: []string{"rotate", "-keystore", alice, "-o", rotatedShare}, stdin: "alice new\n", contacts: []string{"robert"}, verified: []string{"robert"}},
+		{name: "bob imports the rotation", args: []string{"add", "-keystore", bob, rotatedShare}, stdin: "bob pw\n", contacts: []string{"robert"}, verified: []string{"robert"}},
+		{name: "migrate unknown kdf", args: []string{"migrate", "-kdf", "scrypt", "-keystore", alice}, stdin: "alice new\n", err: "unsupported kdf"},
+		{name: "migrate wrong password", args: []string{"migrate", "-kdf", "pbkdf2", "-keystore", alice}, stdin: "alice pw\n", err: "wrong password"},
+		{name: "migrate with argument", args: []string{"migrate", "-keystore", alice, "v2"}, err: errUsage.Error()},
+		{name: "migrate", args: []string{"migrate", "-kdf", "argon2id", "-keystore", alice}, stdin: "alice new\n", contacts: []string{"robert"}, verified: []string{"robert"}},
+		{name: "verify migrated", args: []string{"verify", "-keystore", alice}, stdin: "alice new\n", contacts: []string{"robert"}, verified: []string{"robert"}},
+		{name: "remove unknown", args: []string{"remove", "-keystore", alice, "carol"}, stdin: "alice new\n", err: "contact carol not found"},
+		{name: "remove wrong password", args: []string{"remove", "-keystore", alice, "robert"}, stdin: "guess\n", err: "wrong password"},
+		{name: "remove", args: []string{"remove", "-keystore", alice, "robert"}, stdin: "alice new\n"},
+		{name: "remove again", args: []string{"remove", "-keystore", alice, "robert"}, stdin: "alice new\n", err: "contact robert not found"},
+		{name: "unknown command", args: []string{"import", "-keystore", alice}, err: errUsage.Error()},
+		{name: "no keystore", args: []string{"export"}, err: errUsage.Error()},
+		{name: "missing argument", args: []string{"remove", "-keystore", alice}, err: errUsage.Error()},
+		{name: "add without files", args: []string{"add", "-keystore", alice}, err: errUsage.Error()},
+		{name: "unknown kdf", args: []string{"init", "-kdf", "scrypt", "-keystore", filepath.Join(dir, "carol.keystore"), "carol"}, stdin: "carol pw\n", err: "unsupported kdf"},
+	} {
+		err := runPiped(t, tc.stdin, tc.args...)
+		if len(tc.err) > 0 {
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("%s: got %v, want an error containing %q", tc.name, err, tc.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if len(tc.password) > 0 {
+			alicePassword = tc.password
+		}
+		contacts, verified := contactNames(t, alice, alicePassword)
+		if !slices.Equal(contacts, tc.contacts) {
+			t.Errorf("%s: contacts %q, want %q", tc.name, contacts, tc.contacts)
+		}
+		if !slices.Equal(verified, tc.verified) {
+			t.Errorf("%s: verified contacts %q, want %q", tc.name, verified, tc.verified)
+		}
+	}
+
+	// bob holds alice's rotated key, alice's old key is kept for the backlog
+	rotated := readKeyShare(t, rotatedShare)
+	e := &Encryption{keyStoreFile: bob, password: "bob pw"}
+	if err := e.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.keys.Contacts) != 1 || base64.StdEncoding.EncodeToString(e.keys.Contacts[0].PublicKey.Bytes(false)) != rotated.PublicKey {
+		t.Error("bob didn't import alice's rotated key")
+	}
+	e = &Encryption{keyStoreFile: alice, password: alicePassword}
+	if err := e.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if len(e.keys.PreviousKeys) != 1 || e.loadedKDF.Algorithm != keystore.Argon2id {
+		t.Errorf("alice has %d previous keys and %v, want 1 and argon2id", len(e.keys.PreviousKeys), e.loadedKDF)
+	}
+
+	b, err := os.ReadFile(bobShare)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share := &KeyShare{}
+	if err := json.Unmarshal(b, share); err != nil {
+		t.Fatal(err)
+	}
+	if share.Username != "bob" || len(share.ID) != 64 || len(share.PublicKey) == 0 {
+		t.Errorf("exported keyshare %+v", share)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "carol.keystore")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("failed init left a keystore: %v", err)
+	}
+}
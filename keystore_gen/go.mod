@@ -2,10 +2,18 @@ module keystore_gen
 
 go 1.25.3
 
-require github.com/ecies/go/v2 v2.0.11
+replace ogsma_protocol => ../protocol
+
+require (
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.4.0
+	github.com/ecies/go/v2 v2.0.11
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	golang.org/x/term v0.36.0
+	ogsma_protocol v0.0.0-00010101000000-000000000000
+)
 
 require (
-	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.4.0 // indirect
 	github.com/ethereum/go-ethereum v1.15.8 // indirect
-	golang.org/x/crypto v0.37.0 // indirect
+	golang.org/x/crypto v0.43.0 // indirect
+	golang.org/x/sys v0.37.0 // indirect
 )
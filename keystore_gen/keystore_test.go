@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	ecies "github.com/ecies/go/v2"
+	"ogsma_protocol/keystore"
+)
+
+// writeV1Keystore writes ks in the v1 hex "salt-iv-ciphertext" format.
+func writeV1Keystore(t *testing.T, file, password string, ks *keystore.Keystore) {
+	t.Helper()
+	plaintext, err := json.Marshal(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, iv := make([]byte, 8), make([]byte, keystore.NonceSize)
+	rand.Read(salt)
+	rand.Read(iv)
+	key, err := pbkdf2.Key(sha256.New, password, salt, keystore.LegacyIter, 32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := hex.EncodeToString(salt) + "-" + hex.EncodeToString(iv) + "-" + hex.EncodeToString(gcm.Seal(nil, iv, plaintext, nil))
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	key, err := ecies.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	contact, err := ecies.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "alice.keystore")
+	writeV1Keystore(t, file, "alice pw", &keystore.Keystore{
+		Username:   []byte("alice"),
+		ID:         []byte("alice id"),
+		PublicKey:  key.PublicKey.Bytes(false),
+		PrivateKey: key.Bytes(),
+		Contacts:   []*keystore.StoreContact{{PublicKey: contact.PublicKey.Bytes(false), ID: []byte("bob id"), Username: []byte("bob"), Verified: true}},
+	})
+
+	e := &Encryption{keyStoreFile: file, password: "alice pw"}
+	if err := e.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if e.loadedVersion != 1 || e.loadedKDF != (keystore.KDFParams{Algorithm: keystore.PBKDF2, Time: keystore.LegacyIter}) {
+		t.Errorf("loaded v%d with %v, want v1 with the legacy parameters", e.loadedVersion, e.loadedKDF)
+	}
+	if err := e.migrate(testKDF); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !keystore.IsV2(data) {
+		t.Fatal("migrate didn't write a v2 keystore")
+	}
+	migrated := &Encryption{keyStoreFile: file, password: "alice pw"}
+	if err := migrated.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if migrated.loadedVersion != keystore.Version || migrated.loadedKDF != testKDF {
+		t.Errorf("migrated to v%d with %v, want v%d with %v", migrated.loadedVersion, migrated.loadedKDF, keystore.Version, testKDF)
+	}
+	k := migrated.keys
+	if k.Username != "alice" || k.ID != "alice id" || !k.PublicKey.Equals(key.PublicKey) || len(k.Contacts) != 1 ||
+		k.Contacts[0].Username != "bob" || !k.Contacts[0].Verified || !k.Contacts[0].PublicKey.Equals(contact.PublicKey) {
+		t.Errorf("migrated keys %+v don't match the v1 keystore", k)
+	}
+	if err := (&Encryption{keyStoreFile: file, password: "guess"}).loadKeys(); err == nil {
+		t.Error("the migrated keystore opens with the wrong password")
+	}
+}
@@ -2,175 +2,95 @@ package main
 
 import (
 	"bytes"
-	"crypto/aes"
-	"crypto/cipher"
-	"crypto/pbkdf2"
-	"crypto/rand"
-	"crypto/sha256"
 	"encoding/base64"
-	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"flag"
 	"fmt"
 	"io"
-	"log"
 	"os"
 
 	ecies "github.com/ecies/go/v2"
+	"github.com/skip2/go-qrcode"
+	"ogsma_protocol/keystore"
 )
 
-type Keystore struct {
-	Username   []byte          `json:"username"`
-	ID         []byte          `json:"id"`
-	PublicKey  []byte          `json:"publicKey"`
-	PrivateKey []byte          `json:"privateKey"`
-	Contacts   []*StoreContact `json:"contacts"`
-}
-
-type StoreContact struct {
-	PublicKey []byte `json:"publicKey"`
-	ID        []byte `json:"id"`
-	Username  []byte `json:"username"`
-}
-
 type KeyShare struct {
-	ID        string `json:"id"`
-	Username  string `json:"username"`
-	PublicKey string `json:"publicKey"`
+	ID                string `json:"id"`
+	Username          string `json:"username"`
+	PublicKey         string `json:"publicKey"`
+	PreviousPublicKey string `json:"previousPublicKey,omitempty"` // PreviousPublicKey and Signature are set on key rotation
+	Signature         string `json:"signature,omitempty"`
 }
 
 type Keys struct {
-	Username   string `json:"username"`
-	ID         string `json:"id"`
-	PublicKey  *ecies.PublicKey
-	PrivateKey *ecies.PrivateKey
-	Contacts   []*Contact // Contacts array of contacts
+	Username     string `json:"username"`
+	ID           string `json:"id"`
+	PublicKey    *ecies.PublicKey
+	PrivateKey   *ecies.PrivateKey
+	PreviousKeys []*ecies.PrivateKey
+	Contacts     []*Contact // Contacts array of contacts
 }
 
 type Contact struct {
-	PublicKey *ecies.PublicKey
-	ID        string
-	Username  string
+	PublicKey  *ecies.PublicKey
+	ID         string
+	Username   string
+	Verified   bool
+	KeyChanged bool
 }
 
 type Encryption struct {
-	targetPublicKey *ecies.PublicKey
-	keyStoreFile    string
-	password        string
-	bits            int
-	iter            int
-	keys            *Keys
+	keyStoreFile  string
+	password      string
+	kdf           keystore.KDFParams // kdf is used when saving, loading sets it to the stored parameters
+	loadedKDF     keystore.KDFParams
+	loadedVersion int
+	keys          *Keys
 }
 
 func (e *Encryption) generateECCKeyPair() (*ecies.PrivateKey, *ecies.PublicKey, error) {
 	k, err := ecies.GenerateKey()
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
 	return k, k.PublicKey, nil
 }
 
-func (e *Encryption) passwordEncrypt(plaintext []byte) ([]byte, error) {
-	salt := make([]byte, 16)
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		return nil, fmt.Errorf("error generating salt: %v", err)
-	}
-	key, err := pbkdf2.Key(sha256.New, e.password, salt, e.iter, 32)
-	if err != nil {
-		return nil, fmt.Errorf("error generating pbkdf2 key: %v", err)
-	}
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("aes.NewCipher: %w", err)
-	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("NewGCM: %s", err)
-	}
-	iv := make([]byte, 12)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
-		return nil, fmt.Errorf("failed to generate iv: %s", err)
-	}
-	ciphertext := gcm.Seal(nil, iv, plaintext, nil)
-	hexSalt := make([]byte, hex.EncodedLen(len(salt)))
-	hex.Encode(hexSalt, salt)
-	hexIv := make([]byte, hex.EncodedLen(len(iv)))
-	hex.Encode(hexIv, iv)
-	hexCiphertext := make([]byte, hex.EncodedLen(len(ciphertext)))
-	hex.Encode(hexCiphertext, ciphertext)
-	return append(append(append(append(hexSalt, []byte("-")...), hexIv...), []byte("-")...), hexCiphertext...), nil // lol
-}
-
-func (e *Encryption) passwordDecrypt(cipherText []byte) ([]byte, error) {
-	if !bytes.ContainsAny(cipherText, "-") {
-		return nil, fmt.Errorf("invalid data")
-	}
-	data := bytes.Split(cipherText, []byte("-"))
-	salt := make([]byte, hex.DecodedLen(len(data[0])))
-	if _, err := hex.Decode(salt, data[0]); err != nil {
-		return nil, fmt.Errorf("invalid data: salt")
-	}
-	iv := make([]byte, hex.DecodedLen(len(data[1])))
-	if _, err := hex.Decode(iv, data[1]); err != nil {
-		return nil, fmt.Errorf("invalid data: iv")
-	}
-	ciphertext := make([]byte, hex.DecodedLen(len(data[2])))
-	if _, err := hex.Decode(ciphertext, data[2]); err != nil {
-		return nil, fmt.Errorf("invalid data: ciphertext")
-	}
-	key, err := pbkdf2.Key(sha256.New, e.password, salt, e.iter, 32)
-	if err != nil {
-		return nil, fmt.Errorf("error generating pbkdf2 key: %v", err)
-	}
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return nil, fmt.Errorf("decrypt failed: %v", err)
+func (e *Encryption) keyGen(username string) error {
+	if _, err := os.Stat(e.keyStoreFile); err == nil {
+		return fmt.Errorf("keystore %s already exists", e.keyStoreFile)
 	}
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return nil, fmt.Errorf("decrypt failed: %v", err)
-	}
-	plaintext, err := gcm.Open(nil, iv, ciphertext, nil)
-	if err != nil {
-		return nil, fmt.Errorf("decrypt failed: %v", err)
-	}
-	return plaintext, nil
-}
-
-func (e *Encryption) keyGen(username string) {
 	privateKey, publicKey, err := e.generateECCKeyPair()
 	if err != nil {
-		log.Printf("Error generating ecc keys: %v\n", err)
-		return
+		return fmt.Errorf("generating ecc keys: %v", err)
 	}
-	e.saveKeystore(&Keystore{
+	return e.saveKeystore(&keystore.Keystore{
 		Username:   []byte(username),
 		PublicKey:  publicKey.Bytes(false),
 		PrivateKey: privateKey.Bytes(),
-		Contacts:   []*StoreContact{},
+		Contacts:   []*keystore.StoreContact{},
 		ID:         []byte(generateRandomString(64)),
 	})
-
 }
 
-func (e *Encryption) loadKeys() {
+func (e *Encryption) loadKeys() error {
 	encryptedKeystoreFileBytes, err := os.ReadFile(e.keyStoreFile)
 	if err != nil {
-		log.Printf("Error opening keystore: %v\n", err)
+		return fmt.Errorf("opening keystore: %v", err)
 	}
-	keystoreFileBytes, err := e.passwordDecrypt(encryptedKeystoreFileBytes)
+	ks, params, err := keystore.Read(e.password, encryptedKeystoreFileBytes)
 	if err != nil {
-		log.Printf("Error decrypting keystore: %v\n", err)
-		return
+		return fmt.Errorf("decrypting keystore (wrong password?): %v", err)
 	}
-	ks := &Keystore{}
-	if err := json.Unmarshal(keystoreFileBytes, ks); err != nil {
-		log.Printf("Error unmarshaling keystore: %v\n", err)
+	e.loadedVersion = 1
+	if keystore.IsV2(encryptedKeystoreFileBytes) {
+		e.loadedVersion = keystore.Version
 	}
+	e.loadedKDF = params
+	e.kdf = e.loadedKDF
 	publicKeyFromBytes, err := ecies.NewPublicKeyFromBytes(ks.PublicKey)
 	if err != nil {
-		log.Printf("Error decrypting public key: %v\n", err)
+		return fmt.Errorf("decoding public key: %v", err)
 	}
 	e.keys = &Keys{
 		Username:   string(ks.Username),
@@ -179,151 +99,283 @@ func (e *Encryption) loadKeys() {
 		PrivateKey: ecies.NewPrivateKeyFromBytes(ks.PrivateKey),
 		Contacts:   []*Contact{},
 	}
+	for _, pk := range ks.PreviousPrivateKeys {
+		e.keys.PreviousKeys = append(e.keys.PreviousKeys, ecies.NewPrivateKeyFromBytes(pk))
+	}
 	for _, i := range ks.Contacts {
 		contactPublicKeyFromBytes, err := ecies.NewPublicKeyFromBytes(i.PublicKey)
 		if err != nil {
-			log.Printf("Error decrypting contact: %v\n", err)
+			return fmt.Errorf("decoding contact %s: %v", i.Username, err)
 		}
 		e.keys.Contacts = append(e.keys.Contacts, &Contact{
-			PublicKey: contactPublicKeyFromBytes,
-			ID:        string(i.ID),
-			Username:  string(i.Username),
+			PublicKey:  contactPublicKeyFromBytes,
+			ID:         string(i.ID),
+			Username:   string(i.Username),
+			Verified:   i.Verified,
+			KeyChanged: i.KeyChanged,
 		})
 	}
-}
-
-func (e *Encryption) publicEncrypt(plaintext []byte) ([]byte, error) {
-	ciphertext, err := ecies.Encrypt(e.targetPublicKey, plaintext)
-	if err != nil {
-		return nil, errors.New("error encrypting with public key" + err.Error())
-	}
-	return ciphertext, nil
+	return nil
 }
 
 func (e *Encryption) privateDecrypt(ciphertext []byte) ([]byte, error) {
 	plaintext, err := ecies.Decrypt(e.keys.PrivateKey, ciphertext)
-	if err != nil {
-		return nil, errors.New("error decrypting with private key" + err.Error())
+	if err == nil {
+		return plaintext, nil
+	}
+	for _, pk := range e.keys.PreviousKeys {
+		if plaintext, perr := ecies.Decrypt(pk, ciphertext); perr == nil {
+			return plaintext, nil
+		}
 	}
-	return plaintext, nil
+	return nil, errors.New("error decrypting with private key" + err.Error())
 }
 
-func (e *Encryption) addContact(id, un string, publicKey *ecies.PublicKey) {
-	ks := &Keystore{
+func (e *Encryption) keystore() *keystore.Keystore {
+	ks := &keystore.Keystore{
 		Username:   []byte(e.keys.Username),
 		ID:         []byte(e.keys.ID),
 		PublicKey:  e.keys.PublicKey.Bytes(false),
 		PrivateKey: e.keys.PrivateKey.Bytes(),
-		Contacts:   []*StoreContact{},
+		Contacts:   []*keystore.StoreContact{},
+	}
+	for _, pk := range e.keys.PreviousKeys {
+		ks.PreviousPrivateKeys = append(ks.PreviousPrivateKeys, pk.Bytes())
 	}
 	for _, ct := range e.keys.Contacts {
-		ks.Contacts = append(ks.Contacts, &StoreContact{PublicKey: ct.PublicKey.Bytes(false), ID: []byte(ct.ID), Username: []byte(ct.Username)})
+		ks.Contacts = append(ks.Contacts, &keystore.StoreContact{
+			PublicKey:  ct.PublicKey.Bytes(false),
+			ID:         []byte(ct.ID),
+			Username:   []byte(ct.Username),
+			Verified:   ct.Verified,
+			KeyChanged: ct.KeyChanged,
+		})
 	}
-	ks.Contacts = append(ks.Contacts, &StoreContact{PublicKey: publicKey.Bytes(false), ID: []byte(id), Username: []byte(un)})
-	e.saveKeystore(ks)
+	return ks
 }
 
-func (e *Encryption) saveKeystore(ks *Keystore) {
-	marshaledKeystore, err := json.MarshalIndent(ks, "", " ")
-	if err != nil {
-		log.Printf("Error marshaling keystore: %v\n", err)
-		return
+// findContact matches a contact by ID or, if unambiguous, by username.
+func (e *Encryption) findContact(nameOrID string) (int, error) {
+	found := -1
+	for i, ct := range e.keys.Contacts {
+		if ct.ID == nameOrID {
+			return i, nil
+		}
+		if ct.Username == nameOrID {
+			if found >= 0 {
+				return -1, fmt.Errorf("more than one contact named %s, use the contact id", nameOrID)
+			}
+			found = i
+		}
+	}
+	if found < 0 {
+		return -1, fmt.Errorf("contact %s not found", nameOrID)
 	}
-	// TODO : encrypt entire keystore
-	encryptedKeystore, err := e.passwordEncrypt(marshaledKeystore)
+	return found, nil
+}
+
+// migrate rewrites a loaded keystore of any version as v2 with the configured kdf.
+func (e *Encryption) migrate(kdf keystore.KDFParams) error {
+	from := e.loadedKDF
+	e.kdf = kdf
+	if err := e.saveKeystore(e.keystore()); err != nil {
+		return err
+	}
+	fmt.Printf("migrated %s from v%d (%s) to v%d (%s)\n", e.keyStoreFile, e.loadedVersion, from, keystore.Version, e.kdf)
+	return nil
+}
+
+// saveKeystore writes to a temporary file first so a failed write never truncates the keystore.
+func (e *Encryption) saveKeystore(ks *keystore.Keystore) error {
+	encryptedKeystore, err := keystore.Write(e.password, e.kdf, ks)
 	if err != nil {
-		log.Printf("Error encrypting keystore: %v\n", err)
-		return
+		return fmt.Errorf("encrypting keystore: %v", err)
+	}
+	tmp := e.keyStoreFile + ".tmp"
+	if err := os.WriteFile(tmp, encryptedKeystore, 0600); err != nil {
+		return fmt.Errorf("writing keystore: %v", err)
 	}
-	if err := os.WriteFile(e.keyStoreFile, encryptedKeystore, 0600); err != nil {
-		log.Printf("Error writing keystore: %v\n", err)
+	if err := os.Rename(tmp, e.keyStoreFile); err != nil {
+		return fmt.Errorf("writing keystore: %v", err)
 	}
+	return nil
 }
 
-func (e *Encryption) shareKey() {
-	shs := KeyShare{
+func (e *Encryption) shareKey(filename string) error {
+	if len(filename) == 0 {
+		filename = fmt.Sprintf("%s.keyshare", e.keys.Username)
+	}
+	return writeKeyShare(filename, KeyShare{
 		ID:        e.keys.ID,
 		Username:  e.keys.Username,
 		PublicKey: base64.StdEncoding.EncodeToString(e.keys.PublicKey.Bytes(false)),
-	}
-	jsonBytes, err := json.MarshalIndent(shs, "", " ")
-	if err != nil {
-		log.Printf("Error marshaling keyshare: %v\n", err)
-	}
-	// fmt.Printf("%s\n", jsonBytes)
-	if err := os.WriteFile(fmt.Sprintf("%s.keyshare", e.keys.Username), jsonBytes, 0600); err != nil {
-		log.Printf("Error writing keyshare: %v\n", err)
-	}
+	})
 }
 
-func (e *Encryption) addContactFromFile(filename string) {
+func (e *Encryption) addContactFromFile(filename string) error {
 	file, err := os.ReadFile(filename)
 	if err != nil {
-		log.Printf("Error reading file: %v\n", err)
-		return
+		return fmt.Errorf("reading keyshare: %v", err)
 	}
 	nca := KeyShare{}
 	if err := json.Unmarshal(file, &nca); err != nil {
-		log.Printf("Error unmarshaling file: %v\n", err)
-		return
+		return fmt.Errorf("unmarshaling keyshare %s: %v", filename, err)
+	}
+	if len(nca.ID) == 0 || len(nca.Username) == 0 {
+		return fmt.Errorf("keyshare %s is missing id or username", filename)
+	}
+	if nca.ID == e.keys.ID {
+		return fmt.Errorf("keyshare %s is our own key", filename)
 	}
 	pkb, err := base64.StdEncoding.DecodeString(nca.PublicKey)
 	if err != nil {
-		log.Printf("Error decoding public key: %v\n", err)
+		return fmt.Errorf("decoding public key: %v", err)
 	}
 	contactPublicKey, err := ecies.NewPublicKeyFromBytes(pkb)
 	if err != nil {
-		log.Printf("Error decoding public key: %v\n", err)
+		return fmt.Errorf("decoding public key: %v", err)
+	}
+	for i, ct := range e.keys.Contacts {
+		if ct.ID != nca.ID {
+			continue
+		}
+		if bytes.Equal(ct.PublicKey.Bytes(false), pkb) {
+			fmt.Printf("contact %s is already up to date\n", ct.Username)
+			return nil
+		}
+		if err := verifyRotation(&nca, ct.PublicKey, pkb); err != nil {
+			return fmt.Errorf("updating contact %s: %v", ct.Username, err)
+		}
+		ks := e.keystore()
+		ks.Contacts[i].PublicKey = pkb
+		ks.Contacts[i].Verified = false
+		ks.Contacts[i].KeyChanged = true
+		if err := e.saveKeystore(ks); err != nil {
+			return err
+		}
+		// keep the loaded keys current so the next keyshare in the same run builds on this one
+		ct.PublicKey, ct.Verified, ct.KeyChanged = contactPublicKey, false, true
+		fmt.Printf("updated key for contact %s\n", ct.Username)
+		fmt.Fprintf(os.Stderr, "WARNING: the key for %s has changed, compare the new safety number with them before trusting it:\n%s\n",
+			ct.Username, keystore.FormatSafetyNumber(keystore.SafetyNumber(e.keys.ID, e.keys.PublicKey.Bytes(false), nca.ID, pkb)))
+		return nil
+	}
+	ks := e.keystore()
+	ks.Contacts = append(ks.Contacts, &keystore.StoreContact{PublicKey: contactPublicKey.Bytes(false), ID: []byte(nca.ID), Username: []byte(nca.Username)})
+	if err := e.saveKeystore(ks); err != nil {
+		return err
+	}
+	e.keys.Contacts = append(e.keys.Contacts, &Contact{PublicKey: contactPublicKey, ID: nca.ID, Username: nca.Username})
+	fmt.Printf("added contact %s\n", nca.Username)
+	return nil
+}
+
+func (e *Encryption) removeContact(nameOrID string) error {
+	i, err := e.findContact(nameOrID)
+	if err != nil {
+		return err
+	}
+	ks := e.keystore()
+	ks.Contacts = append(ks.Contacts[:i], ks.Contacts[i+1:]...)
+	if err := e.saveKeystore(ks); err != nil {
+		return err
 	}
-	e.addContact(nca.ID, nca.Username, contactPublicKey)
+	fmt.Printf("removed contact %s\n", e.keys.Contacts[i].Username)
+	return nil
 }
 
-func (e *Encryption) printKeys() {
-	fmt.Printf("keys: %+v\n", e.keys)
-	for _, k := range e.keys.Contacts {
-		fmt.Printf("Contact: %+v\n", k)
+func (e *Encryption) renameContact(nameOrID, username string) error {
+	if len(username) == 0 {
+		return errors.New("new username is empty")
+	}
+	i, err := e.findContact(nameOrID)
+	if err != nil {
+		return err
+	}
+	ks := e.keystore()
+	ks.Contacts[i].Username = []byte(username)
+	if err := e.saveKeystore(ks); err != nil {
+		return err
 	}
+	fmt.Printf("renamed contact %s to %s\n", e.keys.Contacts[i].Username, username)
+	return nil
 }
 
-func main() {
-	var password, contactKeyFile, newUsername, keyStoreFilename string
-	var printKeys, test bool
-	flag.BoolVar(&test, "test", false, "test flag")
-	flag.BoolVar(&printKeys, "print", false, "print keys")
-	flag.StringVar(&password, "password", "", "password to encrypt the keystore")
-	flag.StringVar(&newUsername, "new", "", "New user name")
-	flag.StringVar(&contactKeyFile, "add", "", "path to contact key file")
-	flag.StringVar(&keyStoreFilename, "keystore", "", "path to keystore file")
-	flag.Parse()
-	e := &Encryption{
-		password:     password,
-		keyStoreFile: keyStoreFilename,
-		bits:         4096,
-		iter:         100000,
-	}
-	if len(newUsername) > 0 {
-		e.keyGen(newUsername)
-	}
-	e.loadKeys()
-	if printKeys {
-		e.printKeys()
-		return
-	}
-	if len(contactKeyFile) > 0 {
-		e.addContactFromFile(contactKeyFile)
-	}
-	e.shareKey()
-	if test {
-		e.targetPublicKey = e.keys.PublicKey
-		ciphertext, err := e.publicEncrypt([]byte("hello world, this is ECC public/private key encryption!"))
-		if err != nil {
-			panic(err)
+func (e *Encryption) printFingerprint(w io.Writer, nameOrID string) error {
+	i, err := e.findContact(nameOrID)
+	if err != nil {
+		return err
+	}
+	ct := e.keys.Contacts[i]
+	number := keystore.SafetyNumber(e.keys.ID, e.keys.PublicKey.Bytes(false), ct.ID, ct.PublicKey.Bytes(false))
+	qr, err := qrcode.New(number, qrcode.Medium)
+	if err != nil {
+		return fmt.Errorf("generating qr code: %v", err)
+	}
+	fmt.Fprintf(w, "safety number for %s and %s:\n%s\n%s", e.keys.Username, ct.Username, keystore.FormatSafetyNumber(number), qr.ToSmallString(false))
+	if ct.KeyChanged {
+		fmt.Fprintf(w, "WARNING: the key for %s has changed since it was added\n", ct.Username)
+	}
+	return nil
+}
+
+// trustContact marks a contact verified after the safety number was compared.
+func (e *Encryption) trustContact(nameOrID string) error {
+	i, err := e.findContact(nameOrID)
+	if err != nil {
+		return err
+	}
+	ks := e.keystore()
+	ks.Contacts[i].Verified = true
+	ks.Contacts[i].KeyChanged = false
+	if err := e.saveKeystore(ks); err != nil {
+		return err
+	}
+	fmt.Printf("marked %s as verified\n", e.keys.Contacts[i].Username)
+	return nil
+}
+
+func (e *Encryption) listContacts(w io.Writer) {
+	fmt.Fprintf(w, "%s\t%s\t(v%d, %s)\n", e.keys.Username, e.keys.ID, e.loadedVersion, e.loadedKDF)
+	for _, ct := range e.keys.Contacts {
+		status := "unverified"
+		if ct.Verified {
+			status = "verified"
 		}
-		log.Printf("encrypted: %v\n", ciphertext)
-		plaintext, err := e.privateDecrypt(ciphertext)
-		if err != nil {
-			panic(err)
+		if ct.KeyChanged {
+			status = "KEY CHANGED"
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", ct.Username, ct.ID, status)
+	}
+}
+
+// verifyKeystore checks the key pair belongs together and round trips a message.
+func (e *Encryption) verifyKeystore() error {
+	if len(e.keys.ID) != 64 {
+		return fmt.Errorf("invalid id length %d", len(e.keys.ID))
+	}
+	if !e.keys.PrivateKey.PublicKey.Equals(e.keys.PublicKey) {
+		return errors.New("public key does not match private key")
+	}
+	plaintext := []byte("ogsma keystore verification")
+	ciphertext, err := ecies.Encrypt(e.keys.PublicKey, plaintext)
+	if err != nil {
+		return fmt.Errorf("encrypting with public key: %v", err)
+	}
+	decrypted, err := e.privateDecrypt(ciphertext)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		return errors.New("decrypted text does not match")
+	}
+	seen := map[string]bool{}
+	for _, ct := range e.keys.Contacts {
+		if seen[ct.ID] {
+			return fmt.Errorf("duplicate contact id %s", ct.ID)
 		}
-		log.Printf("decrypted: %s\n", string(plaintext))
+		seen[ct.ID] = true
 	}
+	fmt.Printf("%s ok: %s with %d contacts\n", e.keyStoreFile, e.keys.Username, len(e.keys.Contacts))
+	return nil
 }
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+	ecies "github.com/ecies/go/v2"
+	"ogsma_protocol/keystore"
+)
+
+// rotationDigest is what the previous key signs in a key-rotation keyshare.
+func rotationDigest(id, username string, previousPublicKey, publicKey []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("ogsma-key-rotation"))
+	for _, b := range [][]byte{[]byte(id), []byte(username), previousPublicKey, publicKey} {
+		h.Write([]byte{byte(len(b) >> 8), byte(len(b))})
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// changePassword re-encrypts the loaded keystore with a new password.
+func (e *Encryption) changePassword(newPassword string, kdf keystore.KDFParams) error {
+	if len(newPassword) == 0 {
+		return errors.New("new password is empty")
+	}
+	password, previousKDF := e.password, e.kdf
+	e.password = newPassword
+	e.kdf = kdf
+	if err := e.saveKeystore(e.keystore()); err != nil {
+		e.password, e.kdf = password, previousKDF
+		return err
+	}
+	fmt.Printf("password changed for %s\n", e.keyStoreFile)
+	return nil
+}
+
+// rotate replaces the key pair, keeping the old private key to decrypt backlog,
+// and writes a keyshare signed by the old key so contacts can accept the new one.
+// The keyshare is written to a temporary file before the keystore is saved and
+// only renamed into place after, so a failure never leaves a keystore whose new
+// key no keyshare announces.
+func (e *Encryption) rotate(filename string) error {
+	privateKey, publicKey, err := e.generateECCKeyPair()
+	if err != nil {
+		return fmt.Errorf("generating ecc keys: %v", err)
+	}
+	previousPrivateKey := e.keys.PrivateKey
+	previousPublicKey := e.keys.PublicKey.Bytes(false)
+	digest := rotationDigest(e.keys.ID, e.keys.Username, previousPublicKey, publicKey.Bytes(false))
+	signature := ecdsa.Sign(secp256k1.PrivKeyFromBytes(previousPrivateKey.Bytes()), digest)
+	if len(filename) == 0 {
+		filename = fmt.Sprintf("%s.keyshare", e.keys.Username)
+	}
+	tmp := filename + ".tmp"
+	if err := writeKeyShare(tmp, KeyShare{
+		ID:                e.keys.ID,
+		Username:          e.keys.Username,
+		PublicKey:         base64.StdEncoding.EncodeToString(publicKey.Bytes(false)),
+		PreviousPublicKey: base64.StdEncoding.EncodeToString(previousPublicKey),
+		Signature:         base64.StdEncoding.EncodeToString(signature.Serialize()),
+	}); err != nil {
+		return err
+	}
+	previousKeys := e.keys.PreviousKeys
+	e.keys.PreviousKeys = append(e.keys.PreviousKeys, previousPrivateKey)
+	e.keys.PrivateKey = privateKey
+	e.keys.PublicKey = publicKey
+	if err := e.saveKeystore(e.keystore()); err != nil {
+		os.Remove(tmp)
+		e.keys.PreviousKeys = previousKeys
+		e.keys.PrivateKey = previousPrivateKey
+		e.keys.PublicKey = previousPrivateKey.PublicKey
+		return err
+	}
+	if err := os.Rename(tmp, filename); err != nil {
+		return fmt.Errorf("the keystore is rotated but its keyshare is still in %s: %v", tmp, err)
+	}
+	fmt.Printf("rotated keys for %s, distribute %s to contacts\n", e.keys.Username, filename)
+	return nil
+}
+
+// verifyRotation checks a rotation keyshare against the public key we already hold for the contact.
+func verifyRotation(ks *KeyShare, current *ecies.PublicKey, publicKey []byte) error {
+	if len(ks.Signature) == 0 {
+		return errors.New("keyshare is not a signed key rotation")
+	}
+	previousPublicKey, err := base64.StdEncoding.DecodeString(ks.PreviousPublicKey)
+	if err != nil {
+		return fmt.Errorf("decoding previous public key: %v", err)
+	}
+	if !bytes.Equal(previousPublicKey, current.Bytes(false)) {
+		return errors.New("previous public key does not match stored key")
+	}
+	sig, err := base64.StdEncoding.DecodeString(ks.Signature)
+	if err != nil {
+		return fmt.Errorf("decoding signature: %v", err)
+	}
+	signature, err := ecdsa.ParseDERSignature(sig)
+	if err != nil {
+		return fmt.Errorf("parsing signature: %v", err)
+	}
+	signer, err := secp256k1.ParsePubKey(previousPublicKey)
+	if err != nil {
+		return fmt.Errorf("parsing previous public key: %v", err)
+	}
+	if !signature.Verify(rotationDigest(ks.ID, ks.Username, previousPublicKey, publicKey), signer) {
+		return errors.New("invalid rotation signature")
+	}
+	return nil
+}
+
+func writeKeyShare(filename string, shs KeyShare) error {
+	jsonBytes, err := json.MarshalIndent(shs, "", " ")
+	if err != nil {
+		return fmt.Errorf("marshaling keyshare: %v", err)
+	}
+	if err := os.WriteFile(filename, jsonBytes, 0600); err != nil {
+		return fmt.Errorf("writing keyshare: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	ecies "github.com/ecies/go/v2"
+	"ogsma_protocol/keystore"
+)
+
+// testKDF keeps the tests fast, the strength of the derivation isn't under test.
+var testKDF = keystore.KDFParams{Algorithm: keystore.PBKDF2, Time: 1000}
+
+// newTestKeystore writes a keystore for username to dir and loads it.
+func newTestKeystore(t *testing.T, dir, username, password string) *Encryption {
+	t.Helper()
+	e := &Encryption{keyStoreFile: filepath.Join(dir, username+".keystore"), password: password, kdf: testKDF}
+	if err := e.keyGen(username); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func readKeyShare(t *testing.T, filename string) *KeyShare {
+	t.Helper()
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks := &KeyShare{}
+	if err := json.Unmarshal(b, ks); err != nil {
+		t.Fatal(err)
+	}
+	return ks
+}
+
+func TestRotate(t *testing.T) {
+	dir := t.TempDir()
+	e := newTestKeystore(t, dir, "alice", "alice pw")
+	previous := e.keys.PublicKey
+	share := filepath.Join(dir, "alice.keyshare")
+	if err := e.rotate(share); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(share + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("rotation left the temporary keyshare: %v", err)
+	}
+
+	reopened := &Encryption{keyStoreFile: e.keyStoreFile, password: "alice pw"}
+	if err := reopened.loadKeys(); err != nil {
+		t.Fatal(err)
+	}
+	rotated := readKeyShare(t, share)
+	b, err := base64.StdEncoding.DecodeString(rotated.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey, err := ecies.NewPublicKeyFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !publicKey.Equals(reopened.keys.PublicKey) || publicKey.Equals(previous) {
+		t.Error("the keyshare doesn't carry the saved new key")
+	}
+	if len(reopened.keys.PreviousKeys) != 1 || !reopened.keys.PreviousKeys[0].PublicKey.Equals(previous) {
+		t.Error("the previous private key wasn't kept")
+	}
+
+	other, err := ecies.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name    string
+		change  func(ks *KeyShare)
+		current *ecies.PublicKey
+		err     string // err is a substring of the expected error
+	}{
+		{name: "valid", current: previous},
+		{name: "wrong previous key", current: other.PublicKey, err: "does not match stored key"},
+		{name: "unsigned", change: func(ks *KeyShare) { ks.Signature = "" }, current: previous, err: "not a signed key rotation"},
+		{name: "tampered username", change: func(ks *KeyShare) { ks.Username = "mallory" }, current: previous, err: "invalid rotation signature"},
+		{name: "tampered id", change: func(ks *KeyShare) { ks.ID = strings.Repeat("0", 64) }, current: previous, err: "invalid rotation signature"},
+		{name: "bad signature", change: func(ks *KeyShare) { ks.Signature = "c2lnbmF0dXJl" }, current: previous, err: "parsing signature"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ks := *rotated
+			if tc.change != nil {
+				tc.change(&ks)
+			}
+			err := verifyRotation(&ks, tc.current, publicKey.Bytes(false))
+			if len(tc.err) == 0 {
+				if err != nil {
+					t.Errorf("got %v, want the rotation accepted", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("got %v, want an error containing %q", err, tc.err)
+			}
+		})
+	}
+	// a key other than the one the previous key signed is refused too
+	if err := verifyRotation(rotated, previous, other.PublicKey.Bytes(false)); err == nil {
+		t.Error("accepted a rotation to a key the previous key didn't sign")
+	}
+}
+
+func TestRotateSaveFails(t *testing.T) {
+	dir := t.TempDir()
+	e := newTestKeystore(t, dir, "alice", "alice pw")
+	previous := e.keys.PublicKey
+	// a directory in the way of the keystore's temporary file makes saving fail
+	if err := os.Mkdir(e.keyStoreFile+".tmp", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	share := filepath.Join(dir, "alice.keyshare")
+	if err := e.rotate(share); err == nil {
+		t.Fatal("rotated without saving the keystore")
+	}
+	for _, f := range []string{share, share + ".tmp"} {
+		if _, err := os.Stat(f); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("failed rotation left %s: %v", filepath.Base(f), err)
+		}
+	}
+	if !e.keys.PublicKey.Equals(previous) || len(e.keys.PreviousKeys) != 0 {
+		t.Error("failed rotation changed the loaded keys")
+	}
+}
+
+func TestChangePassword(t *testing.T) {
+	e := newTestKeystore(t, t.TempDir(), "alice", "old pw")
+	if err := e.changePassword("", testKDF); err == nil || !strings.Contains(err.Error(), "new password is empty") {
+		t.Errorf("empty password: got %v", err)
+	}
+	if err := e.changePassword("new pw", testKDF); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		password string
+		ok       bool
+	}{
+		{"new pw", true},
+		{"old pw", false},
+	} {
+		reopened := &Encryption{keyStoreFile: e.keyStoreFile, password: tc.password}
+		err := reopened.loadKeys()
+		if tc.ok && err != nil {
+			t.Errorf("%q: %v", tc.password, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("%q still opens the keystore", tc.password)
+		}
+		if tc.ok && err == nil && !reopened.keys.PublicKey.Equals(e.keys.PublicKey) {
+			t.Errorf("%q opened another key", tc.password)
+		}
+	}
+}
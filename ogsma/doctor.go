@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"ogsma_protocol/keystore"
+)
+
+type ClientConfig struct {
+	Addr     string `json:"addr"`
+	KeyStore string `json:"keystore"`
+	Endpoint string `json:"endpoint"`
+}
+
+type Profile struct {
+	Name     string `json:"name"`
+	Addr     string `json:"addr"`
+	Endpoint string `json:"endpoint"`
+	KeyStore string `json:"keystore"`
+	Cert     string `json:"cert,omitempty"`
+}
+
+type ServerConfig struct {
+	Port       int               `json:"port"`
+	Endpoint   string            `json:"endpoint"`
+	CertFile   string            `json:"certFile"`
+	KeyFile    string            `json:"keyFile"`
+	Users      []string          `json:"users"`
+	UserKeys   map[string]string `json:"userKeys,omitempty"`
+	Federation *Federation       `json:"federation,omitempty"`
+	Store      *StoreConfig      `json:"store,omitempty"`
+	Limits     *Limits           `json:"limits,omitempty"`
+	Policy     *Policy           `json:"policy,omitempty"`
+	DeviceTTL  int               `json:"deviceTTL,omitempty"`
+}
+
+type Policy struct {
+	Mode   string              `json:"mode"`
+	Pairs  [][2]string         `json:"pairs,omitempty"`
+	Groups map[string][]string `json:"groups,omitempty"`
+}
+
+// allows mirrors the server's routing policy check.
+func (p *Policy) allows(from, to string) bool {
+	switch {
+	case p == nil || p.Mode == "" || p.Mode == "all" || from == to:
+		return true
+	case p.Mode == "acl":
+		return slices.Contains(p.Pairs, [2]string{from, to}) || slices.Contains(p.Pairs, [2]string{to, from})
+	}
+	for _, members := range p.Groups {
+		if slices.Contains(members, from) && slices.Contains(members, to) {
+			return true
+		}
+	}
+	return false
+}
+
+type Limits struct {
+	MaxMessageSize int64   `json:"maxMessageSize,omitempty"`
+	HelloTimeout   int     `json:"helloTimeout,omitempty"`
+	ConnectRate    float64 `json:"connectRate,omitempty"`
+	ConnectBurst   int     `json:"connectBurst,omitempty"`
+	FrameRate      float64 `json:"frameRate,omitempty"`
+	FrameBurst     int     `json:"frameBurst,omitempty"`
+	BanAfter       int     `json:"banAfter,omitempty"`
+	BanSeconds     int     `json:"banSeconds,omitempty"`
+	QueueFrames    int     `json:"queueFrames,omitempty"`
+}
+
+type StoreConfig struct {
+	Type string `json:"type"`
+	Path string `json:"path,omitempty"`
+}
+
+type Federation struct {
+	CAFile   string       `json:"caFile"`
+	CertFile string       `json:"certFile,omitempty"`
+	KeyFile  string       `json:"keyFile,omitempty"`
+	Peers    []PeerConfig `json:"peers"`
+
+	QueueFrames int   `json:"queueFrames,omitempty"`
+	QueueBytes  int64 `json:"queueBytes,omitempty"`
+	QueueTTL    int   `json:"queueTTL,omitempty"`
+}
+
+type PeerConfig struct {
+	Name  string   `json:"name"`
+	Addr  string   `json:"addr"`
+	Users []string `json:"users"`
+}
+
+// report collects everything wrong with one file so all problems are shown at once.
+type report struct {
+	file     string
+	problems []string
+	warnings []string
+}
+
+func (r *report) problem(format string, args ...any) {
+	r.problems = append(r.problems, fmt.Sprintf(format, args...))
+}
+
+func (r *report) warn(format string, args ...any) {
+	r.warnings = append(r.warnings, fmt.Sprintf(format, args...))
+}
+
+type doctorCheck struct {
+	certDir    string
+	warnBefore time.Duration
+	now        time.Time
+	pw         *passwordReader
+	server     *ServerConfig
+	serverCert *x509.Certificate
+	users      map[string]bool
+	peerUsers  map[string]string // user ID -> name of the peer server the user is on
+}
+
+func doctor(args []string) error {
+	d := &doctorCheck{now: time.Now(), pw: newPasswordReader(os.Stdin)}
+	var serverFile string
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	fs.StringVar(&serverFile, "server", "", "server config to check and cross-check clients against")
+	fs.StringVar(&d.certDir, "certdir", ".", "directory the server runs from, relative certFile and keyFile paths are resolved from it")
+	fs.DurationVar(&d.warnBefore, "warn", 30*24*time.Hour, "warn about certificates expiring within this duration")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ogsma doctor %s\n\nKeystore passwords are prompted for on a terminal, otherwise read one per line from stdin.\nAn empty password skips decrypting that keystore.\n\n", doctorArgs)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return errUsage
+	}
+	if len(serverFile) == 0 && fs.NArg() == 0 {
+		fs.Usage()
+		return errUsage
+	}
+	var reports []*report
+	if len(serverFile) > 0 {
+		reports = append(reports, d.checkServer(serverFile))
+	}
+	for _, f := range fs.Args() {
+		reports = append(reports, d.checkClient(f))
+	}
+	var problems int
+	for _, r := range reports {
+		problems += len(r.problems)
+		if len(r.problems) == 0 && len(r.warnings) == 0 {
+			fmt.Printf("%s: ok\n", r.file)
+			continue
+		}
+		fmt.Printf("%s:\n", r.file)
+		for _, p := range r.problems {
+			fmt.Printf("  error: %s\n", p)
+		}
+		for _, w := range r.warnings {
+			fmt.Printf("  warning: %s\n", w)
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+	return nil
+}
+
+func decodeStrict(filename string, v any) error {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	return d.Decode(v)
+}
+
+func checkEndpoint(r *report, endpoint string) {
+	switch {
+	case len(endpoint) == 0:
+		r.problem("endpoint is empty, set it to the websocket path the server listens on (config_gen defaults to \"ws\")")
+	case strings.HasPrefix(endpoint, "/"):
+		r.problem("endpoint %q starts with \"/\", which is added when dialing and serving, remove it", endpoint)
+	}
+}
+
+func (d *doctorCheck) checkCert(r *report, what string, cert *x509.Certificate) {
+	switch {
+	case d.now.After(cert.NotAfter):
+		r.problem("%s expired on %s, generate a new certificate and redistribute the profiles", what, cert.NotAfter.Format(time.DateOnly))
+	case d.now.Before(cert.NotBefore):
+		r.problem("%s is not valid until %s, check the clock of the machine that generated it", what, cert.NotBefore.Format(time.DateOnly))
+	case d.now.Add(d.warnBefore).After(cert.NotAfter):
+		r.warn("%s expires on %s", what, cert.NotAfter.Format(time.DateOnly))
+	}
+}
+
+func (d *doctorCheck) checkServer(filename string) *report {
+	r := &report{file: filename}
+	c := &ServerConfig{}
+	if err := decodeStrict(filename, c); err != nil {
+		r.problem("not a valid server config: %v", err)
+		return r
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		r.problem("port %d is out of range, set \"port\" to 1-65535", c.Port)
+	}
+	checkEndpoint(r, c.Endpoint)
+	if c.Store != nil {
+		switch c.Store.Type {
+		case "", "memory":
+		case "bolt", "sqlite":
+			if len(c.Store.Path) == 0 {
+				r.problem("store type %s needs a \"path\" for the database file", c.Store.Type)
+			}
+		default:
+			r.problem("unknown store type %q, use memory, bolt or sqlite", c.Store.Type)
+		}
+	}
+	if l := c.Limits; l != nil {
+		if l.MaxMessageSize < 0 || l.HelloTimeout < 0 || l.ConnectRate < 0 || l.ConnectBurst < 0 ||
+			l.FrameRate < 0 || l.FrameBurst < 0 || l.BanAfter < 0 || l.BanSeconds < 0 || l.QueueFrames < 0 {
+			r.problem("limits must not be negative, leave a field out to use its default")
+		}
+		if l.MaxMessageSize > 0 && l.MaxMessageSize < 4096 {
+			r.warn("maxMessageSize %d is small, messages with a self copy need about twice the text size plus 300 bytes", l.MaxMessageSize)
+		}
+	}
+	d.server = c
+	d.users = map[string]bool{}
+	if len(c.Users) == 0 {
+		r.problem("users is empty, the server will reject every client; generate it with config_gen -type server or deployment")
+	}
+	for _, u := range c.Users {
+		if d.users[u] {
+			r.problem("user %s is listed more than once", u)
+		}
+		d.users[u] = true
+		if _, ok := c.UserKeys[u]; !ok {
+			r.warn("user %s has no key in userKeys, the server refuses the user's new devices", u)
+		}
+	}
+	for _, u := range slices.Sorted(maps.Keys(c.UserKeys)) {
+		if _, err := base64.StdEncoding.DecodeString(c.UserKeys[u]); err != nil {
+			r.problem("userKeys of %s is not base64: %v", u, err)
+		} else if !d.users[u] {
+			r.warn("userKeys lists user %s that is not in users", u)
+		}
+	}
+	if c.DeviceTTL < 0 {
+		r.problem("deviceTTL must not be negative, leave it out to keep devices for 90 days")
+	}
+	if len(c.CertFile) == 0 || len(c.KeyFile) == 0 {
+		r.problem("certFile and keyFile are required, the server cannot start TLS without them")
+		return r
+	}
+	certFile, keyFile := d.serverPath(c.CertFile), d.serverPath(c.KeyFile)
+	missing := false
+	for _, f := range []string{certFile, keyFile} {
+		if _, err := os.Stat(f); err != nil {
+			r.problem("%v (relative paths are resolved from -certdir %s)", err, d.certDir)
+			missing = true
+		}
+	}
+	if missing {
+		return r
+	}
+	pair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		r.problem("cannot load %s with %s: %v", c.CertFile, c.KeyFile, err)
+		return r
+	}
+	if d.serverCert, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+		r.problem("cannot parse %s: %v", c.CertFile, err)
+		return r
+	}
+	d.checkCert(r, "server certificate", d.serverCert)
+	if c.Federation != nil {
+		d.checkFederation(r, c)
+	}
+	if c.Policy != nil {
+		d.checkPolicy(r, c.Policy)
+	}
+	return r
+}
+
+func (d *doctorCheck) checkPolicy(r *report, p *Policy) {
+	var listed []string
+	switch p.Mode {
+	case "", "all":
+	case "acl":
+		for _, pair := range p.Pairs {
+			listed = append(listed, pair[0], pair[1])
+		}
+	case "groups":
+		for _, members := range p.Groups {
+			listed = append(listed, members...)
+		}
+	default:
+		r.problem("unknown policy mode %q, use all, acl or groups", p.Mode)
+	}
+	for _, u := range listed {
+		if _, ok := d.peerUsers[u]; !ok && !d.users[u] {
+			r.warn("policy lists user %s that is not in users or on a federation peer", u)
+		}
+	}
+}
+
+func (d *doctorCheck) checkFederation(r *report, c *ServerConfig) {
+	f := c.Federation
+	d.peerUsers = map[string]string{}
+	if f.QueueFrames < 0 || f.QueueBytes < 0 || f.QueueTTL < 0 {
+		r.problem("federation queue limits must not be negative, leave a field out to use its default")
+	}
+	for _, p := range f.Peers {
+		if len(p.Name) == 0 {
+			r.problem("federation peer at %q has no name, set it to the CN of the peer's certificate", p.Addr)
+		}
+		if _, port, err := net.SplitHostPort(p.Addr); err != nil || len(port) == 0 {
+			r.problem("federation peer %s addr %q must be host:port", p.Name, p.Addr)
+		}
+		for _, u := range p.Users {
+			if d.users[u] {
+				r.problem("user %s is both local and on peer %s, list it on one server only", u, p.Name)
+			} else if other, ok := d.peerUsers[u]; ok {
+				r.problem("user %s is on peers %s and %s", u, other, p.Name)
+			}
+			d.peerUsers[u] = p.Name
+		}
+	}
+	pemBytes, err := os.ReadFile(d.serverPath(f.CAFile))
+	if err != nil {
+		r.problem("federation caFile: %v", err)
+		return
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pemBytes) {
+		r.problem("federation caFile %s has no PEM certificates", f.CAFile)
+		return
+	}
+	certFile, keyFile, leaf := f.CertFile, f.KeyFile, d.serverCert
+	if len(certFile) > 0 {
+		pair, err := tls.LoadX509KeyPair(d.serverPath(certFile), d.serverPath(keyFile))
+		if err != nil {
+			r.problem("cannot load federation cert %s with %s: %v", certFile, keyFile, err)
+			return
+		}
+		if leaf, err = x509.ParseCertificate(pair.Certificate[0]); err != nil {
+			r.problem("cannot parse %s: %v", certFile, err)
+			return
+		}
+		d.checkCert(r, "federation certificate", leaf)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots, KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}); err != nil {
+		r.problem("federation client certificate is not accepted by caFile, peers will refuse it: %v", err)
+	}
+	if _, err := d.serverCert.Verify(x509.VerifyOptions{Roots: roots}); err != nil {
+		r.problem("server certificate is not signed by the federation caFile, peers cannot connect: %v", err)
+	}
+}
+
+func (d *doctorCheck) serverPath(p string) string {
+	if filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(d.certDir, p)
+}
+
+// checkClient checks a client config, or a profile when the file has the .ogsma extension.
+func (d *doctorCheck) checkClient(filename string) *report {
+	r := &report{file: filename}
+	p := &Profile{}
+	if strings.EqualFold(filepath.Ext(filename), ".ogsma") {
+		if err := decodeStrict(filename, p); err != nil {
+			r.problem("not a valid profile: %v", err)
+			return r
+		}
+		if len(p.Name) == 0 {
+			r.problem("profile name is empty, regenerate it with config_gen -type profile -name <name>")
+		}
+		d.checkPinnedCert(r, p.Cert)
+	} else {
+		c := &ClientConfig{}
+		if err := decodeStrict(filename, c); err != nil {
+			r.problem("not a valid client config: %v", err)
+			return r
+		}
+		p.Addr, p.Endpoint, p.KeyStore = c.Addr, c.Endpoint, c.KeyStore
+	}
+	d.checkAddr(r, p.Addr)
+	checkEndpoint(r, p.Endpoint)
+	if d.server != nil && len(p.Endpoint) > 0 && p.Endpoint != d.server.Endpoint {
+		r.problem("endpoint %q does not match the server endpoint %q, dialing wss://%s/%s will fail", p.Endpoint, d.server.Endpoint, p.Addr, p.Endpoint)
+	}
+	d.checkKeystore(r, p.KeyStore)
+	return r
+}
+
+func (d *doctorCheck) checkAddr(r *report, addr string) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		r.problem("addr %q is not host:port, e.g. 10.1.10.194:8443", addr)
+		return
+	}
+	if len(host) == 0 {
+		r.problem("addr %q has no host", addr)
+	}
+	n, err := strconv.Atoi(port)
+	if err != nil || n < 1 || n > 65535 {
+		r.problem("addr %q has an invalid port", addr)
+		return
+	}
+	if d.server != nil && n != d.server.Port {
+		r.problem("addr port %d does not match the server port %d", n, d.server.Port)
+	}
+}
+
+func (d *doctorCheck) checkPinnedCert(r *report, certPEM string) {
+	if len(certPEM) == 0 {
+		r.warn("no pinned certificate, the client will only accept certificates trusted by the system")
+		return
+	}
+	block, _ := pem.Decode([]byte(certPEM))
+	if block == nil || block.Type != "CERTIFICATE" {
+		r.problem("cert is not a PEM certificate, regenerate the profile with -cert pointing at the server certificate")
+		return
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		r.problem("cannot parse the pinned cert: %v", err)
+		return
+	}
+	d.checkCert(r, "pinned certificate", cert)
+	if d.serverCert != nil && !bytes.Equal(cert.Raw, d.serverCert.Raw) {
+		r.problem("pinned certificate is not the server certificate, the client will refuse to connect; regenerate the profile with the current -cert")
+	}
+}
+
+func (d *doctorCheck) checkKeystore(r *report, encoded string) {
+	if len(encoded) == 0 {
+		r.problem("keystore is empty, generate one with keystore_gen init")
+		return
+	}
+	data := []byte(encoded)
+	// v1 keystores are hex "salt-iv-ciphertext", v2 ones are base64 encoded
+	if !strings.Contains(encoded, "-") {
+		var err error
+		if data, err = base64.StdEncoding.DecodeString(encoded); err != nil {
+			r.problem("keystore is not valid base64: %v", err)
+			return
+		}
+		if !keystore.IsV2(data) {
+			r.problem("keystore is not an ogsma keystore, it should be the base64 of a keystore_gen file")
+			return
+		}
+	} else {
+		r.warn("keystore is the old v1 format, upgrade it with keystore_gen migrate")
+	}
+	password, err := d.pw.read(fmt.Sprintf("Password for %s (empty to skip): ", r.file))
+	if err != nil {
+		r.problem("%v", err)
+		return
+	}
+	if len(password) == 0 {
+		r.warn("keystore was not decrypted, no password given")
+		return
+	}
+	ks, _, err := keystore.Read(password, data)
+	if err != nil {
+		r.problem("cannot open keystore: %v; check the password", err)
+		return
+	}
+	if d.server == nil {
+		return
+	}
+	if !d.users[string(ks.ID)] {
+		r.problem("keystore user %s (%s) is not in the server users, the server will reject it; regenerate the server config", ks.Username, ks.ID)
+	} else if k, ok := d.server.UserKeys[string(ks.ID)]; ok && k != base64.StdEncoding.EncodeToString(ks.PublicKey) {
+		r.problem("the server has another key for %s, it will refuse new devices; regenerate the server config after a key rotation", ks.Username)
+	}
+	for _, c := range ks.Contacts {
+		if _, ok := d.peerUsers[string(c.ID)]; !ok && !d.users[string(c.ID)] {
+			r.problem("contact %s (%s) is not in the server users, messages to them will be dropped", c.Username, c.ID)
+		} else if !d.server.Policy.allows(string(ks.ID), string(c.ID)) {
+			r.problem("the server policy does not allow messages to contact %s (%s), the server will reject them", c.Username, c.ID)
+		}
+	}
+}
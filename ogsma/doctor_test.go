@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"ogsma_protocol/keystore"
+)
+
+// writeCert writes a self-signed certificate usable both as a TLS server cert and as
+// its own federation CA to dir/name.crt and dir/name.key, and returns the PEM.
+func writeCert(t *testing.T, dir, name string, notBefore, notAfter time.Time) string {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             notBefore,
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := os.WriteFile(filepath.Join(dir, name+".crt"), certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return string(certPEM)
+}
+
+// sealTestKeystore encrypts ks as a base64 v2 keystore with a cheap PBKDF2 count.
+func sealTestKeystore(t *testing.T, password string, ks *keystore.Keystore) string {
+	t.Helper()
+	data, err := keystore.Write(password, keystore.KDFParams{Algorithm: keystore.PBKDF2, Time: 1000}, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+func testUserID(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+func writeJSONFile(t *testing.T, path string, v any) {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, b, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDoctorChecks(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	serverPEM := writeCert(t, dir, "server", now.Add(-time.Hour), now.AddDate(1, 0, 0))
+	otherPEM := writeCert(t, dir, "other", now.Add(-time.Hour), now.AddDate(1, 0, 0))
+	writeCert(t, dir, "expired", now.AddDate(-1, 0, 0), now.Add(-time.Hour))
+	writeCert(t, dir, "expiring", now.Add(-time.Hour), now.AddDate(0, 0, 7))
+	alice, bob, carol := testUserID("alice"), testUserID("bob"), testUserID("carol")
+	userKey := func(id string) string { return base64.StdEncoding.EncodeToString([]byte("key of " + id)) }
+	aliceKeystore := sealTestKeystore(t, "secret", &keystore.Keystore{
+		Username:  []byte("alice"),
+		ID:        []byte(alice),
+		PublicKey: []byte("key of " + alice),
+		Contacts:  []*keystore.StoreContact{{ID: []byte(bob), Username: []byte("bob")}},
+	})
+
+	for _, tc := range []struct {
+		name     string
+		server   func(c *ServerConfig) // server edits a valid server config, nil checks no server, userKeys are filled in unless set
+		client   func(p *Profile)      // client edits a valid profile, nil checks no client
+		plain    bool                  // plain writes the client as a client config instead of a profile
+		raw      string                // raw replaces the client file
+		password string
+		problems []string // problems and warnings are substrings of the reported ones, in order
+		warnings []string
+	}{
+		{name: "valid", server: func(*ServerConfig) {}, client: func(*Profile) {}, password: "secret"},
+		{name: "port out of range", server: func(c *ServerConfig) { c.Port = 70000 }, problems: []string{"port 70000 is out of range"}},
+		{name: "endpoint with slash", server: func(c *ServerConfig) { c.Endpoint = "/ws" }, problems: []string{`endpoint "/ws" starts with "/"`}},
+		{name: "empty endpoint", server: func(c *ServerConfig) { c.Endpoint = "" }, problems: []string{"endpoint is empty"}},
+		{name: "store without path", server: func(c *ServerConfig) { c.Store = &StoreConfig{Type: "bolt"} }, problems: []string{"store type bolt needs a \"path\""}},
+		{name: "unknown store", server: func(c *ServerConfig) { c.Store = &StoreConfig{Type: "redis"} }, problems: []string{`unknown store type "redis"`}},
+		{name: "negative limit", server: func(c *ServerConfig) { c.Limits = &Limits{FrameRate: -1} }, problems: []string{"limits must not be negative"}},
+		{name: "negative queue limit", server: func(c *ServerConfig) { c.Limits = &Limits{QueueFrames: -1} }, problems: []string{"limits must not be negative"}},
+		{name: "small messages", server: func(c *ServerConfig) { c.Limits = &Limits{MaxMessageSize: 1024} }, warnings: []string{"maxMessageSize 1024 is small"}},
+		{name: "no users", server: func(c *ServerConfig) { c.Users = nil }, problems: []string{"users is empty"}},
+		{name: "duplicate user", server: func(c *ServerConfig) { c.Users = append(c.Users, alice) }, problems: []string{"user " + alice + " is listed more than once"}},
+		{name: "no key file", server: func(c *ServerConfig) { c.KeyFile = "" }, problems: []string{"certFile and keyFile are required"}},
+		{name: "missing cert", server: func(c *ServerConfig) { c.CertFile = "missing.crt" }, problems: []string{"missing.crt"}},
+		{name: "mismatched key", server: func(c *ServerConfig) { c.KeyFile = "other.key" }, problems: []string{"cannot load server.crt with other.key"}},
+		{name: "expired cert", server: func(c *ServerConfig) { c.CertFile, c.KeyFile = "expired.crt", "expired.key" }, problems: []string{"server certificate expired"}},
+		{name: "expiring cert", server: func(c *ServerConfig) { c.CertFile, c.KeyFile = "expiring.crt", "expiring.key" }, warnings: []string{"server certificate expires"}},
+		{name: "user without a key", server: func(c *ServerConfig) { c.UserKeys = map[string]string{alice: userKey(alice)} }, warnings: []string{"user " + bob + " has no key in userKeys"}},
+		{name: "user key not base64", server: func(c *ServerConfig) { c.UserKeys = map[string]string{alice: "not*base64", bob: userKey(bob)} }, problems: []string{"userKeys of " + alice + " is not base64"}},
+		{name: "key of an unknown user", server: func(c *ServerConfig) {
+			c.UserKeys = map[string]string{alice: userKey(alice), bob: userKey(bob), carol: userKey(carol)}
+		}, warnings: []string{"userKeys lists user " + carol}},
+		{name: "negative device ttl", server: func(c *ServerConfig) { c.DeviceTTL = -1 }, problems: []string{"deviceTTL must not be negative"}},
+		{
+			name:     "server has another user key",
+			server:   func(c *ServerConfig) { c.UserKeys = map[string]string{alice: userKey(carol), bob: userKey(bob)} },
+			client:   func(*Profile) {},
+			password: "secret",
+			problems: []string{"the server has another key for alice"},
+		},
+		{name: "unknown config field", raw: `{"addr":"localhost:8443","endpoint":"ws","keystore":"","port":1}`, plain: true, problems: []string{"not a valid client config"}},
+		{
+			name: "federation",
+			server: func(c *ServerConfig) {
+				c.Federation = &Federation{CAFile: "server.crt", Peers: []PeerConfig{{Name: "b", Addr: "b.example:8443", Users: []string{carol}}}}
+				c.Policy = &Policy{Mode: "acl", Pairs: [][2]string{{alice, bob}, {alice, carol}}}
+			},
+		},
+		{
+			name: "federation queue limits",
+			server: func(c *ServerConfig) {
+				c.Federation = &Federation{CAFile: "server.crt", QueueFrames: 100, QueueBytes: -1}
+			},
+			problems: []string{"federation queue limits must not be negative"},
+		},
+		{
+			name: "federation user also local",
+			server: func(c *ServerConfig) {
+				c.Federation = &Federation{CAFile: "server.crt", Peers: []PeerConfig{{Name: "b", Addr: "b.example:8443", Users: []string{bob}}}}
+			},
+			problems: []string{"user " + bob + " is both local and on peer b"},
+		},
+		{
+			name: "federation user on two peers",
+			server: func(c *ServerConfig) {
+				c.Federation = &Federation{CAFile: "server.crt", Peers: []PeerConfig{
+					{Name: "b", Addr: "b.example:8443", Users: []string{carol}},
+					{Name: "c", Addr: "c.example:8443", Users: []string{carol}},
+				}}
+			},
+			problems: []string{"user " + carol + " is on peers b and c"},
+		},
+		{
+			name: "federation peer without name or port",
+			server: func(c *ServerConfig) {
+				c.Federation = &Federation{CAFile: "server.crt", Peers: []PeerConfig{{Addr: "b.example"}}}
+			},
+			problems: []string{`federation peer at "b.example" has no name`, `addr "b.example" must be host:port`},
+		},
+		{
+			name: "federation with another ca",
+			server: func(c *ServerConfig) {
+				c.Federation = &Federation{CAFile: "other.crt"}
+			},
+			problems: []string{"federation client certificate is not accepted by caFile", "server certificate is not signed by the federation caFile"},
+		},
+		{name: "federation without ca", server: func(c *ServerConfig) { c.Federation = &Federation{CAFile: "missing.crt"} }, problems: []string{"federation caFile"}},
+		{name: "unknown policy", server: func(c *ServerConfig) { c.Policy = &Policy{Mode: "friends"} }, problems: []string{`unknown policy mode "friends"`}},
+		{name: "policy lists unknown user", server: func(c *ServerConfig) {
+			c.Policy = &Policy{Mode: "groups", Groups: map[string][]string{"team": {alice, carol}}}
+		}, warnings: []string{"policy lists user " + carol}},
+		{
+			name:     "policy forbids contact",
+			server:   func(c *ServerConfig) { c.Policy = &Policy{Mode: "acl", Pairs: [][2]string{{alice, carol}}} },
+			client:   func(*Profile) {},
+			password: "secret",
+			problems: []string{"the server policy does not allow messages to contact bob"},
+			warnings: []string{"policy lists user " + carol},
+		},
+		{name: "contact not on server", server: func(c *ServerConfig) { c.Users = []string{alice} }, client: func(*Profile) {}, password: "secret", problems: []string{"contact bob (" + bob + ") is not in the server users"}},
+		{name: "user not on server", server: func(c *ServerConfig) { c.Users = []string{bob} }, client: func(*Profile) {}, password: "secret", problems: []string{"keystore user alice"}},
+		{name: "client port mismatch", server: func(*ServerConfig) {}, client: func(p *Profile) { p.Addr = "localhost:9443" }, problems: []string{"addr port 9443 does not match the server port 8443"}, warnings: []string{"not decrypted"}},
+		{name: "client endpoint mismatch", server: func(*ServerConfig) {}, client: func(p *Profile) { p.Endpoint = "chat" }, problems: []string{`endpoint "chat" does not match the server endpoint "ws"`}, warnings: []string{"not decrypted"}},
+		{name: "client addr without port", client: func(p *Profile) { p.Addr = "localhost" }, problems: []string{`addr "localhost" is not host:port`}, warnings: []string{"not decrypted"}},
+		{name: "client addr without host", client: func(p *Profile) { p.Addr = ":8443" }, problems: []string{`addr ":8443" has no host`}, warnings: []string{"not decrypted"}},
+		{name: "client addr with bad port", client: func(p *Profile) { p.Addr = "localhost:http" }, problems: []string{`addr "localhost:http" has an invalid port`}, warnings: []string{"not decrypted"}},
+		{name: "profile without name", client: func(p *Profile) { p.Name = "" }, problems: []string{"profile name is empty"}, warnings: []string{"not decrypted"}},
+		{name: "profile without cert", client: func(p *Profile) { p.Cert = "" }, warnings: []string{"no pinned certificate", "not decrypted"}},
+		{name: "profile with invalid cert", client: func(p *Profile) { p.Cert = "not pem" }, problems: []string{"cert is not a PEM certificate"}, warnings: []string{"not decrypted"}},
+		{name: "profile pinning another cert", server: func(*ServerConfig) {}, client: func(p *Profile) { p.Cert = otherPEM }, problems: []string{"pinned certificate is not the server certificate"}, warnings: []string{"not decrypted"}},
+		{name: "client config", client: func(*Profile) {}, plain: true, password: "secret"},
+		{name: "wrong password", client: func(*Profile) {}, password: "guess", problems: []string{"cannot open keystore"}},
+		{name: "empty keystore", client: func(p *Profile) { p.KeyStore = "" }, problems: []string{"keystore is empty"}},
+		{name: "keystore not base64", client: func(p *Profile) { p.KeyStore = "not*base64" }, problems: []string{"keystore is not valid base64"}},
+		{name: "keystore not ogsma", client: func(p *Profile) { p.KeyStore = base64.StdEncoding.EncodeToString([]byte("something else")) }, problems: []string{"keystore is not an ogsma keystore"}},
+		{name: "v1 keystore", client: func(p *Profile) { p.KeyStore = "00-00-00" }, warnings: []string{"old v1 format", "not decrypted"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := &doctorCheck{
+				certDir:    dir,
+				warnBefore: 30 * 24 * time.Hour,
+				now:        now,
+				pw:         &passwordReader{in: bufio.NewReader(strings.NewReader(tc.password + "\n"))},
+			}
+			var reports []*report
+			if tc.server != nil {
+				c := &ServerConfig{Port: 8443, Endpoint: "ws", CertFile: "server.crt", KeyFile: "server.key", Users: []string{alice, bob}}
+				tc.server(c)
+				if c.UserKeys == nil {
+					c.UserKeys = map[string]string{}
+					for _, u := range c.Users {
+						c.UserKeys[u] = userKey(u)
+					}
+				}
+				file := filepath.Join(t.TempDir(), "server.json")
+				writeJSONFile(t, file, c)
+				reports = append(reports, d.checkServer(file))
+			}
+			if tc.client != nil || len(tc.raw) > 0 {
+				p := &Profile{Name: "alice", Addr: "localhost:8443", Endpoint: "ws", KeyStore: aliceKeystore, Cert: serverPEM}
+				if tc.client != nil {
+					tc.client(p)
+				}
+				file := filepath.Join(t.TempDir(), "alice.ogsma")
+				if tc.plain {
+					file = filepath.Join(filepath.Dir(file), "alice.json")
+				}
+				switch {
+				case len(tc.raw) > 0:
+					if err := os.WriteFile(file, []byte(tc.raw), 0o600); err != nil {
+						t.Fatal(err)
+					}
+				case tc.plain:
+					writeJSONFile(t, file, &ClientConfig{Addr: p.Addr, KeyStore: p.KeyStore, Endpoint: p.Endpoint})
+				default:
+					writeJSONFile(t, file, p)
+				}
+				reports = append(reports, d.checkClient(file))
+			}
+			var problems, warnings []string
+			for _, r := range reports {
+				problems = append(problems, r.problems...)
+				warnings = append(warnings, r.warnings...)
+			}
+			if !matches(problems, tc.problems) {
+				t.Errorf("problems %q, want %q", problems, tc.problems)
+			}
+			if !matches(warnings, tc.warnings) {
+				t.Errorf("warnings %q, want %q", warnings, tc.warnings)
+			}
+		})
+	}
+}
+
+// matches reports whether every reported message contains the wanted substring at its position.
+func matches(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if !strings.Contains(got[i], want[i]) {
+			return false
+		}
+	}
+	return true
+}
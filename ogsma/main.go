@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var errUsage = errors.New("usage")
+
+type command struct {
+	args string
+	help string
+	run  func(args []string) error
+}
+
+const doctorArgs = "[-server <server_config.json>] [client configs and profiles...]"
+
+var commands = map[string]*command{
+	"doctor": {doctorArgs, "check configs, certificates and keystores", doctor},
+}
+
+// passwordReader prompts on the terminal without echo, or reads one password per line
+// from stdin when it is not a terminal so scripts can pipe passwords in.
+type passwordReader struct {
+	fd  int
+	tty bool
+	in  *bufio.Reader
+}
+
+func newPasswordReader(f *os.File) *passwordReader {
+	return &passwordReader{
+		fd:  int(f.Fd()),
+		tty: term.IsTerminal(int(f.Fd())),
+		in:  bufio.NewReader(f),
+	}
+}
+
+func (p *passwordReader) read(prompt string) (string, error) {
+	if p.tty {
+		fmt.Fprint(os.Stderr, prompt)
+		b, err := term.ReadPassword(p.fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", fmt.Errorf("reading password: %v", err)
+		}
+		return string(b), nil
+	}
+	line, err := p.in.ReadString('\n')
+	if err == io.EOF && len(line) == 0 {
+		return "", nil
+	}
+	if err != nil && err != io.EOF {
+		return "", fmt.Errorf("reading password from stdin: %v", err)
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: ogsma <command> [flags] [args]\n\ncommands:\n")
+	for name, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-8s %s\n           %s\n", name, c.help, c.args)
+	}
+}
+
+func run(args []string) error {
+	if len(args) == 0 {
+		usage()
+		return errUsage
+	}
+	c, ok := commands[args[0]]
+	if !ok {
+		usage()
+		return errUsage
+	}
+	return c.run(args[1:])
+}
+
+func main() {
+	if err := run(os.Args[1:]); err != nil {
+		if errors.Is(err, errUsage) {
+			os.Exit(2)
+		}
+		fmt.Fprintf(os.Stderr, "ogsma: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,59 @@
+package keystore
+
+import (
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+const fingerprintIterations = 5200
+
+// Fingerprint is 30 digits derived from one party's public key and id.
+func Fingerprint(id string, publicKey []byte) string {
+	h := sha512.New()
+	h.Write([]byte{0, 0})
+	h.Write(publicKey)
+	h.Write([]byte(id))
+	digest := h.Sum(nil)
+	for i := 0; i < fingerprintIterations; i++ {
+		h.Reset()
+		h.Write(digest)
+		h.Write(publicKey)
+		digest = h.Sum(nil)
+	}
+	var b strings.Builder
+	for i := 0; i < 6; i++ {
+		chunk := make([]byte, 8)
+		copy(chunk[3:], digest[i*5:i*5+5])
+		fmt.Fprintf(&b, "%05d", binary.BigEndian.Uint64(chunk)%100000)
+	}
+	return b.String()
+}
+
+// SafetyNumber is the same 60 digit number on both sides of a conversation,
+// the two halves are ordered so neither party's view depends on who is local.
+func SafetyNumber(localID string, localKey []byte, remoteID string, remoteKey []byte) string {
+	local := Fingerprint(localID, localKey)
+	remote := Fingerprint(remoteID, remoteKey)
+	if local > remote {
+		local, remote = remote, local
+	}
+	return local + remote
+}
+
+// FormatSafetyNumber splits the number into groups of five digits, four groups per line.
+func FormatSafetyNumber(number string) string {
+	var b strings.Builder
+	for i := 0; i < len(number); i += 5 {
+		if i > 0 {
+			if i%20 == 0 {
+				b.WriteString("\n")
+			} else {
+				b.WriteString(" ")
+			}
+		}
+		b.WriteString(number[i:min(i+5, len(number))])
+	}
+	return b.String()
+}
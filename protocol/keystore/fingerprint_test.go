@@ -0,0 +1,42 @@
+package keystore
+
+import "testing"
+
+func TestSafetyNumber(t *testing.T) {
+	alice, bob := []byte("alice key"), []byte("bob key")
+	want := SafetyNumber("alice", alice, "bob", bob)
+	// the number is compared between installs, so it must never change for the same keys
+	if want != "451845515328217301593654098441680336273571518137290507652087" {
+		t.Errorf("safety number %s changed for fixed keys", want)
+	}
+	if got := SafetyNumber("bob", bob, "alice", alice); got != want {
+		t.Errorf("bob sees %s, alice sees %s", got, want)
+	}
+	for _, tc := range []struct {
+		name                string
+		localKey, remoteKey []byte
+		localID, remoteID   string
+	}{
+		{"local key changed", []byte("alice new key"), bob, "alice", "bob"},
+		{"remote key changed", alice, []byte("bob new key"), "alice", "bob"},
+		{"id changed", alice, bob, "alice", "mallory"},
+	} {
+		if got := SafetyNumber(tc.localID, tc.localKey, tc.remoteID, tc.remoteKey); got == want || len(got) != 60 {
+			t.Errorf("%s: got %s, want another 60 digit number", tc.name, got)
+		}
+	}
+}
+
+func TestFormatSafetyNumber(t *testing.T) {
+	for _, tc := range []struct {
+		number, want string
+	}{
+		{"", ""},
+		{"1234", "1234"},
+		{"123456789012345678901234567890", "12345 67890 12345 67890\n12345 67890"},
+	} {
+		if got := FormatSafetyNumber(tc.number); got != tc.want {
+			t.Errorf("%q: got %q, want %q", tc.number, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+// Package keystore reads and writes the encrypted keystores shared by keystore_gen,
+// config_gen, the doctor and the client.
+package keystore
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Keystore v2 layout, the header is authenticated as AES-GCM additional data:
+//
+//	magic "OGKS" | version u8 | kdf u8 | time u32 | memory u32 | threads u8 | salt len u8 | salt | nonce [12] | ciphertext
+//
+// The ciphertext is a gob encoded Keystore. v1 stores are the hex "salt-iv-ciphertext"
+// string with a JSON Keystore and a fixed PBKDF2 iteration count.
+const (
+	Magic      = "OGKS"
+	Version    = 2
+	PBKDF2     = 1
+	Argon2id   = 2
+	LegacyIter = 100000 // LegacyIter is the PBKDF2 iteration count of v1 keystores
+	NonceSize  = 12
+	SaltSize   = 16
+
+	// Limits on the KDF parameters read from a keystore header, a crafted file could
+	// otherwise ask for terabytes of memory before the password is checked.
+	maxArgon2Time    = 16
+	maxArgon2Memory  = 1 << 20 // KiB, 1 GiB
+	maxArgon2Threads = 16
+	maxPBKDF2Iter    = 10000000
+)
+
+type Keystore struct {
+	Username            []byte          `json:"username"`
+	ID                  []byte          `json:"id"`
+	PublicKey           []byte          `json:"publicKey"`
+	PrivateKey          []byte          `json:"privateKey"`
+	PreviousPrivateKeys [][]byte        `json:"previousPrivateKeys"` // PreviousPrivateKeys are kept after rotation to decrypt backlog
+	Contacts            []*StoreContact `json:"contacts"`
+}
+
+type StoreContact struct {
+	PublicKey  []byte `json:"publicKey"`
+	ID         []byte `json:"id"`
+	Username   []byte `json:"username"`
+	Verified   bool   `json:"verified"`   // Verified is set once the safety number was compared out of band
+	KeyChanged bool   `json:"keyChanged"` // KeyChanged is set when the public key was replaced, until verified again
+}
+
+type KDFParams struct {
+	Algorithm uint8
+	Time      uint32 // Time is the PBKDF2 iteration count or the Argon2id time cost
+	Memory    uint32 // Memory is the Argon2id memory cost in KiB
+	Threads   uint8
+}
+
+// DefaultKDFParams returns the parameters new keystores use for an algorithm name.
+func DefaultKDFParams(algorithm string) (KDFParams, error) {
+	switch algorithm {
+	case "argon2id":
+		return KDFParams{Algorithm: Argon2id, Time: 3, Memory: 64 * 1024, Threads: 4}, nil
+	case "pbkdf2":
+		return KDFParams{Algorithm: PBKDF2, Time: 600000}, nil
+	default:
+		return KDFParams{}, fmt.Errorf("unsupported kdf: %s (argon2id, pbkdf2)", algorithm)
+	}
+}
+
+func (p KDFParams) String() string {
+	switch p.Algorithm {
+	case Argon2id:
+		return fmt.Sprintf("argon2id t=%d m=%dKiB p=%d", p.Time, p.Memory, p.Threads)
+	case PBKDF2:
+		return fmt.Sprintf("pbkdf2-sha256 iter=%d", p.Time)
+	default:
+		return fmt.Sprintf("unknown kdf %d", p.Algorithm)
+	}
+}
+
+func (p KDFParams) deriveKey(password string, salt []byte) ([]byte, error) {
+	switch p.Algorithm {
+	case Argon2id:
+		if p.Time == 0 || p.Memory == 0 || p.Threads == 0 {
+			return nil, errors.New("invalid argon2id parameters")
+		}
+		return argon2.IDKey([]byte(password), salt, p.Time, p.Memory, p.Threads, 32), nil
+	case PBKDF2:
+		if p.Time == 0 {
+			return nil, errors.New("invalid pbkdf2 parameters")
+		}
+		return pbkdf2.Key(sha256.New, password, salt, int(p.Time), 32)
+	default:
+		return nil, fmt.Errorf("unsupported kdf algorithm %d", p.Algorithm)
+	}
+}
+
+func (p KDFParams) header(salt, nonce []byte) []byte {
+	h := make([]byte, 0, 16+len(salt)+len(nonce))
+	h = append(h, Magic...)
+	h = append(h, Version, p.Algorithm)
+	h = binary.BigEndian.AppendUint32(h, p.Time)
+	h = binary.BigEndian.AppendUint32(h, p.Memory)
+	h = append(h, p.Threads, byte(len(salt)))
+	h = append(h, salt...)
+	return append(h, nonce...)
+}
+
+// checkLimits rejects KDF parameters above the limits, before any key is derived.
+func (p KDFParams) checkLimits() error {
+	switch {
+	case p.Algorithm == Argon2id && (p.Time > maxArgon2Time || p.Memory > maxArgon2Memory || p.Threads > maxArgon2Threads):
+		return fmt.Errorf("argon2id parameters t=%d m=%dKiB p=%d exceed the limits", p.Time, p.Memory, p.Threads)
+	case p.Algorithm == PBKDF2 && p.Time > maxPBKDF2Iter:
+		return fmt.Errorf("pbkdf2 iteration count %d exceeds the limit", p.Time)
+	}
+	return nil
+}
+
+// IsV2 reports whether data starts with the v2 magic.
+func IsV2(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(Magic))
+}
+
+// Seal encrypts plaintext as a v2 keystore with a fresh salt and nonce.
+func Seal(password string, p KDFParams, plaintext []byte) ([]byte, error) {
+	salt := make([]byte, SaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, fmt.Errorf("error generating salt: %v", err)
+	}
+	nonce := make([]byte, NonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	key, err := p.deriveKey(password, salt)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key: %v", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := p.header(salt, nonce)
+	return gcm.Seal(header, nonce, plaintext, header), nil
+}
+
+// Open decrypts a v2 keystore and returns the parameters it was sealed with.
+func Open(password string, data []byte) ([]byte, KDFParams, error) {
+	p := KDFParams{}
+	if len(data) < 16 || !IsV2(data) {
+		return nil, p, errors.New("invalid data: not a v2 keystore")
+	}
+	if data[4] != Version {
+		return nil, p, fmt.Errorf("unsupported keystore version %d", data[4])
+	}
+	p.Algorithm = data[5]
+	p.Time = binary.BigEndian.Uint32(data[6:10])
+	p.Memory = binary.BigEndian.Uint32(data[10:14])
+	p.Threads = data[14]
+	saltLen := int(data[15])
+	if saltLen == 0 {
+		return nil, p, errors.New("invalid data: empty salt")
+	}
+	headerLen := 16 + saltLen + NonceSize
+	if len(data) < headerLen {
+		return nil, p, errors.New("invalid data: truncated header")
+	}
+	if err := p.checkLimits(); err != nil {
+		return nil, p, err
+	}
+	salt := data[16 : 16+saltLen]
+	nonce := data[16+saltLen : headerLen]
+	key, err := p.deriveKey(password, salt)
+	if err != nil {
+		return nil, p, fmt.Errorf("error deriving key: %v", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, p, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, data[headerLen:], data[:headerLen])
+	if err != nil {
+		return nil, p, fmt.Errorf("decrypt failed: %v", err)
+	}
+	return plaintext, p, nil
+}
+
+// ParseV1 splits a v1 "salt-iv-ciphertext" hex keystore.
+func ParseV1(data []byte) (salt, iv, ciphertext []byte, err error) {
+	parts := bytes.Split(bytes.TrimSpace(data), []byte("-"))
+	if len(parts) != 3 {
+		return nil, nil, nil, errors.New("invalid data: expected salt-iv-ciphertext")
+	}
+	var decoded [3][]byte
+	for i, name := range []string{"salt", "iv", "ciphertext"} {
+		decoded[i] = make([]byte, hex.DecodedLen(len(parts[i])))
+		if _, err := hex.Decode(decoded[i], parts[i]); err != nil {
+			return nil, nil, nil, fmt.Errorf("invalid data: %s %v", name, err)
+		}
+	}
+	if len(decoded[1]) != NonceSize {
+		return nil, nil, nil, errors.New("invalid data: iv must be 12 bytes")
+	}
+	return decoded[0], decoded[1], decoded[2], nil
+}
+
+// OpenV1 decrypts a v1 keystore.
+func OpenV1(password string, data []byte) ([]byte, error) {
+	salt, iv, ciphertext, err := ParseV1(data)
+	if err != nil {
+		return nil, err
+	}
+	key, err := KDFParams{Algorithm: PBKDF2, Time: LegacyIter}.deriveKey(password, salt)
+	if err != nil {
+		return nil, fmt.Errorf("error deriving key: %v", err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, iv, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("decrypt failed: %v", err)
+	}
+	return plaintext, nil
+}
+
+// Read decrypts a v2 keystore or a v1 hex string. v1 keystores report the
+// fixed parameters they were derived with.
+func Read(password string, data []byte) (*Keystore, KDFParams, error) {
+	ks := &Keystore{}
+	if IsV2(data) {
+		plaintext, p, err := Open(password, data)
+		if err != nil {
+			return nil, p, err
+		}
+		if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(ks); err != nil {
+			return nil, p, fmt.Errorf("decoding keystore: %v", err)
+		}
+		return ks, p, nil
+	}
+	p := KDFParams{Algorithm: PBKDF2, Time: LegacyIter}
+	plaintext, err := OpenV1(password, data)
+	if err != nil {
+		return nil, p, err
+	}
+	if err := json.Unmarshal(plaintext, ks); err != nil {
+		return nil, p, fmt.Errorf("unmarshaling keystore: %v", err)
+	}
+	return ks, p, nil
+}
+
+// Write encrypts ks as a v2 keystore.
+func Write(password string, p KDFParams, ks *Keystore) ([]byte, error) {
+	var plaintext bytes.Buffer
+	if err := gob.NewEncoder(&plaintext).Encode(ks); err != nil {
+		return nil, fmt.Errorf("encoding keystore: %v", err)
+	}
+	return Seal(password, p, plaintext.Bytes())
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes.NewCipher: %w", err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("NewGCM: %w", err)
+	}
+	return gcm, nil
+}
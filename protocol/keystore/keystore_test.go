@@ -0,0 +1,144 @@
+package keystore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// sealV1 encrypts ks the way v1 keystores were written.
+func sealV1(t *testing.T, password string, ks *Keystore) []byte {
+	t.Helper()
+	plaintext, err := json.Marshal(ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	salt, iv := make([]byte, 8), make([]byte, NonceSize)
+	rand.Read(salt)
+	rand.Read(iv)
+	key, err := KDFParams{Algorithm: PBKDF2, Time: LegacyIter}.deriveKey(password, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []byte(hex.EncodeToString(salt) + "-" + hex.EncodeToString(iv) + "-" + hex.EncodeToString(gcm.Seal(nil, iv, plaintext, nil)))
+}
+
+func TestSealOpen(t *testing.T) {
+	for _, kdf := range []string{"argon2id", "pbkdf2"} {
+		p, err := DefaultKDFParams(kdf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := Seal("secret", p, []byte("keys"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		plaintext, got, err := Open("secret", data)
+		if err != nil || string(plaintext) != "keys" || got != p {
+			t.Errorf("%s: opened %q with %v, %v", kdf, plaintext, got, err)
+		}
+		if _, _, err := Open("wrong", data); err == nil {
+			t.Errorf("%s: opened with the wrong password", kdf)
+		}
+	}
+	if _, err := DefaultKDFParams("scrypt"); err == nil {
+		t.Error("accepted an unknown kdf")
+	}
+}
+
+func TestOpenHostileHeader(t *testing.T) {
+	for _, tc := range []struct {
+		p    KDFParams
+		salt int
+		err  string // err is a substring of the expected error
+	}{
+		{KDFParams{Algorithm: Argon2id, Time: 1, Memory: 0xFFFFFFFF, Threads: 1}, SaltSize, "exceed"},
+		{KDFParams{Algorithm: Argon2id, Time: 0xFFFFFFFF, Memory: 64, Threads: 1}, SaltSize, "exceed"},
+		{KDFParams{Algorithm: Argon2id, Time: 1, Memory: 64, Threads: 255}, SaltSize, "exceed"},
+		{KDFParams{Algorithm: PBKDF2, Time: 0xFFFFFFFF}, SaltSize, "exceed"},
+		{KDFParams{Algorithm: PBKDF2, Time: 1000}, 0, "empty salt"},
+		{KDFParams{Algorithm: 7, Time: 1}, SaltSize, "unsupported kdf"},
+		// parameters within the limits get as far as decrypting
+		{KDFParams{Algorithm: Argon2id, Time: 1, Memory: 64, Threads: 1}, SaltSize, "decrypt failed"},
+	} {
+		// the parameters are only in the header, no key is derived when building it
+		data := append(tc.p.header(make([]byte, tc.salt), make([]byte, NonceSize)), make([]byte, 32)...)
+		if _, _, err := Open("secret", data); err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v with a %d byte salt: got %v, want an error containing %q", tc.p, tc.salt, err, tc.err)
+		}
+	}
+	for _, data := range [][]byte{[]byte(Magic), append([]byte(Magic), 1, PBKDF2, 0, 0, 0, 1, 0, 0, 0, 0, 0, 16)} {
+		if _, _, err := Open("secret", data); err == nil {
+			t.Errorf("%x: opened a truncated or unsupported keystore", data)
+		}
+	}
+}
+
+func TestParseV1(t *testing.T) {
+	iv := strings.Repeat("00", NonceSize)
+	for _, tc := range []struct {
+		keystore string
+		valid    bool
+	}{
+		{"x-", false},
+		{"-", false},
+		{"aa-" + iv, false},
+		{"zz-" + iv + "-aa", false},
+		{"aa-00-aa", false},
+		{"aa-" + iv + "-aa", true},
+		{"aa-" + iv + "-aa\n", true},
+	} {
+		if _, _, _, err := ParseV1([]byte(tc.keystore)); (err == nil) != tc.valid {
+			t.Errorf("%q: got %v, want valid %v", tc.keystore, err, tc.valid)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	ks := &Keystore{
+		Username:  []byte("alice"),
+		ID:        []byte("alice id"),
+		PublicKey: []byte("public"),
+		Contacts:  []*StoreContact{{Username: []byte("bob"), ID: []byte("bob id"), PublicKey: []byte("bob public"), Verified: true}},
+	}
+	fast := KDFParams{Algorithm: PBKDF2, Time: 1000}
+	v2, err := Write("secret", fast, ks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name string
+		data []byte
+		kdf  KDFParams
+	}{
+		{"v1", sealV1(t, "secret", ks), KDFParams{Algorithm: PBKDF2, Time: LegacyIter}},
+		{"v2", v2, fast},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, p, err := Read("secret", tc.data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != tc.kdf {
+				t.Errorf("kdf %v, want %v", p, tc.kdf)
+			}
+			if !bytes.Equal(got.Username, ks.Username) || len(got.Contacts) != 1 || !got.Contacts[0].Verified ||
+				!bytes.Equal(got.Contacts[0].PublicKey, ks.Contacts[0].PublicKey) {
+				t.Errorf("read %+v, want %+v", got, ks)
+			}
+			if _, _, err := Read("wrong", tc.data); err == nil || !strings.Contains(err.Error(), "decrypt failed") {
+				t.Errorf("wrong password: got %v", err)
+			}
+		})
+	}
+	if _, _, err := Read("secret", []byte("not a keystore")); err == nil {
+		t.Error("read garbage as a keystore")
+	}
+}
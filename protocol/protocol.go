@@ -0,0 +1,307 @@
+// Package protocol holds the frames spoken between the server, client and bench.
+// PROTOCOL.md in the repository root describes them.
+package protocol
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+	"github.com/decred/dcrd/dcrec/secp256k1/v4/ecdsa"
+)
+
+const (
+	// ProtocolVersion is the newest protocol version spoken, MinProtocolVersion the oldest still accepted.
+	ProtocolVersion    = 3
+	MinProtocolVersion = 1
+
+	// EncodingBinary frames are only negotiated from version 2, JSON is always understood.
+	EncodingJSON   = "json"
+	EncodingBinary = "binary"
+
+	FrameHello    = "hello"
+	FrameWelcome  = "welcome"
+	FrameMessage  = "message"
+	FrameAck      = "ack"
+	FrameError    = "error"
+	FramePresence = "presence"
+	FrameReceipt  = "receipt"
+	FrameTyping   = "typing"
+
+	// Close codes sent with the close frame when the handshake fails.
+	CloseUnsupportedVersion = 4000
+	CloseInvalidHello       = 4001
+	CloseUnknownUser        = 4003
+	CloseInvalidDevice      = 4004
+
+	// Codes carried by error frames.
+	ErrUnknownType  = "unknown_type"
+	ErrInvalidFrame = "invalid_frame"
+	ErrForbidden    = "forbidden"
+	ErrRateLimited  = "rate_limited"
+	ErrQueueFull    = "queue_full"
+	ErrUnknownUser  = "unknown_user"
+)
+
+// Frame holds the fields common to every frame, it is decoded first to route a
+// frame without decoding the rest of it.
+type Frame struct {
+	Type string `json:"type"`
+	ID   string `json:"id,omitempty"` // ID is the user the frame is addressed to
+	From string `json:"from,omitempty"`
+	Ref  string `json:"ref,omitempty"`
+	// Expires is when a message is dropped from the server's queues, zero keeps it until delivered
+	Expires time.Time `json:"expires,omitzero"`
+}
+
+// Hello is the first frame a client sends, listing the protocol versions and encodings it speaks.
+// Devices with a key sign the hello with it, see SignHello, and new devices carry
+// a grant from the user's identity key, see GrantDevice.
+type Hello struct {
+	Type      string   `json:"type"`
+	ID        string   `json:"id"`
+	Device    string   `json:"device"`
+	Versions  []int    `json:"versions"`
+	Encodings []string `json:"encodings,omitempty"`
+	Key       []byte   `json:"key,omitempty"`  // Key is the device's ed25519 public key
+	Time      int64    `json:"time,omitempty"` // Time is when the hello was signed, in Unix seconds
+	Sig       []byte   `json:"sig,omitempty"`
+	Grant     []byte   `json:"grant,omitempty"` // Grant is the identity key's DER signature of the device key
+}
+
+func (h *Hello) signed() []byte {
+	return fmt.Appendf(nil, "ogsma hello\x00%s\x00%s\x00%d", h.ID, h.Device, h.Time)
+}
+
+// SignHello sets the device key of h and signs the user, device and time with it.
+func SignHello(h *Hello, key ed25519.PrivateKey, t time.Time) {
+	h.Key = key.Public().(ed25519.PublicKey)
+	h.Time = t.Unix()
+	h.Sig = ed25519.Sign(key, h.signed())
+}
+
+// VerifyHello checks the signature of a hello carrying a device key, signed no
+// further than skew from now.
+func VerifyHello(h *Hello, now time.Time, skew time.Duration) error {
+	if len(h.Key) != ed25519.PublicKeySize {
+		return errors.New("invalid device key")
+	}
+	if d := now.Sub(time.Unix(h.Time, 0)); d > skew || d < -skew {
+		return errors.New("hello signed at the wrong time, check the device clock")
+	}
+	if !ed25519.Verify(h.Key, h.signed(), h.Sig) {
+		return errors.New("invalid hello signature")
+	}
+	return nil
+}
+
+// grantDigest is what the user's identity key signs to let a device key register.
+func grantDigest(id, device string, key []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte("ogsma-device-grant"))
+	for _, b := range [][]byte{[]byte(id), []byte(device), key} {
+		h.Write([]byte{byte(len(b) >> 8), byte(len(b))})
+		h.Write(b)
+	}
+	return h.Sum(nil)
+}
+
+// GrantDevice signs the user, device and device key of a signed hello with the
+// user's secp256k1 identity private key.
+func GrantDevice(h *Hello, identity []byte) {
+	h.Grant = ecdsa.Sign(secp256k1.PrivKeyFromBytes(identity), grantDigest(h.ID, h.Device, h.Key)).Serialize()
+}
+
+// VerifyGrant checks the grant of h against the user's identity public key.
+func VerifyGrant(h *Hello, identity []byte) error {
+	if len(h.Grant) == 0 {
+		return errors.New("the device key is not granted by the user's identity key")
+	}
+	signer, err := secp256k1.ParsePubKey(identity)
+	if err != nil {
+		return fmt.Errorf("parsing identity key: %v", err)
+	}
+	sig, err := ecdsa.ParseDERSignature(h.Grant)
+	if err != nil {
+		return fmt.Errorf("parsing grant: %v", err)
+	}
+	if !sig.Verify(grantDigest(h.ID, h.Device, h.Key), signer) {
+		return errors.New("invalid device grant")
+	}
+	return nil
+}
+
+// Welcome answers a hello with the negotiated protocol version and encoding.
+type Welcome struct {
+	Type     string `json:"type"`
+	Version  int    `json:"version"`
+	Device   string `json:"device"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+// Msg is a message, typing notification or receipt. Message and Self are ECIES
+// ciphertexts the server never decrypts.
+type Msg struct {
+	Type      string    `json:"type"`
+	ID        string    `json:"id"`
+	Ref       string    `json:"ref,omitempty"` // Ref is chosen by the sender, acks, errors and receipts refer to it
+	Message   []byte    `json:"msg,omitempty"`
+	TimeStamp time.Time `json:"timestamp"`
+	FromID    string    `json:"from"`
+	Self      []byte    `json:"self,omitempty"` // Self copy of Message encrypted for the sender's other devices
+	Expires   time.Time `json:"expires,omitzero"`
+}
+
+// Ack confirms the server accepted a message for delivery.
+type Ack struct {
+	Type string `json:"type"`
+	Ref  string `json:"ref"`
+}
+
+// ErrorFrame reports a frame the server rejected, the connection stays open.
+type ErrorFrame struct {
+	Type   string `json:"type"`
+	Ref    string `json:"ref,omitempty"`
+	Code   string `json:"code"`
+	Reason string `json:"reason"`
+}
+
+type Presence struct {
+	Type     string    `json:"type"`
+	From     string    `json:"from,omitempty"`
+	Status   string    `json:"status"`
+	LastSeen time.Time `json:"lastSeen"`
+	Contacts []string  `json:"contacts,omitempty"`
+}
+
+// NegotiateVersion picks the newest version offered that is also supported.
+func NegotiateVersion(offered []int) (int, bool) {
+	best := 0
+	for _, v := range offered {
+		if v >= MinProtocolVersion && v <= ProtocolVersion && v > best {
+			best = v
+		}
+	}
+	return best, best > 0
+}
+
+// NegotiateEncoding picks binary when the client offers it on a version that has it.
+func NegotiateEncoding(version int, offered []string) string {
+	if version >= 2 && slices.Contains(offered, EncodingBinary) {
+		return EncodingBinary
+	}
+	return EncodingJSON
+}
+
+// Binary frames carry message, typing and receipt frames, big endian:
+//
+//	type u8 | id len u8 | id | from len u8 | from | ref len u8 | ref | [expires i64 unix ns] | timestamp i64 unix ns | msg len u32 | msg | self len u32 | self
+//
+// The type, id, from, ref and expires fields form the routing header, the server reads
+// only those. expires is only present when the type has the BinaryExpires bit, which
+// version 3 added. The type byte is below 0x20 so a binary frame never looks like JSON.
+var binaryFrameTypes = []string{"", FrameMessage, FrameTyping, FrameReceipt}
+
+const BinaryExpires = 0x10
+
+var errShortFrame = errors.New("binary frame is truncated")
+
+func IsBinaryFrame(b []byte) bool {
+	return len(b) > 0 && b[0]&^BinaryExpires > 0 && int(b[0]&^BinaryExpires) < len(binaryFrameTypes)
+}
+
+func EncodeBinary(m *Msg) ([]byte, error) {
+	code := slices.Index(binaryFrameTypes, m.Type)
+	if code < 1 {
+		return nil, fmt.Errorf("%q frames have no binary form", m.Type)
+	}
+	for _, f := range []string{m.ID, m.FromID, m.Ref} {
+		if len(f) > 255 {
+			return nil, fmt.Errorf("binary frame field is longer than 255 bytes")
+		}
+	}
+	if !m.Expires.IsZero() {
+		code |= BinaryExpires
+	}
+	b := make([]byte, 0, 4+len(m.ID)+len(m.FromID)+len(m.Ref)+24+len(m.Message)+len(m.Self))
+	b = append(b, byte(code))
+	for _, f := range []string{m.ID, m.FromID, m.Ref} {
+		b = append(b, byte(len(f)))
+		b = append(b, f...)
+	}
+	if !m.Expires.IsZero() {
+		b = binary.BigEndian.AppendUint64(b, uint64(m.Expires.UnixNano()))
+	}
+	var ts int64
+	if !m.TimeStamp.IsZero() {
+		ts = m.TimeStamp.UnixNano()
+	}
+	b = binary.BigEndian.AppendUint64(b, uint64(ts))
+	for _, f := range [][]byte{m.Message, m.Self} {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(f)))
+		b = append(b, f...)
+	}
+	return b, nil
+}
+
+// DecodeRoute reads only the routing header of a binary frame, returning where the rest starts.
+func DecodeRoute(b []byte) (*Frame, int, error) {
+	if !IsBinaryFrame(b) {
+		return nil, 0, errors.New("not a binary frame")
+	}
+	f := &Frame{Type: binaryFrameTypes[b[0]&^BinaryExpires]}
+	off := 1
+	for _, field := range []*string{&f.ID, &f.From, &f.Ref} {
+		if off >= len(b) || off+1+int(b[off]) > len(b) {
+			return nil, 0, errShortFrame
+		}
+		*field = string(b[off+1 : off+1+int(b[off])])
+		off += 1 + int(b[off])
+	}
+	if b[0]&BinaryExpires != 0 {
+		if off+8 > len(b) {
+			return nil, 0, errShortFrame
+		}
+		f.Expires = time.Unix(0, int64(binary.BigEndian.Uint64(b[off:])))
+		off += 8
+	}
+	return f, off, nil
+}
+
+func DecodeBinary(b []byte) (*Msg, error) {
+	f, off, err := DecodeRoute(b)
+	if err != nil {
+		return nil, err
+	}
+	m := &Msg{Type: f.Type, ID: f.ID, FromID: f.From, Ref: f.Ref, Expires: f.Expires}
+	if off+8 > len(b) {
+		return nil, errShortFrame
+	}
+	if ts := int64(binary.BigEndian.Uint64(b[off:])); ts != 0 {
+		m.TimeStamp = time.Unix(0, ts)
+	}
+	off += 8
+	for _, field := range []*[]byte{&m.Message, &m.Self} {
+		if off+4 > len(b) {
+			return nil, errShortFrame
+		}
+		n := int(binary.BigEndian.Uint32(b[off:]))
+		off += 4
+		if n > len(b)-off {
+			return nil, errShortFrame
+		}
+		if n > 0 {
+			*field = b[off : off+n]
+		}
+		off += n
+	}
+	if off != len(b) {
+		return nil, errors.New("binary frame has trailing bytes")
+	}
+	return m, nil
+}
@@ -0,0 +1,165 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1/v4"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	for _, tc := range []struct {
+		offered []int
+		want    int
+		ok      bool
+	}{
+		{[]int{ProtocolVersion}, ProtocolVersion, true},
+		{[]int{ProtocolVersion + 1, ProtocolVersion}, ProtocolVersion, true},
+		{[]int{0}, 0, false},
+		{nil, 0, false},
+	} {
+		if v, ok := NegotiateVersion(tc.offered); v != tc.want || ok != tc.ok {
+			t.Errorf("NegotiateVersion(%v) = %d, %v, want %d, %v", tc.offered, v, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		version int
+		offered []string
+		want    string
+	}{
+		{2, []string{EncodingBinary, EncodingJSON}, EncodingBinary},
+		{2, []string{EncodingJSON}, EncodingJSON},
+		{2, nil, EncodingJSON},
+		{1, []string{EncodingBinary}, EncodingJSON},
+	} {
+		if got := NegotiateEncoding(tc.version, tc.offered); got != tc.want {
+			t.Errorf("NegotiateEncoding(%d, %v) = %s, want %s", tc.version, tc.offered, got, tc.want)
+		}
+	}
+}
+
+func TestBinaryFrames(t *testing.T) {
+	m := &Msg{Type: FrameMessage, ID: "to", Ref: "r1", Message: []byte("ct"), TimeStamp: time.Unix(0, 1700000000123456789), FromID: "from", Self: []byte("self")}
+	b, err := EncodeBinary(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsBinaryFrame(b) {
+		t.Fatal("encoded frame is not recognised as binary")
+	}
+	got, err := DecodeBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Type != m.Type || got.ID != m.ID || got.Ref != m.Ref || got.FromID != m.FromID ||
+		!got.TimeStamp.Equal(m.TimeStamp) || !bytes.Equal(got.Message, m.Message) || !bytes.Equal(got.Self, m.Self) {
+		t.Errorf("decoded %+v, want %+v", got, m)
+	}
+	f, _, err := DecodeRoute(b)
+	if err != nil || f.Type != FrameMessage || f.ID != "to" || f.From != "from" || f.Ref != "r1" {
+		t.Errorf("route %+v, %v", f, err)
+	}
+	for i := range b {
+		if _, err := DecodeBinary(b[:i]); err == nil {
+			t.Errorf("decoding %d of %d bytes succeeded", i, len(b))
+		}
+	}
+	if _, err := DecodeBinary(append(b, 0)); err == nil {
+		t.Error("decoding a frame with trailing bytes succeeded")
+	}
+	if _, err := EncodeBinary(&Msg{Type: FramePresence}); err == nil {
+		t.Error("encoding a presence frame succeeded")
+	}
+
+	m.Expires = time.Unix(0, 1700000060000000000)
+	if b, err = EncodeBinary(m); err != nil {
+		t.Fatal(err)
+	}
+	if !IsBinaryFrame(b) || b[0] != BinaryExpires|1 {
+		t.Fatalf("frame with expiry starts with %#x", b[0])
+	}
+	if f, _, err := DecodeRoute(b); err != nil || f.Type != FrameMessage || !f.Expires.Equal(m.Expires) {
+		t.Errorf("route %+v, %v, want expires %v", f, err, m.Expires)
+	}
+	if got, err := DecodeBinary(b); err != nil || !got.Expires.Equal(m.Expires) || !bytes.Equal(got.Self, m.Self) {
+		t.Errorf("decoded %+v, %v", got, err)
+	}
+}
+
+func TestSignedHello(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	sign := func() *Hello {
+		h := &Hello{Type: FrameHello, ID: "user", Device: "phone"}
+		SignHello(h, key, now)
+		return h
+	}
+	for _, tc := range []struct {
+		name   string
+		change func(h *Hello)
+		ok     bool
+	}{
+		{"valid", func(h *Hello) {}, true},
+		{"other device", func(h *Hello) { h.Device = "laptop" }, false},
+		{"other user", func(h *Hello) { h.ID = "someone" }, false},
+		{"no signature", func(h *Hello) { h.Sig = nil }, false},
+		{"short key", func(h *Hello) { h.Key = h.Key[:8] }, false},
+		{"stale", func(h *Hello) { h.Time -= 600 }, false},
+		{"resigned later", func(h *Hello) { SignHello(h, key, now.Add(time.Minute)) }, true},
+	} {
+		h := sign()
+		tc.change(h)
+		if err := VerifyHello(h, now, 5*time.Minute); (err == nil) != tc.ok {
+			t.Errorf("%s: VerifyHello = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestDeviceGrant(t *testing.T) {
+	identity, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, otherKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	public := identity.PubKey().SerializeUncompressed()
+	for _, tc := range []struct {
+		name   string
+		change func(h *Hello)
+		ok     bool
+	}{
+		{"valid", func(h *Hello) {}, true},
+		{"no grant", func(h *Hello) { h.Grant = nil }, false},
+		{"other identity", func(h *Hello) { GrantDevice(h, other.Serialize()) }, false},
+		{"other device", func(h *Hello) { h.Device = "laptop" }, false},
+		{"other user", func(h *Hello) { h.ID = "someone" }, false},
+		{"other device key", func(h *Hello) { SignHello(h, otherKey, time.Now()) }, false},
+		{"garbage", func(h *Hello) { h.Grant = []byte("not a signature") }, false},
+	} {
+		h := &Hello{Type: FrameHello, ID: "user", Device: "phone"}
+		SignHello(h, key, time.Now())
+		GrantDevice(h, identity.Serialize())
+		tc.change(h)
+		if err := VerifyGrant(h, public); (err == nil) != tc.ok {
+			t.Errorf("%s: VerifyGrant = %v, want ok %v", tc.name, err, tc.ok)
+		}
+	}
+}
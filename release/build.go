@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const programName = "ogsma"
+
+type Release struct {
+	manifest  *Manifest
+	repo      string // repo is the checkout containing server, client, keystore_gen and config_gen
+	out       string
+	workspace string
+	jobs      int
+	mu        sync.Mutex
+	artifacts []string // artifacts are the files this build wrote to out
+}
+
+func (r *Release) dir(parts ...string) string {
+	return filepath.Join(append([]string{r.workspace}, parts...)...)
+}
+
+// produced records a file written to r.out so it is listed in SHA256SUMS.
+func (r *Release) produced(name string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.artifacts = append(r.artifacts, name)
+}
+
+// command runs name in dir, feeding stdin and returning the combined output with any error.
+func (r *Release) command(dir, stdin string, env []string, name string, args ...string) error {
+	cmd := exec.Command(name, args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdin = strings.NewReader(stdin)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("%s %s: %v\n%s", filepath.Base(name), strings.Join(args, " "), err, output.String())
+	}
+	return nil
+}
+
+// parallel runs fn for every user with at most r.jobs running at once.
+func (r *Release) parallel(fn func(u UserManifest) error) error {
+	sem := make(chan struct{}, r.jobs)
+	errs := make([]error, len(r.manifest.Users))
+	var wg sync.WaitGroup
+	for i, u := range r.manifest.Users {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			if err := fn(u); err != nil {
+				errs[i] = fmt.Errorf("%s: %w", u.Name, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (r *Release) buildTools() error {
+	for _, tool := range []string{"keystore_gen", "config_gen"} {
+		log.Printf("building %s", tool)
+		if err := r.command(filepath.Join(r.repo, tool), "", []string{"GOFLAGS=-mod=mod"}, "go", "build", "-o", r.dir("bin", tool), "."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *Release) generateKeystores() error {
+	keystoreGen := r.dir("bin", "keystore_gen")
+	keys := r.dir("keys")
+	if err := r.parallel(func(u UserManifest) error {
+		log.Printf("generating keystore for %s", u.Name)
+		password, err := u.password()
+		if err != nil {
+			return err
+		}
+		ks := filepath.Join(keys, u.Name+".keystore")
+		if err := r.command(keys, password+"\n", nil, keystoreGen, "init", "-keystore", ks, "-kdf", r.manifest.KDF, u.Name); err != nil {
+			return err
+		}
+		return r.command(keys, password+"\n", nil, keystoreGen, "export", "-keystore", ks, "-o", filepath.Join(keys, u.Name+".keyshare"))
+	}); err != nil {
+		return err
+	}
+	return r.parallel(func(u UserManifest) error {
+		log.Printf("adding contacts to keystore for %s", u.Name)
+		password, err := u.password()
+		if err != nil {
+			return err
+		}
+		args := []string{"add", "-keystore", filepath.Join(keys, u.Name+".keystore")}
+		for _, c := range r.manifest.Users {
+			if c.Name != u.Name {
+				args = append(args, filepath.Join(keys, c.Name+".keyshare"))
+			}
+		}
+		return r.command(keys, password+"\n", nil, keystoreGen, args...)
+	})
+}
+
+// generateConfigs runs config_gen's deployment mode once over all keystores so the client
+// configs, profiles and server config are checked against each other before building.
+func (r *Release) generateConfigs() error {
+	passwords := map[string]string{}
+	for _, u := range r.manifest.Users {
+		p, err := u.password()
+		if err != nil {
+			return fmt.Errorf("%s: %w", u.Name, err)
+		}
+		passwords[u.Name] = p
+	}
+	b, err := json.Marshal(passwords)
+	if err != nil {
+		return err
+	}
+	passwordFile := r.dir("keys", "passwords.json")
+	if err := os.WriteFile(passwordFile, b, 0600); err != nil {
+		return err
+	}
+	defer os.Remove(passwordFile)
+	s := r.manifest.Server
+	log.Printf("generating configs for %d users", len(r.manifest.Users))
+	if err := r.command(r.dir("keys"), "", nil, r.dir("bin", "config_gen"), "-type", "deployment",
+		"-dir", r.dir("keys"), "-out", r.dir("configs"), "-passwords", passwordFile, "-port", strconv.Itoa(s.Port),
+		"-addr", s.Addr, "-endpoint", s.Endpoint, "-cert", s.CertFile, "-key", s.KeyFile); err != nil {
+		return err
+	}
+	// profiles let a single generic client build log in as any user
+	for _, u := range r.manifest.Users {
+		if err := copyFile(r.dir("configs", u.Name+".ogsma"), filepath.Join(r.out, u.Name+".ogsma")); err != nil {
+			return err
+		}
+		r.produced(u.Name + ".ogsma")
+	}
+	return nil
+}
+
+// copySource copies a module directory so several binaries with different embedded
+// configs can be built at the same time, skipping configs and previously built executables.
+func copySource(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if rel != "." && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return os.MkdirAll(filepath.Join(dst, rel), 0700)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() || info.Mode()&0111 != 0 || d.Name() == "config.json" {
+			return nil
+		}
+		return copyFile(path, filepath.Join(dst, rel))
+	})
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func (r *Release) buildServer() error {
+	log.Printf("building server")
+	src := r.dir("build", "server")
+	if err := copySource(filepath.Join(r.repo, "server"), src); err != nil {
+		return err
+	}
+	if err := copyFile(r.dir("configs", "server_config.json"), filepath.Join(src, "defaults", "config.json")); err != nil {
+		return err
+	}
+	if err := r.command(src, "", []string{"GOFLAGS=-mod=mod"}, "go", "build", "-o", filepath.Join(r.out, programName+"_server"), "."); err != nil {
+		return err
+	}
+	r.produced(programName + "_server")
+	return nil
+}
+
+func (r *Release) buildClient(u UserManifest) error {
+	log.Printf("building executable for %s", u.Name)
+	src := r.dir("build", "client-"+u.Name)
+	if err := copySource(filepath.Join(r.repo, "client"), src); err != nil {
+		return err
+	}
+	if err := copyFile(r.dir("configs", u.Name+"_config.json"), filepath.Join(src, "defaults", "config.json")); err != nil {
+		return err
+	}
+	if err := r.command(src, "", []string{"GOFLAGS=-mod=mod"}, "go", "build", "-o", filepath.Join(r.out, u.Name+"_"+programName), "."); err != nil {
+		return err
+	}
+	r.produced(u.Name + "_" + programName)
+	if !r.manifest.Android {
+		return nil
+	}
+	if err := r.command(src, "", []string{"GOFLAGS=-mod=mod", "ANDROID_NDK_HOME=" + os.ExpandEnv(r.manifest.NDK)},
+		"fyne", "package", "--release", "--os", "android/arm64"); err != nil {
+		return err
+	}
+	apk := u.Name + "_" + programName + ".apk"
+	if err := os.Rename(filepath.Join(src, programName+".apk"), filepath.Join(r.out, apk)); err != nil {
+		return err
+	}
+	r.produced(apk)
+	return nil
+}
+
+func (r *Release) buildBinaries() error {
+	// the server and client modules replace ogsma_protocol with ../protocol
+	if err := copySource(filepath.Join(r.repo, "protocol"), r.dir("build", "protocol")); err != nil {
+		return err
+	}
+	var serverErr error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		serverErr = r.buildServer()
+	}()
+	clientErr := r.parallel(r.buildClient)
+	wg.Wait()
+	return errors.Join(serverErr, clientErr)
+}
+
+// writeChecksums writes SHA256SUMS for the files this build produced, in the format
+// read by sha256sum -c. Other files already in the output directory are left out.
+func (r *Release) writeChecksums() error {
+	names := slices.Clone(r.artifacts)
+	sort.Strings(names)
+	var sums strings.Builder
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(r.out, name))
+		if err != nil {
+			return err
+		}
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&sums, "%s  %s\n", hex.EncodeToString(h.Sum(nil)), name)
+	}
+	return os.WriteFile(filepath.Join(r.out, "SHA256SUMS"), []byte(sums.String()), 0644)
+}
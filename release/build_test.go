@@ -0,0 +1,100 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string, mode os.FileMode) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWriteChecksums(t *testing.T) {
+	out := t.TempDir()
+	files := map[string]string{"bob_ogsma": "bob's client", "alice_ogsma": "alice's client", "ogsma_server": "server"}
+	writeFiles(t, out, files, 0o600)
+	writeFiles(t, out, map[string]string{"old_ogsma": "from an earlier run"}, 0o600)
+	r := &Release{out: out}
+	for _, name := range []string{"ogsma_server", "bob_ogsma", "alice_ogsma"} {
+		r.produced(name)
+	}
+	if err := r.writeChecksums(); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(out, "SHA256SUMS"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want strings.Builder
+	for _, name := range []string{"alice_ogsma", "bob_ogsma", "ogsma_server"} {
+		sum := sha256.Sum256([]byte(files[name]))
+		want.WriteString(hex.EncodeToString(sum[:]) + "  " + name + "\n")
+	}
+	// sorted by name in sha256sum -c format, without files the run didn't build
+	if string(b) != want.String() {
+		t.Errorf("SHA256SUMS is\n%s\nwant\n%s", b, want.String())
+	}
+
+	r.produced("missing_ogsma")
+	if err := r.writeChecksums(); err == nil {
+		t.Error("listed an artifact that doesn't exist")
+	}
+}
+
+func TestCopySource(t *testing.T) {
+	src, dst := t.TempDir(), filepath.Join(t.TempDir(), "copy")
+	writeFiles(t, src, map[string]string{
+		"main.go":              "package main",
+		"go.mod":               "module ogsma_client",
+		"defaults/config.json": "{}",
+		"defaults/README":      "configs go here",
+		"assets/icon.png":      "png",
+		".git/HEAD":            "ref: refs/heads/main",
+	}, 0o600)
+	writeFiles(t, src, map[string]string{"ogsma": "an earlier build"}, 0o700)
+	if err := copySource(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		copied bool
+	}{
+		{"main.go", true},
+		{"go.mod", true},
+		{"defaults/README", true},
+		{"assets/icon.png", true},
+		{"defaults/config.json", false},
+		{".git/HEAD", false},
+		{"ogsma", false},
+	} {
+		b, err := os.ReadFile(filepath.Join(dst, tc.name))
+		switch {
+		case tc.copied && err != nil:
+			t.Errorf("%s was not copied: %v", tc.name, err)
+		case tc.copied:
+			if want, _ := os.ReadFile(filepath.Join(src, tc.name)); string(b) != string(want) {
+				t.Errorf("%s is %q, want %q", tc.name, b, want)
+			}
+		case !errors.Is(err, os.ErrNotExist):
+			t.Errorf("%s was copied: %v", tc.name, err)
+		}
+	}
+	// the embedded config is written into the copied defaults directory later
+	if fi, err := os.Stat(filepath.Join(dst, "defaults")); err != nil || !fi.IsDir() {
+		t.Errorf("defaults directory missing: %v", err)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+func (r *Release) run() error {
+	for _, d := range []string{"bin", "keys", "configs", "build"} {
+		if err := os.MkdirAll(r.dir(d), 0700); err != nil {
+			return err
+		}
+	}
+	if err := os.MkdirAll(r.out, 0755); err != nil {
+		return err
+	}
+	for _, step := range []func() error{
+		r.buildTools,
+		r.generateKeystores,
+		r.generateConfigs,
+		r.buildBinaries,
+		r.writeChecksums,
+	} {
+		if err := step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func main() {
+	var manifestFile, repo, out string
+	var jobs int
+	var keep bool
+	flag.StringVar(&manifestFile, "manifest", "deployment.yaml", "deployment manifest (YAML, or JSON with a .json extension)")
+	flag.StringVar(&repo, "repo", ".", "path to the ogsma checkout")
+	flag.StringVar(&out, "out", "dist", "output directory for binaries and SHA256SUMS")
+	flag.IntVar(&jobs, "j", runtime.NumCPU(), "number of parallel jobs")
+	flag.BoolVar(&keep, "keep", false, "keep the workspace with keystores and configs instead of removing it")
+	flag.Parse()
+	m, err := loadManifest(manifestFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	r := &Release{manifest: m, jobs: max(jobs, 1)}
+	if r.repo, err = filepath.Abs(repo); err != nil {
+		log.Fatal(err)
+	}
+	if r.out, err = filepath.Abs(out); err != nil {
+		log.Fatal(err)
+	}
+	if r.workspace, err = os.MkdirTemp("", "ogsma-release-"); err != nil {
+		log.Fatal(err)
+	}
+	err = r.run()
+	if keep {
+		fmt.Printf("workspace kept in %s\n", r.workspace)
+	} else if rerr := os.RemoveAll(r.workspace); rerr != nil {
+		log.Printf("removing workspace: %v", rerr)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("release written to %s\n", r.out)
+}
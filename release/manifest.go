@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Manifest describes a deployment, it is read from YAML or, with a .json extension, JSON.
+type Manifest struct {
+	Server  ServerManifest `json:"server" yaml:"server"`
+	KDF     string         `json:"kdf" yaml:"kdf"`         // KDF for generated keystores (argon2id, pbkdf2)
+	Android bool           `json:"android" yaml:"android"` // Android also packages an apk per user with fyne
+	NDK     string         `json:"ndk" yaml:"ndk"`
+	Users   []UserManifest `json:"users" yaml:"users"`
+}
+
+type ServerManifest struct {
+	Addr     string `json:"addr" yaml:"addr"`
+	Port     int    `json:"port" yaml:"port"`
+	Endpoint string `json:"endpoint" yaml:"endpoint"`
+	CertFile string `json:"cert" yaml:"cert"`
+	KeyFile  string `json:"key" yaml:"key"`
+}
+
+// UserManifest takes the keystore password from exactly one of Password,
+// PasswordEnv or PasswordFile so manifests can be committed without secrets.
+type UserManifest struct {
+	Name         string `json:"name" yaml:"name"`
+	Password     string `json:"password" yaml:"password"`
+	PasswordEnv  string `json:"passwordEnv" yaml:"passwordEnv"`
+	PasswordFile string `json:"passwordFile" yaml:"passwordFile"`
+}
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func loadManifest(filename string) (*Manifest, error) {
+	b, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading manifest: %v", err)
+	}
+	m := &Manifest{}
+	if strings.EqualFold(filepath.Ext(filename), ".json") {
+		d := json.NewDecoder(bytes.NewReader(b))
+		d.DisallowUnknownFields()
+		err = d.Decode(m)
+	} else {
+		d := yaml.NewDecoder(bytes.NewReader(b))
+		d.KnownFields(true)
+		err = d.Decode(m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing manifest %s: %v", filename, err)
+	}
+	if len(m.Server.Endpoint) == 0 {
+		m.Server.Endpoint = "ws"
+	}
+	if len(m.KDF) == 0 {
+		m.KDF = "argon2id"
+	}
+	// relative cert paths are relative to the manifest
+	base := filepath.Dir(filename)
+	for _, p := range []*string{&m.Server.CertFile, &m.Server.KeyFile} {
+		if len(*p) > 0 && !filepath.IsAbs(*p) {
+			*p = filepath.Join(base, *p)
+		}
+	}
+	for i := range m.Users {
+		if p := m.Users[i].PasswordFile; len(p) > 0 && !filepath.IsAbs(p) {
+			m.Users[i].PasswordFile = filepath.Join(base, p)
+		}
+	}
+	return m, m.validate()
+}
+
+func (m *Manifest) validate() error {
+	var errs []error
+	if len(m.Server.Addr) == 0 {
+		errs = append(errs, errors.New("server.addr is required"))
+	}
+	if m.Server.Port < 1 || m.Server.Port > 65535 {
+		errs = append(errs, fmt.Errorf("server.port %d is not a valid port", m.Server.Port))
+	}
+	if len(m.Server.CertFile) == 0 || len(m.Server.KeyFile) == 0 {
+		errs = append(errs, errors.New("server.cert and server.key are required"))
+	}
+	if m.Android && len(m.NDK) == 0 {
+		errs = append(errs, errors.New("ndk is required for android builds"))
+	}
+	if len(m.Users) < 2 {
+		errs = append(errs, errors.New("at least two users are required"))
+	}
+	seen := map[string]bool{}
+	for i, u := range m.Users {
+		if !validName.MatchString(u.Name) {
+			errs = append(errs, fmt.Errorf("users[%d]: invalid name %q", i, u.Name))
+		}
+		if seen[u.Name] {
+			errs = append(errs, fmt.Errorf("users[%d]: duplicate name %q", i, u.Name))
+		}
+		seen[u.Name] = true
+		if _, err := u.password(); err != nil {
+			errs = append(errs, fmt.Errorf("users[%d] %s: %v", i, u.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (u UserManifest) password() (string, error) {
+	var sources int
+	for _, s := range []string{u.Password, u.PasswordEnv, u.PasswordFile} {
+		if len(s) > 0 {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return "", errors.New("exactly one of password, passwordEnv or passwordFile is required")
+	}
+	switch {
+	case len(u.PasswordEnv) > 0:
+		p, ok := os.LookupEnv(u.PasswordEnv)
+		if !ok || len(p) == 0 {
+			return "", fmt.Errorf("environment variable %s is not set", u.PasswordEnv)
+		}
+		return p, nil
+	case len(u.PasswordFile) > 0:
+		b, err := os.ReadFile(u.PasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("reading password file: %v", err)
+		}
+		p := strings.TrimRight(string(b), "\r\n")
+		if len(p) == 0 {
+			return "", fmt.Errorf("password file %s is empty", u.PasswordFile)
+		}
+		return p, nil
+	default:
+		return u.Password, nil
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadManifest(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bob.pw"), []byte("bob secret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "empty.pw"), []byte("\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OGSMA_TEST_ALICE", "alice secret")
+	const server = "server: {addr: example.com, port: 8443, cert: server.crt, key: server.key}\n"
+	const users = "users:\n  - {name: alice, passwordEnv: OGSMA_TEST_ALICE}\n  - {name: bob, passwordFile: bob.pw}\n"
+	for _, tc := range []struct {
+		name     string
+		file     string // file is the manifest name, its extension picks the format
+		manifest string
+		errs     []string // errs are substrings of the error, none means the manifest is valid
+	}{
+		{name: "valid", manifest: server + users},
+		{name: "valid json", file: "deployment.json", manifest: `{"server":{"addr":"example.com","port":8443,"cert":"c","key":"k"},
+			"users":[{"name":"alice","password":"a"},{"name":"bob","password":"b"}]}`},
+		{name: "unknown field", manifest: server + users + "colour: blue\n", errs: []string{"field colour not found"}},
+		{name: "unknown json field", file: "deployment.json", manifest: `{"colour":"blue"}`, errs: []string{`unknown field "colour"`}},
+		{name: "no server", manifest: users, errs: []string{"server.addr is required", "server.port 0 is not a valid port", "server.cert and server.key are required"}},
+		{name: "port out of range", manifest: strings.Replace(server, "8443", "70000", 1) + users, errs: []string{"server.port 70000"}},
+		{name: "android without ndk", manifest: server + users + "android: true\n", errs: []string{"ndk is required"}},
+		{name: "one user", manifest: server + "users:\n  - {name: alice, password: a}\n", errs: []string{"at least two users"}},
+		{
+			name:     "bad names",
+			manifest: server + "users:\n  - {name: alice, password: a}\n  - {name: alice, password: b}\n  - {name: ../carol, password: c}\n",
+			errs:     []string{`users[1]: duplicate name "alice"`, `users[2]: invalid name "../carol"`},
+		},
+		{
+			name:     "password sources",
+			manifest: server + "users:\n  - {name: alice}\n  - {name: bob, password: b, passwordEnv: OGSMA_TEST_ALICE}\n",
+			errs:     []string{"users[0] alice: exactly one of", "users[1] bob: exactly one of"},
+		},
+		{
+			name:     "missing passwords",
+			manifest: server + "users:\n  - {name: alice, passwordEnv: OGSMA_TEST_UNSET}\n  - {name: bob, passwordFile: missing.pw}\n  - {name: carol, passwordFile: empty.pw}\n",
+			errs:     []string{"environment variable OGSMA_TEST_UNSET is not set", "reading password file", "empty.pw is empty"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			file := filepath.Join(dir, tc.file)
+			if len(tc.file) == 0 {
+				file = filepath.Join(dir, "deployment.yaml")
+			}
+			if err := os.WriteFile(file, []byte(tc.manifest), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			m, err := loadManifest(file)
+			if len(tc.errs) == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if m.Server.Endpoint != "ws" || m.KDF != "argon2id" {
+					t.Errorf("defaults endpoint %q kdf %q, want ws and argon2id", m.Server.Endpoint, m.KDF)
+				}
+				return
+			}
+			for _, want := range tc.errs {
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("error %v, want %q", err, want)
+				}
+			}
+		})
+	}
+
+	// relative paths are resolved against the manifest's directory
+	file := filepath.Join(dir, "deployment.yaml")
+	if err := os.WriteFile(file, []byte(server+users), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	m, err := loadManifest(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Server.CertFile != filepath.Join(dir, "server.crt") || m.Users[1].PasswordFile != filepath.Join(dir, "bob.pw") {
+		t.Errorf("cert %s and password file %s are not relative to the manifest", m.Server.CertFile, m.Users[1].PasswordFile)
+	}
+	for i, want := range []string{"alice secret", "bob secret"} {
+		if p, err := m.Users[i].password(); err != nil || p != want {
+			t.Errorf("%s: password %q, %v, want %q", m.Users[i].Name, p, err, want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"runtime"
+)
+
+// serveDebug publishes runtime and session counts on /debug/vars, next to the
+// memstats and cmdline variables expvar registers itself.
+func (s *Server) serveDebug(addr string) {
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("sessions", expvar.Func(func() any {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		n := 0
+		for _, devices := range s.websockets {
+			n += len(devices)
+		}
+		return n
+	}))
+	expvar.Publish("queued", expvar.Func(func() any {
+		n, err := s.store.Queued()
+		if err != nil {
+			log.Printf("Error counting queued messages: %v\n", err)
+		}
+		return n
+	}))
+	expvar.Publish("peerQueued", expvar.Func(func() any {
+		q := make(map[string]int)
+		for _, p := range s.peers {
+			q[p.name] = p.queued()
+		}
+		return q
+	}))
+	expvar.Publish("peerDropped", expvar.Func(func() any {
+		d := make(map[string]int)
+		for _, p := range s.peers {
+			d[p.name] = p.droppedFrames()
+		}
+		return d
+	}))
+	go func() {
+		if err := http.ListenAndServe(addr, expvar.Handler()); err != nil {
+			log.Printf("debug server: %v\n", err)
+		}
+	}()
+}
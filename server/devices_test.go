@@ -0,0 +1,157 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ogsma_protocol"
+)
+
+// signedHello is a hello for device signed with key and granted by the user's
+// identity key, change edits it after signing.
+func signedHello(t *testing.T, u *testUser, device string, key ed25519.PrivateKey, change func(h *protocol.Hello)) []byte {
+	t.Helper()
+	h := &protocol.Hello{Type: protocol.FrameHello, ID: u.ID, Device: device, Versions: []int{protocol.ProtocolVersion}}
+	protocol.SignHello(h, key, time.Now())
+	protocol.GrantDevice(h, u.key.Bytes())
+	if change != nil {
+		change(h)
+	}
+	b, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func newDeviceKey(t *testing.T) ed25519.PrivateKey {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestDeviceKeys(t *testing.T) {
+	ts := newTestServer(t, 1)
+	alice := ts.users[0]
+	key, other := newDeviceKey(t), newDeviceKey(t)
+
+	c := ts.connectRaw(t, websocket.TextMessage, signedHello(t, alice, "phone", key, nil))
+	c.expectFrame(t, protocol.FrameWelcome, &protocol.Welcome{})
+	c.close()
+	waitFor(t, "phone offline", func() bool { return !ts.online(alice.ID, "phone") })
+
+	for _, tc := range []struct {
+		name  string
+		hello []byte
+	}{
+		{"another key", signedHello(t, alice, "phone", other, nil)},
+		{"no key", signedHello(t, alice, "phone", key, func(h *protocol.Hello) { h.Key, h.Time, h.Sig = nil, 0, nil })},
+		{"forged signature", signedHello(t, alice, "phone", other, func(h *protocol.Hello) { h.Key = key.Public().(ed25519.PublicKey) })},
+		{"old signature", signedHello(t, alice, "phone", key, func(h *protocol.Hello) { protocol.SignHello(h, key, time.Now().Add(-time.Hour)) })},
+	} {
+		code, reason := ts.connectRaw(t, websocket.TextMessage, tc.hello).expectClosed(t)
+		if code != protocol.CloseInvalidDevice {
+			t.Errorf("%s: closed with %d %q, want %d", tc.name, code, reason, protocol.CloseInvalidDevice)
+		}
+	}
+
+	c = ts.connectRaw(t, websocket.TextMessage, signedHello(t, alice, "phone", key, nil))
+	c.expectFrame(t, protocol.FrameWelcome, &protocol.Welcome{})
+	// other devices register their own keys
+	ts.connectRaw(t, websocket.TextMessage, signedHello(t, alice, "laptop", other, nil)).expectFrame(t, protocol.FrameWelcome, &protocol.Welcome{})
+}
+
+func TestDeviceGrants(t *testing.T) {
+	ts := newTestServer(t, 2)
+	alice, bob := ts.users[0], ts.users[1]
+	stranger := newTestUser(t)
+	// a device registered before keys existed
+	if _, err := ts.store.AddDevice(alice.ID, Device{Name: "old", LastSeen: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	keyless := func(device string) func(h *protocol.Hello) {
+		return func(h *protocol.Hello) { h.Device, h.Key, h.Time, h.Sig, h.Grant = device, nil, 0, nil, nil }
+	}
+	for _, tc := range []struct {
+		name  string
+		hello []byte
+		ok    bool
+	}{
+		{"new device without a key", signedHello(t, alice, "tablet", newDeviceKey(t), keyless("tablet")), false},
+		{"new device without a grant", signedHello(t, alice, "tablet", newDeviceKey(t), func(h *protocol.Hello) { h.Grant = nil }), false},
+		{"granted by another identity", signedHello(t, alice, "tablet", newDeviceKey(t), func(h *protocol.Hello) { protocol.GrantDevice(h, stranger.key.Bytes()) }), false},
+		{"grant for another device", signedHello(t, alice, "tablet", newDeviceKey(t), func(h *protocol.Hello) {
+			h.Device = "watch"
+			protocol.SignHello(h, newDeviceKey(t), time.Now())
+		}), false},
+		{"grant for another user", signedHello(t, alice, "tablet", newDeviceKey(t), func(h *protocol.Hello) { protocol.GrantDevice(h, bob.key.Bytes()) }), false},
+		{"old device gaining a key without a grant", signedHello(t, alice, "old", newDeviceKey(t), func(h *protocol.Hello) { h.Grant = nil }), false},
+		{"old device without a key", signedHello(t, alice, "old", newDeviceKey(t), keyless("old")), true},
+		{"old device gaining a granted key", signedHello(t, alice, "old", newDeviceKey(t), nil), true},
+		{"granted new device", signedHello(t, alice, "tablet", newDeviceKey(t), nil), true},
+	} {
+		c := ts.connectRaw(t, websocket.TextMessage, tc.hello)
+		if tc.ok {
+			c.expectFrame(t, protocol.FrameWelcome, &protocol.Welcome{})
+			c.close()
+			waitFor(t, "device offline", func() bool {
+				ts.mu.Lock()
+				defer ts.mu.Unlock()
+				return len(ts.websockets[alice.ID]) == 0
+			})
+			continue
+		}
+		if code, reason := c.expectClosed(t); code != protocol.CloseInvalidDevice {
+			t.Errorf("%s: closed with %d %q, want %d", tc.name, code, reason, protocol.CloseInvalidDevice)
+		}
+	}
+	// once it has a key the old device can't connect without it
+	code, _ := ts.connectRaw(t, websocket.TextMessage, signedHello(t, alice, "old", newDeviceKey(t), keyless("old"))).expectClosed(t)
+	if code != protocol.CloseInvalidDevice {
+		t.Errorf("keyless hello for a keyed device closed with %d", code)
+	}
+
+	// users without a configured identity key can't add devices
+	ts.reconfigure(t, func(c *Config) { delete(c.UserKeys, bob.ID) })
+	code, reason := ts.connectRaw(t, websocket.TextMessage, signedHello(t, bob, "default", newDeviceKey(t), nil)).expectClosed(t)
+	if code != protocol.CloseInvalidDevice || !strings.Contains(reason, "userKeys") {
+		t.Errorf("closed with %d %q, want %d naming userKeys", code, reason, protocol.CloseInvalidDevice)
+	}
+}
+
+func TestStaleDevicesPruned(t *testing.T) {
+	ts := newTestServer(t, 2)
+	alice, bob := ts.users[0], ts.users[1]
+	ts.connect(t, alice, "phone")
+	laptop := ts.connect(t, alice, "laptop")
+	b := ts.connect(t, bob, "default")
+	laptop.close()
+	waitFor(t, "laptop offline", func() bool { return !ts.online(alice.ID, "laptop") })
+
+	b.send(t, alice, "while the laptop is away")
+	waitFor(t, "message queued for the laptop", func() bool { return ts.queued(alice.ID, "laptop") == 1 })
+
+	ts.pruneDevices(time.Now().Add(ts.deviceTTL - time.Hour))
+	if _, err := ts.store.Device(alice.ID, "laptop"); err != nil {
+		t.Fatalf("device removed before the TTL: %v", err)
+	}
+	ts.pruneDevices(time.Now().Add(ts.deviceTTL + time.Hour))
+	if _, err := ts.store.Device(alice.ID, "laptop"); !errors.Is(err, errNotFound) {
+		t.Errorf("stale device still registered: %v", err)
+	}
+	if n := ts.queued(alice.ID, "laptop"); n != 0 {
+		t.Errorf("%d frames left for a removed device", n)
+	}
+	// online devices are never removed
+	if _, err := ts.store.Device(alice.ID, "phone"); err != nil {
+		t.Errorf("online device removed: %v", err)
+	}
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ogsma_protocol"
+)
+
+const federationPath = "/federation"
+
+// peerBackoff is the first delay before redialing a peer, it doubles up to 30s.
+var peerBackoff = time.Second
+
+// Federation lists the sibling servers this one forwards to. Every server's cert
+// is signed by CAFile, peers authenticate each other with it in both directions.
+type Federation struct {
+	CAFile   string       `json:"caFile"`
+	CertFile string       `json:"certFile,omitempty"` // CertFile is the client cert shown to peers, the server cert when empty
+	KeyFile  string       `json:"keyFile,omitempty"`
+	Peers    []PeerConfig `json:"peers"`
+	// QueueFrames and QueueBytes bound the frames queued per peer, QueueTTL is the
+	// seconds a frame waits for the peer before it is dropped
+	QueueFrames int   `json:"queueFrames,omitempty"`
+	QueueBytes  int64 `json:"queueBytes,omitempty"`
+	QueueTTL    int   `json:"queueTTL,omitempty"`
+}
+
+type PeerConfig struct {
+	Name  string   `json:"name"` // Name must be the CN or a SAN of the peer's cert
+	Addr  string   `json:"addr"` // Addr is the peer's host:port
+	Users []string `json:"users"`
+}
+
+// peer is the outgoing link to one sibling server. Frames stay queued until the
+// peer acknowledges them, so they survive the peer being down or restarting, up
+// to the queue limits.
+type peer struct {
+	name      string
+	addr      string
+	users     []string
+	dialer    *websocket.Dialer
+	mu        sync.Mutex
+	queue     []peerFrame // queue holds the frames not acknowledged yet
+	bytes     int64       // bytes is the size of the frames in queue
+	sent      int         // sent is how many frames of queue were written on the current connection
+	acked     int         // acked is the peer's count of frames received on the current connection
+	dropped   int         // dropped counts frames refused by a full queue or expired
+	up        bool
+	wake      chan struct{}
+	retry     time.Duration // retry is the first redial delay
+	maxFrames int
+	maxBytes  int64
+	ttl       time.Duration
+}
+
+type peerFrame struct {
+	data   []byte
+	queued time.Time
+}
+
+// loadFederation reads the federation certs and sets up a link per peer, the
+// links are started by startPeers.
+func (s *Server) loadFederation(c *Config) error {
+	f := c.Federation
+	if f == nil {
+		return nil
+	}
+	ca, err := os.ReadFile(f.CAFile)
+	if err != nil {
+		return fmt.Errorf("reading federation CA: %v", err)
+	}
+	s.peerCAs = x509.NewCertPool()
+	if !s.peerCAs.AppendCertsFromPEM(ca) {
+		return fmt.Errorf("no certificates in %s", f.CAFile)
+	}
+	certFile, keyFile := f.CertFile, f.KeyFile
+	if len(certFile) == 0 {
+		certFile, keyFile = c.CertFile, c.KeyFile
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return fmt.Errorf("loading federation cert: %v", err)
+	}
+	maxFrames, maxBytes, ttl := f.QueueFrames, f.QueueBytes, f.QueueTTL
+	if maxFrames == 0 {
+		maxFrames = 10000
+	}
+	if maxBytes == 0 {
+		maxBytes = 64 << 20
+	}
+	if ttl == 0 {
+		ttl = 24 * 60 * 60
+	}
+	s.peerUsers = make(map[string]*peer)
+	for _, pc := range f.Peers {
+		host, _, err := net.SplitHostPort(pc.Addr)
+		if err != nil {
+			return fmt.Errorf("peer %s: %v", pc.Name, err)
+		}
+		p := &peer{
+			name:  pc.Name,
+			addr:  pc.Addr,
+			users: pc.Users,
+			dialer: &websocket.Dialer{
+				TLSClientConfig:  &tls.Config{RootCAs: s.peerCAs, Certificates: []tls.Certificate{cert}, ServerName: host},
+				HandshakeTimeout: 5 * time.Second,
+			},
+			wake:      make(chan struct{}, 1),
+			retry:     peerBackoff,
+			maxFrames: maxFrames,
+			maxBytes:  maxBytes,
+			ttl:       time.Duration(ttl) * time.Second,
+		}
+		for _, u := range pc.Users {
+			if s.isLocal(u) {
+				return fmt.Errorf("user %s is both local and on peer %s", u, pc.Name)
+			}
+			if other, ok := s.peerUsers[u]; ok {
+				return fmt.Errorf("user %s is on peers %s and %s", u, other.name, pc.Name)
+			}
+			s.peerUsers[u] = p
+		}
+		s.peers = append(s.peers, p)
+	}
+	return nil
+}
+
+func (s *Server) startPeers() {
+	for _, p := range s.peers {
+		go p.run(s.stop)
+	}
+}
+
+// tlsConfig asks for, but doesn't require, a client cert so peers can authenticate
+// on the same port clients use.
+func (s *Server) tlsConfig() *tls.Config {
+	if s.peerCAs == nil {
+		return &tls.Config{}
+	}
+	return &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: s.peerCAs}
+}
+
+// forward queues frame for the peer owning its recipient, it returns false when
+// the recipient isn't on a peer and an error when the peer's queue is full. Typing
+// frames are dropped while the peer is down.
+func (s *Server) forward(f *protocol.Frame, frame []byte) (bool, error) {
+	p, ok := s.peerUsers[f.ID]
+	if !ok {
+		return false, nil
+	}
+	p.mu.Lock()
+	if f.Type == protocol.FrameTyping && !p.up {
+		p.mu.Unlock()
+		return true, nil
+	}
+	p.expire(time.Now())
+	if len(p.queue) >= p.maxFrames || p.bytes+int64(len(frame)) > p.maxBytes {
+		p.dropped++
+		p.mu.Unlock()
+		log.Printf("Dropping %s frame for peer %s: queue full\n", f.Type, p.name)
+		return true, fmt.Errorf("queue for %s is full", p.name)
+	}
+	p.queue = append(p.queue, peerFrame{data: frame, queued: time.Now()})
+	p.bytes += int64(len(frame))
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// expire drops the frames queued longer than the TTL that are not waiting for an
+// ack, p.mu must be held.
+func (p *peer) expire(now time.Time) {
+	start := p.sent
+	if !p.up {
+		start = 0
+	}
+	end := start
+	for end < len(p.queue) && now.Sub(p.queue[end].queued) > p.ttl {
+		p.bytes -= int64(len(p.queue[end].data))
+		end++
+	}
+	if end == start {
+		return
+	}
+	log.Printf("Dropping %d frames for peer %s queued longer than %v\n", end-start, p.name, p.ttl)
+	p.dropped += end - start
+	p.queue = slices.Delete(p.queue, start, end)
+}
+
+// dropBefore removes the first n frames of the queue once the peer acked them,
+// p.mu must be held.
+func (p *peer) dropBefore(n int) {
+	for _, f := range p.queue[:n] {
+		p.bytes -= int64(len(f.data))
+	}
+	p.queue = p.queue[n:]
+}
+
+func (p *peer) queued() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.queue)
+}
+
+func (p *peer) droppedFrames() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.dropped
+}
+
+// run keeps the link to the peer up until stop is closed.
+func (p *peer) run(stop chan struct{}) {
+	backoff := p.retry
+	for {
+		conn, _, err := p.dialer.Dial(fmt.Sprintf("wss://%s%s", p.addr, federationPath), nil)
+		if err == nil {
+			log.Printf("Connected to peer %s\n", p.name)
+			backoff = p.retry
+			err = p.serve(conn, stop)
+			conn.Close()
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		log.Printf("Peer %s link down: %v\n", p.name, err)
+		select {
+		case <-stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// serve writes queued frames to the peer and drops them as the peer acks them.
+// Unacked frames are resent on the next connection, so a peer may see a frame twice.
+func (p *peer) serve(conn *websocket.Conn, stop chan struct{}) error {
+	p.mu.Lock()
+	p.sent, p.acked, p.up = 0, 0, true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		// everything unacked is resent on the next connection
+		p.up, p.sent, p.acked = false, 0, 0
+		p.mu.Unlock()
+	}()
+	conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	})
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			_, m, err := conn.ReadMessage()
+			if err != nil {
+				errc <- err
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+			a := &protocol.Ack{}
+			if err := json.Unmarshal(m, a); err != nil || a.Type != protocol.FrameAck {
+				continue
+			}
+			n, err := strconv.Atoi(a.Ref)
+			p.mu.Lock()
+			if err != nil || n < p.acked || n > p.sent {
+				p.mu.Unlock()
+				errc <- fmt.Errorf("invalid ack %q", a.Ref)
+				return
+			}
+			p.dropBefore(n - p.acked)
+			p.sent -= n - p.acked
+			p.acked = n
+			p.mu.Unlock()
+		}
+	}()
+	ping := time.NewTicker(time.Second)
+	defer ping.Stop()
+	for {
+		p.mu.Lock()
+		p.expire(time.Now())
+		frames := slices.Clone(p.queue[p.sent:])
+		p.sent = len(p.queue)
+		p.mu.Unlock()
+		for _, f := range frames {
+			mt := websocket.TextMessage
+			if protocol.IsBinaryFrame(f.data) {
+				mt = websocket.BinaryMessage
+			}
+			if err := conn.WriteMessage(mt, f.data); err != nil {
+				return err
+			}
+		}
+		select {
+		case <-p.wake:
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(time.Second)); err != nil {
+				return err
+			}
+		case err := <-errc:
+			return err
+		case <-stop:
+			conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second))
+			return errors.New("server stopping")
+		}
+	}
+}
+
+// peerFor returns the configured peer a verified client cert belongs to.
+func (s *Server) peerFor(cert *x509.Certificate) *peer {
+	for _, p := range s.peers {
+		if cert.Subject.CommonName == p.name || cert.VerifyHostname(p.name) == nil {
+			return p
+		}
+	}
+	return nil
+}
+
+// servePeer receives frames forwarded by a peer and delivers them to local users,
+// acking each with the number of frames received on this connection.
+func (s *Server) servePeer(w http.ResponseWriter, r *http.Request) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		http.Error(w, "client certificate required", http.StatusForbidden)
+		return
+	}
+	p := s.peerFor(r.TLS.VerifiedChains[0][0])
+	if p == nil {
+		log.Printf("Rejected federation connection from %s: unknown peer %s\n", r.RemoteAddr, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+		http.Error(w, "unknown peer", http.StatusForbidden)
+		return
+	}
+	c, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Println("upgrade to websocket conn:", err)
+		return
+	}
+	defer c.Close()
+	c.SetReadLimit(s.limits.MaxMessageSize)
+	log.Printf("Peer %s connected from %s\n", p.name, r.RemoteAddr)
+	c.SetReadDeadline(time.Now().Add(3 * time.Second))
+	c.SetPingHandler(func(m string) error {
+		c.SetReadDeadline(time.Now().Add(3 * time.Second))
+		return c.WriteControl(websocket.PongMessage, []byte(m), time.Now().Add(time.Second))
+	})
+	for n := 1; ; n++ {
+		mt, m, err := c.ReadMessage()
+		if err != nil {
+			log.Printf("Peer %s disconnected: %v\n", p.name, err)
+			return
+		}
+		f := &protocol.Frame{}
+		if mt == websocket.BinaryMessage {
+			f, _, err = protocol.DecodeRoute(m)
+		} else {
+			err = json.Unmarshal(m, f)
+		}
+		switch {
+		case err != nil:
+			log.Printf("Dropping malformed frame from peer %s: %v\n", p.name, err)
+		case !slices.Contains(p.users, f.From):
+			log.Printf("Dropping frame from peer %s for user %s it doesn't own\n", p.name, f.From)
+		case !s.isLocal(f.ID):
+			log.Printf("Dropping frame from peer %s for non-local user %s\n", p.name, f.ID)
+		case !s.policy.allows(f.From, f.ID):
+			log.Printf("Dropping frame from peer %s the routing policy doesn't allow\n", p.name)
+		case f.Type == protocol.FrameTyping:
+			s.deliverOnline(f.ID, "", m)
+		case f.Type == protocol.FrameMessage || f.Type == protocol.FrameReceipt:
+			if err := s.deliver(f.ID, "", m); err != nil {
+				log.Printf("Dropping frame from peer %s: %v\n", p.name, err)
+			}
+		default:
+			log.Printf("Dropping %q frame from peer %s\n", f.Type, p.name)
+		}
+		ack, _ := json.Marshal(&protocol.Ack{Type: protocol.FrameAck, Ref: strconv.Itoa(n)})
+		if err := c.WriteMessage(websocket.TextMessage, ack); err != nil {
+			log.Printf("Error acking peer %s: %v\n", p.name, err)
+			return
+		}
+	}
+}
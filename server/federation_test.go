@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ogsma_protocol"
+)
+
+func TestFederatedDelivery(t *testing.T) {
+	sites := newTestSites(t, 1, 1)
+	alice, bob := sites[0].users[0], sites[1].users[0]
+	a := sites[0].connectEncoding(t, alice, "default", protocol.EncodingBinary)
+	b := sites[1].connect(t, bob, "default")
+
+	a.send(t, bob, "hello from site0")
+	a.expectFrame(t, protocol.FrameAck, &protocol.Ack{})
+	if from, text := b.receiveText(t); from != alice.ID || text != "hello from site0" {
+		t.Errorf("bob received %q from %s, want %q from alice", text, from, "hello from site0")
+	}
+	b.send(t, alice, "hello from site1")
+	if from, text := a.receiveText(t); from != bob.ID || text != "hello from site1" {
+		t.Errorf("alice received %q from %s, want %q from bob", text, from, "hello from site1")
+	}
+	waitFor(t, "acked frames", func() bool { return sites[0].peers[0].queued() == 0 && sites[1].peers[0].queued() == 0 })
+}
+
+func TestFederationStoreAndForward(t *testing.T) {
+	defer func(d time.Duration) { peerBackoff = d }(peerBackoff)
+	peerBackoff = 50 * time.Millisecond
+	sites := newTestSites(t, 1, 1)
+	alice, bob := sites[0].users[0], sites[1].users[0]
+	a := sites[0].connect(t, alice, "default")
+	waitFor(t, "peer link", func() bool {
+		p := sites[0].peers[0]
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return p.up
+	})
+
+	sites[1].shutdown()
+	want := []string{"one", "two", "three"}
+	for _, m := range want {
+		a.send(t, bob, m)
+	}
+	waitFor(t, "frames queued for the peer", func() bool { return sites[0].peers[0].queued() == len(want) })
+
+	sites[1].restart(t)
+	b := sites[1].connect(t, bob, "default")
+	for _, w := range want {
+		if _, text := b.receiveText(t); text != w {
+			t.Errorf("received %q, want %q", text, w)
+		}
+	}
+	waitFor(t, "acked frames", func() bool { return sites[0].peers[0].queued() == 0 })
+}
+
+func TestFederationRejectsUnknownPeers(t *testing.T) {
+	sites := newTestSites(t, 1, 1)
+	alice := sites[0].users[0]
+	a := sites[0].connect(t, alice, "default")
+	url := "wss://" + strings.TrimPrefix(sites[0].ts.URL, "https://") + federationPath
+	dial := func(certs ...tls.Certificate) (*websocket.Conn, *http.Response, error) {
+		d := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: sites[0].roots, Certificates: certs}, HandshakeTimeout: testTimeout}
+		return d.Dial(url, nil)
+	}
+	if _, resp, err := dial(); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("dial without a client cert: %v, want 403", err)
+	}
+	if _, resp, err := dial(newTestCA(t).issue(t, siteName(1))); err == nil || resp != nil && resp.StatusCode == http.StatusSwitchingProtocols {
+		t.Error("dial with a cert from another CA succeeded")
+	}
+
+	// a peer can only send for the users it owns
+	conn, _, err := dial(sites[1].cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	forged, _ := json.Marshal(&protocol.Msg{Type: protocol.FrameMessage, ID: alice.ID, Message: []byte("x"), FromID: alice.ID})
+	if err := conn.WriteMessage(websocket.TextMessage, forged); err != nil {
+		t.Fatal(err)
+	}
+	ack := &protocol.Ack{}
+	if err := conn.ReadJSON(ack); err != nil || ack.Ref != "1" {
+		t.Errorf("ack %+v, %v, want ref 1", ack, err)
+	}
+	a.expectNothing(t, 200*time.Millisecond)
+}
+
+func TestFederationQueueLimits(t *testing.T) {
+	defer func(d time.Duration) { peerBackoff = d }(peerBackoff)
+	peerBackoff = 50 * time.Millisecond
+	sites := newTestSites(t, 1, 1)
+	alice, bob := sites[0].users[0], sites[1].users[0]
+	sites[1].shutdown()
+	sites[0].reconfigure(t, func(c *Config) {
+		c.Federation.QueueFrames = 2
+		c.Federation.QueueTTL = 1
+	})
+	a := sites[0].connect(t, alice, "default")
+	p := sites[0].peers[0]
+
+	a.send(t, bob, "one")
+	a.send(t, bob, "two")
+	waitFor(t, "frames queued for the peer", func() bool { return p.queued() == 2 })
+	if err := a.writeMsg(&protocol.Msg{Type: protocol.FrameMessage, ID: bob.ID, Ref: "r3", Message: []byte("x"), FromID: alice.ID}); err != nil {
+		t.Fatal(err)
+	}
+	e := &protocol.ErrorFrame{}
+	a.expectFrame(t, protocol.FrameError, e)
+	if e.Code != protocol.ErrQueueFull || e.Ref != "r3" {
+		t.Errorf("error %+v, want %s for r3", e, protocol.ErrQueueFull)
+	}
+	if p.queued() != 2 || p.droppedFrames() != 1 {
+		t.Errorf("%d queued and %d dropped, want 2 and 1", p.queued(), p.droppedFrames())
+	}
+
+	// frames older than the TTL make room and are never delivered
+	time.Sleep(1100 * time.Millisecond)
+	a.send(t, bob, "three")
+	waitFor(t, "expired frames dropped", func() bool { return p.queued() == 1 && p.droppedFrames() == 3 })
+	sites[1].restart(t)
+	b := sites[1].connect(t, bob, "default")
+	if _, text := b.receiveText(t); text != "three" {
+		t.Errorf("received %q, want %q", text, "three")
+	}
+	b.expectNothing(t, 200*time.Millisecond)
+}
@@ -1,5 +1,30 @@
 module ogsma_server
 
-go 1.25
+go 1.25.3
 
-require github.com/gorilla/websocket v1.5.3
+replace ogsma_protocol => ../protocol
+
+require (
+	github.com/ecies/go/v2 v2.0.11
+	github.com/gorilla/websocket v1.5.3
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/time v0.9.0
+	modernc.org/sqlite v1.39.0
+	ogsma_protocol v0.0.0-00010101000000-000000000000
+)
+
+require (
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.4.0 // indirect
+	github.com/dustin/go-humanize v1.0.1 // indirect
+	github.com/ethereum/go-ethereum v1.15.8 // indirect
+	github.com/google/uuid v1.6.0 // indirect
+	github.com/mattn/go-isatty v0.0.20 // indirect
+	github.com/ncruces/go-strftime v0.1.9 // indirect
+	github.com/remyoudompheng/bigfft v0.0.0-20230129092748-24d4a6f8daec // indirect
+	golang.org/x/crypto v0.43.0 // indirect
+	golang.org/x/exp v0.0.0-20250620022241-b7579e27df2b // indirect
+	golang.org/x/sys v0.37.0 // indirect
+	modernc.org/libc v1.66.3 // indirect
+	modernc.org/mathutil v1.7.1 // indirect
+	modernc.org/memory v1.11.0 // indirect
+)
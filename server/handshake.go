@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ogsma_protocol"
+)
+
+// helloSkew is how far the time a hello was signed may be from the server's clock.
+const helloSkew = 5 * time.Minute
+
+func (ss *Session) writeJSON(v any) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ss.write(websocket.TextMessage, b)
+}
+
+func (ss *Session) sendError(ref, code, reason string) {
+	if err := ss.writeJSON(&protocol.ErrorFrame{Type: protocol.FrameError, Ref: ref, Code: code, Reason: reason}); err != nil {
+		log.Printf("Error writing error frame: %v\n", err)
+	}
+}
+
+func (s *Server) failed(remoteAddr string) {
+	if s.bans.fail(remoteIP(remoteAddr)) {
+		log.Printf("Banning %s for %ds after repeated failed handshakes\n", remoteIP(remoteAddr), s.limits.BanSeconds)
+	}
+}
+
+func (ss *Session) encoding() string {
+	if ss.binary {
+		return protocol.EncodingBinary
+	}
+	return protocol.EncodingJSON
+}
+
+// close sends a close frame so the client can show why it was disconnected.
+func (ss *Session) close(code int, reason string) {
+	ss.wmu.Lock()
+	defer ss.wmu.Unlock()
+	if err := ss.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second)); err != nil {
+		log.Printf("Error writing close: %v\n", err)
+	}
+}
+
+// handshake reads the hello and negotiates the protocol version, closing the
+// connection with a reason when the client can't be accepted. Invalid hellos and
+// unknown users count towards a ban of the remote IP.
+func (s *Server) handshake(c *websocket.Conn, remoteAddr string) (*Session, bool) {
+	ss := &Session{conn: c}
+	c.SetReadDeadline(time.Now().Add(time.Duration(s.limits.HelloTimeout) * time.Second))
+	mt, m, err := c.ReadMessage()
+	if err != nil {
+		log.Printf("Error reading init message from %s: %v\n", remoteAddr, err)
+		if errors.Is(err, websocket.ErrReadLimit) {
+			s.failed(remoteAddr)
+			return nil, false
+		}
+		if ne, ok := err.(net.Error); ok && ne.Timeout() {
+			s.failed(remoteAddr)
+			ss.close(protocol.CloseInvalidHello, "no hello received in time")
+		}
+		return nil, false
+	}
+	c.SetReadDeadline(time.Time{})
+	if mt == websocket.BinaryMessage {
+		// protocol 0 clients sent an untyped binary hello
+		ss.close(protocol.CloseUnsupportedVersion, fmt.Sprintf("protocol 0 is not supported, update the client to protocol %d", protocol.ProtocolVersion))
+		return nil, false
+	}
+	h := &protocol.Hello{}
+	if err := json.Unmarshal(m, h); err != nil || h.Type != protocol.FrameHello {
+		log.Printf("Error parsing init message from %s\n", remoteAddr)
+		s.failed(remoteAddr)
+		ss.close(protocol.CloseInvalidHello, "the first frame must be a hello")
+		return nil, false
+	}
+	version, ok := protocol.NegotiateVersion(h.Versions)
+	if !ok {
+		ss.close(protocol.CloseUnsupportedVersion, fmt.Sprintf("no common protocol version, the server supports %d to %d", protocol.MinProtocolVersion, protocol.ProtocolVersion))
+		return nil, false
+	}
+	if len(h.ID) != 64 {
+		s.failed(remoteAddr)
+		ss.close(protocol.CloseInvalidHello, "invalid user id")
+		return nil, false
+	}
+	if !s.isLocal(h.ID) {
+		log.Printf("User %s not found in USERS\n", h.ID)
+		s.failed(remoteAddr)
+		ss.close(protocol.CloseUnknownUser, "unknown user")
+		return nil, false
+	}
+	if len(h.Device) == 0 {
+		h.Device = "default"
+	}
+	if len(h.Key) > 0 || len(h.Sig) > 0 {
+		if err := protocol.VerifyHello(h, time.Now(), helloSkew); err != nil {
+			log.Printf("Invalid device key from %s: %v\n", remoteAddr, err)
+			s.failed(remoteAddr)
+			ss.close(protocol.CloseInvalidDevice, err.Error())
+			return nil, false
+		}
+	}
+	ss.userID = h.ID
+	ss.device = h.Device
+	ss.key = h.Key
+	ss.grant = h.Grant
+	ss.version = version
+	ss.binary = protocol.NegotiateEncoding(version, h.Encodings) == protocol.EncodingBinary
+	log.Printf("User  %s Connected from %s device %s protocol %d %s\n", h.ID, remoteAddr, h.Device, version, ss.encoding())
+	return ss, true
+}
@@ -0,0 +1,587 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ecies "github.com/ecies/go/v2"
+	"github.com/gorilla/websocket"
+	"ogsma_protocol"
+)
+
+const testTimeout = 5 * time.Second
+
+// testUser is the part of a keystore_gen keystore the tests need.
+type testUser struct {
+	ID      string
+	key     *ecies.PrivateKey
+	mu      sync.Mutex
+	devices map[string]ed25519.PrivateKey // devices are the device keys by device name
+}
+
+// deviceKey returns the key of device, generating it on first use.
+func (u *testUser) deviceKey(t *testing.T, device string) ed25519.PrivateKey {
+	t.Helper()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if k, ok := u.devices[device]; ok {
+		return k
+	}
+	_, k, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.devices[device] = k
+	return k
+}
+
+// hello is a hello for device signed with its key and granted by the user's identity key.
+func (u *testUser) hello(t *testing.T, device string, encodings ...string) *protocol.Hello {
+	t.Helper()
+	h := &protocol.Hello{Type: protocol.FrameHello, ID: u.ID, Device: device, Versions: []int{protocol.ProtocolVersion}, Encodings: encodings}
+	protocol.SignHello(h, u.deviceKey(t, device), time.Now())
+	protocol.GrantDevice(h, u.key.Bytes())
+	return h
+}
+
+func newTestUser(t *testing.T) *testUser {
+	t.Helper()
+	key, err := ecies.GenerateKey()
+	if err != nil {
+		t.Fatalf("generating key: %v", err)
+	}
+	chars := "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_"
+	id := make([]byte, 64)
+	for i := range id {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(chars))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id[i] = chars[n.Int64()]
+	}
+	return &testUser{ID: string(id), key: key, devices: map[string]ed25519.PrivateKey{}}
+}
+
+// testServer is a Server on an ephemeral loopback port with a generated self-signed cert.
+type testServer struct {
+	*Server
+	ts        *httptest.Server
+	roots     *x509.CertPool
+	users     []*testUser
+	config    *Config
+	cert      tls.Certificate
+	conns     *trackingListener
+	closeOnce sync.Once
+}
+
+// trackingListener remembers accepted connections, httptest doesn't close the
+// hijacked websocket ones.
+type trackingListener struct {
+	net.Listener
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+func (l *trackingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.mu.Lock()
+		l.conns = append(l.conns, c)
+		l.mu.Unlock()
+	}
+	return c, err
+}
+
+func (l *trackingListener) closeAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, c := range l.conns {
+		c.Close()
+	}
+}
+
+func newTestServer(t *testing.T, n int) *testServer {
+	t.Helper()
+	return newTestSites(t, n)[0]
+}
+
+// newTestSites starts a federated server per entry of users, each owning that many
+// users and peering with all the others. The certs are signed by one test CA.
+func newTestSites(t *testing.T, users ...int) []*testServer {
+	t.Helper()
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	writePEM(t, caFile, "CERTIFICATE", ca.cert.Raw)
+	sites := make([]*testServer, len(users))
+	var peers []PeerConfig
+	var userKeys []map[string]string
+	for i, n := range users {
+		ts := &testServer{roots: x509.NewCertPool()}
+		ts.roots.AddCert(ca.cert)
+		ts.ts = httptest.NewUnstartedServer(nil)
+		var ids []string
+		keys := map[string]string{}
+		for range n {
+			u := newTestUser(t)
+			ts.users = append(ts.users, u)
+			ids = append(ids, u.ID)
+			keys[u.ID] = base64.StdEncoding.EncodeToString(u.key.PublicKey.Bytes(false))
+		}
+		userKeys = append(userKeys, keys)
+		sites[i] = ts
+		peers = append(peers, PeerConfig{Name: siteName(i), Addr: ts.ts.Listener.Addr().String(), Users: ids})
+	}
+	for i, ts := range sites {
+		cert := ca.issue(t, siteName(i))
+		certFile, keyFile := filepath.Join(dir, siteName(i)+".pem"), filepath.Join(dir, siteName(i)+".key")
+		writePEM(t, certFile, "CERTIFICATE", cert.Certificate[0])
+		key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(t, keyFile, "PRIVATE KEY", key)
+		c := &Config{Endpoint: "ws", Users: peers[i].Users, UserKeys: userKeys[i], CertFile: certFile, KeyFile: keyFile}
+		if len(sites) > 1 {
+			c.Federation = &Federation{CAFile: caFile, Peers: slices.Delete(slices.Clone(peers), i, i+1)}
+		}
+		ts.config, ts.cert = c, cert
+		ts.start(t)
+	}
+	return sites
+}
+
+func (ts *testServer) start(t *testing.T) {
+	t.Helper()
+	var err error
+	if ts.Server, err = newServer(ts.config); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.loadFederation(ts.config); err != nil {
+		t.Fatal(err)
+	}
+	ts.conns = &trackingListener{Listener: ts.ts.Listener}
+	ts.ts.Listener = ts.conns
+	ts.ts.Config.Handler = ts.handler()
+	ts.ts.TLS = ts.tlsConfig()
+	ts.ts.TLS.Certificates = []tls.Certificate{ts.cert}
+	ts.ts.StartTLS()
+	ts.startPeers()
+	go ts.sweepQueues(ts.stop)
+	t.Cleanup(ts.shutdown)
+}
+
+// reconfigure restarts the site with a changed config.
+func (ts *testServer) reconfigure(t *testing.T, change func(c *Config)) {
+	t.Helper()
+	ts.shutdown()
+	change(ts.config)
+	ts.restart(t)
+}
+
+// restart brings a shut down site back on the same address with empty state.
+func (ts *testServer) restart(t *testing.T) {
+	t.Helper()
+	l, err := net.Listen("tcp", ts.conns.Addr().String())
+	if err != nil {
+		t.Fatalf("relisten: %v", err)
+	}
+	ts.ts = &httptest.Server{Listener: l, Config: &http.Server{}}
+	ts.closeOnce = sync.Once{}
+	ts.start(t)
+}
+
+func siteName(i int) string {
+	return fmt.Sprintf("site%d", i)
+}
+
+// shutdown stops the peer links and closes every connection, like the process exiting.
+func (ts *testServer) shutdown() {
+	ts.closeOnce.Do(func() {
+		close(ts.stop)
+		ts.conns.closeAll()
+		ts.ts.Close()
+		ts.store.Close()
+	})
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ogsma test CA"},
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// issue returns a 127.0.0.1 cert for name usable as both server and federation client cert.
+func (ca *testCA) issue(t *testing.T, name string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func writePEM(t *testing.T, file, blockType string, der []byte) {
+	t.Helper()
+	if err := os.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// queued returns the number of messages queued for a device of userID.
+func (ts *testServer) queued(userID, device string) int {
+	n, err := ts.store.QueueLen(userID, device)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+func (ts *testServer) online(userID, device string) bool {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	_, ok := ts.websockets[userID][device]
+	return ok
+}
+
+// waitFor polls cond until it holds or the test times out.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(testTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testClient speaks the same protocol as the client's Client: a hello, pings every
+// half second to stay inside the server timeout and JSON or binary frames.
+type testClient struct {
+	user      *testUser
+	device    string
+	binary    bool // binary is set when the server agreed to the binary encoding
+	conn      *websocket.Conn
+	wmu       sync.Mutex
+	closeOnce sync.Once
+	frames    chan []byte
+	closed    chan struct{}
+	closeErr  error // closeErr is set before closed is closed
+	done      chan struct{}
+}
+
+func (ts *testServer) dial(t *testing.T) *websocket.Conn {
+	t.Helper()
+	d := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: ts.roots}, HandshakeTimeout: testTimeout}
+	conn, _, err := d.Dial("wss://"+strings.TrimPrefix(ts.ts.URL, "https://")+"/ws", nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return conn
+}
+
+func (ts *testServer) connect(t *testing.T, u *testUser, device string) *testClient {
+	t.Helper()
+	return ts.connectEncoding(t, u, device, protocol.EncodingJSON)
+}
+
+// connectEncoding connects offering encoding and checks the server agreed to it.
+func (ts *testServer) connectEncoding(t *testing.T, u *testUser, device, encoding string) *testClient {
+	t.Helper()
+	c := &testClient{
+		user:   u,
+		device: device,
+		conn:   ts.dial(t),
+		frames: make(chan []byte, 64),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	hello, _ := json.Marshal(u.hello(t, device, encoding))
+	if err := c.write(websocket.TextMessage, hello); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	go c.read()
+	go c.keepAlive()
+	t.Cleanup(c.close)
+	w := &protocol.Welcome{}
+	if err := json.Unmarshal(c.next(t), w); err != nil || w.Type != protocol.FrameWelcome {
+		t.Fatalf("expected a welcome, got %+v: %v", w, err)
+	}
+	if w.Version != protocol.ProtocolVersion || w.Device != device || w.Encoding != encoding {
+		t.Fatalf("welcome %+v, want version %d device %s encoding %s", w, protocol.ProtocolVersion, device, encoding)
+	}
+	c.binary = encoding == protocol.EncodingBinary
+	return c
+}
+
+// connectRaw dials and sends hello without waiting for registration, for hellos the server rejects.
+func (ts *testServer) connectRaw(t *testing.T, messageType int, hello []byte) *testClient {
+	t.Helper()
+	c := &testClient{
+		conn:   ts.dial(t),
+		frames: make(chan []byte, 64),
+		closed: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if err := c.write(messageType, hello); err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+	go c.read()
+	t.Cleanup(c.close)
+	return c
+}
+
+func (c *testClient) write(messageType int, data []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	return c.conn.WriteMessage(messageType, data)
+}
+
+func (c *testClient) read() {
+	defer close(c.closed)
+	for {
+		_, m, err := c.conn.ReadMessage()
+		if err != nil {
+			c.closeErr = err
+			return
+		}
+		select {
+		case c.frames <- m:
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func (c *testClient) keepAlive() {
+	t := time.NewTicker(500 * time.Millisecond)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+			c.write(websocket.PingMessage, []byte("ping"))
+		}
+	}
+}
+
+func (c *testClient) close() {
+	c.closeOnce.Do(c.shutdown)
+}
+
+func (c *testClient) shutdown() {
+	close(c.done)
+	c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.conn.Close()
+	<-c.closed
+}
+
+// send encrypts text for to and, like the client, a self copy for the sender's other devices.
+func (c *testClient) send(t *testing.T, to *testUser, text string) {
+	t.Helper()
+	ct, err := ecies.Encrypt(to.key.PublicKey, []byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	self, err := ecies.Encrypt(c.user.key.PublicKey, []byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.writeMsg(&protocol.Msg{Type: protocol.FrameMessage, ID: to.ID, Message: ct, TimeStamp: time.Now(), FromID: c.user.ID, Self: self}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+}
+
+// writeMsg writes m in the encoding negotiated at connect.
+func (c *testClient) writeMsg(m *protocol.Msg) error {
+	if c.binary {
+		b, err := protocol.EncodeBinary(m)
+		if err != nil {
+			return err
+		}
+		return c.write(websocket.BinaryMessage, b)
+	}
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return c.write(websocket.TextMessage, b)
+}
+
+// decodeMsg decodes a JSON or binary frame.
+func decodeMsg(f []byte) (*protocol.Msg, error) {
+	if protocol.IsBinaryFrame(f) {
+		return protocol.DecodeBinary(f)
+	}
+	m := &protocol.Msg{}
+	return m, json.Unmarshal(f, m)
+}
+
+// receive returns the next message frame, skipping acks, presence and typing frames.
+func (c *testClient) receive(t *testing.T) *protocol.Msg {
+	t.Helper()
+	for {
+		f := c.next(t)
+		m, err := decodeMsg(f)
+		if err != nil {
+			t.Fatalf("invalid frame %q: %v", f, err)
+		}
+		if m.Type == protocol.FrameMessage {
+			return m
+		}
+	}
+}
+
+// next returns the next frame, frames read before the connection closed are still returned.
+func (c *testClient) next(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case f := <-c.frames:
+		return f
+	case <-c.closed:
+		select {
+		case f := <-c.frames:
+			return f
+		default:
+			t.Fatal("connection closed while waiting for a message")
+		}
+	case <-time.After(testTimeout):
+		t.Fatal("timed out waiting for a message")
+	}
+	return nil
+}
+
+// expectNothing checks no message frame arrives within d.
+func (c *testClient) expectNothing(t *testing.T, d time.Duration) {
+	t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case f := <-c.frames:
+			if m, err := decodeMsg(f); err == nil && m.Type != protocol.FrameMessage {
+				continue
+			}
+			t.Fatalf("unexpected frame %q", f)
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// receiveText decrypts the next message, using the self copy when it was sent by this user.
+func (c *testClient) receiveText(t *testing.T) (from, text string) {
+	t.Helper()
+	m := c.receive(t)
+	ct := m.Message
+	if m.FromID == c.user.ID {
+		ct = m.Self
+	}
+	pt, err := ecies.Decrypt(c.user.key, ct)
+	if err != nil {
+		t.Fatalf("decrypting message from %s: %v", m.FromID, err)
+	}
+	return m.FromID, string(pt)
+}
+
+// expectClosed waits for the server to close the connection and returns the close code and reason.
+func (c *testClient) expectClosed(t *testing.T) (int, string) {
+	t.Helper()
+	select {
+	case <-c.closed:
+	case <-time.After(testTimeout):
+		t.Fatal("connection was not closed")
+	}
+	if ce, ok := c.closeErr.(*websocket.CloseError); ok {
+		return ce.Code, ce.Text
+	}
+	return 0, ""
+}
+
+// expectFrame returns the next frame of the given type, skipping others.
+func (c *testClient) expectFrame(t *testing.T, frameType string, v any) {
+	t.Helper()
+	for {
+		b := c.next(t)
+		if protocol.IsBinaryFrame(b) {
+			m, err := protocol.DecodeBinary(b)
+			if err != nil {
+				t.Fatalf("invalid binary frame: %v", err)
+			}
+			b, _ = json.Marshal(m)
+		}
+		f := &protocol.Frame{}
+		if err := json.Unmarshal(b, f); err != nil {
+			t.Fatalf("invalid frame %q: %v", b, err)
+		}
+		if f.Type == frameType {
+			if err := json.Unmarshal(b, v); err != nil {
+				t.Fatal(err)
+			}
+			return
+		}
+	}
+}
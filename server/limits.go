@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Limits protects the websocket endpoint, zero fields use the defaults below.
+type Limits struct {
+	MaxMessageSize int64   `json:"maxMessageSize,omitempty"` // MaxMessageSize is the largest frame read, in bytes
+	HelloTimeout   int     `json:"helloTimeout,omitempty"`   // HelloTimeout is the seconds a client has to send its hello
+	ConnectRate    float64 `json:"connectRate,omitempty"`    // ConnectRate is connection attempts per second per IP
+	ConnectBurst   int     `json:"connectBurst,omitempty"`
+	FrameRate      float64 `json:"frameRate,omitempty"` // FrameRate is frames per second per user, across devices
+	FrameBurst     int     `json:"frameBurst,omitempty"`
+	BanAfter       int     `json:"banAfter,omitempty"` // BanAfter failed handshakes from an IP ban it
+	BanSeconds     int     `json:"banSeconds,omitempty"`
+	QueueFrames    int     `json:"queueFrames,omitempty"` // QueueFrames is the most frames queued for one device
+}
+
+func (l *Limits) withDefaults() *Limits {
+	d := Limits{}
+	if l != nil {
+		d = *l
+	}
+	if d.MaxMessageSize == 0 {
+		d.MaxMessageSize = 1 << 20
+	}
+	if d.HelloTimeout == 0 {
+		d.HelloTimeout = 5
+	}
+	if d.ConnectRate == 0 {
+		d.ConnectRate = 2
+	}
+	if d.ConnectBurst == 0 {
+		d.ConnectBurst = 20
+	}
+	if d.FrameRate == 0 {
+		d.FrameRate = 20
+	}
+	if d.FrameBurst == 0 {
+		d.FrameBurst = 100
+	}
+	if d.BanAfter == 0 {
+		d.BanAfter = 10
+	}
+	if d.BanSeconds == 0 {
+		d.BanSeconds = 600
+	}
+	if d.QueueFrames == 0 {
+		d.QueueFrames = 1000
+	}
+	return &d
+}
+
+// limiter keeps a token bucket per key, buckets idle for idleAfter are dropped.
+type limiter struct {
+	mu        sync.Mutex
+	limit     rate.Limit
+	burst     int
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	*rate.Limiter
+	lastUsed time.Time
+}
+
+const idleAfter = 10 * time.Minute
+
+func newLimiter(perSecond float64, burst int) *limiter {
+	return &limiter{limit: rate.Limit(perSecond), burst: burst, buckets: make(map[string]*bucket), lastSweep: time.Now()}
+}
+
+func (l *limiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) > idleAfter {
+		for k, b := range l.buckets {
+			if now.Sub(b.lastUsed) > idleAfter {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{Limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.buckets[key] = b
+	}
+	b.lastUsed = now
+	return b.AllowN(now, 1)
+}
+
+// banList bans an IP for a while after repeated failed handshakes.
+type banList struct {
+	mu        sync.Mutex
+	after     int
+	duration  time.Duration
+	failures  map[string]*failures
+	lastSweep time.Time
+}
+
+type failures struct {
+	count int
+	since time.Time
+	until time.Time // until is set while the IP is banned
+}
+
+func newBanList(after int, duration time.Duration) *banList {
+	return &banList{after: after, duration: duration, failures: make(map[string]*failures), lastSweep: time.Now()}
+}
+
+func (b *banList) banned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f, ok := b.failures[ip]
+	return ok && time.Now().Before(f.until)
+}
+
+// fail records a failed handshake, it reports whether the IP is now banned.
+// Failures older than the ban duration are forgotten.
+func (b *banList) fail(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if now.Sub(b.lastSweep) > time.Minute {
+		for k, f := range b.failures {
+			if now.Sub(f.since) > b.duration && now.After(f.until) {
+				delete(b.failures, k)
+			}
+		}
+		b.lastSweep = now
+	}
+	f, ok := b.failures[ip]
+	if ok && now.Sub(f.since) > b.duration {
+		f.count, f.since = 0, now
+	}
+	if !ok {
+		f = &failures{since: now}
+		b.failures[ip] = f
+	}
+	f.count++
+	if f.count >= b.after {
+		f.until = now.Add(b.duration)
+		f.count = 0
+		f.since = now
+		return true
+	}
+	return false
+}
+
+func remoteIP(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ogsma_protocol"
+)
+
+func TestFrameRateLimit(t *testing.T) {
+	ts := newTestServer(t, 2)
+	ts.reconfigure(t, func(c *Config) { c.Limits = &Limits{FrameRate: 0.5, FrameBurst: 3} })
+	alice, bob := ts.users[0], ts.users[1]
+	a := ts.connect(t, alice, "default")
+	b := ts.connect(t, bob, "default")
+	for range 4 {
+		a.send(t, bob, "flood")
+	}
+	e := &protocol.ErrorFrame{}
+	a.expectFrame(t, protocol.FrameError, e)
+	if e.Code != protocol.ErrRateLimited {
+		t.Errorf("error %+v, want %s", e, protocol.ErrRateLimited)
+	}
+	for range 3 {
+		b.receive(t)
+	}
+	b.expectNothing(t, 200*time.Millisecond)
+}
+
+func TestReadLimit(t *testing.T) {
+	ts := newTestServer(t, 2)
+	ts.reconfigure(t, func(c *Config) { c.Limits = &Limits{MaxMessageSize: 1024} })
+	alice, bob := ts.users[0], ts.users[1]
+	a := ts.connect(t, alice, "default")
+	m, _ := json.Marshal(&protocol.Msg{Type: protocol.FrameMessage, ID: bob.ID, Message: bytes.Repeat([]byte("x"), 2048), FromID: alice.ID})
+	if err := a.write(websocket.TextMessage, m); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := a.expectClosed(t); code != websocket.CloseMessageTooBig {
+		t.Errorf("closed with %d, want %d", code, websocket.CloseMessageTooBig)
+	}
+}
+
+func TestHelloTimeout(t *testing.T) {
+	ts := newTestServer(t, 1)
+	ts.reconfigure(t, func(c *Config) { c.Limits = &Limits{HelloTimeout: 1} })
+	c := ts.connectRaw(t, websocket.PingMessage, nil)
+	if code, reason := c.expectClosed(t); code != protocol.CloseInvalidHello {
+		t.Errorf("closed with %d %q, want %d", code, reason, protocol.CloseInvalidHello)
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.websockets) != 0 {
+		t.Errorf("silent connection registered sessions: %v", ts.websockets)
+	}
+}
+
+func (ts *testServer) dialStatus(t *testing.T) int {
+	t.Helper()
+	d := websocket.Dialer{TLSClientConfig: &tls.Config{RootCAs: ts.roots}, HandshakeTimeout: testTimeout}
+	conn, resp, err := d.Dial("wss://"+strings.TrimPrefix(ts.ts.URL, "https://")+"/ws", nil)
+	if err == nil {
+		conn.Close()
+	}
+	if resp == nil {
+		t.Fatalf("dial: %v", err)
+	}
+	return resp.StatusCode
+}
+
+func TestConnectRateLimit(t *testing.T) {
+	ts := newTestServer(t, 1)
+	ts.reconfigure(t, func(c *Config) { c.Limits = &Limits{ConnectRate: 0.01, ConnectBurst: 2} })
+	for i, want := range []int{http.StatusSwitchingProtocols, http.StatusSwitchingProtocols, http.StatusTooManyRequests} {
+		if got := ts.dialStatus(t); got != want {
+			t.Errorf("attempt %d: status %d, want %d", i+1, got, want)
+		}
+	}
+}
+
+func TestBanAfterFailedHandshakes(t *testing.T) {
+	ts := newTestServer(t, 1)
+	ts.reconfigure(t, func(c *Config) { c.Limits = &Limits{BanAfter: 2, BanSeconds: 60} })
+	stranger := newTestUser(t)
+	hello, _ := json.Marshal(&protocol.Hello{Type: protocol.FrameHello, ID: stranger.ID, Device: "default", Versions: []int{protocol.ProtocolVersion}})
+	for range 2 {
+		c := ts.connectRaw(t, websocket.TextMessage, hello)
+		if code, _ := c.expectClosed(t); code != protocol.CloseUnknownUser {
+			t.Fatalf("closed with %d, want %d", code, protocol.CloseUnknownUser)
+		}
+	}
+	if got := ts.dialStatus(t); got != http.StatusForbidden {
+		t.Errorf("status %d after repeated failures, want %d", got, http.StatusForbidden)
+	}
+}
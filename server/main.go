@@ -1,56 +1,345 @@
 package main
 
 import (
-	_ "embed"
+	"bytes"
+	"crypto/x509"
+	"embed"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"slices"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
+	"ogsma_protocol"
 )
 
 var (
-	//go:embed config.json
-	configFile []byte
+	// defaults holds the build time config.json
+	//go:embed all:defaults
+	defaults embed.FS
 )
 
 type Config struct {
-	Port     int      `json:"port"`
-	Endpoint string   `json:"endpoint"`
-	CertFile string   `json:"certFile"`
-	KeyFile  string   `json:"keyFile"`
-	Users    []string `json:"users"`
+	Port       int               `json:"port"`
+	Endpoint   string            `json:"endpoint"`
+	CertFile   string            `json:"certFile"`
+	KeyFile    string            `json:"keyFile"`
+	Users      []string          `json:"users"`
+	UserKeys   map[string]string `json:"userKeys,omitempty"` // UserKeys are the base64 identity public keys of the users, new devices must be granted by them
+	Federation *Federation       `json:"federation,omitempty"`
+	Store      *StoreConfig      `json:"store,omitempty"`
+	Limits     *Limits           `json:"limits,omitempty"`
+	Policy     *Policy           `json:"policy,omitempty"`
+	DeviceTTL  int               `json:"deviceTTL,omitempty"` // DeviceTTL is the days a device can stay away before it and its queue are removed, 90 when unset
 }
 
 type Server struct {
-	endpoint     string
-	websockets   map[string]*websocket.Conn
-	messageQueue map[string][][]byte
-	tlsPort      int
-	cert         string
-	key          string
-	upgrader     websocket.Upgrader
-	users        []string
+	endpoint   string
+	mu         sync.Mutex
+	websockets map[string]map[string]*Session // user ID -> device ID -> session
+	store      Store
+	presence   map[string]*protocol.Presence
+	tlsPort    int
+	cert       string
+	key        string
+	upgrader   websocket.Upgrader
+	peers      []*peer
+	peerUsers  map[string]*peer // user ID -> peer the user connects to
+	peerCAs    *x509.CertPool
+	stop       chan struct{}
+	limits     *Limits
+	connects   *limiter // connects limits connection attempts per IP
+	frames     *limiter // frames limits frames per user
+	bans       *banList
+	policy     *routingPolicy
+	deviceTTL  time.Duration
+	userKeys   map[string][]byte // userKeys are the identity public keys by user ID
+	started    time.Time         // started stands in for the last seen time of devices registered before it was stored
 }
 
-type MessageTemplate struct {
-	ID  string `json:"id"`
-	Msg []byte `json:"msg"`
+// Session is a single device connection, writes are serialized since
+// messages for a device can arrive from any other connection goroutine.
+type Session struct {
+	conn    *websocket.Conn
+	userID  string
+	device  string
+	key     []byte // key is the device's public key, empty for devices without one
+	grant   []byte // grant is the identity key's signature of key, checked when the device registers
+	version int    // version is the negotiated protocol version
+	binary  bool   // binary is set when the device negotiated the binary encoding
+	wmu     sync.Mutex
 }
 
-func (s *Server) oc() func(r *http.Request) bool {
+func (ss *Session) write(messageType int, data []byte) error {
+	ss.wmu.Lock()
+	defer ss.wmu.Unlock()
+	return ss.conn.WriteMessage(messageType, data)
+}
+
+// send writes a routed frame, binary frames are converted to JSON for devices
+// that didn't negotiate the binary encoding, and lose their expiry for version 2
+// devices that can't read it.
+func (ss *Session) send(frame []byte) error {
+	if !protocol.IsBinaryFrame(frame) {
+		return ss.write(websocket.TextMessage, frame)
+	}
+	if ss.binary && (ss.version >= 3 || frame[0]&protocol.BinaryExpires == 0) {
+		return ss.write(websocket.BinaryMessage, frame)
+	}
+	m, err := protocol.DecodeBinary(frame)
+	if err != nil {
+		return err
+	}
+	if !ss.binary {
+		return ss.writeJSON(m)
+	}
+	m.Expires = time.Time{}
+	b, err := protocol.EncodeBinary(m)
+	if err != nil {
+		return err
+	}
+	return ss.write(websocket.BinaryMessage, b)
+}
+
+// register adds the session to the user's devices. A device registered with a key
+// must connect with the same key, a new device needs a key granted by the user's
+// identity key. Only devices registered before keys existed connect without one.
+func (s *Server) register(userID string, ss *Session) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, err := s.store.Device(userID, ss.device)
+	registered := err == nil
+	switch {
+	case errors.Is(err, errNotFound):
+	case err != nil:
+		return nil, fmt.Errorf("reading device: %v", err)
+	case len(d.Key) > 0 && !bytes.Equal(d.Key, ss.key):
+		return nil, errors.New("the device is registered with another key")
+	}
+	switch {
+	case len(d.Key) > 0:
+	case len(ss.key) > 0:
+		if err := s.verifyGrant(userID, ss); err != nil {
+			return nil, err
+		}
+	case !registered:
+		return nil, errors.New("a new device must connect with a signed key")
+	}
+	added, err := s.store.AddDevice(userID, Device{Name: ss.device, Key: ss.key, LastSeen: time.Now()})
+	if err != nil {
+		log.Printf("Error registering device %s of %s: %v\n", ss.device, userID, err)
+	}
+	if added {
+		// a device registering for the first time picks up anything queued before the user had devices
+		pending, err := s.store.Take(userID, "")
+		if err != nil {
+			log.Printf("Error reading pending messages for %s: %v\n", userID, err)
+		}
+		if len(pending) > 0 {
+			devices, err := s.store.Devices(userID)
+			if err != nil {
+				log.Printf("Error reading devices of %s: %v\n", userID, err)
+			}
+			for _, d := range devices {
+				for _, m := range pending {
+					s.enqueue(userID, d, m)
+				}
+			}
+		}
+	}
+	if s.websockets[userID] == nil {
+		s.websockets[userID] = make(map[string]*Session)
+	}
+	s.websockets[userID][ss.device] = ss
+	queued, err := s.store.Take(userID, ss.device)
+	if err != nil {
+		log.Printf("Error reading queued messages for %s device %s: %v\n", userID, ss.device, err)
+	}
+	return queued, nil
+}
+
+// verifyGrant checks the device key of ss is signed by the user's identity key.
+func (s *Server) verifyGrant(userID string, ss *Session) error {
+	identity, ok := s.userKeys[userID]
+	if !ok {
+		return errors.New("no identity key is configured for the user, add it to userKeys")
+	}
+	return protocol.VerifyGrant(&protocol.Hello{ID: userID, Device: ss.device, Key: ss.key, Grant: ss.grant}, identity)
+}
+
+func (s *Server) unregister(userID string, ss *Session) {
+	s.mu.Lock()
+	if s.websockets[userID][ss.device] != ss {
+		s.mu.Unlock()
+		return
+	}
+	log.Printf("removing websocket session for %s device %s\n", userID, ss.device)
+	if _, err := s.store.AddDevice(userID, Device{Name: ss.device, LastSeen: time.Now()}); err != nil {
+		log.Printf("Error updating device %s of %s: %v\n", ss.device, userID, err)
+	}
+	delete(s.websockets[userID], ss.device)
+	if len(s.websockets[userID]) == 0 {
+		delete(s.websockets, userID)
+	}
+	s.mu.Unlock()
+	s.userOffline(userID)
+}
+
+var errQueueFull = errors.New("the recipient's queue is full")
+
+func (s *Server) enqueue(userID, device string, message []byte) {
+	if err := s.store.Enqueue(userID, device, message, expiresAt(message)); err != nil {
+		log.Printf("Error queueing message for %s device %s, dropped: %v\n", userID, device, err)
+	}
+}
+
+// route forwards a message or receipt to the peer serving its recipient or
+// delivers it locally. It returns errUnknownRecipient for a user that is
+// neither a peer's nor one of ours, so nothing is queued for it.
+func (s *Server) route(f *protocol.Frame, message []byte) error {
+	forwarded, err := s.forward(f, message)
+	switch {
+	case err != nil:
+		return err
+	case forwarded:
+		return nil
+	case !s.isLocal(f.ID):
+		return errUnknownRecipient
+	}
+	return s.deliver(f.ID, "", message)
+}
+
+var errUnknownRecipient = errors.New("the recipient is not a user of this server or its peers")
+
+// routeErrorCode is the error frame code for an error returned by route.
+func routeErrorCode(err error) string {
+	if errors.Is(err, errUnknownRecipient) {
+		return protocol.ErrUnknownUser
+	}
+	return protocol.ErrQueueFull
+}
+
+func (s *Server) isLocal(userID string) bool {
+	ok, err := s.store.HasUser(userID)
+	if err != nil {
+		log.Printf("Error looking up user %s: %v\n", userID, err)
+	}
+	return ok
+}
+
+// deliver sends message to every device of userID except skipDevice,
+// queueing it for devices that are currently offline. It delivers nothing and
+// returns errQueueFull when the queue of one of those devices is full.
+func (s *Server) deliver(userID, skipDevice string, message []byte) error {
+	s.mu.Lock()
+	var online []*Session
+	var offline []string
+	devices, err := s.store.Devices(userID)
+	if err != nil {
+		log.Printf("Error reading devices of %s: %v\n", userID, err)
+	}
+	if len(devices) == 0 {
+		offline = append(offline, "")
+	}
+	for _, d := range devices {
+		if d == skipDevice {
+			continue
+		}
+		if ss, ok := s.websockets[userID][d]; ok {
+			online = append(online, ss)
+		} else {
+			offline = append(offline, d)
+		}
+	}
+	for _, d := range offline {
+		n, err := s.store.QueueLen(userID, d)
+		if err != nil {
+			log.Printf("Error reading the queue of %s device %s: %v\n", userID, d, err)
+		}
+		if n >= s.limits.QueueFrames {
+			s.mu.Unlock()
+			log.Printf("Dropping message for %s: the queue of device %s is full\n", userID, d)
+			return errQueueFull
+		}
+	}
+	for _, d := range offline {
+		s.enqueue(userID, d, message)
+	}
+	s.mu.Unlock()
+	for _, ss := range online {
+		if err := ss.send(message); err != nil {
+			log.Printf("Error writing message to %s device %s: %v\n", userID, ss.device, err)
+			s.mu.Lock()
+			s.enqueue(userID, ss.device, message)
+			s.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+func oc() func(r *http.Request) bool {
 	return func(r *http.Request) bool {
 		return true
 	}
 }
 
-func (s *Server) start() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+func newServer(c *Config) (*Server, error) {
+	policy, err := newRoutingPolicy(c.Policy)
+	if err != nil {
+		return nil, err
+	}
+	store, err := openStore(c.Store)
+	if err != nil {
+		return nil, fmt.Errorf("opening store: %v", err)
+	}
+	// the config is the source of the user list, the store only keeps a copy
+	if err := store.SetUsers(c.Users); err != nil {
+		store.Close()
+		return nil, fmt.Errorf("storing users: %v", err)
+	}
+	userKeys := make(map[string][]byte, len(c.UserKeys))
+	for id, k := range c.UserKeys {
+		if userKeys[id], err = base64.StdEncoding.DecodeString(k); err != nil {
+			store.Close()
+			return nil, fmt.Errorf("decoding the key of user %s: %v", id, err)
+		}
+	}
+	limits := c.Limits.withDefaults()
+	deviceTTL := c.DeviceTTL
+	if deviceTTL == 0 {
+		deviceTTL = 90
+	}
+	return &Server{
+		policy:     policy,
+		limits:     limits,
+		connects:   newLimiter(limits.ConnectRate, limits.ConnectBurst),
+		frames:     newLimiter(limits.FrameRate, limits.FrameBurst),
+		bans:       newBanList(limits.BanAfter, time.Duration(limits.BanSeconds)*time.Second),
+		endpoint:   c.Endpoint,
+		tlsPort:    c.Port,
+		cert:       c.CertFile,
+		key:        c.KeyFile,
+		websockets: make(map[string]map[string]*Session),
+		store:      store,
+		deviceTTL:  time.Duration(deviceTTL) * 24 * time.Hour,
+		userKeys:   userKeys,
+		started:    time.Now(),
+		presence:   make(map[string]*protocol.Presence),
+		upgrader:   websocket.Upgrader{CheckOrigin: oc()},
+		stop:       make(chan struct{}),
+	}, nil
+}
+
+func (s *Server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		fmt.Printf("%s %s %s\n", r.RemoteAddr, r.Method, r.URL)
 		pll := r.ContentLength
 		if pll > 0 {
@@ -63,115 +352,201 @@ func (s *Server) start() {
 		http.Redirect(w, r, "https://youtu.be/dQw4w9WgXcQ", http.StatusMovedPermanently) // ROFL
 		return
 	})
-	http.HandleFunc(fmt.Sprintf("/%s", s.endpoint), func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(federationPath, s.servePeer)
+	mux.HandleFunc(fmt.Sprintf("/%s", s.endpoint), func(w http.ResponseWriter, r *http.Request) {
 		var currentUserID string
-		s.upgrader.CheckOrigin = s.oc()
+		ip := remoteIP(r.RemoteAddr)
+		if s.bans.banned(ip) {
+			http.Error(w, "too many failed attempts, try again later", http.StatusForbidden)
+			return
+		}
+		if !s.connects.allow(ip) {
+			log.Printf("Connection rate limit hit by %s\n", ip)
+			http.Error(w, "too many connection attempts", http.StatusTooManyRequests)
+			return
+		}
 		c, err := s.upgrader.Upgrade(w, r, nil)
 		if err != nil {
 			log.Println("upgrade to websocket conn:", err)
 			return
 		}
-		pmt, pm, err := c.ReadMessage()
+		defer c.Close()
+		c.SetReadLimit(s.limits.MaxMessageSize)
+		ss, ok := s.handshake(c, r.RemoteAddr)
+		if !ok {
+			return
+		}
+		currentUserID = ss.userID
+		queued, err := s.register(currentUserID, ss)
 		if err != nil {
-			log.Printf("Error reading init message: %v\n", err)
+			log.Printf("Rejected device %s of %s: %v\n", ss.device, currentUserID, err)
+			s.failed(r.RemoteAddr)
+			ss.close(protocol.CloseInvalidDevice, err.Error())
 			return
 		}
-		if pmt == websocket.BinaryMessage {
-			prs := struct {
-				ID string `json:"id"`
-			}{}
-			if err := json.Unmarshal(pm, &prs); err != nil {
-				log.Printf("Error parsing init message: %v\n", err)
-			}
-			if len(prs.ID) != 64 {
-				return
-			}
-			// TODO : check if id is in s.users
-			if !slices.Contains(s.users, prs.ID) {
-				log.Printf("User %s not found in USERS\n", prs.ID)
-				return
-			}
-			currentUserID = prs.ID
-			s.websockets[prs.ID] = c
-			log.Printf("User  %s Connected from %s\n", prs.ID, r.RemoteAddr)
-		} else {
-			log.Printf("Error parsing init message: %v\n", string(pm))
+		if err := ss.writeJSON(&protocol.Welcome{Type: protocol.FrameWelcome, Version: ss.version, Device: ss.device, Encoding: ss.encoding()}); err != nil {
+			log.Printf("Error writing welcome: %v\n", err)
+			s.unregister(currentUserID, ss)
 			return
 		}
 
+		var timeoutMu sync.Mutex
 		websocketTimeout := time.Now()
 		c.SetPingHandler(func(m string) error {
+			timeoutMu.Lock()
 			websocketTimeout = time.Now()
-			if err := c.WriteMessage(websocket.PongMessage, []byte("pong")); err != nil {
+			timeoutMu.Unlock()
+			if err := ss.write(websocket.PongMessage, []byte("pong")); err != nil {
 				return errors.New("websocket pong: " + err.Error())
 			}
 			return nil
 		})
 		go func() {
 			for {
-				if time.Now().Sub(websocketTimeout) > time.Second*3 {
-					log.Printf("removing websocket session for %s\n", currentUserID)
-					delete(s.websockets, currentUserID)
+				time.Sleep(250 * time.Millisecond)
+				timeoutMu.Lock()
+				expired := time.Now().Sub(websocketTimeout) > time.Second*3
+				timeoutMu.Unlock()
+				if expired {
+					s.unregister(currentUserID, ss)
 					return
 				}
 			}
 		}()
-		if val, ok := s.messageQueue[currentUserID]; ok {
-			for i := 0; i < len(val); i++ {
-				if err := s.websockets[currentUserID].WriteMessage(websocket.TextMessage, val[i]); err != nil {
-					log.Printf("Error writing message: %v\n", err)
-					return
+		s.sendKnownPresence(currentUserID, ss)
+		for i := 0; i < len(queued); i++ {
+			if err := ss.send(queued[i]); err != nil {
+				log.Printf("Error writing message: %v\n", err)
+				s.mu.Lock()
+				for _, m := range queued[i:] {
+					s.enqueue(currentUserID, ss.device, m)
 				}
+				s.mu.Unlock()
+				s.unregister(currentUserID, ss)
+				return
 			}
-			delete(s.messageQueue, currentUserID)
 		}
 		for {
 			messageType, message, err := c.ReadMessage()
 			if err != nil {
 				log.Printf("Error reading message: %v\n", err)
-				log.Printf("removing websocket session for %s\n", currentUserID)
-				delete(s.websockets, currentUserID)
+				s.unregister(currentUserID, ss)
 				return
 			}
-			switch messageType {
-			case websocket.TextMessage:
-				mt := &MessageTemplate{}
-				if err := json.Unmarshal(message, mt); err != nil {
-					log.Printf("Error parsing message: %v\n", err)
+			if !s.frames.allow(currentUserID) {
+				ss.sendError("", protocol.ErrRateLimited, "too many frames, slow down")
+				continue
+			}
+			f := &protocol.Frame{}
+			if messageType == websocket.BinaryMessage {
+				if !ss.binary {
+					ss.sendError("", protocol.ErrInvalidFrame, "binary frames need the binary encoding")
+					continue
+				}
+				// only the routing header is read, the ciphertexts are forwarded untouched
+				if f, _, err = protocol.DecodeRoute(message); err != nil {
+					log.Printf("Error parsing binary frame: %v\n", err)
+					ss.close(websocket.CloseInvalidFramePayloadData, "malformed binary frame")
+					s.unregister(currentUserID, ss)
 					return
 				}
-				if value, ok := s.websockets[mt.ID]; ok {
-					if err := value.WriteMessage(messageType, message); err != nil {
-						log.Printf("Error writing message: %v\n", err)
-						return
+			} else if err := json.Unmarshal(message, f); err != nil {
+				log.Printf("Error parsing message: %v\n", err)
+				ss.close(websocket.CloseInvalidFramePayloadData, "frames must be JSON")
+				s.unregister(currentUserID, ss)
+				return
+			}
+			if (f.Type == protocol.FrameMessage || f.Type == protocol.FrameTyping || f.Type == protocol.FrameReceipt) && f.From != currentUserID {
+				ss.sendError(f.Ref, protocol.ErrForbidden, "from does not match the authenticated user")
+				continue
+			}
+			if (f.Type == protocol.FrameMessage || f.Type == protocol.FrameReceipt) && !s.policy.allows(currentUserID, f.ID) {
+				ss.sendError(f.Ref, protocol.ErrForbidden, "the routing policy does not allow messages to this user")
+				continue
+			}
+			if f.Type == protocol.FrameTyping && !s.policy.allows(currentUserID, f.ID) {
+				continue
+			}
+			switch f.Type {
+			case protocol.FramePresence:
+				p := &protocol.Presence{}
+				if err := json.Unmarshal(message, p); err != nil {
+					log.Printf("Error parsing presence: %v\n", err)
+					ss.sendError(f.Ref, protocol.ErrInvalidFrame, "invalid presence frame")
+					continue
+				}
+				s.updatePresence(currentUserID, p)
+			case protocol.FrameTyping:
+				if forwarded, _ := s.forward(f, message); !forwarded {
+					s.deliverOnline(f.ID, "", message)
+				}
+			case protocol.FrameReceipt:
+				if err := s.route(f, message); err != nil {
+					ss.sendError(f.Ref, routeErrorCode(err), err.Error())
+				}
+			case protocol.FrameMessage:
+				if f.ID == currentUserID {
+					if err := s.deliver(f.ID, ss.device, message); err != nil {
+						ss.sendError(f.Ref, protocol.ErrQueueFull, err.Error())
+						continue
 					}
 				} else {
-					s.messageQueue[mt.ID] = append(s.messageQueue[mt.ID], message)
+					if err := s.route(f, message); err != nil {
+						ss.sendError(f.Ref, routeErrorCode(err), err.Error())
+						continue
+					}
+					// copy to the sender's other devices so their conversations stay in sync,
+					// a full queue there was logged and doesn't fail the message
+					_ = s.deliver(currentUserID, ss.device, message)
+				}
+				if err := ss.writeJSON(&protocol.Ack{Type: protocol.FrameAck, Ref: f.Ref}); err != nil {
+					log.Printf("Error writing ack: %v\n", err)
 				}
 			default:
-				fmt.Printf("Unused message type: %v\n", messageType)
-				continue
+				ss.sendError(f.Ref, protocol.ErrUnknownType, fmt.Sprintf("unknown frame type %q", f.Type))
 			}
 		}
 	})
-	if err := http.ListenAndServeTLS(fmt.Sprintf(":%d", s.tlsPort), s.cert, s.key, nil); err != nil {
-		log.Printf("ListenAndServeTLS: %v\n", err)
+	return mux
+}
+
+func (s *Server) start() {
+	s.startPeers()
+	go s.sweepQueues(s.stop)
+	hs := &http.Server{Addr: fmt.Sprintf(":%d", s.tlsPort), Handler: s.handler(), TLSConfig: s.tlsConfig()}
+	if err := hs.ListenAndServeTLS(s.cert, s.key); err != nil {
+		log.Fatalf("ListenAndServeTLS: %v\n", err)
 	}
 }
 
 func main() {
+	var configPath, debugAddr string
+	flag.StringVar(&configPath, "config", "", "config file to use instead of the embedded defaults/config.json")
+	flag.StringVar(&debugAddr, "debug", "", "address to serve expvar stats on, e.g. 127.0.0.1:6060")
+	flag.Parse()
+	var configFile []byte
+	var err error
+	if len(configPath) > 0 {
+		configFile, err = os.ReadFile(configPath)
+	} else {
+		configFile, err = defaults.ReadFile("defaults/config.json")
+	}
+	if err != nil {
+		log.Fatalf("Error reading config file, build with defaults/config.json or use -config: %v\n", err)
+	}
 	c := &Config{}
 	if err := json.Unmarshal(configFile, c); err != nil {
 		log.Fatalf("Error parsing config file: %v\n", err)
 	}
-	s := &Server{
-		endpoint: c.Endpoint,
-		tlsPort:  c.Port,
-		cert:     c.CertFile,
-		key:      c.KeyFile,
-		users:    c.Users,
+	s, err := newServer(c)
+	if err != nil {
+		log.Fatalf("Error starting server: %v\n", err)
+	}
+	if err := s.loadFederation(c); err != nil {
+		log.Fatalf("Error loading federation config: %v\n", err)
+	}
+	if len(debugAddr) > 0 {
+		s.serveDebug(debugAddr)
 	}
-	s.websockets = make(map[string]*websocket.Conn)
-	s.messageQueue = make(map[string][][]byte)
 	s.start()
 }
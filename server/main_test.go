@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ogsma_protocol"
+)
+
+func TestDirectDelivery(t *testing.T) {
+	ts := newTestServer(t, 3)
+	alice, bob, carol := ts.users[0], ts.users[1], ts.users[2]
+	phone := ts.connect(t, alice, "phone")
+	laptop := ts.connect(t, alice, "laptop")
+	b := ts.connect(t, bob, "default")
+	c := ts.connect(t, carol, "default")
+
+	phone.send(t, bob, "hello bob")
+	if from, text := b.receiveText(t); from != alice.ID || text != "hello bob" {
+		t.Errorf("bob received %q from %s, want %q from alice", text, from, "hello bob")
+	}
+	// the sender's other devices get a copy they can decrypt
+	if from, text := laptop.receiveText(t); from != alice.ID || text != "hello bob" {
+		t.Errorf("alice's laptop received %q from %s, want the sync copy", text, from)
+	}
+	phone.expectNothing(t, 200*time.Millisecond)
+	c.expectNothing(t, 200*time.Millisecond)
+}
+
+func TestOfflineQueueReplay(t *testing.T) {
+	ts := newTestServer(t, 2)
+	alice, bob := ts.users[0], ts.users[1]
+	a := ts.connect(t, alice, "default")
+	want := []string{"one", "two", "three"}
+	for _, m := range want {
+		a.send(t, bob, m)
+	}
+	// bob has never connected, so messages wait in the pending queue for his first device
+	waitFor(t, "queued messages", func() bool { return ts.queued(bob.ID, "") == len(want) })
+	b := ts.connect(t, bob, "default")
+	for _, w := range want {
+		if _, text := b.receiveText(t); text != w {
+			t.Errorf("received %q, want %q", text, w)
+		}
+	}
+	if n := ts.queued(bob.ID, "default"); n != 0 {
+		t.Errorf("%d messages still queued after replay", n)
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	ts := newTestServer(t, 2)
+	alice, bob := ts.users[0], ts.users[1]
+	a := ts.connect(t, alice, "default")
+	b := ts.connect(t, bob, "phone")
+	a.send(t, bob, "before")
+	if _, text := b.receiveText(t); text != "before" {
+		t.Fatalf("received %q, want %q", text, "before")
+	}
+	b.close()
+	waitFor(t, "bob to go offline", func() bool { return !ts.online(bob.ID, "phone") })
+
+	a.send(t, bob, "while away")
+	waitFor(t, "queued message", func() bool { return ts.queued(bob.ID, "phone") == 1 })
+	b = ts.connect(t, bob, "phone")
+	if _, text := b.receiveText(t); text != "while away" {
+		t.Errorf("received %q after reconnect, want %q", text, "while away")
+	}
+	a.send(t, bob, "after")
+	if _, text := b.receiveText(t); text != "after" {
+		t.Errorf("received %q, want %q", text, "after")
+	}
+}
+
+func TestHandshakeRejected(t *testing.T) {
+	ts := newTestServer(t, 1)
+	stranger := newTestUser(t)
+	hello := func(id string, versions ...int) []byte {
+		b, _ := json.Marshal(&protocol.Hello{Type: protocol.FrameHello, ID: id, Device: "default", Versions: versions})
+		return b
+	}
+	legacy, _ := json.Marshal(map[string]string{"id": ts.users[0].ID, "device": "default"})
+	for _, tc := range []struct {
+		name        string
+		messageType int
+		hello       []byte
+		code        int
+	}{
+		{"unknown user", websocket.TextMessage, hello(stranger.ID, protocol.ProtocolVersion), protocol.CloseUnknownUser},
+		{"short id", websocket.TextMessage, hello("short", protocol.ProtocolVersion), protocol.CloseInvalidHello},
+		{"protocol 0 hello", websocket.BinaryMessage, legacy, protocol.CloseUnsupportedVersion},
+		{"no common version", websocket.TextMessage, hello(ts.users[0].ID, protocol.ProtocolVersion+1), protocol.CloseUnsupportedVersion},
+		{"no versions", websocket.TextMessage, hello(ts.users[0].ID), protocol.CloseUnsupportedVersion},
+		{"not a hello", websocket.TextMessage, []byte(`{"type":"message"}`), protocol.CloseInvalidHello},
+		{"invalid json", websocket.TextMessage, []byte("{not json"), protocol.CloseInvalidHello},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := ts.connectRaw(t, tc.messageType, tc.hello)
+			code, reason := c.expectClosed(t)
+			if code != tc.code || len(reason) == 0 {
+				t.Errorf("closed with %d %q, want code %d with a reason", code, reason, tc.code)
+			}
+		})
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if len(ts.websockets) != 0 {
+		t.Errorf("rejected connections registered sessions: %v", ts.websockets)
+	}
+}
+
+func TestAckAndReceipt(t *testing.T) {
+	ts := newTestServer(t, 2)
+	alice, bob := ts.users[0], ts.users[1]
+	a := ts.connect(t, alice, "default")
+	b := ts.connect(t, bob, "default")
+	m, _ := json.Marshal(&protocol.Msg{Type: protocol.FrameMessage, ID: bob.ID, Ref: "r1", Message: []byte("x"), FromID: alice.ID})
+	if err := a.write(websocket.TextMessage, m); err != nil {
+		t.Fatal(err)
+	}
+	ack := &protocol.Ack{}
+	a.expectFrame(t, protocol.FrameAck, ack)
+	if ack.Ref != "r1" {
+		t.Errorf("ack ref %q, want r1", ack.Ref)
+	}
+	if got := b.receive(t); got.Ref != "r1" {
+		t.Fatalf("received ref %q, want r1", got.Ref)
+	}
+	r, _ := json.Marshal(&protocol.Msg{Type: protocol.FrameReceipt, ID: alice.ID, Ref: "r1", FromID: bob.ID})
+	if err := b.write(websocket.TextMessage, r); err != nil {
+		t.Fatal(err)
+	}
+	receipt := &protocol.Msg{}
+	a.expectFrame(t, protocol.FrameReceipt, receipt)
+	if receipt.Ref != "r1" || receipt.FromID != bob.ID {
+		t.Errorf("receipt %+v, want ref r1 from bob", receipt)
+	}
+}
+
+func TestRejectedFrames(t *testing.T) {
+	ts := newTestServer(t, 2)
+	alice, bob := ts.users[0], ts.users[1]
+	a := ts.connect(t, alice, "default")
+	b := ts.connect(t, bob, "default")
+	for _, tc := range []struct {
+		name  string
+		frame any
+		code  string
+	}{
+		{"unknown type", &protocol.Frame{Type: "shout", Ref: "r1"}, protocol.ErrUnknownType},
+		{"forged from", &protocol.Msg{Type: protocol.FrameMessage, ID: bob.ID, Ref: "r2", FromID: bob.ID}, protocol.ErrForbidden},
+		{"untyped message", &protocol.Msg{ID: bob.ID, Ref: "r3", FromID: alice.ID}, protocol.ErrUnknownType},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f, _ := json.Marshal(tc.frame)
+			if err := a.write(websocket.TextMessage, f); err != nil {
+				t.Fatal(err)
+			}
+			e := &protocol.ErrorFrame{}
+			a.expectFrame(t, protocol.FrameError, e)
+			if e.Code != tc.code || len(e.Reason) == 0 {
+				t.Errorf("error %+v, want code %s with a reason", e, tc.code)
+			}
+		})
+	}
+	b.expectNothing(t, 200*time.Millisecond)
+}
+
+func TestUnknownRecipient(t *testing.T) {
+	ts := newTestServer(t, 1)
+	alice := ts.users[0]
+	a := ts.connect(t, alice, "default")
+	stranger := newTestUser(t)
+	for _, frameType := range []string{protocol.FrameMessage, protocol.FrameReceipt} {
+		if err := a.writeMsg(&protocol.Msg{Type: frameType, ID: stranger.ID, Ref: frameType, Message: []byte("x"), FromID: alice.ID}); err != nil {
+			t.Fatal(err)
+		}
+		e := &protocol.ErrorFrame{}
+		a.expectFrame(t, protocol.FrameError, e)
+		if e.Code != protocol.ErrUnknownUser || e.Ref != frameType {
+			t.Errorf("error %+v, want %s for %s", e, protocol.ErrUnknownUser, frameType)
+		}
+	}
+	if n, err := ts.store.Queued(); err != nil || n != 0 {
+		t.Errorf("%d frames queued, %v, want none", n, err)
+	}
+}
+
+func TestQueueLimit(t *testing.T) {
+	ts := newTestServer(t, 2)
+	alice, bob := ts.users[0], ts.users[1]
+	ts.reconfigure(t, func(c *Config) { c.Limits = &Limits{QueueFrames: 2} })
+	b := ts.connect(t, bob, "phone")
+	b.close()
+	waitFor(t, "bob to go offline", func() bool { return !ts.online(bob.ID, "phone") })
+	laptop := ts.connect(t, bob, "laptop")
+	a := ts.connect(t, alice, "default")
+	for i := range 3 {
+		ref := fmt.Sprintf("r%d", i)
+		if err := a.writeMsg(&protocol.Msg{Type: protocol.FrameMessage, ID: bob.ID, Ref: ref, Message: []byte("x"), FromID: alice.ID}); err != nil {
+			t.Fatal(err)
+		}
+		if i < 2 {
+			ack := &protocol.Ack{}
+			a.expectFrame(t, protocol.FrameAck, ack)
+			if ack.Ref != ref {
+				t.Errorf("ack %+v, want %s", ack, ref)
+			}
+			continue
+		}
+		e := &protocol.ErrorFrame{}
+		a.expectFrame(t, protocol.FrameError, e)
+		if e.Code != protocol.ErrQueueFull || e.Ref != ref {
+			t.Errorf("error %+v, want %s for %s", e, protocol.ErrQueueFull, ref)
+		}
+	}
+	if n := ts.queued(bob.ID, "phone"); n != 2 {
+		t.Errorf("%d frames queued for the phone, want 2", n)
+	}
+	// a refused message reaches none of the devices, so a retry doesn't duplicate it
+	for _, ref := range []string{"r0", "r1"} {
+		if got := laptop.receive(t); got.Ref != ref {
+			t.Errorf("laptop received %s, want %s", got.Ref, ref)
+		}
+	}
+	laptop.expectNothing(t, 200*time.Millisecond)
+}
+
+// TestProtocolCopies checks the protocol types every module carries are identical.
+func TestMalformedFrames(t *testing.T) {
+	ts := newTestServer(t, 2)
+	alice, bob := ts.users[0], ts.users[1]
+	a := ts.connect(t, alice, "default")
+	b := ts.connect(t, bob, "default")
+
+	// binary frames after the hello are answered with an error
+	if err := a.write(websocket.BinaryMessage, []byte{0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	e := &protocol.ErrorFrame{}
+	a.expectFrame(t, protocol.FrameError, e)
+	if e.Code != protocol.ErrInvalidFrame {
+		t.Errorf("error code %s, want %s", e.Code, protocol.ErrInvalidFrame)
+	}
+	a.send(t, bob, "still here")
+	if _, text := b.receiveText(t); text != "still here" {
+		t.Fatalf("received %q, want %q", text, "still here")
+	}
+
+	// a text frame that isn't JSON drops the connection
+	if err := b.write(websocket.TextMessage, []byte("{not json")); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := b.expectClosed(t); code != websocket.CloseInvalidFramePayloadData {
+		t.Errorf("closed with %d, want %d", code, websocket.CloseInvalidFramePayloadData)
+	}
+	waitFor(t, "bob to go offline", func() bool { return !ts.online(bob.ID, "default") })
+
+	// the server keeps working and queues for the dropped device
+	a.send(t, bob, "queued")
+	waitFor(t, "queued message", func() bool { return ts.queued(bob.ID, "default") == 1 })
+	b = ts.connect(t, bob, "default")
+	if _, text := b.receiveText(t); text != "queued" {
+		t.Errorf("received %q, want %q", text, "queued")
+	}
+}
+
+func TestExpiringMessages(t *testing.T) {
+	ts := newTestServer(t, 3)
+	alice, bob, carol := ts.users[0], ts.users[1], ts.users[2]
+	a := ts.connectEncoding(t, alice, "default", protocol.EncodingBinary)
+	b := ts.connect(t, bob, "default")
+	b.close()
+	waitFor(t, "bob to go offline", func() bool { return !ts.online(bob.ID, "default") })
+
+	// frames whose expiry passes while queued are never delivered
+	for i, expires := range []time.Time{time.Now().Add(200 * time.Millisecond), {}} {
+		if err := a.writeMsg(&protocol.Msg{Type: protocol.FrameMessage, ID: bob.ID, Ref: fmt.Sprint(i), Message: []byte("ct"), FromID: alice.ID, Expires: expires}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "queued messages", func() bool { return ts.queued(bob.ID, "default") == 2 })
+	time.Sleep(300 * time.Millisecond)
+	b = ts.connect(t, bob, "default")
+	if m := b.receive(t); m.Ref != "1" {
+		t.Errorf("bob received %q, want only the message without expiry", m.Ref)
+	}
+	b.expectNothing(t, 200*time.Millisecond)
+
+	// version 2 binary devices get the frame without the expiry they can't decode
+	h := carol.hello(t, "default", protocol.EncodingBinary)
+	h.Versions = []int{2}
+	hello, _ := json.Marshal(h)
+	c := ts.connectRaw(t, websocket.TextMessage, hello)
+	c.expectFrame(t, protocol.FrameWelcome, &protocol.Welcome{})
+	if err := a.writeMsg(&protocol.Msg{Type: protocol.FrameMessage, ID: carol.ID, Ref: "r", Message: []byte("ct"), FromID: alice.ID, Expires: time.Now().Add(time.Hour)}); err != nil {
+		t.Fatal(err)
+	}
+	f := c.next(t)
+	if !protocol.IsBinaryFrame(f) || f[0]&protocol.BinaryExpires != 0 {
+		t.Fatalf("carol received %q, want a version 2 binary frame", f)
+	}
+	if m, err := protocol.DecodeBinary(f); err != nil || m.Ref != "r" || !m.Expires.IsZero() {
+		t.Errorf("carol received %+v, %v", m, err)
+	}
+}
+
+func TestBinaryEncoding(t *testing.T) {
+	ts := newTestServer(t, 3)
+	alice, bob, carol := ts.users[0], ts.users[1], ts.users[2]
+	a := ts.connectEncoding(t, alice, "default", protocol.EncodingBinary)
+	b := ts.connectEncoding(t, bob, "default", protocol.EncodingBinary)
+	c := ts.connect(t, carol, "default")
+
+	// binary to binary is forwarded as is
+	a.send(t, bob, "hello bob")
+	if f := b.next(t); !protocol.IsBinaryFrame(f) {
+		t.Errorf("bob received %q, want a binary frame", f)
+	} else if m, err := protocol.DecodeBinary(f); err != nil || m.FromID != alice.ID {
+		t.Errorf("bob received %+v, %v", m, err)
+	}
+	a.expectFrame(t, protocol.FrameAck, &protocol.Ack{})
+
+	// JSON only devices get binary frames converted
+	a.send(t, carol, "hello carol")
+	if from, text := c.receiveText(t); from != alice.ID || text != "hello carol" {
+		t.Errorf("carol received %q from %s, want %q from alice", text, from, "hello carol")
+	}
+
+	// binary devices still accept JSON frames
+	c.send(t, bob, "hello from json")
+	if from, text := b.receiveText(t); from != carol.ID || text != "hello from json" {
+		t.Errorf("bob received %q from %s, want %q from carol", text, from, "hello from json")
+	}
+
+	// routing checks apply to the binary header
+	if err := a.writeMsg(&protocol.Msg{Type: protocol.FrameMessage, ID: bob.ID, Ref: "r2", FromID: bob.ID}); err != nil {
+		t.Fatal(err)
+	}
+	e := &protocol.ErrorFrame{}
+	a.expectFrame(t, protocol.FrameError, e)
+	if e.Code != protocol.ErrForbidden || e.Ref != "r2" {
+		t.Errorf("error %+v, want %s for r2", e, protocol.ErrForbidden)
+	}
+
+	// queued binary frames are converted when the device reconnects without binary
+	c.close()
+	waitFor(t, "carol to go offline", func() bool { return !ts.online(carol.ID, "default") })
+	a.send(t, carol, "queued")
+	waitFor(t, "queued message", func() bool { return ts.queued(carol.ID, "default") == 1 })
+	c = ts.connect(t, carol, "default")
+	if f := c.next(t); protocol.IsBinaryFrame(f) {
+		t.Error("queued frame replayed as binary to a JSON device")
+	} else if m := (&protocol.Msg{}); json.Unmarshal(f, m) != nil || m.Type != protocol.FrameMessage {
+		t.Errorf("replayed %q, want a message", f)
+	}
+
+	// a truncated binary frame drops the connection
+	if err := b.write(websocket.BinaryMessage, []byte{1, 64}); err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := b.expectClosed(t); code != websocket.CloseInvalidFramePayloadData {
+		t.Errorf("closed with %d, want %d", code, websocket.CloseInvalidFramePayloadData)
+	}
+}
+
+func TestVersion1Hello(t *testing.T) {
+	ts := newTestServer(t, 1)
+	h := ts.users[0].hello(t, "default", protocol.EncodingBinary)
+	h.Versions = []int{1}
+	hello, _ := json.Marshal(h)
+	c := ts.connectRaw(t, websocket.TextMessage, hello)
+	w := &protocol.Welcome{}
+	c.expectFrame(t, protocol.FrameWelcome, w)
+	if w.Version != 1 || w.Encoding != protocol.EncodingJSON {
+		t.Errorf("welcome %+v, want version 1 with JSON", w)
+	}
+}
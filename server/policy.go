@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Policy restricts which users may send to each other, a user can always send to
+// their own devices. Without a policy everyone may message everyone.
+type Policy struct {
+	Mode   string              `json:"mode"`             // Mode is all, acl or groups
+	Pairs  [][2]string         `json:"pairs,omitempty"`  // Pairs lists users allowed to message each other in acl mode
+	Groups map[string][]string `json:"groups,omitempty"` // Groups lets members of a group message each other in groups mode
+}
+
+type routingPolicy struct {
+	mode   string
+	pairs  map[string][]string // user ID -> users they may message
+	groups map[string][]string // user ID -> names of their groups
+}
+
+func newRoutingPolicy(p *Policy) (*routingPolicy, error) {
+	if p == nil {
+		return &routingPolicy{mode: "all"}, nil
+	}
+	rp := &routingPolicy{mode: p.Mode, pairs: make(map[string][]string), groups: make(map[string][]string)}
+	switch p.Mode {
+	case "", "all":
+		rp.mode = "all"
+	case "acl":
+		for _, pair := range p.Pairs {
+			rp.pairs[pair[0]] = append(rp.pairs[pair[0]], pair[1])
+			rp.pairs[pair[1]] = append(rp.pairs[pair[1]], pair[0])
+		}
+	case "groups":
+		for name, members := range p.Groups {
+			for _, m := range members {
+				rp.groups[m] = append(rp.groups[m], name)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("unknown policy mode %q, use all, acl or groups", p.Mode)
+	}
+	return rp, nil
+}
+
+func (rp *routingPolicy) allows(from, to string) bool {
+	switch {
+	case rp.mode == "all" || from == to:
+		return true
+	case rp.mode == "acl":
+		return slices.Contains(rp.pairs[from], to)
+	}
+	for _, g := range rp.groups[from] {
+		if slices.Contains(rp.groups[to], g) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"ogsma_protocol"
+)
+
+func TestRoutingPolicyAllows(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		policy *Policy
+		from   string
+		to     string
+		want   bool
+	}{
+		{"no policy", nil, "a", "b", true},
+		{"all", &Policy{Mode: "all"}, "a", "b", true},
+		{"acl pair", &Policy{Mode: "acl", Pairs: [][2]string{{"a", "b"}}}, "a", "b", true},
+		{"acl reverse", &Policy{Mode: "acl", Pairs: [][2]string{{"a", "b"}}}, "b", "a", true},
+		{"acl missing", &Policy{Mode: "acl", Pairs: [][2]string{{"a", "b"}}}, "a", "c", false},
+		{"acl self", &Policy{Mode: "acl"}, "a", "a", true},
+		{"same group", &Policy{Mode: "groups", Groups: map[string][]string{"ops": {"a", "b"}, "dev": {"c"}}}, "a", "b", true},
+		{"other group", &Policy{Mode: "groups", Groups: map[string][]string{"ops": {"a", "b"}, "dev": {"c"}}}, "a", "c", false},
+		{"shared group", &Policy{Mode: "groups", Groups: map[string][]string{"ops": {"a"}, "all": {"a", "c"}}}, "c", "a", true},
+	} {
+		rp, err := newRoutingPolicy(tc.policy)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := rp.allows(tc.from, tc.to); got != tc.want {
+			t.Errorf("%s: allows(%s, %s) = %v, want %v", tc.name, tc.from, tc.to, got, tc.want)
+		}
+	}
+	if _, err := newRoutingPolicy(&Policy{Mode: "friends"}); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestRoutingPolicyEnforced(t *testing.T) {
+	ts := newTestServer(t, 3)
+	alice, bob, carol := ts.users[0], ts.users[1], ts.users[2]
+	ts.reconfigure(t, func(c *Config) {
+		c.Policy = &Policy{Mode: "acl", Pairs: [][2]string{{alice.ID, bob.ID}}}
+	})
+	a := ts.connect(t, alice, "default")
+	b := ts.connect(t, bob, "default")
+	c := ts.connect(t, carol, "default")
+
+	a.send(t, bob, "allowed")
+	if _, text := b.receiveText(t); text != "allowed" {
+		t.Errorf("bob received %q, want %q", text, "allowed")
+	}
+	if err := c.writeMsg(&protocol.Msg{Type: protocol.FrameMessage, ID: alice.ID, Ref: "r1", Message: []byte("x"), FromID: carol.ID}); err != nil {
+		t.Fatal(err)
+	}
+	e := &protocol.ErrorFrame{}
+	c.expectFrame(t, protocol.FrameError, e)
+	if e.Code != protocol.ErrForbidden || e.Ref != "r1" {
+		t.Errorf("error %+v, want %s for r1", e, protocol.ErrForbidden)
+	}
+	a.expectNothing(t, 200*time.Millisecond)
+}
+
+func TestRoutingPolicyPresence(t *testing.T) {
+	ts := newTestServer(t, 3)
+	alice, bob, carol := ts.users[0], ts.users[1], ts.users[2]
+	ts.reconfigure(t, func(c *Config) {
+		c.Policy = &Policy{Mode: "acl", Pairs: [][2]string{{alice.ID, bob.ID}}}
+	})
+	a := ts.connect(t, alice, "default")
+	b := ts.connect(t, bob, "default")
+	c := ts.connect(t, carol, "default")
+
+	a.writeJSON(t, &protocol.Presence{Type: protocol.FramePresence, Status: statusOnline, Contacts: []string{bob.ID, carol.ID}})
+	p := &protocol.Presence{}
+	b.expectFrame(t, protocol.FramePresence, p)
+	if p.From != alice.ID || p.Status != statusOnline {
+		t.Errorf("presence %+v, want alice online", p)
+	}
+	c.expectNoFrame(t, protocol.FramePresence, 200*time.Millisecond)
+	ts.connect(t, carol, "laptop").expectNoFrame(t, protocol.FramePresence, 200*time.Millisecond)
+	ts.connect(t, bob, "laptop").expectFrame(t, protocol.FramePresence, p)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ogsma_protocol"
+)
+
+const (
+	statusOnline  = "online"
+	statusAway    = "away"
+	statusOffline = "offline"
+)
+
+// updatePresence starts tracking presence for a user that opted in by sending a
+// presence message, it is only pushed to the contacts they listed that the routing
+// policy lets them message. An offline status opts out again.
+func (s *Server) updatePresence(userID string, p *protocol.Presence) {
+	switch p.Status {
+	case statusOnline, statusAway:
+	case statusOffline:
+		s.stopPresence(userID)
+		return
+	default:
+		log.Printf("Invalid presence status from %s: %s\n", userID, p.Status)
+		return
+	}
+	contacts := slices.DeleteFunc(slices.Clone(p.Contacts), func(c string) bool { return !s.policy.allows(userID, c) })
+	s.mu.Lock()
+	s.presence[userID] = &protocol.Presence{
+		Type:     protocol.FramePresence,
+		From:     userID,
+		Status:   p.Status,
+		LastSeen: time.Now(),
+		Contacts: contacts,
+	}
+	s.mu.Unlock()
+	s.pushPresence(userID)
+}
+
+// userOffline marks an opted in user offline once their last device disconnects.
+func (s *Server) userOffline(userID string) {
+	s.mu.Lock()
+	p, ok := s.presence[userID]
+	online := len(s.websockets[userID]) > 0
+	if ok && !online {
+		p.Status = statusOffline
+		p.LastSeen = time.Now()
+	}
+	s.mu.Unlock()
+	if ok && !online {
+		s.pushPresence(userID)
+	}
+}
+
+// stopPresence forgets the presence of a user that opted out, their contacts see
+// them offline and nothing more.
+func (s *Server) stopPresence(userID string) {
+	s.mu.Lock()
+	p, ok := s.presence[userID]
+	delete(s.presence, userID)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	p.Status, p.LastSeen = statusOffline, time.Now()
+	s.sendPresence(p)
+}
+
+func (s *Server) pushPresence(userID string) {
+	s.mu.Lock()
+	p, ok := s.presence[userID]
+	var current protocol.Presence
+	if ok {
+		current = *p
+	}
+	s.mu.Unlock()
+	if ok {
+		s.sendPresence(&current)
+	}
+}
+
+// sendPresence sends p to the online devices of the contacts it lists, without the list.
+func (s *Server) sendPresence(p *protocol.Presence) {
+	pb, err := json.Marshal(&protocol.Presence{Type: p.Type, From: p.From, Status: p.Status, LastSeen: p.LastSeen})
+	if err != nil {
+		log.Printf("Error marshalling presence: %v\n", err)
+		return
+	}
+	for _, c := range p.Contacts {
+		s.deliverOnline(c, "", pb)
+	}
+}
+
+// sendKnownPresence tells a newly connected device about every user sharing presence with it.
+func (s *Server) sendKnownPresence(userID string, ss *Session) {
+	s.mu.Lock()
+	var frames [][]byte
+	for _, p := range s.presence {
+		if !slices.Contains(p.Contacts, userID) {
+			continue
+		}
+		pb, err := json.Marshal(&protocol.Presence{Type: p.Type, From: p.From, Status: p.Status, LastSeen: p.LastSeen})
+		if err != nil {
+			log.Printf("Error marshalling presence: %v\n", err)
+			continue
+		}
+		frames = append(frames, pb)
+	}
+	s.mu.Unlock()
+	for _, f := range frames {
+		if err := ss.write(websocket.TextMessage, f); err != nil {
+			log.Printf("Error writing presence: %v\n", err)
+			return
+		}
+	}
+}
+
+// deliverOnline sends message to the online devices of userID only, used for
+// transient messages such as typing notifications that are never queued.
+func (s *Server) deliverOnline(userID, skipDevice string, message []byte) {
+	s.mu.Lock()
+	var online []*Session
+	for d, ss := range s.websockets[userID] {
+		if d != skipDevice {
+			online = append(online, ss)
+		}
+	}
+	s.mu.Unlock()
+	for _, ss := range online {
+		if err := ss.send(message); err != nil {
+			log.Printf("Error writing message to %s device %s: %v\n", userID, ss.device, err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"ogsma_protocol"
+)
+
+// writeJSON writes v as a text frame.
+func (c *testClient) writeJSON(t *testing.T, v any) {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.write(websocket.TextMessage, b); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectNoFrame fails if a frame of frameType arrives within d, expectNothing
+// only looks for messages.
+func (c *testClient) expectNoFrame(t *testing.T, frameType string, d time.Duration) {
+	t.Helper()
+	timeout := time.After(d)
+	for {
+		select {
+		case b := <-c.frames:
+			f := &protocol.Frame{}
+			if err := json.Unmarshal(b, f); err == nil && f.Type == frameType {
+				t.Fatalf("unexpected frame %q", b)
+			}
+		case <-timeout:
+			return
+		}
+	}
+}
+
+func TestTypingReachesSameNamedDevice(t *testing.T) {
+	ts := newTestServer(t, 2)
+	alice, bob := ts.users[0], ts.users[1]
+	a := ts.connect(t, alice, "default")
+	b := ts.connect(t, bob, "default")
+
+	a.writeJSON(t, &protocol.Msg{Type: protocol.FrameTyping, ID: bob.ID, FromID: alice.ID, TimeStamp: time.Now()})
+	m := &protocol.Msg{}
+	b.expectFrame(t, protocol.FrameTyping, m)
+	if m.FromID != alice.ID {
+		t.Errorf("typing from %s, want alice", m.FromID)
+	}
+}
+
+func TestPresenceOptOut(t *testing.T) {
+	ts := newTestServer(t, 2)
+	alice, bob := ts.users[0], ts.users[1]
+	a := ts.connect(t, alice, "phone")
+	b := ts.connect(t, bob, "phone")
+
+	a.writeJSON(t, &protocol.Presence{Type: protocol.FramePresence, Status: statusOnline, Contacts: []string{bob.ID}})
+	p := &protocol.Presence{}
+	b.expectFrame(t, protocol.FramePresence, p)
+	if p.From != alice.ID || p.Status != statusOnline {
+		t.Fatalf("presence %+v, want alice online", p)
+	}
+
+	a.writeJSON(t, &protocol.Presence{Type: protocol.FramePresence, Status: statusOffline})
+	b.expectFrame(t, protocol.FramePresence, p)
+	if p.From != alice.ID || p.Status != statusOffline {
+		t.Fatalf("presence %+v, want alice offline", p)
+	}
+	waitFor(t, "presence forgotten", func() bool {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		return ts.presence[alice.ID] == nil
+	})
+	ts.connect(t, bob, "laptop").expectNoFrame(t, protocol.FramePresence, 200*time.Millisecond)
+	a.close()
+	b.expectNoFrame(t, protocol.FramePresence, 200*time.Millisecond)
+}
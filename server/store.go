@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"ogsma_protocol"
+)
+
+var errNotFound = errors.New("not found")
+
+// Store keeps the state that outlives a connection: the users allowed to connect,
+// their registered devices, frames queued for offline devices and blobs. Live
+// sessions and presence stay in memory on the Server.
+type Store interface {
+	// SetUsers replaces the user registry.
+	SetUsers(ids []string) error
+	HasUser(id string) (bool, error)
+	Users() ([]string, error)
+	// AddDevice registers a device or records that it was seen again, it reports
+	// whether the device is new. A key is only stored for a device that has none.
+	AddDevice(userID string, d Device) (bool, error)
+	// Device returns errNotFound for a device that isn't registered.
+	Device(userID, name string) (Device, error)
+	Devices(userID string) ([]string, error)
+	// RemoveDevice unregisters a device and drops its queue.
+	RemoveDevice(userID, name string) error
+	// Enqueue appends a frame to a device's queue, device "" holds frames for
+	// users that have no devices yet. A frame with a non-zero expires is dropped
+	// once it has passed.
+	Enqueue(userID, device string, frame []byte, expires time.Time) error
+	// Take removes and returns a device's queue, oldest first, without expired frames.
+	Take(userID, device string) ([][]byte, error)
+	// Expire drops the frames that expired before now, it returns how many.
+	Expire(now time.Time) (int, error)
+	QueueLen(userID, device string) (int, error)
+	// Queued counts the frames queued for every device.
+	Queued() (int, error)
+	PutBlob(key string, data []byte) error
+	// Blob returns errNotFound for a missing key.
+	Blob(key string) ([]byte, error)
+	DeleteBlob(key string) error
+	Close() error
+}
+
+// Device is a registered device of a user.
+type Device struct {
+	Name     string
+	Key      []byte    // Key is the device's ed25519 public key, empty for devices that connect without one
+	LastSeen time.Time // LastSeen is when the device last connected or disconnected, zero when unknown
+}
+
+// StoreConfig selects the storage backend, memory is used when it's missing.
+type StoreConfig struct {
+	Type string `json:"type"`           // Type is memory, bolt or sqlite
+	Path string `json:"path,omitempty"` // Path is the database file for bolt and sqlite
+}
+
+func openStore(c *StoreConfig) (Store, error) {
+	if c == nil {
+		return newMemoryStore(), nil
+	}
+	switch c.Type {
+	case "", "memory":
+		return newMemoryStore(), nil
+	case "bolt":
+		return openBoltStore(c.Path)
+	case "sqlite":
+		return openSQLiteStore(c.Path)
+	}
+	return nil, fmt.Errorf("unknown store type %q, use memory, bolt or sqlite", c.Type)
+}
+
+// expiresAt reads the expiry of a queued JSON or binary frame.
+func expiresAt(frame []byte) time.Time {
+	if protocol.IsBinaryFrame(frame) {
+		f, _, err := protocol.DecodeRoute(frame)
+		if err != nil {
+			return time.Time{}
+		}
+		return f.Expires
+	}
+	f := &protocol.Frame{}
+	if err := json.Unmarshal(frame, f); err != nil {
+		return time.Time{}
+	}
+	return f.Expires
+}
+
+// sweepQueues drops expired frames and stale devices every minute until stop is
+// closed, Take already skips expired frames so this only frees the space.
+func (s *Server) sweepQueues(stop chan struct{}) {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-t.C:
+			n, err := s.store.Expire(now)
+			if err != nil {
+				log.Printf("Error dropping expired frames: %v\n", err)
+			} else if n > 0 {
+				log.Printf("Dropped %d expired frames\n", n)
+			}
+			s.pruneDevices(now)
+		}
+	}
+}
+
+// pruneDevices removes the devices that haven't connected for the device TTL,
+// with everything queued for them.
+func (s *Server) pruneDevices(now time.Time) {
+	users, err := s.store.Users()
+	if err != nil {
+		log.Printf("Error reading users: %v\n", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range users {
+		names, err := s.store.Devices(u)
+		if err != nil {
+			log.Printf("Error reading devices of %s: %v\n", u, err)
+			continue
+		}
+		for _, name := range names {
+			if _, online := s.websockets[u][name]; online {
+				continue
+			}
+			d, err := s.store.Device(u, name)
+			if err != nil {
+				log.Printf("Error reading device %s of %s: %v\n", name, u, err)
+				continue
+			}
+			seen := d.LastSeen
+			if seen.IsZero() {
+				seen = s.started
+			}
+			if now.Sub(seen) < s.deviceTTL {
+				continue
+			}
+			if err := s.store.RemoveDevice(u, name); err != nil {
+				log.Printf("Error removing device %s of %s: %v\n", name, u, err)
+				continue
+			}
+			log.Printf("Removed device %s of %s, last seen %s\n", name, u, seen.Format(time.RFC3339))
+		}
+	}
+}
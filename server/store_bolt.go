@@ -0,0 +1,339 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltUsers   = []byte("users")
+	boltDevices = []byte("devices") // user ID -> bucket of device IDs -> last seen unix ns and key
+	boltQueue   = []byte("queue")   // user ID \x00 device ID -> bucket of frames keyed by sequence
+	boltExpiry  = []byte("expiry")  // user ID \x00 device ID -> bucket of expiry unix ns keyed by frame sequence
+	boltBlobs   = []byte("blobs")
+)
+
+// boltStore keeps everything in a single bbolt database file.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	if len(path) == 0 {
+		return nil, errors.New("the bolt store needs a path")
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{boltUsers, boltDevices, boltQueue, boltExpiry, boltBlobs} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func queueKey(userID, device string) []byte {
+	return []byte(userID + "\x00" + device)
+}
+
+func (s *boltStore) SetUsers(ids []string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(boltUsers); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(boltUsers)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := b.Put([]byte(id), nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) HasUser(id string) (bool, error) {
+	found := false
+	err := s.db.View(func(tx *bolt.Tx) error {
+		found = tx.Bucket(boltUsers).Get([]byte(id)) != nil
+		return nil
+	})
+	return found, err
+}
+
+func (s *boltStore) Users() ([]string, error) {
+	var ids []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsers).ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+	})
+	return ids, err
+}
+
+// boltDevice decodes a device value, devices registered before keys have an empty one.
+func boltDevice(name string, v []byte) Device {
+	d := Device{Name: name}
+	if len(v) < 8 {
+		return d
+	}
+	if ns := int64(binary.BigEndian.Uint64(v)); ns != 0 {
+		d.LastSeen = time.Unix(0, ns)
+	}
+	if len(v) > 8 {
+		d.Key = slices.Clone(v[8:])
+	}
+	return d
+}
+
+func (s *boltStore) AddDevice(userID string, d Device) (bool, error) {
+	added := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltDevices).CreateBucketIfNotExists([]byte(userID))
+		if err != nil {
+			return err
+		}
+		key := d.Key
+		if v := b.Get([]byte(d.Name)); v != nil {
+			if old := boltDevice(d.Name, v); len(old.Key) > 0 {
+				key = old.Key
+			}
+		} else {
+			added = true
+		}
+		v := make([]byte, 8, 8+len(key))
+		if !d.LastSeen.IsZero() {
+			binary.BigEndian.PutUint64(v, uint64(d.LastSeen.UnixNano()))
+		}
+		return b.Put([]byte(d.Name), append(v, key...))
+	})
+	return added, err
+}
+
+func (s *boltStore) Device(userID, name string) (Device, error) {
+	var d Device
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDevices).Bucket([]byte(userID))
+		if b == nil {
+			return errNotFound
+		}
+		v := b.Get([]byte(name))
+		if v == nil {
+			return errNotFound
+		}
+		d = boltDevice(name, v)
+		return nil
+	})
+	return d, err
+}
+
+func (s *boltStore) RemoveDevice(userID, name string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(boltDevices).Bucket([]byte(userID)); b != nil {
+			if err := b.Delete([]byte(name)); err != nil {
+				return err
+			}
+		}
+		for _, bucket := range [][]byte{boltQueue, boltExpiry} {
+			if tx.Bucket(bucket).Bucket(queueKey(userID, name)) == nil {
+				continue
+			}
+			if err := tx.Bucket(bucket).DeleteBucket(queueKey(userID, name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Devices(userID string) ([]string, error) {
+	var devices []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltDevices).Bucket([]byte(userID))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, _ []byte) error {
+			devices = append(devices, string(k))
+			return nil
+		})
+	})
+	return devices, err
+}
+
+func (s *boltStore) Enqueue(userID, device string, frame []byte, expires time.Time) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.Bucket(boltQueue).CreateBucketIfNotExists(queueKey(userID, device))
+		if err != nil {
+			return err
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := binary.BigEndian.AppendUint64(nil, seq)
+		if !expires.IsZero() {
+			e, err := tx.Bucket(boltExpiry).CreateBucketIfNotExists(queueKey(userID, device))
+			if err != nil {
+				return err
+			}
+			if err := e.Put(key, binary.BigEndian.AppendUint64(nil, uint64(expires.UnixNano()))); err != nil {
+				return err
+			}
+		}
+		return b.Put(key, frame)
+	})
+}
+
+func boltExpired(e *bolt.Bucket, seq []byte, now time.Time) bool {
+	if e == nil {
+		return false
+	}
+	v := e.Get(seq)
+	return v != nil && now.UnixNano() > int64(binary.BigEndian.Uint64(v))
+}
+
+func (s *boltStore) Take(userID, device string) ([][]byte, error) {
+	var frames [][]byte
+	now := time.Now()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		q, expiry := tx.Bucket(boltQueue), tx.Bucket(boltExpiry)
+		b := q.Bucket(queueKey(userID, device))
+		if b == nil {
+			return nil
+		}
+		e := expiry.Bucket(queueKey(userID, device))
+		// values are only valid during the transaction
+		if err := b.ForEach(func(k, v []byte) error {
+			if !boltExpired(e, k, now) {
+				frames = append(frames, slices.Clone(v))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if e != nil {
+			if err := expiry.DeleteBucket(queueKey(userID, device)); err != nil {
+				return err
+			}
+		}
+		return q.DeleteBucket(queueKey(userID, device))
+	})
+	return frames, err
+}
+
+func (s *boltStore) Expire(now time.Time) (int, error) {
+	n := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		q, expiry := tx.Bucket(boltQueue), tx.Bucket(boltExpiry)
+		var empty [][]byte
+		err := expiry.ForEachBucket(func(qk []byte) error {
+			e := expiry.Bucket(qk)
+			var expired [][]byte
+			total := 0
+			if err := e.ForEach(func(k, _ []byte) error {
+				total++
+				if boltExpired(e, k, now) {
+					expired = append(expired, slices.Clone(k))
+				}
+				return nil
+			}); err != nil {
+				return err
+			}
+			b := q.Bucket(qk)
+			for _, k := range expired {
+				if err := e.Delete(k); err != nil {
+					return err
+				}
+				if b != nil {
+					if err := b.Delete(k); err != nil {
+						return err
+					}
+				}
+			}
+			n += len(expired)
+			if total == len(expired) {
+				empty = append(empty, slices.Clone(qk))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, qk := range empty {
+			if err := expiry.DeleteBucket(qk); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltStore) QueueLen(userID, device string) (int, error) {
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if b := tx.Bucket(boltQueue).Bucket(queueKey(userID, device)); b != nil {
+			n = b.Stats().KeyN
+		}
+		return nil
+	})
+	return n, err
+}
+
+func (s *boltStore) Queued() (int, error) {
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		q := tx.Bucket(boltQueue)
+		return q.ForEachBucket(func(k []byte) error {
+			n += q.Bucket(k).Stats().KeyN
+			return nil
+		})
+	})
+	return n, err
+}
+
+func (s *boltStore) PutBlob(key string, data []byte) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlobs).Put([]byte(key), data)
+	})
+}
+
+func (s *boltStore) Blob(key string) ([]byte, error) {
+	var data []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltBlobs).Get([]byte(key))
+		if v == nil {
+			return errNotFound
+		}
+		data = slices.Clone(v)
+		return nil
+	})
+	return data, err
+}
+
+func (s *boltStore) DeleteBlob(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBlobs).Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
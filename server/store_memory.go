@@ -0,0 +1,192 @@
+package main
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// memoryStore loses everything on restart.
+type memoryStore struct {
+	mu      sync.Mutex
+	users   map[string]bool
+	devices map[string][]Device            // user ID -> registered devices
+	queue   map[string]map[string][]queued // user ID -> device ID -> queued frames
+	blobs   map[string][]byte
+}
+
+type queued struct {
+	frame   []byte
+	expires time.Time
+}
+
+func (q queued) expired(now time.Time) bool {
+	return !q.expires.IsZero() && now.After(q.expires)
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		users:   make(map[string]bool),
+		devices: make(map[string][]Device),
+		queue:   make(map[string]map[string][]queued),
+		blobs:   make(map[string][]byte),
+	}
+}
+
+func (m *memoryStore) SetUsers(ids []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.users = make(map[string]bool)
+	for _, id := range ids {
+		m.users[id] = true
+	}
+	return nil
+}
+
+func (m *memoryStore) HasUser(id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.users[id], nil
+}
+
+func (m *memoryStore) Users() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var ids []string
+	for id := range m.users {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+func (m *memoryStore) AddDevice(userID string, d Device) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.devices[userID], func(r Device) bool { return r.Name == d.Name })
+	if i < 0 {
+		d.Key = slices.Clone(d.Key)
+		m.devices[userID] = append(m.devices[userID], d)
+		return true, nil
+	}
+	r := &m.devices[userID][i]
+	r.LastSeen = d.LastSeen
+	if len(r.Key) == 0 {
+		r.Key = slices.Clone(d.Key)
+	}
+	return false, nil
+}
+
+func (m *memoryStore) Device(userID, name string) (Device, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	i := slices.IndexFunc(m.devices[userID], func(r Device) bool { return r.Name == name })
+	if i < 0 {
+		return Device{}, errNotFound
+	}
+	d := m.devices[userID][i]
+	d.Key = slices.Clone(d.Key)
+	return d, nil
+}
+
+func (m *memoryStore) Devices(userID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var names []string
+	for _, d := range m.devices[userID] {
+		names = append(names, d.Name)
+	}
+	return names, nil
+}
+
+func (m *memoryStore) RemoveDevice(userID, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.devices[userID] = slices.DeleteFunc(m.devices[userID], func(r Device) bool { return r.Name == name })
+	delete(m.queue[userID], name)
+	return nil
+}
+
+func (m *memoryStore) Enqueue(userID, device string, frame []byte, expires time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.queue[userID] == nil {
+		m.queue[userID] = make(map[string][]queued)
+	}
+	m.queue[userID][device] = append(m.queue[userID][device], queued{frame: frame, expires: expires})
+	return nil
+}
+
+func (m *memoryStore) Take(userID, device string) ([][]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var frames [][]byte
+	now := time.Now()
+	for _, q := range m.queue[userID][device] {
+		if !q.expired(now) {
+			frames = append(frames, q.frame)
+		}
+	}
+	delete(m.queue[userID], device)
+	return frames, nil
+}
+
+func (m *memoryStore) Expire(now time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, devices := range m.queue {
+		for d, q := range devices {
+			kept := slices.DeleteFunc(q, func(q queued) bool { return q.expired(now) })
+			n += len(q) - len(kept)
+			devices[d] = kept
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) QueueLen(userID, device string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.queue[userID][device]), nil
+}
+
+func (m *memoryStore) Queued() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := 0
+	for _, devices := range m.queue {
+		for _, q := range devices {
+			n += len(q)
+		}
+	}
+	return n, nil
+}
+
+func (m *memoryStore) PutBlob(key string, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.blobs[key] = slices.Clone(data)
+	return nil
+}
+
+func (m *memoryStore) Blob(key string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b, ok := m.blobs[key]
+	if !ok {
+		return nil, errNotFound
+	}
+	return slices.Clone(b), nil
+}
+
+func (m *memoryStore) DeleteBlob(key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.blobs, key)
+	return nil
+}
+
+func (m *memoryStore) Close() error {
+	return nil
+}
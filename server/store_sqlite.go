@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (id TEXT PRIMARY KEY);
+CREATE TABLE IF NOT EXISTS devices (user TEXT NOT NULL, device TEXT NOT NULL, key BLOB, last_seen INTEGER NOT NULL DEFAULT 0, PRIMARY KEY (user, device));
+CREATE TABLE IF NOT EXISTS queue (seq INTEGER PRIMARY KEY AUTOINCREMENT, user TEXT NOT NULL, device TEXT NOT NULL, frame BLOB NOT NULL, expires INTEGER NOT NULL DEFAULT 0);
+CREATE INDEX IF NOT EXISTS queue_device ON queue (user, device, seq);
+CREATE TABLE IF NOT EXISTS blobs (key TEXT PRIMARY KEY, data BLOB NOT NULL);
+`
+
+// sqliteStore keeps everything in a SQLite database, using the pure Go driver so
+// the server still builds without cgo.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+func openSQLiteStore(path string) (*sqliteStore, error) {
+	if len(path) == 0 {
+		return nil, errors.New("the sqlite store needs a path")
+	}
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes writers instead of failing with SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// databases created before expiring frames and device keys lack the columns
+	for _, alter := range []string{
+		`ALTER TABLE queue ADD COLUMN expires INTEGER NOT NULL DEFAULT 0`,
+		`ALTER TABLE devices ADD COLUMN key BLOB`,
+		`ALTER TABLE devices ADD COLUMN last_seen INTEGER NOT NULL DEFAULT 0`,
+	} {
+		if _, err := db.Exec(alter); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) SetUsers(ids []string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM users`); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO users (id) VALUES (?)`, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) HasUser(id string) (bool, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM users WHERE id = ?`, id).Scan(&n)
+	return n > 0, err
+}
+
+func (s *sqliteStore) strings(query string, args ...any) ([]string, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var v string
+		if err := rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+func (s *sqliteStore) Users() ([]string, error) {
+	return s.strings(`SELECT id FROM users ORDER BY id`)
+}
+
+func (s *sqliteStore) AddDevice(userID string, d Device) (bool, error) {
+	var seen int64
+	if !d.LastSeen.IsZero() {
+		seen = d.LastSeen.UnixNano()
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	r, err := tx.Exec(`INSERT OR IGNORE INTO devices (user, device, key, last_seen) VALUES (?, ?, ?, ?)`, userID, d.Name, d.Key, seen)
+	if err != nil {
+		return false, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	if n == 0 {
+		if _, err := tx.Exec(`UPDATE devices SET last_seen = ?, key = CASE WHEN key IS NULL OR length(key) = 0 THEN ? ELSE key END WHERE user = ? AND device = ?`,
+			seen, d.Key, userID, d.Name); err != nil {
+			return false, err
+		}
+	}
+	return n > 0, tx.Commit()
+}
+
+func (s *sqliteStore) Device(userID, name string) (Device, error) {
+	d := Device{Name: name}
+	var seen int64
+	err := s.db.QueryRow(`SELECT key, last_seen FROM devices WHERE user = ? AND device = ?`, userID, name).Scan(&d.Key, &seen)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Device{}, errNotFound
+	}
+	if seen != 0 {
+		d.LastSeen = time.Unix(0, seen)
+	}
+	return d, err
+}
+
+func (s *sqliteStore) Devices(userID string) ([]string, error) {
+	return s.strings(`SELECT device FROM devices WHERE user = ? ORDER BY device`, userID)
+}
+
+func (s *sqliteStore) RemoveDevice(userID, name string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM devices WHERE user = ? AND device = ?`, userID, name); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM queue WHERE user = ? AND device = ?`, userID, name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Enqueue(userID, device string, frame []byte, expires time.Time) error {
+	var ns int64
+	if !expires.IsZero() {
+		ns = expires.UnixNano()
+	}
+	_, err := s.db.Exec(`INSERT INTO queue (user, device, frame, expires) VALUES (?, ?, ?, ?)`, userID, device, frame, ns)
+	return err
+}
+
+func (s *sqliteStore) Take(userID, device string) ([][]byte, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	rows, err := tx.Query(`SELECT frame FROM queue WHERE user = ? AND device = ? AND (expires = 0 OR expires >= ?) ORDER BY seq`, userID, device, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	var frames [][]byte
+	for rows.Next() {
+		var f []byte
+		if err := rows.Scan(&f); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		frames = append(frames, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(`DELETE FROM queue WHERE user = ? AND device = ?`, userID, device); err != nil {
+		return nil, err
+	}
+	return frames, tx.Commit()
+}
+
+func (s *sqliteStore) Expire(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM queue WHERE expires != 0 AND expires < ?`, now.UnixNano())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *sqliteStore) QueueLen(userID, device string) (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM queue WHERE user = ? AND device = ?`, userID, device).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteStore) Queued() (int, error) {
+	var n int
+	err := s.db.QueryRow(`SELECT COUNT(*) FROM queue`).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteStore) PutBlob(key string, data []byte) error {
+	if data == nil {
+		data = []byte{}
+	}
+	_, err := s.db.Exec(`INSERT INTO blobs (key, data) VALUES (?, ?) ON CONFLICT (key) DO UPDATE SET data = excluded.data`, key, data)
+	return err
+}
+
+func (s *sqliteStore) Blob(key string) ([]byte, error) {
+	var data []byte
+	err := s.db.QueryRow(`SELECT data FROM blobs WHERE key = ?`, key).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errNotFound
+	}
+	return data, err
+}
+
+func (s *sqliteStore) DeleteBlob(key string) error {
+	_, err := s.db.Exec(`DELETE FROM blobs WHERE key = ?`, key)
+	return err
+}
+
+func (s *sqliteStore) Close() error {
+	return s.db.Close()
+}
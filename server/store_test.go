@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// storeBackends lists every backend, each must pass the conformance tests.
+var storeBackends = []struct {
+	name       string
+	persistent bool
+	config     func(dir string) *StoreConfig
+}{
+	{"memory", false, func(string) *StoreConfig { return &StoreConfig{Type: "memory"} }},
+	{"bolt", true, func(dir string) *StoreConfig { return &StoreConfig{Type: "bolt", Path: filepath.Join(dir, "ogsma.db")} }},
+	{"sqlite", true, func(dir string) *StoreConfig {
+		return &StoreConfig{Type: "sqlite", Path: filepath.Join(dir, "ogsma.sqlite")}
+	}},
+}
+
+func openTestStore(t *testing.T, c *StoreConfig) Store {
+	t.Helper()
+	s, err := openStore(c)
+	if err != nil {
+		t.Fatalf("opening %s store: %v", c.Type, err)
+	}
+	return s
+}
+
+func TestStoreConformance(t *testing.T) {
+	for _, b := range storeBackends {
+		t.Run(b.name, func(t *testing.T) {
+			for _, tc := range []struct {
+				name string
+				test func(t *testing.T, s Store)
+			}{
+				{"users", testStoreUsers},
+				{"devices", testStoreDevices},
+				{"device keys", testStoreDeviceKeys},
+				{"queue", testStoreQueue},
+				{"concurrent queue", testStoreConcurrentQueue},
+				{"expiry", testStoreExpiry},
+				{"blobs", testStoreBlobs},
+			} {
+				t.Run(tc.name, func(t *testing.T) {
+					s := openTestStore(t, b.config(t.TempDir()))
+					defer s.Close()
+					tc.test(t, s)
+				})
+			}
+			if b.persistent {
+				t.Run("reopen", func(t *testing.T) { testStoreReopen(t, b.config(t.TempDir())) })
+			}
+		})
+	}
+}
+
+func must(t *testing.T, err error) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testStoreUsers(t *testing.T, s Store) {
+	must(t, s.SetUsers([]string{"b", "a"}))
+	for id, want := range map[string]bool{"a": true, "b": true, "c": false} {
+		if ok, err := s.HasUser(id); err != nil || ok != want {
+			t.Errorf("HasUser(%s) = %v, %v, want %v", id, ok, err, want)
+		}
+	}
+	must(t, s.SetUsers([]string{"c"}))
+	users, err := s.Users()
+	must(t, err)
+	if !slices.Equal(users, []string{"c"}) {
+		t.Errorf("users %v after replacing them, want [c]", users)
+	}
+}
+
+func testStoreDevices(t *testing.T, s Store) {
+	for _, tc := range []struct {
+		device string
+		added  bool
+	}{{"phone", true}, {"laptop", true}, {"phone", false}} {
+		if added, err := s.AddDevice("a", Device{Name: tc.device}); err != nil || added != tc.added {
+			t.Errorf("AddDevice(%s) = %v, %v, want %v", tc.device, added, err, tc.added)
+		}
+	}
+	devices, err := s.Devices("a")
+	must(t, err)
+	slices.Sort(devices)
+	if !slices.Equal(devices, []string{"laptop", "phone"}) {
+		t.Errorf("devices %v, want [laptop phone]", devices)
+	}
+	if devices, err := s.Devices("b"); err != nil || len(devices) != 0 {
+		t.Errorf("devices of an unknown user %v, %v", devices, err)
+	}
+}
+
+func testStoreDeviceKeys(t *testing.T, s Store) {
+	seen := time.Unix(1700000000, 0)
+	key := []byte("0123456789abcdef0123456789abcdef")
+	_, err := s.AddDevice("a", Device{Name: "old"})
+	must(t, err)
+	_, err = s.AddDevice("a", Device{Name: "phone", Key: key, LastSeen: seen})
+	must(t, err)
+	// seeing a device again updates the time but never replaces its key
+	_, err = s.AddDevice("a", Device{Name: "phone", Key: []byte("other"), LastSeen: seen.Add(time.Hour)})
+	must(t, err)
+	d, err := s.Device("a", "phone")
+	must(t, err)
+	if !bytes.Equal(d.Key, key) || !d.LastSeen.Equal(seen.Add(time.Hour)) {
+		t.Errorf("device %+v, want the first key seen an hour later", d)
+	}
+	// a device without a key takes the first one it connects with
+	_, err = s.AddDevice("a", Device{Name: "old", Key: key, LastSeen: seen})
+	must(t, err)
+	if d, err := s.Device("a", "old"); err != nil || !bytes.Equal(d.Key, key) {
+		t.Errorf("device %+v, %v, want the key stored", d, err)
+	}
+	if _, err := s.Device("a", "missing"); !errors.Is(err, errNotFound) {
+		t.Errorf("Device of a missing device: %v, want errNotFound", err)
+	}
+
+	must(t, s.Enqueue("a", "phone", []byte("m1"), time.Time{}))
+	must(t, s.Enqueue("a", "phone", []byte("m2"), seen.Add(time.Hour)))
+	must(t, s.Enqueue("a", "old", []byte("m3"), time.Time{}))
+	must(t, s.RemoveDevice("a", "phone"))
+	if _, err := s.Device("a", "phone"); !errors.Is(err, errNotFound) {
+		t.Errorf("Device after remove: %v, want errNotFound", err)
+	}
+	if n, err := s.QueueLen("a", "phone"); err != nil || n != 0 {
+		t.Errorf("%d frames left for a removed device, %v", n, err)
+	}
+	if n, err := s.Queued(); err != nil || n != 1 {
+		t.Errorf("%d frames queued after removing a device, %v, want 1", n, err)
+	}
+	if n, err := s.Expire(seen.Add(2 * time.Hour)); err != nil || n != 0 {
+		t.Errorf("Expire after remove = %d, %v", n, err)
+	}
+	must(t, s.RemoveDevice("a", "missing"))
+}
+
+func testStoreQueue(t *testing.T, s Store) {
+	frames := [][]byte{[]byte("one"), {1, 0, 2}, []byte("three")}
+	for _, f := range frames {
+		must(t, s.Enqueue("a", "phone", f, time.Time{}))
+	}
+	must(t, s.Enqueue("a", "", []byte("pending"), time.Time{}))
+	must(t, s.Enqueue("b", "phone", []byte("other"), time.Time{}))
+	if n, err := s.QueueLen("a", "phone"); err != nil || n != len(frames) {
+		t.Errorf("QueueLen = %d, %v, want %d", n, err, len(frames))
+	}
+	if n, err := s.Queued(); err != nil || n != len(frames)+2 {
+		t.Errorf("Queued = %d, %v, want %d", n, err, len(frames)+2)
+	}
+	got, err := s.Take("a", "phone")
+	must(t, err)
+	if !slices.EqualFunc(got, frames, bytes.Equal) {
+		t.Errorf("Take = %q, want %q in order", got, frames)
+	}
+	if got, err := s.Take("a", "phone"); err != nil || len(got) != 0 {
+		t.Errorf("second Take = %q, %v, want nothing", got, err)
+	}
+	if got, err := s.Take("a", ""); err != nil || len(got) != 1 || string(got[0]) != "pending" {
+		t.Errorf("Take of the pending queue = %q, %v", got, err)
+	}
+	if n, err := s.Queued(); err != nil || n != 1 {
+		t.Errorf("Queued = %d, %v after taking, want 1", n, err)
+	}
+}
+
+func testStoreConcurrentQueue(t *testing.T, s Store) {
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 25 {
+				if err := s.Enqueue("a", "phone", fmt.Appendf(nil, "%d-%d", i, j), time.Time{}); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n, err := s.QueueLen("a", "phone"); err != nil || n != 200 {
+		t.Errorf("QueueLen = %d, %v, want 200", n, err)
+	}
+}
+
+func testStoreExpiry(t *testing.T, s Store) {
+	now := time.Now()
+	must(t, s.Enqueue("a", "phone", []byte("expired"), now.Add(-time.Second)))
+	must(t, s.Enqueue("a", "phone", []byte("kept"), time.Time{}))
+	must(t, s.Enqueue("a", "phone", []byte("later"), now.Add(time.Hour)))
+	must(t, s.Enqueue("b", "phone", []byte("expired"), now.Add(-time.Second)))
+	if n, err := s.Expire(now); err != nil || n != 2 {
+		t.Errorf("Expire = %d, %v, want 2", n, err)
+	}
+	if n, err := s.Queued(); err != nil || n != 2 {
+		t.Errorf("Queued = %d, %v after expiring, want 2", n, err)
+	}
+	must(t, s.Enqueue("a", "phone", []byte("expired"), now.Add(-time.Second)))
+	got, err := s.Take("a", "phone")
+	must(t, err)
+	if !slices.EqualFunc(got, [][]byte{[]byte("kept"), []byte("later")}, bytes.Equal) {
+		t.Errorf("Take = %q, want the unexpired frames", got)
+	}
+	if n, err := s.Expire(now.Add(2 * time.Hour)); err != nil || n != 0 {
+		t.Errorf("Expire after Take = %d, %v, want 0", n, err)
+	}
+}
+
+func testStoreBlobs(t *testing.T, s Store) {
+	if _, err := s.Blob("missing"); !errors.Is(err, errNotFound) {
+		t.Errorf("Blob of a missing key: %v, want errNotFound", err)
+	}
+	must(t, s.PutBlob("k", []byte("v1")))
+	must(t, s.PutBlob("k", []byte("v2")))
+	if b, err := s.Blob("k"); err != nil || string(b) != "v2" {
+		t.Errorf("Blob = %q, %v, want v2", b, err)
+	}
+	must(t, s.DeleteBlob("k"))
+	if _, err := s.Blob("k"); !errors.Is(err, errNotFound) {
+		t.Errorf("Blob after delete: %v, want errNotFound", err)
+	}
+}
+
+func testStoreReopen(t *testing.T, c *StoreConfig) {
+	s := openTestStore(t, c)
+	must(t, s.SetUsers([]string{"a"}))
+	_, err := s.AddDevice("a", Device{Name: "phone", Key: []byte("key"), LastSeen: time.Unix(1700000000, 0)})
+	must(t, err)
+	must(t, s.Enqueue("a", "phone", []byte("kept"), time.Time{}))
+	must(t, s.PutBlob("k", []byte("v")))
+	must(t, s.Close())
+
+	s = openTestStore(t, c)
+	defer s.Close()
+	if ok, err := s.HasUser("a"); err != nil || !ok {
+		t.Errorf("user lost on reopen: %v", err)
+	}
+	if devices, err := s.Devices("a"); err != nil || !slices.Equal(devices, []string{"phone"}) {
+		t.Errorf("devices %v, %v after reopen", devices, err)
+	}
+	if d, err := s.Device("a", "phone"); err != nil || string(d.Key) != "key" || !d.LastSeen.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("device %+v, %v after reopen", d, err)
+	}
+	if got, err := s.Take("a", "phone"); err != nil || len(got) != 1 || string(got[0]) != "kept" {
+		t.Errorf("queue %q, %v after reopen", got, err)
+	}
+	if b, err := s.Blob("k"); err != nil || string(b) != "v" {
+		t.Errorf("blob %q, %v after reopen", b, err)
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	for _, b := range storeBackends {
+		if !b.persistent {
+			continue
+		}
+		t.Run(b.name, func(t *testing.T) {
+			ts := newTestServer(t, 2)
+			alice, bob := ts.users[0], ts.users[1]
+			ts.reconfigure(t, func(c *Config) { c.Store = b.config(t.TempDir()) })
+
+			b := ts.connect(t, bob, "default")
+			b.close()
+			waitFor(t, "bob to go offline", func() bool { return !ts.online(bob.ID, "default") })
+			a := ts.connect(t, alice, "default")
+			a.send(t, bob, "kept across restarts")
+			waitFor(t, "queued message", func() bool { return ts.queued(bob.ID, "default") == 1 })
+			ts.shutdown()
+			ts.restart(t)
+
+			b = ts.connect(t, bob, "default")
+			if _, text := b.receiveText(t); text != "kept across restarts" {
+				t.Errorf("received %q, want %q", text, "kept across restarts")
+			}
+		})
+	}
+}